@@ -4,6 +4,7 @@
 package raft
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -74,6 +75,19 @@ var (
 	// client requests because it is attempting to transfer leadership.
 	ErrLeadershipTransferInProgress = errors.New("leadership transfer in progress")
 
+	// ErrLeaseReadsDisabled is returned when LeaseRead is called but
+	// Config.LeaseReads is not enabled.
+	ErrLeaseReadsDisabled = errors.New("lease reads are not enabled")
+
+	// ErrLeaseExpired is returned when the leader can't serve a lease read
+	// because it hasn't heard from a quorum recently enough. ReadIndex can be
+	// used instead.
+	ErrLeaseExpired = errors.New("leader lease has expired")
+
+	// ErrUnknownLeader is returned when an operation has to be forwarded to
+	// the leader but no leader is currently known.
+	ErrUnknownLeader = errors.New("no known leader")
+
 	// ErrIncompatibleLogStore is returned when the log store does not support
 	// or implement some required methods.
 	ErrIncompatibleLogStore = errors.New("log store does not implement some required methods or malformed")
@@ -122,6 +136,17 @@ type Raft struct {
 	lastContact     time.Time
 	lastContactLock sync.RWMutex
 
+	// leaderContact is the last time we heard from a leader in its current
+	// term, unlike lastContact which is also updated for other reasons. It's
+	// used for CheckQuorum and protected by lastContactLock.
+	leaderContact time.Time
+
+	// appliedCh is closed and replaced whenever lastApplied advances, to
+	// wake anything waiting for an index to be applied. It is created lazily
+	// by the first waiter.
+	appliedCh   chan struct{}
+	appliedLock sync.Mutex
+
 	// leaderAddr is the current cluster leader Address
 	leaderAddr ServerAddress
 	// LeaderID is the current cluster leader ID
@@ -174,6 +199,15 @@ type Raft struct {
 	// snapshots is used to store and retrieve snapshots
 	snapshots SnapshotStore
 
+	// snapshotTransfer is the chunked snapshot being received from the
+	// leader, if any. It's only used by the main thread.
+	snapshotTransfer *snapshotTransfer
+
+	// catchUps holds the snapshots this server is sending to other followers
+	// on behalf of the leader, by target.
+	catchUps     map[ServerID]*SnapshotMeta
+	catchUpsLock sync.Mutex
+
 	// userSnapshotCh is used for user-triggered snapshots
 	userSnapshotCh chan *userSnapshotFuture
 
@@ -355,8 +389,11 @@ func RecoverCluster(conf *Config, fsm FSM, logs LogStore, stable StableStore,
 	logger := conf.getOrCreateLogger()
 
 	for _, snapshot := range snapshots {
-		var source io.ReadCloser
-		_, source, err = snaps.Open(snapshot.ID)
+		var (
+			meta   *SnapshotMeta
+			source io.ReadCloser
+		)
+		meta, source, err = snaps.Open(snapshot.ID)
 		if err != nil {
 			// Skip this one and try the next. We will detect if we
 			// couldn't open any snapshots.
@@ -376,8 +413,8 @@ func RecoverCluster(conf *Config, fsm FSM, logs LogStore, stable StableStore,
 			"size-in-bytes", snapshot.Size,
 		)
 		crc := newCountingReadCloser(source)
-		monitor := startSnapshotRestoreMonitor(snapLogger, crc, snapshot.Size, false)
-		err = fsm.Restore(crc)
+		monitor := startSnapshotRestoreMonitor(snapLogger, crc, meta.Size, false)
+		err = restoreSnapshotChain(fsm, crc, meta.Chain)
 		// Close the source after the restore has completed
 		_ = source.Close()
 		monitor.StopAndWait()
@@ -447,6 +484,131 @@ func RecoverCluster(conf *Config, fsm FSM, logs LogStore, stable StableStore,
 	return nil
 }
 
+// RecoverToIndex is used to rebuild the state of the FSM as of a past log
+// index, for example to roll a cluster back to just before an entry that
+// should never have been applied. It restores the newest snapshot at or
+// before targetIndex, replays the log entries after it up to exactly
+// targetIndex, and writes a snapshot of the result at targetIndex to snaps,
+// with the configuration as of that index.
+//
+// Each entry is read from logArchive, which holds the logs that were compacted
+// away, and if it's missing there, from logs, the server's own log store,
+// which holds the entries that haven't been compacted yet. logs may be nil if
+// logArchive already covers every entry up to targetIndex. Only entries that
+// were committed should be replayed, so targetIndex must not be past the
+// cluster's commit index.
+//
+// trans is only used to encode the servers of the configuration into the
+// snapshot, as RecoverCluster does; no requests are sent over it, so the
+// server's normal transport can be passed without starting it.
+//
+// Raft starts from the newest snapshot it has, so to roll a cluster back to the
+// new snapshot, shut down all servers and start them with empty log and
+// stable stores and a snapshot store holding only the new snapshot, or
+// bootstrap a single server that way and join the others to it as new
+// servers.
+//
+// As with RecoverCluster, the FSM passed here is used for the snapshot
+// operations and will be left in a state that should not be used by the
+// application.
+func RecoverToIndex(conf *Config, fsm FSM, snaps SnapshotStore, logArchive, logs LogStore,
+	trans Transport, targetIndex uint64,
+) error {
+	// Validate the Raft server config.
+	if err := ValidateConfig(conf); err != nil {
+		return err
+	}
+	if targetIndex == 0 {
+		return fmt.Errorf("target index must be positive")
+	}
+
+	// Restore the newest snapshot at or before the target, if any.
+	snapshots, err := snaps.List()
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	logger := conf.getOrCreateLogger()
+	var (
+		lastIndex          uint64
+		lastTerm           uint64
+		configuration      Configuration
+		configurationIndex uint64
+		restored           bool
+		candidates         int
+	)
+	for _, snapshot := range snapshots {
+		if snapshot.Index > targetIndex {
+			continue
+		}
+		candidates++
+		meta, source, err := snaps.Open(snapshot.ID)
+		if err != nil {
+			logger.Warn("failed to open snapshot", "id", snapshot.ID, "error", err)
+			continue
+		}
+		err = restoreSnapshotChain(fsm, source, meta.Chain)
+		_ = source.Close()
+		if err != nil {
+			logger.Warn("failed to restore snapshot", "id", snapshot.ID, "error", err)
+			continue
+		}
+
+		lastIndex, lastTerm = meta.Index, meta.Term
+		configuration, configurationIndex = meta.Configuration, meta.ConfigurationIndex
+		restored = true
+		break
+	}
+	if candidates > 0 && !restored {
+		return fmt.Errorf("failed to restore any of the available snapshots at or before index %d", targetIndex)
+	}
+
+	// Replay the logs after the snapshot, up to the target.
+	for index := lastIndex + 1; index <= targetIndex; index++ {
+		var entry Log
+		if err := logArchive.GetLog(index, &entry); err != nil {
+			if logs == nil {
+				return fmt.Errorf("failed to get archived log at index %d: %v", index, err)
+			}
+			if err := logs.GetLog(index, &entry); err != nil {
+				return fmt.Errorf("failed to get log at index %d from the archive or the log store: %v", index, err)
+			}
+		}
+		switch entry.Type {
+		case LogCommand:
+			_ = fsm.Apply(&entry)
+		case LogConfiguration:
+			configuration = DecodeConfiguration(entry.Data)
+			configurationIndex = entry.Index
+		}
+		lastIndex = entry.Index
+		lastTerm = entry.Term
+	}
+	if len(configuration.Servers) == 0 {
+		return fmt.Errorf("no configuration found at or before index %d", targetIndex)
+	}
+
+	// Create a new snapshot of the state at the target.
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot FSM: %v", err)
+	}
+	defer snapshot.Release()
+	version := getSnapshotVersion(conf.ProtocolVersion)
+	sink, err := snaps.Create(version, lastIndex, lastTerm, configuration, configurationIndex, trans)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	if err = snapshot.Persist(sink); err != nil {
+		_ = sink.Cancel()
+		return fmt.Errorf("failed to persist snapshot: %v", err)
+	}
+	if err = sink.Close(); err != nil {
+		return fmt.Errorf("failed to finalize snapshot: %v", err)
+	}
+	logger.Info("recovered state to index", "index", lastIndex, "snapshot", sink.ID())
+	return nil
+}
+
 // GetConfiguration returns the persisted configuration of the Raft cluster
 // without starting a Raft instance or connecting to the cluster. This function
 // has identical behavior to Raft.GetConfiguration.
@@ -676,6 +838,7 @@ func (r *Raft) restoreSnapshot() error {
 		}
 		r.setCommittedConfiguration(conf, index)
 		r.setLatestConfiguration(conf, index)
+		r.configurations.applied = conf
 
 		// Success!
 		return nil
@@ -702,13 +865,13 @@ func (r *Raft) tryRestoreSingleSnapshot(snapshot *SnapshotMeta) bool {
 
 	snapLogger.Info("starting restore from snapshot")
 
-	_, source, err := r.snapshots.Open(snapshot.ID)
+	meta, source, err := r.snapshots.Open(snapshot.ID)
 	if err != nil {
 		snapLogger.Error("failed to open snapshot", "error", err)
 		return false
 	}
 
-	if err := fsmRestoreAndMeasure(snapLogger, r.fsm, source, snapshot.Size); err != nil {
+	if err := fsmRestoreAndMeasure(snapLogger, r.fsm, source, meta.Size, meta.Chain); err != nil {
 		_ = source.Close()
 		snapLogger.Error("failed to restore snapshot", "error", err)
 		return false
@@ -826,6 +989,22 @@ func (r *Raft) BootstrapCluster(configuration Configuration) Future {
 	}
 }
 
+// BootstrapClusterContext is like BootstrapCluster, but gives up and returns
+// ctx.Err() if ctx is done before the bootstrap completes.
+func (r *Raft) BootstrapClusterContext(ctx context.Context, configuration Configuration) Future {
+	bootstrapReq := &bootstrapFuture{}
+	bootstrapReq.init()
+	bootstrapReq.configuration = configuration
+	select {
+	case <-ctx.Done():
+		return errorFuture{ctx.Err()}
+	case <-r.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	case r.bootstrapCh <- bootstrapReq:
+		return contextFuture{bootstrapReq, ctx}
+	}
+}
+
 // Leader is used to return the current leader of the cluster.
 // Deprecated: use LeaderWithID instead
 // It may return empty string if there is no current leader
@@ -868,16 +1047,35 @@ func (r *Raft) Apply(cmd []byte, timeout time.Duration) ApplyFuture {
 	return r.ApplyLog(Log{Data: cmd}, timeout)
 }
 
+// ApplyContext is like Apply, but uses ctx instead of a timeout. If ctx is
+// done before the command is enqueued, or while waiting on the returned
+// future, ctx.Err() is returned. As with a timeout, a command that has already
+// been enqueued may still be applied.
+func (r *Raft) ApplyContext(ctx context.Context, cmd []byte) ApplyFuture {
+	return r.ApplyLogContext(ctx, Log{Data: cmd})
+}
+
 // ApplyLog performs Apply but takes in a Log directly. The only values
 // currently taken from the submitted Log are Data and Extensions. See
 // Apply for details on error cases.
 func (r *Raft) ApplyLog(log Log, timeout time.Duration) ApplyFuture {
-	metrics.IncrCounter([]string{"raft", "apply"}, 1)
-
 	var timer <-chan time.Time
 	if timeout > 0 {
 		timer = time.After(timeout)
 	}
+	return r.applyLog(context.Background(), log, timer)
+}
+
+// ApplyLogContext performs ApplyContext but takes in a Log directly. See
+// ApplyLog and ApplyContext for details.
+func (r *Raft) ApplyLogContext(ctx context.Context, log Log) ApplyFuture {
+	return contextApplyFuture{r.applyLog(ctx, log, nil), ctx}
+}
+
+// applyLog enqueues the given log for the leader, giving up if timer fires or
+// ctx is done first.
+func (r *Raft) applyLog(ctx context.Context, log Log, timer <-chan time.Time) ApplyFuture {
+	metrics.IncrCounter([]string{"raft", "apply"}, 1)
 
 	// Create a log future, no index or term yet
 	logFuture := &logFuture{
@@ -892,6 +1090,8 @@ func (r *Raft) ApplyLog(log Log, timeout time.Duration) ApplyFuture {
 	select {
 	case <-timer:
 		return errorFuture{ErrEnqueueTimeout}
+	case <-ctx.Done():
+		return errorFuture{ctx.Err()}
 	case <-r.shutdownCh:
 		return errorFuture{ErrRaftShutdown}
 	case r.applyCh <- logFuture:
@@ -905,11 +1105,24 @@ func (r *Raft) ApplyLog(log Log, timeout time.Duration) ApplyFuture {
 // limit the amount of time we wait for the command to be started. This
 // must be run on the leader, or it will fail.
 func (r *Raft) Barrier(timeout time.Duration) Future {
-	metrics.IncrCounter([]string{"raft", "barrier"}, 1)
 	var timer <-chan time.Time
 	if timeout > 0 {
 		timer = time.After(timeout)
 	}
+	return r.barrier(context.Background(), timer)
+}
+
+// BarrierContext is like Barrier, but uses ctx instead of a timeout. If ctx is
+// done before the barrier is enqueued, or while waiting on the returned
+// future, ctx.Err() is returned.
+func (r *Raft) BarrierContext(ctx context.Context) Future {
+	return contextFuture{r.barrier(ctx, nil), ctx}
+}
+
+// barrier enqueues a barrier for the leader, giving up if timer fires or ctx
+// is done first.
+func (r *Raft) barrier(ctx context.Context, timer <-chan time.Time) Future {
+	metrics.IncrCounter([]string{"raft", "barrier"}, 1)
 
 	// Create a log future, no index or term yet
 	logFuture := &logFuture{log: Log{Type: LogBarrier}}
@@ -918,6 +1131,8 @@ func (r *Raft) Barrier(timeout time.Duration) Future {
 	select {
 	case <-timer:
 		return errorFuture{ErrEnqueueTimeout}
+	case <-ctx.Done():
+		return errorFuture{ctx.Err()}
 	case <-r.shutdownCh:
 		return errorFuture{ErrRaftShutdown}
 	case r.applyCh <- logFuture:
@@ -940,6 +1155,147 @@ func (r *Raft) VerifyLeader() Future {
 	}
 }
 
+// VerifyLeaderContext is like VerifyLeader, but gives up and returns
+// ctx.Err() if ctx is done before leadership is confirmed.
+func (r *Raft) VerifyLeaderContext(ctx context.Context) Future {
+	metrics.IncrCounter([]string{"raft", "verify_leader"}, 1)
+	verifyFuture := &verifyFuture{}
+	verifyFuture.init()
+	select {
+	case <-ctx.Done():
+		return errorFuture{ctx.Err()}
+	case <-r.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	case r.verifyCh <- verifyFuture:
+		return contextFuture{verifyFuture, ctx}
+	}
+}
+
+// ReadIndex returns a commit index that is safe to use for a linearizable
+// read, following the ReadIndex protocol in section 6.4 of the Raft
+// dissertation. The leader records its commit index and then confirms it is
+// still the leader with a round of heartbeats, without appending anything to
+// the log. Once the FSM has applied up to the returned index (see
+// AppliedIndex), a read from the FSM reflects every write that was committed
+// before ReadIndex was called. This must be run on the leader or it will fail.
+//
+// If the leader has not yet committed an entry in its current term, the
+// request waits until it has. If ctx is done before the index is confirmed,
+// ctx.Err() is returned.
+func (r *Raft) ReadIndex(ctx context.Context) (uint64, error) {
+	metrics.IncrCounter([]string{"raft", "read_index"}, 1)
+	verifyFuture := &verifyFuture{readIndexReq: true}
+	verifyFuture.ShutdownCh = r.shutdownCh
+	verifyFuture.init()
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-r.shutdownCh:
+		return 0, ErrRaftShutdown
+	case r.verifyCh <- verifyFuture:
+	}
+	if err := verifyFuture.errorContext(ctx); err != nil {
+		return 0, err
+	}
+	return verifyFuture.readIndex, nil
+}
+
+// LeaseRead returns a commit index that is safe to use for a linearizable
+// read, like ReadIndex, but without a round of heartbeats. Instead it relies on
+// the leader lease described in section 6.4.1 of the Raft dissertation: while
+// the leader has heard from a quorum within LeaderLeaseTimeout minus
+// Config.LeaseReadMaxClockDrift, no other leader can have been elected. This
+// is only as safe as the clock drift bound, so it must be enabled with
+// Config.LeaseReads. This must be run on the leader or it will fail.
+//
+// ErrLeaseExpired is returned if the lease can't be relied on, including when
+// the leader has not yet committed an entry in its current term. Callers
+// should then fall back to ReadIndex.
+func (r *Raft) LeaseRead() (uint64, error) {
+	if !r.config().LeaseReads {
+		return 0, ErrLeaseReadsDisabled
+	}
+	metrics.IncrCounter([]string{"raft", "lease_read"}, 1)
+	verifyFuture := &verifyFuture{leaseRead: true}
+	verifyFuture.ShutdownCh = r.shutdownCh
+	verifyFuture.init()
+	select {
+	case <-r.shutdownCh:
+		return 0, ErrRaftShutdown
+	case r.verifyCh <- verifyFuture:
+	}
+	if err := verifyFuture.Error(); err != nil {
+		return 0, err
+	}
+	return verifyFuture.readIndex, nil
+}
+
+// LinearizableRead blocks until a read from this server's FSM would be
+// linearizable and returns the read index it waited for. Unlike ReadIndex it
+// can be called on any server, so read traffic can be spread across the
+// cluster. On the leader the read index comes from ReadIndex. On any other
+// server it is requested from the known leader over the transport, which must
+// implement WithReadIndex. In both cases this then waits until AppliedIndex
+// has caught up with the read index.
+//
+// As with AppliedIndex, the index is considered applied once it has been
+// handed to the FSM goroutine. Applications reading state that the FSM
+// updates asynchronously should also wait for their own applied index to
+// reach the returned value.
+func (r *Raft) LinearizableRead(ctx context.Context) (uint64, error) {
+	var index uint64
+	var err error
+	if r.getState() == Leader {
+		index, err = r.ReadIndex(ctx)
+	} else {
+		index, err = r.forwardReadIndex(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := r.waitForApplied(ctx, index); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// forwardReadIndex asks the known leader for a read index.
+func (r *Raft) forwardReadIndex(ctx context.Context) (uint64, error) {
+	trans, ok := r.trans.(WithReadIndex)
+	if !ok {
+		return 0, fmt.Errorf("transport does not support read index requests")
+	}
+	leaderAddr, leaderID := r.LeaderWithID()
+	if leaderAddr == "" {
+		return 0, ErrUnknownLeader
+	}
+	metrics.IncrCounter([]string{"raft", "read_index", "forward"}, 1)
+
+	req := &ReadIndexRequest{RPCHeader: r.getRPCHeader()}
+	var resp ReadIndexResponse
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- trans.ReadIndex(leaderID, leaderAddr, req, &resp)
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return 0, err
+		}
+		// A leader from an older term than ours may have been deposed
+		// without knowing it yet, so its read index can't be trusted.
+		if term := r.getCurrentTerm(); resp.Term < term {
+			return 0, fmt.Errorf("%w: %s answered for term %d, but the current term is %d",
+				ErrNotLeader, leaderID, resp.Term, term)
+		}
+		return resp.ReadIndex, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-r.shutdownCh:
+		return 0, ErrRaftShutdown
+	}
+}
+
 // GetConfiguration returns the latest configuration. This may not yet be
 // committed. The main loop can access this directly.
 func (r *Raft) GetConfiguration() ConfigurationFuture {
@@ -1004,6 +1360,23 @@ func (r *Raft) AddVoter(id ServerID, address ServerAddress, prevIndex uint64, ti
 	}, timeout)
 }
 
+// AddVoterContext is like AddVoter, but uses ctx instead of a timeout. If ctx
+// is done before the change is enqueued, or while waiting on the returned
+// future, ctx.Err() is returned. As with a timeout, a change that has already
+// been enqueued may still be applied.
+func (r *Raft) AddVoterContext(ctx context.Context, id ServerID, address ServerAddress, prevIndex uint64) IndexFuture {
+	if r.protocolVersion < 2 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChangeContext(ctx, configurationChangeRequest{
+		command:       AddVoter,
+		serverID:      id,
+		serverAddress: address,
+		prevIndex:     prevIndex,
+	})
+}
+
 // AddNonvoter will add the given server to the cluster but won't assign it a
 // vote. The server will receive log entries, but it won't participate in
 // elections or log entry commitment. If the server is already in the cluster,
@@ -1022,6 +1395,57 @@ func (r *Raft) AddNonvoter(id ServerID, address ServerAddress, prevIndex uint64,
 	}, timeout)
 }
 
+// AddNonvoterContext is like AddNonvoter, but uses ctx instead of a timeout.
+// See AddVoterContext.
+func (r *Raft) AddNonvoterContext(ctx context.Context, id ServerID, address ServerAddress, prevIndex uint64) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChangeContext(ctx, configurationChangeRequest{
+		command:       AddNonvoter,
+		serverID:      id,
+		serverAddress: address,
+		prevIndex:     prevIndex,
+	})
+}
+
+// AddWitness will add the given server to the cluster as a Witness. The server
+// votes in elections and log entry commitment, but only receives the index and
+// term of commands, never applies them to its FSM and never becomes leader. Its
+// FSM only has to accept the empty snapshots the leader sends it. A server
+// that's already in the cluster as a Voter or Nonvoter must be removed first.
+// If the server is already a Witness, this updates the server's address. This
+// must be run on the leader or it will fail. For prevIndex and timeout, see
+// AddVoter.
+func (r *Raft) AddWitness(id ServerID, address ServerAddress, prevIndex uint64, timeout time.Duration) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChange(configurationChangeRequest{
+		command:       AddWitness,
+		serverID:      id,
+		serverAddress: address,
+		prevIndex:     prevIndex,
+	}, timeout)
+}
+
+// AddWitnessContext is like AddWitness, but uses ctx instead of a timeout.
+// See AddVoterContext.
+func (r *Raft) AddWitnessContext(ctx context.Context, id ServerID, address ServerAddress, prevIndex uint64) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChangeContext(ctx, configurationChangeRequest{
+		command:       AddWitness,
+		serverID:      id,
+		serverAddress: address,
+		prevIndex:     prevIndex,
+	})
+}
+
 // RemoveServer will remove the given server from the cluster. If the current
 // leader is being removed, it will cause a new election to occur. This must be
 // run on the leader or it will fail. For prevIndex and timeout, see AddVoter.
@@ -1037,6 +1461,20 @@ func (r *Raft) RemoveServer(id ServerID, prevIndex uint64, timeout time.Duration
 	}, timeout)
 }
 
+// RemoveServerContext is like RemoveServer, but uses ctx instead of a
+// timeout. See AddVoterContext.
+func (r *Raft) RemoveServerContext(ctx context.Context, id ServerID, prevIndex uint64) IndexFuture {
+	if r.protocolVersion < 2 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChangeContext(ctx, configurationChangeRequest{
+		command:   RemoveServer,
+		serverID:  id,
+		prevIndex: prevIndex,
+	})
+}
+
 // DemoteVoter will take away a server's vote, if it has one. If present, the
 // server will continue to receive log entries, but it won't participate in
 // elections or log entry commitment. If the server is not in the cluster, this
@@ -1054,6 +1492,91 @@ func (r *Raft) DemoteVoter(id ServerID, prevIndex uint64, timeout time.Duration)
 	}, timeout)
 }
 
+// DemoteVoterContext is like DemoteVoter, but uses ctx instead of a timeout.
+// See AddVoterContext.
+func (r *Raft) DemoteVoterContext(ctx context.Context, id ServerID, prevIndex uint64) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChangeContext(ctx, configurationChangeRequest{
+		command:   DemoteVoter,
+		serverID:  id,
+		prevIndex: prevIndex,
+	})
+}
+
+// SetPriority changes the leader Priority of the given server. If a caught up
+// voter has a higher priority than the leader, the leader will transfer
+// leadership to it. This must be run on the leader or it will fail. For
+// prevIndex and timeout, see AddVoter.
+func (r *Raft) SetPriority(id ServerID, priority int, prevIndex uint64, timeout time.Duration) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChange(configurationChangeRequest{
+		command:   SetPriority,
+		serverID:  id,
+		priority:  priority,
+		prevIndex: prevIndex,
+	}, timeout)
+}
+
+// SetPriorityContext is like SetPriority, but uses ctx instead of a timeout.
+// See AddVoterContext.
+func (r *Raft) SetPriorityContext(ctx context.Context, id ServerID, priority int, prevIndex uint64) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChangeContext(ctx, configurationChangeRequest{
+		command:   SetPriority,
+		serverID:  id,
+		priority:  priority,
+		prevIndex: prevIndex,
+	})
+}
+
+// ChangeMembership applies several membership changes as a single step, such
+// as replacing some or all of the voters. Each change must be AddVoter,
+// AddNonvoter, AddWitness, DemoteVoter or RemoveServer, and each server may
+// only appear once. If the set of voters changes, the cluster moves through a joint
+// consensus configuration (section 4.3 of the Raft dissertation), in which
+// elections and commitment need a majority of both the old and the new
+// voters, so there is never an unsafe intermediate quorum. The leader then
+// moves on to the final configuration automatically, and the returned future
+// holds the index of that final configuration entry. Other configuration
+// changes are rejected until then.
+//
+// This must be run on the leader or it will fail. For prevIndex and timeout,
+// see AddVoter.
+func (r *Raft) ChangeMembership(changes []ConfigurationChange, prevIndex uint64, timeout time.Duration) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChange(configurationChangeRequest{
+		command:   ChangeMembership,
+		prevIndex: prevIndex,
+		changes:   changes,
+	}, timeout)
+}
+
+// ChangeMembershipContext is like ChangeMembership, but uses ctx instead of a
+// timeout. See AddVoterContext.
+func (r *Raft) ChangeMembershipContext(ctx context.Context, changes []ConfigurationChange, prevIndex uint64) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChangeContext(ctx, configurationChangeRequest{
+		command:   ChangeMembership,
+		prevIndex: prevIndex,
+		changes:   changes,
+	})
+}
+
 // Shutdown is used to stop the Raft background routines.
 // This is not a graceful operation. Provides a future that
 // can be used to block until all background routines have exited.
@@ -1087,6 +1610,24 @@ func (r *Raft) Snapshot() SnapshotFuture {
 	}
 }
 
+// SnapshotContext is like Snapshot, but gives up and returns ctx.Err() if ctx
+// is done before the snapshot completes. A snapshot that has already started
+// will still run to completion in the background.
+func (r *Raft) SnapshotContext(ctx context.Context) SnapshotFuture {
+	future := &userSnapshotFuture{}
+	future.init()
+	select {
+	case r.userSnapshotCh <- future:
+		return contextSnapshotFuture{future, ctx}
+	case <-ctx.Done():
+		future.respond(ctx.Err())
+		return future
+	case <-r.shutdownCh:
+		future.respond(ErrRaftShutdown)
+		return future
+	}
+}
+
 // Restore is used to manually force Raft to consume an external snapshot, such
 // as if restoring from a backup. We will use the current Raft configuration,
 // not the one from the snapshot, so that we can restore into a new cluster. We
@@ -1102,11 +1643,25 @@ func (r *Raft) Snapshot() SnapshotFuture {
 // the leader commits ahead of its followers, so should only be used for disaster
 // recovery into a fresh cluster, and should not be used in normal operations.
 func (r *Raft) Restore(meta *SnapshotMeta, reader io.Reader, timeout time.Duration) error {
-	metrics.IncrCounter([]string{"raft", "restore"}, 1)
 	var timer <-chan time.Time
 	if timeout > 0 {
 		timer = time.After(timeout)
 	}
+	return r.restore(context.Background(), meta, reader, timer)
+}
+
+// RestoreContext is like Restore, but uses ctx instead of a timeout. If ctx is
+// done before the restore completes, ctx.Err() is returned. Once the restore
+// has been handed to the leader it will still run to completion in the
+// background.
+func (r *Raft) RestoreContext(ctx context.Context, meta *SnapshotMeta, reader io.Reader) error {
+	return r.restore(ctx, meta, reader, nil)
+}
+
+// restore performs a user restore, giving up if timer fires or ctx is done
+// first.
+func (r *Raft) restore(ctx context.Context, meta *SnapshotMeta, reader io.Reader, timer <-chan time.Time) error {
+	metrics.IncrCounter([]string{"raft", "restore"}, 1)
 
 	// Perform the restore.
 	restore := &userRestoreFuture{
@@ -1117,11 +1672,13 @@ func (r *Raft) Restore(meta *SnapshotMeta, reader io.Reader, timeout time.Durati
 	select {
 	case <-timer:
 		return ErrEnqueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
 	case <-r.shutdownCh:
 		return ErrRaftShutdown
 	case r.userRestoreCh <- restore:
 		// If the restore is ingested then wait for it to complete.
-		if err := restore.Error(); err != nil {
+		if err := restore.errorContext(ctx); err != nil {
 			return err
 		}
 	}
@@ -1139,10 +1696,12 @@ func (r *Raft) Restore(meta *SnapshotMeta, reader io.Reader, timeout time.Durati
 	select {
 	case <-timer:
 		return ErrEnqueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
 	case <-r.shutdownCh:
 		return ErrRaftShutdown
 	case r.applyCh <- noop:
-		return noop.Error()
+		return noop.errorContext(ctx)
 	}
 }
 
@@ -1240,7 +1799,7 @@ func (r *Raft) Stats() map[string]string {
 		hasUs := false
 		numPeers := 0
 		for _, server := range configuration.Servers {
-			if server.Suffrage == Voter {
+			if server.Suffrage.canVote() {
 				if server.ID == r.localID {
 					hasUs = true
 				} else {
@@ -1277,8 +1836,7 @@ func (r *Raft) LastIndex() uint64 {
 }
 
 // CommitIndex returns the committed index.
-// This API maybe helpful for server to implement the read index optimization
-// as described in the Raft paper.
+// See ReadIndex for a linearizable read index confirmed by the leader.
 func (r *Raft) CommitIndex() uint64 {
 	return r.getCommitIndex()
 }
@@ -1314,6 +1872,13 @@ func (r *Raft) LeadershipTransfer() Future {
 	return r.initiateLeadershipTransfer(nil, nil)
 }
 
+// LeadershipTransferContext is like LeadershipTransfer, but the returned
+// future gives up waiting and returns ctx.Err() once ctx is done. The transfer
+// itself is not aborted.
+func (r *Raft) LeadershipTransferContext(ctx context.Context) Future {
+	return contextFuture{r.LeadershipTransfer(), ctx}
+}
+
 // LeadershipTransferToServer does the same as LeadershipTransfer but takes a
 // server in the arguments in case a leadership should be transitioned to a
 // specific server in the cluster.  Note that raft protocol version 3 is not
@@ -1328,3 +1893,10 @@ func (r *Raft) LeadershipTransferToServer(id ServerID, address ServerAddress) Fu
 
 	return r.initiateLeadershipTransfer(&id, &address)
 }
+
+// LeadershipTransferToServerContext is like LeadershipTransferToServer, but
+// the returned future gives up waiting and returns ctx.Err() once ctx is done.
+// See LeadershipTransferContext.
+func (r *Raft) LeadershipTransferToServerContext(ctx context.Context, id ServerID, address ServerAddress) Future {
+	return contextFuture{r.LeadershipTransferToServer(id, address), ctx}
+}
@@ -0,0 +1,59 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raftbench
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func testWALStore(b *testing.B) *raft.WALStore {
+	store, err := raft.NewWALStore(b.TempDir())
+	if err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	b.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func BenchmarkWALStore_FirstIndex(b *testing.B) {
+	FirstIndex(b, testWALStore(b))
+}
+
+func BenchmarkWALStore_LastIndex(b *testing.B) {
+	LastIndex(b, testWALStore(b))
+}
+
+func BenchmarkWALStore_GetLog(b *testing.B) {
+	GetLog(b, testWALStore(b))
+}
+
+func BenchmarkWALStore_StoreLog(b *testing.B) {
+	StoreLog(b, testWALStore(b))
+}
+
+func BenchmarkWALStore_StoreLogs(b *testing.B) {
+	StoreLogs(b, testWALStore(b))
+}
+
+func BenchmarkWALStore_DeleteRange(b *testing.B) {
+	DeleteRange(b, testWALStore(b))
+}
+
+func BenchmarkWALStore_Set(b *testing.B) {
+	Set(b, testWALStore(b))
+}
+
+func BenchmarkWALStore_Get(b *testing.B) {
+	Get(b, testWALStore(b))
+}
+
+func BenchmarkWALStore_SetUint64(b *testing.B) {
+	SetUint64(b, testWALStore(b))
+}
+
+func BenchmarkWALStore_GetUint64(b *testing.B) {
+	GetUint64(b, testWALStore(b))
+}
@@ -0,0 +1,268 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxCatchUpDonors is how many followers a leader asks to send a
+	// snapshot to a lagging follower before sending its own.
+	maxCatchUpDonors = 3
+)
+
+// catchUpState tracks a follower that was asked to send a snapshot to another
+// follower on the leader's behalf.
+type catchUpState struct {
+	// donor is the follower sending the snapshot, and index is the last index
+	// the snapshot includes.
+	donor ServerID
+	index uint64
+
+	// deadline is when the leader stops waiting and sends its own snapshot.
+	// expired is set once it has passed.
+	deadline time.Time
+	expired  bool
+}
+
+// catchUpFromFollower is used when a follower needs a snapshot, to ask another
+// follower to send it one instead of the leader. It returns true while another
+// follower is sending it, and false if the leader should send its own.
+func (r *Raft) catchUpFromFollower(s *followerReplication) bool {
+	conf := r.config()
+	trans, ok := r.trans.(WithCatchUp)
+	if !conf.CatchUpFromFollowers || !ok {
+		return false
+	}
+
+	s.peerLock.RLock()
+	peer := s.peer
+	s.peerLock.RUnlock()
+
+	// A witness only gets the snapshot metadata, which is cheap to send.
+	if peer.Suffrage == Witness {
+		return false
+	}
+
+	if c := s.catchUp; c.donor != "" {
+		switch {
+		case atomic.LoadUint64(&s.matchIndex) >= c.index:
+			// The last catch-up worked, but the follower fell behind again.
+			s.catchUp = catchUpState{}
+		case c.expired:
+			return false
+		case time.Now().Before(c.deadline):
+			// Keep probing from the end of the snapshot being sent, so we
+			// find out as soon as it's been installed.
+			atomic.StoreUint64(&s.nextIndex, c.index+1)
+			return true
+		default:
+			r.logger.Warn("timed out waiting for follower to send snapshot",
+				"peer", peer.ID, "from", c.donor)
+			s.catchUp.expired = true
+			return false
+		}
+	}
+
+	// The snapshot has to be recent enough that we still have the logs that
+	// follow it.
+	minIndex, err := r.logs.FirstIndex()
+	if err != nil {
+		r.logger.Error("failed to get first index", "error", err)
+		return false
+	}
+	if minIndex == 0 {
+		minIndex, _ = r.getLastSnapshot()
+	}
+
+	// Ask the voters that are furthest ahead first.
+	matchIndexes := s.commitment.getMatchIndexes()
+	var donors []Server
+	for _, server := range r.getLatestConfiguration().Servers {
+		idx, ok := matchIndexes[server.ID]
+		if !ok || idx < minIndex || server.ID == r.localID || server.ID == peer.ID ||
+			server.Suffrage == Witness {
+			continue
+		}
+		donors = append(donors, server)
+	}
+	sort.SliceStable(donors, func(i, j int) bool {
+		return matchIndexes[donors[i].ID] > matchIndexes[donors[j].ID]
+	})
+	if len(donors) > maxCatchUpDonors {
+		donors = donors[:maxCatchUpDonors]
+	}
+
+	req := CatchUpRequest{
+		RPCHeader:  r.getRPCHeader(),
+		Term:       s.currentTerm,
+		TargetID:   []byte(peer.ID),
+		TargetAddr: r.trans.EncodePeer(peer.ID, peer.Address),
+		MinIndex:   minIndex,
+		Deadline:   time.Now().Add(conf.CatchUpTimeout),
+	}
+	for _, donor := range donors {
+		var resp CatchUpResponse
+		if err := trans.CatchUp(donor.ID, donor.Address, &req, &resp); err != nil {
+			r.logger.Debug("failed to ask follower to send snapshot", "peer", peer.ID, "from", donor.ID, "error", err)
+			continue
+		}
+		if !resp.Success {
+			continue
+		}
+		r.logger.Info("follower is sending snapshot", "peer", peer.ID, "from", donor.ID,
+			"index", resp.LastLogIndex)
+		s.catchUp = catchUpState{
+			donor:    donor.ID,
+			index:    resp.LastLogIndex,
+			deadline: req.Deadline,
+		}
+		atomic.StoreUint64(&s.nextIndex, resp.LastLogIndex+1)
+		return true
+	}
+	return false
+}
+
+// catchUp is invoked when we get a CatchUp RPC call. If we have a recent enough
+// snapshot, we start sending it to the target in the background. This must
+// only be called from the main thread.
+func (r *Raft) catchUp(rpc RPC, req *CatchUpRequest) {
+	resp := &CatchUpResponse{
+		RPCHeader: r.getRPCHeader(),
+		Term:      r.getCurrentTerm(),
+	}
+	var rpcErr error
+	defer func() {
+		rpc.Respond(resp, rpcErr)
+	}()
+
+	// Only help the leader of the current term
+	_, leaderID := r.LeaderWithID()
+	if req.Term != r.getCurrentTerm() || r.getState() != Follower || leaderID != ServerID(req.ID) ||
+		!time.Now().Before(req.Deadline) {
+		r.logger.Debug("rejecting catch-up request", "from", ServerID(req.ID), "term", req.Term)
+		return
+	}
+	if isWitness(r.configurations.latest, r.localID) {
+		return
+	}
+
+	target := Server{
+		ID:      ServerID(req.TargetID),
+		Address: r.trans.DecodePeer(req.TargetAddr),
+	}
+	r.catchUpsLock.Lock()
+	defer r.catchUpsLock.Unlock()
+	if meta, ok := r.catchUps[target.ID]; ok {
+		// Already on it
+		resp.Success = true
+		resp.LastLogIndex, resp.LastLogTerm = meta.Index, meta.Term
+		return
+	}
+
+	snapshots, err := r.snapshots.List()
+	if err != nil {
+		r.logger.Error("failed to list snapshots", "error", err)
+		rpcErr = err
+		return
+	}
+	if len(snapshots) == 0 || snapshots[0].Index < req.MinIndex {
+		r.logger.Debug("no recent enough snapshot for catch-up", "peer", target.ID, "min-index", req.MinIndex)
+		return
+	}
+	meta := snapshots[0]
+
+	if r.catchUps == nil {
+		r.catchUps = make(map[ServerID]*SnapshotMeta)
+	}
+	r.catchUps[target.ID] = meta
+	leader := req.Addr
+	term, deadline := req.Term, req.Deadline
+	r.goFunc(func() { r.sendCatchUpSnapshot(target, leader, term, deadline, meta) })
+
+	resp.Success = true
+	resp.LastLogIndex, resp.LastLogTerm = meta.Index, meta.Term
+}
+
+// sendCatchUpSnapshot sends a snapshot to a lagging follower on behalf of the
+// leader, retrying until it succeeds, the term changes or the leader's
+// deadline passes.
+func (r *Raft) sendCatchUpSnapshot(target Server, leader []byte, term uint64, deadline time.Time, meta *SnapshotMeta) {
+	defer func() {
+		r.catchUpsLock.Lock()
+		delete(r.catchUps, target.ID)
+		r.catchUpsLock.Unlock()
+	}()
+
+	r.logger.Info("sending snapshot on behalf of leader", "peer", target.ID, "id", meta.ID, "size", meta.Size)
+	var progress snapshotProgress
+	var failures uint64
+	for {
+		if failures > 0 {
+			select {
+			case <-time.After(backoff(failureWait, failures, maxFailureScale)):
+			case <-r.shutdownCh:
+				return
+			}
+		}
+		if r.getCurrentTerm() != term || time.Now().After(deadline) {
+			r.logger.Warn("gave up sending snapshot on behalf of leader", "peer", target.ID, "id", meta.ID)
+			return
+		}
+
+		done, err := r.relaySnapshot(target, leader, term, meta.ID, &progress)
+		if err != nil {
+			r.logger.Error("failed to send snapshot on behalf of leader", "peer", target.ID, "id", meta.ID, "error", err)
+			failures++
+			continue
+		}
+		if done {
+			r.logger.Info("sent snapshot on behalf of leader", "peer", target.ID, "id", meta.ID)
+		} else {
+			r.logger.Warn("snapshot sent on behalf of leader was rejected", "peer", target.ID, "id", meta.ID)
+		}
+		return
+	}
+}
+
+// relaySnapshot makes one attempt at sending a snapshot to a follower on behalf
+// of the leader. It returns whether the follower installed it.
+func (r *Raft) relaySnapshot(target Server, leader []byte, term uint64, snapID string, progress *snapshotProgress) (bool, error) {
+	meta, snapshot, err := r.openSnapshotToSend(snapID)
+	if err != nil {
+		return false, err
+	}
+	cursor := &snapshotCursor{open: r.openSnapshotToSend, id: snapID, rc: snapshot}
+	defer func() { _ = cursor.Close() }()
+
+	req := InstallSnapshotRequest{
+		RPCHeader:          r.getRPCHeader(),
+		SnapshotVersion:    meta.Version,
+		Term:               term,
+		Leader:             leader,
+		LastLogIndex:       meta.Index,
+		LastLogTerm:        meta.Term,
+		Peers:              meta.Peers,
+		Size:               meta.Size,
+		Configuration:      EncodeConfiguration(meta.Configuration),
+		ConfigurationIndex: meta.ConfigurationIndex,
+		Compression:        meta.Compression,
+		Checksum:           meta.Checksum,
+		Chain:              meta.Chain,
+		Relayed:            true,
+	}
+	var resp InstallSnapshotResponse
+	if chunkSize := r.config().SnapshotChunkSize; chunkSize > 0 {
+		err = r.sendSnapshotChunks(target, progress, &req, &resp, cursor, int64(chunkSize))
+	} else {
+		err = r.trans.InstallSnapshot(target.ID, target.Address, &req, &resp, cursor)
+	}
+	if err != nil {
+		return false, err
+	}
+	return resp.Success && resp.Term == term, nil
+}
@@ -0,0 +1,161 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_CatchUpFromFollower(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 10
+	conf.SnapshotThreshold = 1 << 20
+	conf.SnapshotChunkSize = 128
+	conf.CatchUpFromFollowers = true
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	followers := c.GetInState(Follower)
+	require.Len(t, followers, 2)
+	lagging, donor := followers[0], followers[1]
+
+	// Commit a lot of things while one follower is away.
+	c.Disconnect(lagging.localAddr)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0).Error())
+	}
+	donorFSM := getMockFSM(c.fsms[c.IndexOf(donor)])
+	require.Eventually(t, func() bool {
+		return len(donorFSM.Logs()) == 100
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Both snapshot and compact their logs, then the leader loses its
+	// snapshot, so the follower can only catch up from the donor.
+	require.NoError(t, donor.Snapshot().Error())
+	require.NoError(t, leader.Snapshot().Error())
+	snapDir := c.snaps[c.IndexOf(leader)].path
+	entries, err := os.ReadDir(snapDir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NoError(t, os.RemoveAll(filepath.Join(snapDir, entry.Name())))
+	}
+
+	c.FullyConnect()
+	laggingFSM := getMockFSM(c.fsms[c.IndexOf(lagging)])
+	require.Eventually(t, func() bool {
+		return len(laggingFSM.Logs()) == 100
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, leader.Apply([]byte("after"), 0).Error())
+	c.WaitForReplication(101)
+	c.EnsureSame(t)
+	require.Equal(t, leader.localAddr, func() ServerAddress {
+		addr, _ := lagging.LeaderWithID()
+		return addr
+	}())
+}
+
+func TestRaft_CatchUpFromFollower_LeaderSnapshotWins(t *testing.T) {
+	c := MakeClusterNoBootstrap(1, t, nil)
+	defer c.Close()
+	r := c.rafts[0]
+	fsm := getMockFSM(c.fsms[0])
+
+	_, trans := NewInmemTransport("")
+	trans.Connect(r.localAddr, c.trans[0])
+	header := RPCHeader{ProtocolVersion: ProtocolVersionMax, ID: []byte("leader"), Addr: []byte(trans.LocalAddr())}
+	configuration := Configuration{Servers: []Server{
+		{Suffrage: Voter, ID: r.localID, Address: r.localAddr},
+		{Suffrage: Voter, ID: "leader", Address: trans.LocalAddr()},
+	}}
+	install := func(index uint64, relayed bool) *InstallSnapshotResponse {
+		var logs [][]byte
+		for i := uint64(0); i < index; i++ {
+			logs = append(logs, []byte(fmt.Sprintf("test%d", i)))
+		}
+		var data []byte
+		require.NoError(t, codec.NewEncoderBytes(&data, &codec.MsgpackHandle{}).Encode(logs))
+		req := &InstallSnapshotRequest{
+			RPCHeader:          header,
+			SnapshotVersion:    SnapshotVersionMax,
+			Term:               1,
+			Leader:             []byte(trans.LocalAddr()),
+			LastLogIndex:       index,
+			LastLogTerm:        1,
+			Configuration:      EncodeConfiguration(configuration),
+			ConfigurationIndex: 1,
+			Size:               int64(len(data)),
+			Relayed:            relayed,
+		}
+		if relayed {
+			req.RPCHeader.ID = []byte("donor")
+		}
+		var resp InstallSnapshotResponse
+		require.NoError(t, trans.InstallSnapshot(r.localID, r.localAddr, req, &resp, bytes.NewReader(data)))
+		return &resp
+	}
+
+	// The leader gives up on the donor and sends its own snapshot, and the
+	// logs after it.
+	require.True(t, install(50, false).Success)
+	appendReq := &AppendEntriesRequest{
+		RPCHeader:         header,
+		Term:              1,
+		PrevLogEntry:      50,
+		PrevLogTerm:       1,
+		Entries:           []*Log{{Index: 51, Term: 1, Type: LogCommand, Data: []byte("test50")}},
+		LeaderCommitIndex: 51,
+	}
+	var appendResp AppendEntriesResponse
+	require.NoError(t, trans.AppendEntries(r.localID, r.localAddr, appendReq, &appendResp))
+	require.True(t, appendResp.Success)
+	require.Eventually(t, func() bool {
+		return len(fsm.Logs()) == 51
+	}, time.Second, time.Millisecond)
+
+	// The donor's snapshot arrives late, and doesn't roll the state back.
+	require.False(t, install(40, true).Success)
+	require.False(t, install(51, true).Success)
+	require.Len(t, fsm.Logs(), 51)
+	require.Equal(t, uint64(51), r.getLastApplied())
+	lastSnapIndex, _ := r.getLastSnapshot()
+	require.Equal(t, uint64(50), lastSnapIndex)
+
+	// A newer one is still installed.
+	require.True(t, install(60, true).Success)
+	require.Len(t, fsm.Logs(), 60)
+}
+
+func TestRaft_CatchUpFromFollower_Deadline(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.CatchUpFromFollowers = true
+	c := MakeCluster(2, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+	require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	follower := c.Followers()[0]
+	require.NoError(t, follower.Snapshot().Error())
+
+	// A follower doesn't start sending a snapshot once the leader has
+	// stopped waiting for it.
+	req := &CatchUpRequest{
+		RPCHeader:  leader.getRPCHeader(),
+		Term:       leader.getCurrentTerm(),
+		TargetID:   []byte("lagging"),
+		TargetAddr: []byte("lagging"),
+		Deadline:   time.Now().Add(-time.Second),
+	}
+	var resp CatchUpResponse
+	trans := c.trans[c.IndexOf(leader)].(WithCatchUp)
+	require.NoError(t, trans.CatchUp(follower.localID, follower.localAddr, req, &resp))
+	require.False(t, resp.Success)
+}
@@ -3,6 +3,8 @@
 
 package raft
 
+import "time"
+
 // RPCHeader is a common sub-structure used to pass along protocol version and
 // other information about the cluster. For older Raft implementations before
 // versioning was added this will default to a zero-valued structure when read
@@ -15,6 +17,12 @@ type RPCHeader struct {
 	ID []byte
 	// Addr is the ServerAddr of the node sending the RPC Request or Response
 	Addr []byte
+	// Codecs lists the IDs of the codecs, beyond msgpack, the sender's
+	// transport can decode. See Codec.
+	Codecs []byte
+	// GroupID identifies the raft group a request is for, when the receiver
+	// hosts several groups. See MultiRaft.
+	GroupID []byte
 }
 
 // WithRPCHeader is an interface that exposes the RPC header.
@@ -180,6 +188,37 @@ type InstallSnapshotRequest struct {
 
 	// Size of the snapshot
 	Size int64
+
+	// Chunked is set when the request carries a single chunk of the snapshot
+	// rather than all of it. SnapshotID identifies the snapshot on the
+	// leader, so that the follower can resume a transfer that failed part of
+	// the way through.
+	Chunked    bool
+	SnapshotID string
+
+	// ChunkIndex numbers the chunks of a snapshot from zero. ChunkOffset is
+	// where the chunk starts in the snapshot, ChunkSize is how many bytes of
+	// it follow the request, and ChunkChecksum is their CRC-32 (Castagnoli).
+	ChunkIndex    uint64
+	ChunkOffset   int64
+	ChunkSize     int64
+	ChunkChecksum uint32
+
+	// Compression names the algorithm the snapshot data is compressed with,
+	// if any. Checksum is the CRC-64 (ECMA) of the data as sent, if the
+	// sender knows it, which the receiver checks before restoring it.
+	Compression string
+	Checksum    []byte
+
+	// Chain is the number of snapshots in the data, if it's a full snapshot
+	// followed by delta snapshots, as described by SnapshotMeta.Chain.
+	Chain int
+
+	// Relayed is set when a follower sends the snapshot on behalf of the
+	// leader, in answer to a CatchUpRequest. The receiver doesn't take the
+	// sender to be the leader, and ignores the snapshot unless it's newer
+	// than its own state.
+	Relayed bool
 }
 
 // GetRPCHeader - See WithRPCHeader.
@@ -187,6 +226,14 @@ func (r *InstallSnapshotRequest) GetRPCHeader() RPCHeader {
 	return r.RPCHeader
 }
 
+// dataSize returns how many bytes of snapshot data follow the request.
+func (r *InstallSnapshotRequest) dataSize() int64 {
+	if r.Chunked {
+		return r.ChunkSize
+	}
+	return r.Size
+}
+
 // InstallSnapshotResponse is the response returned from an
 // InstallSnapshotRequest.
 type InstallSnapshotResponse struct {
@@ -194,6 +241,12 @@ type InstallSnapshotResponse struct {
 
 	Term    uint64
 	Success bool
+
+	// NextChunk and NextOffset tell the leader which chunk of a chunked
+	// snapshot the follower expects next, and where it starts. The leader
+	// carries on from there if it sent a different chunk.
+	NextChunk  uint64
+	NextOffset int64
 }
 
 // GetRPCHeader - See WithRPCHeader.
@@ -221,3 +274,109 @@ type TimeoutNowResponse struct {
 func (r *TimeoutNowResponse) GetRPCHeader() RPCHeader {
 	return r.RPCHeader
 }
+
+// ReadIndexRequest is the command used by a follower to ask the leader for a
+// read index it can use to serve a linearizable read.
+type ReadIndexRequest struct {
+	RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *ReadIndexRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// ReadIndexResponse is the response returned from a ReadIndexRequest.
+type ReadIndexResponse struct {
+	RPCHeader
+
+	// Term is the leader's current term.
+	Term uint64
+
+	// ReadIndex is the commit index the leader confirmed while still holding
+	// leadership. Reads are linearizable once this index has been applied.
+	ReadIndex uint64
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *ReadIndexResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// CatchUpRequest is the command used by a leader to ask a follower to send its
+// latest snapshot to another server that has fallen too far behind, so that
+// the leader doesn't have to.
+type CatchUpRequest struct {
+	RPCHeader
+
+	// Term is the leader's current term.
+	Term uint64
+
+	// TargetID and TargetAddr identify the server to send the snapshot to.
+	TargetID   []byte
+	TargetAddr []byte
+
+	// MinIndex is the oldest snapshot index that's of use to the target,
+	// since the leader has the logs that follow it.
+	MinIndex uint64
+
+	// Deadline is when the leader stops waiting for the snapshot and sends
+	// its own. The follower doesn't start or retry the transfer after it.
+	Deadline time.Time
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *CatchUpRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// CatchUpResponse is the response returned from a CatchUpRequest.
+type CatchUpResponse struct {
+	RPCHeader
+
+	// Term is the follower's current term.
+	Term uint64
+
+	// Success is true if the follower is sending its snapshot to the target.
+	// LastLogIndex and LastLogTerm are the last index and term it includes.
+	Success      bool
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *CatchUpResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// HeartbeatBatchRequest carries the heartbeats of several raft groups to the
+// same server in a single RPC. See MultiRaft.
+type HeartbeatBatchRequest struct {
+	RPCHeader
+
+	// Heartbeats are the heartbeats of each group, tagged with their
+	// RPCHeader.GroupID.
+	Heartbeats []*AppendEntriesRequest
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *HeartbeatBatchRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// HeartbeatBatchResponse is the response returned from a
+// HeartbeatBatchRequest.
+type HeartbeatBatchResponse struct {
+	RPCHeader
+
+	// Responses holds the response to each heartbeat, in order.
+	Responses []*AppendEntriesResponse
+
+	// Errors holds the error each heartbeat failed with, if any, in order.
+	Errors []string
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *HeartbeatBatchResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
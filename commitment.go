@@ -18,6 +18,11 @@ type commitment struct {
 	commitCh chan struct{}
 	// voter ID to log index: the server stores up through this log entry
 	matchIndexes map[ServerID]uint64
+	// during a joint consensus change, the IDs of the incoming and outgoing
+	// voters: an entry must be stored by a majority of each to be committed.
+	// Both are nil otherwise.
+	incoming []ServerID
+	outgoing []ServerID
 	// a quorum stores up through this log entry. monotonically increases.
 	commitIndex uint64
 	// the first index of this leader's term: this needs to be replicated to a
@@ -33,18 +38,14 @@ type commitment struct {
 // 'startIndex' is the first index created in this term (see
 // its description above).
 func newCommitment(commitCh chan struct{}, configuration Configuration, startIndex uint64) *commitment {
-	matchIndexes := make(map[ServerID]uint64)
-	for _, server := range configuration.Servers {
-		if server.Suffrage == Voter {
-			matchIndexes[server.ID] = 0
-		}
-	}
-	return &commitment{
+	c := &commitment{
 		commitCh:     commitCh,
-		matchIndexes: matchIndexes,
+		matchIndexes: make(map[ServerID]uint64),
 		commitIndex:  0,
 		startIndex:   startIndex,
 	}
+	c.setVoters(configuration, nil)
+	return c
 }
 
 // Called when a new cluster membership configuration is created: it will be
@@ -55,12 +56,27 @@ func (c *commitment) setConfiguration(configuration Configuration) {
 	defer c.Unlock()
 	oldMatchIndexes := c.matchIndexes
 	c.matchIndexes = make(map[ServerID]uint64)
+	c.setVoters(configuration, oldMatchIndexes)
+	c.recalculate()
+}
+
+// setVoters fills in matchIndexes for the voters of the configuration,
+// carrying over any match indexes from oldMatchIndexes, and records both sets
+// of voters during a joint consensus change. Must be called with lock held.
+func (c *commitment) setVoters(configuration Configuration, oldMatchIndexes map[ServerID]uint64) {
+	c.incoming, c.outgoing = nil, nil
 	for _, server := range configuration.Servers {
-		if server.Suffrage == Voter {
+		if server.Suffrage.canVote() {
 			c.matchIndexes[server.ID] = oldMatchIndexes[server.ID] // defaults to 0
+			if inJointConsensus(configuration) {
+				c.incoming = append(c.incoming, server.ID)
+			}
 		}
 	}
-	c.recalculate()
+	for _, server := range configuration.Outgoing {
+		c.matchIndexes[server.ID] = oldMatchIndexes[server.ID]
+		c.outgoing = append(c.outgoing, server.ID)
+	}
 }
 
 // Called by leader after commitCh is notified
@@ -70,6 +86,17 @@ func (c *commitment) getCommitIndex() uint64 {
 	return c.commitIndex
 }
 
+// getMatchIndexes returns a copy of the voters' match indexes.
+func (c *commitment) getMatchIndexes() map[ServerID]uint64 {
+	c.Lock()
+	defer c.Unlock()
+	out := make(map[ServerID]uint64, len(c.matchIndexes))
+	for id, idx := range c.matchIndexes {
+		out[id] = idx
+	}
+	return out
+}
+
 // Match is called once a server completes writing entries to disk: either the
 // leader has written the new entry or a follower has replied to an
 // AppendEntries RPC. The given server's disk agrees with this server's log up
@@ -90,15 +117,41 @@ func (c *commitment) recalculate() {
 		return
 	}
 
-	matched := make([]uint64, 0, len(c.matchIndexes))
-	for _, idx := range c.matchIndexes {
-		matched = append(matched, idx)
+	var quorumMatchIndex uint64
+	if c.outgoing == nil {
+		matched := make([]uint64, 0, len(c.matchIndexes))
+		for _, idx := range c.matchIndexes {
+			matched = append(matched, idx)
+		}
+		quorumMatchIndex = medianMatchIndex(matched)
+	} else {
+		// During joint consensus both the incoming and outgoing voters need
+		// to have stored an entry.
+		quorumMatchIndex = min(c.quorumMatchIndex(c.incoming), c.quorumMatchIndex(c.outgoing))
 	}
-	sort.Sort(uint64Slice(matched))
-	quorumMatchIndex := matched[(len(matched)-1)/2]
 
 	if quorumMatchIndex > c.commitIndex && quorumMatchIndex >= c.startIndex {
 		c.commitIndex = quorumMatchIndex
 		asyncNotifyCh(c.commitCh)
 	}
 }
+
+// quorumMatchIndex returns the highest index stored by a majority of the given
+// voters. Must be called with lock held.
+func (c *commitment) quorumMatchIndex(voters []ServerID) uint64 {
+	if len(voters) == 0 {
+		return 0
+	}
+	matched := make([]uint64, 0, len(voters))
+	for _, id := range voters {
+		matched = append(matched, c.matchIndexes[id])
+	}
+	return medianMatchIndex(matched)
+}
+
+// medianMatchIndex sorts the given match indexes and returns the one stored by
+// a majority.
+func medianMatchIndex(matched []uint64) uint64 {
+	sort.Sort(uint64Slice(matched))
+	return matched[(len(matched)-1)/2]
+}
@@ -242,3 +242,35 @@ func TestCommitment_singleVoter(t *testing.T) {
 		t.Fatalf("expected commit notify")
 	}
 }
+
+// Tests that a joint configuration needs a majority of both sets of voters.
+func TestCommitment_jointConsensus(t *testing.T) {
+	commitCh := make(chan struct{}, 1)
+	joint := makeConfiguration([]string{"d", "e", "f"})
+	joint.Outgoing = makeConfiguration([]string{"a", "b", "c"}).Servers
+	c := newCommitment(commitCh, joint, 0)
+
+	// A majority of the outgoing voters isn't enough
+	c.match("a", 10)
+	c.match("b", 10)
+	c.match("c", 10)
+	if c.getCommitIndex() != 0 {
+		t.Fatalf("expected nothing committed, found %d", c.getCommitIndex())
+	}
+
+	// Only what both majorities have stored is committed
+	c.match("d", 20)
+	c.match("e", 20)
+	if c.getCommitIndex() != 10 {
+		t.Fatalf("expected 10 entries committed, found %d", c.getCommitIndex())
+	}
+	if !drainNotifyCh(commitCh) {
+		t.Fatalf("expected commit notify")
+	}
+
+	// Leaving joint consensus drops the outgoing voters
+	c.setConfiguration(makeConfiguration([]string{"d", "e", "f"}))
+	if c.getCommitIndex() != 20 {
+		t.Fatalf("expected 20 entries committed, found %d", c.getCommitIndex())
+	}
+}
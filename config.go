@@ -198,6 +198,13 @@ type Config struct {
 	// setting used. This can be tuned during operation using ReloadConfig.
 	SnapshotThreshold uint64
 
+	// MaxSnapshotDeltas lets an FSM that implements IncrementalFSM take delta
+	// snapshots, which only hold what changed since the previous snapshot,
+	// when the SnapshotStore implements DeltaSnapshotStore. At most this many
+	// deltas are chained after a full snapshot before the next full one is
+	// taken. Zero, the default, only takes full snapshots.
+	MaxSnapshotDeltas int
+
 	// LeaderLeaseTimeout is used to control how long the "lease" lasts
 	// for being the leader without being able to contact a quorum
 	// of nodes. If we reach this interval without contact, we will
@@ -253,6 +260,73 @@ type Config struct {
 	// interface. Otherwise, Raft will fail to start and return ErrIncompatibleLogStore.
 	RestoreCommittedLogs bool
 
+	// LeaseReads enables Raft.LeaseRead, which lets the leader serve
+	// linearizable reads without a network round trip for as long as it has
+	// heard from a quorum within its lease. This relies on bounded clock
+	// drift between servers, so it is off by default.
+	LeaseReads bool
+
+	// LeaseReadMaxClockDrift bounds how much faster or slower clocks may run
+	// across the cluster over one LeaderLeaseTimeout. A lease read is only
+	// served while quorum contact is newer than LeaderLeaseTimeout minus this
+	// value. It must be positive and smaller than LeaderLeaseTimeout when
+	// LeaseReads is enabled.
+	LeaseReadMaxClockDrift time.Duration
+
+	// CheckQuorum makes servers reject RequestVote and RequestPreVote requests
+	// while they have heard from a leader within ElectionTimeout, even once
+	// they have forgotten who the leader is, unless the request is part of a
+	// leadership transfer. Leaders already step down once they lose contact
+	// with a quorum for LeaderLeaseTimeout. Together these stop a server that
+	// rejoins after a partition from bumping the term of a healthy cluster,
+	// even when pre-vote is disabled or some servers don't support it.
+	CheckQuorum bool
+
+	// AutoPromoteNonvoters lets the leader promote a Nonvoter to Voter on its
+	// own, once the server's log has stayed within NonvoterPromotionMaxLag
+	// entries of the leader's for NonvoterPromotionStabilizationTime. Only one
+	// server is promoted at a time.
+	AutoPromoteNonvoters bool
+
+	// NonvoterPromotionMaxLag is how many entries a Nonvoter may be behind the
+	// leader's last index and still count as caught up.
+	NonvoterPromotionMaxLag uint64
+
+	// NonvoterPromotionStabilizationTime is how long a Nonvoter must stay
+	// caught up before it's promoted. It must be positive when
+	// AutoPromoteNonvoters is enabled.
+	NonvoterPromotionStabilizationTime time.Duration
+
+	// SnapshotChunkSize is the most bytes of a snapshot the leader sends to a
+	// follower in one InstallSnapshot RPC. Each chunk is checksummed and
+	// acknowledged, and a transfer that fails is resumed from the last chunk
+	// the follower acknowledged. If zero, the default, snapshots are sent in
+	// one piece. Servers running older versions can only receive a snapshot
+	// in one piece, so only set this once all of them have been upgraded;
+	// a few MiB is a reasonable size.
+	SnapshotChunkSize int
+
+	// CatchUpFromFollowers lets the leader ask an up-to-date voter to send its
+	// latest snapshot to a follower that has fallen too far behind, instead of
+	// streaming its own, which keeps the leader's network free for
+	// replication. The leader sends the logs after that snapshot itself, and
+	// falls back to sending its own snapshot if no voter has a recent enough
+	// one. This requires a transport that implements WithCatchUp.
+	CatchUpFromFollowers bool
+
+	// CatchUpTimeout is how long the leader waits for a follower to send a
+	// snapshot on its behalf before it sends its own. It must be positive
+	// when CatchUpFromFollowers is enabled.
+	CatchUpTimeout time.Duration
+
+	// LogArchiver, if set, is given every range of committed logs before
+	// it's deleted from the LogStore, and compaction waits for it to store
+	// them durably. If it fails, the logs are kept and archiving is retried
+	// at the next compaction. When a snapshot from the leader replaces the
+	// whole log of a MonotonicLogStore and the logs can't be archived, the
+	// install fails and the leader sends the snapshot again.
+	LogArchiver LogArchiver
+
 	// skipStartup allows NewRaft() to bypass all background work goroutines
 	skipStartup bool
 }
@@ -325,6 +399,13 @@ func (rc *ReloadableConfig) fromConfig(from Config) {
 	rc.ElectionTimeout = from.ElectionTimeout
 }
 
+const (
+	// MaxSnapshotChunkSize is the largest Config.SnapshotChunkSize, and the
+	// largest chunk a follower accepts. Chunks are held in memory on both
+	// sides while they're checked.
+	MaxSnapshotChunkSize = 64 * 1024 * 1024
+)
+
 // DefaultConfig returns a Config with usable defaults.
 func DefaultConfig() *Config {
 	return &Config{
@@ -339,6 +420,11 @@ func DefaultConfig() *Config {
 		SnapshotThreshold:  8192,
 		LeaderLeaseTimeout: 500 * time.Millisecond,
 		LogLevel:           "DEBUG",
+
+		LeaseReadMaxClockDrift:             50 * time.Millisecond,
+		NonvoterPromotionMaxLag:            128,
+		NonvoterPromotionStabilizationTime: 10 * time.Second,
+		CatchUpTimeout:                     5 * time.Minute,
 	}
 }
 
@@ -385,5 +471,28 @@ func ValidateConfig(config *Config) error {
 	if config.ElectionTimeout < config.HeartbeatTimeout {
 		return fmt.Errorf("ElectionTimeout (%s) must be equal or greater than Heartbeat Timeout (%s)", config.ElectionTimeout, config.HeartbeatTimeout)
 	}
+	if config.LeaseReads {
+		if config.LeaseReadMaxClockDrift <= 0 {
+			return fmt.Errorf("LeaseReadMaxClockDrift must be positive when LeaseReads is enabled")
+		}
+		if config.LeaseReadMaxClockDrift >= config.LeaderLeaseTimeout {
+			return fmt.Errorf("LeaseReadMaxClockDrift (%s) must be less than LeaderLeaseTimeout (%s)", config.LeaseReadMaxClockDrift, config.LeaderLeaseTimeout)
+		}
+	}
+	if config.MaxSnapshotDeltas < 0 {
+		return fmt.Errorf("MaxSnapshotDeltas must not be negative")
+	}
+	if config.SnapshotChunkSize < 0 {
+		return fmt.Errorf("SnapshotChunkSize must not be negative")
+	}
+	if config.SnapshotChunkSize > MaxSnapshotChunkSize {
+		return fmt.Errorf("SnapshotChunkSize is too large")
+	}
+	if config.CatchUpFromFollowers && config.CatchUpTimeout <= 0 {
+		return fmt.Errorf("CatchUpTimeout must be positive when CatchUpFromFollowers is enabled")
+	}
+	if config.AutoPromoteNonvoters && config.NonvoterPromotionStabilizationTime <= 0 {
+		return fmt.Errorf("NonvoterPromotionStabilizationTime must be positive when AutoPromoteNonvoters is enabled")
+	}
 	return nil
 }
@@ -3,7 +3,10 @@
 
 package raft
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // ServerSuffrage determines whether a Server in a Configuration gets a vote.
 type ServerSuffrage int
@@ -21,6 +24,13 @@ const (
 	// into a Voter.
 	// Deprecated: use Nonvoter instead.
 	Staging
+	// Witness is a server whose vote is counted in elections and commitment
+	// like a Voter's, but which only keeps the index and term of command
+	// entries, not their data, and never applies them to its FSM. A Witness
+	// never stands for election, so it can break ties between full replicas
+	// without storing their data. Snapshots are sent to a Witness without
+	// their data, so its FSM's Restore must accept an empty snapshot.
+	Witness
 )
 
 func (s ServerSuffrage) String() string {
@@ -31,10 +41,17 @@ func (s ServerSuffrage) String() string {
 		return "Nonvoter"
 	case Staging:
 		return "Staging"
+	case Witness:
+		return "Witness"
 	}
 	return "ServerSuffrage"
 }
 
+// canVote returns true if servers with this suffrage have a vote.
+func (s ServerSuffrage) canVote() bool {
+	return s == Voter || s == Witness
+}
+
 // ConfigurationStore provides an interface that can optionally be implemented by FSMs
 // to store configuration updates made in the replicated log. In general this is only
 // necessary for FSMs that mutate durable state directly instead of applying changes
@@ -65,6 +82,12 @@ type Server struct {
 	ID ServerID
 	// Address is its network address that a transport can contact.
 	Address ServerAddress
+	// Priority is how strongly this server should be preferred as leader,
+	// with higher values preferred. Voters with a lower priority than another
+	// voter hold off their elections for longer, and a leader hands off
+	// leadership to a caught up voter with a higher priority than its own.
+	// All servers default to 0.
+	Priority int
 }
 
 // Configuration tracks which servers are in the cluster, and whether they have
@@ -73,14 +96,56 @@ type Server struct {
 // These entries are appended to the log during membership changes.
 type Configuration struct {
 	Servers []Server
+
+	// Outgoing is only set while a joint consensus change started with
+	// ChangeMembership is in progress. It holds the voters of the outgoing
+	// configuration, while Servers holds the incoming one. Servers listed only
+	// here still receive log entries and may still vote. Elections and
+	// commitment need a majority of the voters in Servers and a majority of
+	// the voters in Outgoing.
+	Outgoing []Server
 }
 
 // Clone makes a deep copy of a Configuration.
 func (c *Configuration) Clone() (copy Configuration) {
 	copy.Servers = append(copy.Servers, c.Servers...)
+	copy.Outgoing = append(copy.Outgoing, c.Outgoing...)
 	return
 }
 
+// String formats the configuration's servers, and its outgoing voters during a
+// joint consensus change.
+func (c Configuration) String() string {
+	if !inJointConsensus(c) {
+		return fmt.Sprintf("{%v}", formatServers(c.Servers))
+	}
+	return fmt.Sprintf("{%v outgoing:%v}", formatServers(c.Servers), formatServers(c.Outgoing))
+}
+
+// formatServers formats servers as %v would, leaving out the priority unless
+// it has been set.
+func formatServers(servers []Server) []string {
+	formatted := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if server.Priority == 0 {
+			formatted = append(formatted, fmt.Sprintf("{%v %v %v}", server.Suffrage, server.ID, server.Address))
+		} else {
+			formatted = append(formatted, fmt.Sprintf("{%v %v %v %d}", server.Suffrage, server.ID, server.Address, server.Priority))
+		}
+	}
+	return formatted
+}
+
+// ConfigurationChange is a single membership change made as part of a
+// ChangeMembership call. Command must be one of AddVoter, AddNonvoter,
+// AddWitness, DemoteVoter or RemoveServer, and Address is only used when
+// adding a server.
+type ConfigurationChange struct {
+	Command ConfigurationChangeCommand
+	ID      ServerID
+	Address ServerAddress
+}
+
 // ConfigurationChangeCommand is the different ways to change the cluster
 // configuration.
 type ConfigurationChangeCommand uint8
@@ -98,6 +163,18 @@ const (
 	// no-op if the server is not Staging.
 	// Deprecated: use AddVoter instead.
 	Promote
+	// ChangeMembership applies several changes at once, entering a joint
+	// consensus configuration if the set of voters changes.
+	ChangeMembership
+	// LeaveJoint drops the outgoing voters once a joint consensus
+	// configuration has been committed. The leader issues it automatically.
+	LeaveJoint
+	// AddWitness adds a server with Suffrage of Witness. A server that's
+	// already in the cluster must be removed before it can become a Witness.
+	AddWitness
+	// SetPriority changes a server's leader Priority. The command will be a
+	// no-op if the server is absent.
+	SetPriority
 	// AddStaging makes a server a Voter.
 	// Deprecated: AddStaging was actually AddVoter. Use AddVoter instead.
 	AddStaging = 0 // explicit 0 to preserve the old value.
@@ -115,6 +192,14 @@ func (c ConfigurationChangeCommand) String() string {
 		return "RemoveServer"
 	case Promote:
 		return "Promote"
+	case ChangeMembership:
+		return "ChangeMembership"
+	case LeaveJoint:
+		return "LeaveJoint"
+	case AddWitness:
+		return "AddWitness"
+	case SetPriority:
+		return "SetPriority"
 	}
 	return "ConfigurationChangeCommand"
 }
@@ -126,10 +211,13 @@ type configurationChangeRequest struct {
 	command       ConfigurationChangeCommand
 	serverID      ServerID
 	serverAddress ServerAddress // only present for AddVoter, AddNonvoter
+	priority      int           // only present for SetPriority
 	// prevIndex, if nonzero, is the index of the only configuration upon which
 	// this change may be applied; if another configuration entry has been
 	// added in the meantime, this request will fail.
 	prevIndex uint64
+	// changes is only present for ChangeMembership.
+	changes []ConfigurationChange
 }
 
 // configurations is state tracked on every server about its Configurations.
@@ -154,6 +242,9 @@ type configurations struct {
 	latest Configuration
 	// latestIndex is the log index where 'latest' was written.
 	latestIndex uint64
+	// applied is the configuration in effect at the last applied index,
+	// which decides whether entries were stored as a witness.
+	applied Configuration
 }
 
 // Clone makes a deep copy of a configurations object.
@@ -162,31 +253,188 @@ func (c *configurations) Clone() (copy configurations) {
 	copy.committedIndex = c.committedIndex
 	copy.latest = c.latest.Clone()
 	copy.latestIndex = c.latestIndex
+	copy.applied = c.applied.Clone()
 	return
 }
 
-// hasVote returns true if the server identified by 'id' is a Voter in the
-// provided Configuration.
+// hasVote returns true if the server identified by 'id' is a Voter or Witness
+// in the provided Configuration, including as an outgoing voter during a joint
+// consensus change.
 func hasVote(configuration Configuration, id ServerID) bool {
+	for _, server := range configuration.Outgoing {
+		if server.ID == id {
+			return true
+		}
+	}
+	for _, server := range configuration.Servers {
+		if server.ID == id {
+			return server.Suffrage.canVote()
+		}
+	}
+	return false
+}
+
+// isWitness returns true if the server identified by 'id' is a Witness in the
+// provided Configuration, including as an outgoing voter during a joint
+// consensus change.
+func isWitness(configuration Configuration, id ServerID) bool {
+	for _, server := range configuration.Outgoing {
+		if server.ID == id && server.Suffrage == Witness {
+			return true
+		}
+	}
 	for _, server := range configuration.Servers {
 		if server.ID == id {
-			return server.Suffrage == Voter
+			return server.Suffrage == Witness
 		}
 	}
 	return false
 }
 
+// serverPriority returns the Priority of the server identified by 'id' in the
+// provided Configuration, or 0 if it's absent.
+func serverPriority(configuration Configuration, id ServerID) int {
+	for _, server := range configuration.Servers {
+		if server.ID == id {
+			return server.Priority
+		}
+	}
+	return 0
+}
+
+// electionDelay returns how much longer than the heartbeat timeout the server
+// identified by 'id' should wait before starting an election: one extra
+// timeout for each distinct Priority above its own held by a Voter. This gives
+// the preferred servers the first chance to take over.
+func electionDelay(configuration Configuration, id ServerID, timeout time.Duration) time.Duration {
+	priority := serverPriority(configuration, id)
+	higher := make(map[int]bool)
+	for _, server := range configuration.Servers {
+		if server.Suffrage == Voter && server.Priority > priority {
+			higher[server.Priority] = true
+		}
+	}
+	return time.Duration(len(higher)) * timeout
+}
+
 // inConfiguration returns true if the server identified by 'id' is in the
-// provided Configuration.
+// provided Configuration, including as an outgoing voter during a joint
+// consensus change.
 func inConfiguration(configuration Configuration, id ServerID) bool {
 	for _, server := range configuration.Servers {
 		if server.ID == id {
 			return true
 		}
 	}
+	for _, server := range configuration.Outgoing {
+		if server.ID == id {
+			return true
+		}
+	}
 	return false
 }
 
+// inJointConsensus returns true if the configuration is part way through a
+// joint consensus change.
+func inJointConsensus(configuration Configuration) bool {
+	return len(configuration.Outgoing) > 0
+}
+
+// configurationServers returns every server that should receive log entries
+// under the configuration: its Servers plus any outgoing voters that are being
+// removed.
+func configurationServers(configuration Configuration) []Server {
+	if !inJointConsensus(configuration) {
+		return configuration.Servers
+	}
+	servers := append([]Server(nil), configuration.Servers...)
+	for _, server := range configuration.Outgoing {
+		if !inConfiguration(Configuration{Servers: configuration.Servers}, server.ID) {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// configurationVoters returns every server whose vote counts under the
+// configuration, from both sides of a joint consensus change.
+func configurationVoters(configuration Configuration) []Server {
+	var voters []Server
+	for _, server := range configurationServers(configuration) {
+		if hasVote(configuration, server.ID) {
+			voters = append(voters, server)
+		}
+	}
+	return voters
+}
+
+// voteTally counts votes from the voters of a configuration, ignoring servers
+// without a vote. A quorum is a majority of the voters, and during a joint
+// consensus change also a majority of the outgoing voters.
+type voteTally struct {
+	incoming map[ServerID]bool
+	outgoing map[ServerID]bool
+}
+
+// newVoteTally returns a voteTally with no votes granted yet.
+func newVoteTally(configuration Configuration) *voteTally {
+	t := &voteTally{incoming: make(map[ServerID]bool)}
+	for _, server := range configuration.Servers {
+		if server.Suffrage.canVote() {
+			t.incoming[server.ID] = false
+		}
+	}
+	if inJointConsensus(configuration) {
+		t.outgoing = make(map[ServerID]bool)
+		for _, server := range configuration.Outgoing {
+			t.outgoing[server.ID] = false
+		}
+	}
+	return t
+}
+
+// grant records a vote from the given server.
+func (t *voteTally) grant(id ServerID) {
+	if _, ok := t.incoming[id]; ok {
+		t.incoming[id] = true
+	}
+	if _, ok := t.outgoing[id]; ok {
+		t.outgoing[id] = true
+	}
+}
+
+// quorum returns true once the granted votes form a quorum.
+func (t *voteTally) quorum() bool {
+	return hasMajority(t.incoming) && (t.outgoing == nil || hasMajority(t.outgoing))
+}
+
+// String describes the votes granted so far, for logging.
+func (t *voteTally) String() string {
+	s := describeVotes(t.incoming)
+	if t.outgoing != nil {
+		s += ", outgoing " + describeVotes(t.outgoing)
+	}
+	return s
+}
+
+func hasMajority(votes map[ServerID]bool) bool {
+	return grantedVotes(votes) >= len(votes)/2+1
+}
+
+func grantedVotes(votes map[ServerID]bool) int {
+	granted := 0
+	for _, ok := range votes {
+		if ok {
+			granted++
+		}
+	}
+	return granted
+}
+
+func describeVotes(votes map[ServerID]bool) string {
+	return fmt.Sprintf("%d of %d, %d needed", grantedVotes(votes), len(votes), len(votes)/2+1)
+}
+
 // checkConfiguration tests a cluster membership configuration for common
 // errors.
 func checkConfiguration(configuration Configuration) error {
@@ -215,6 +463,26 @@ func checkConfiguration(configuration Configuration) error {
 	if voters == 0 {
 		return fmt.Errorf("need at least one voter in configuration: %v", configuration)
 	}
+
+	outgoingSet := make(map[ServerID]bool)
+	for _, server := range configuration.Outgoing {
+		if server.ID == "" {
+			return fmt.Errorf("empty ID in outgoing configuration: %v", configuration)
+		}
+		if server.Address == "" {
+			return fmt.Errorf("empty address in outgoing configuration: %v", server)
+		}
+		if !server.Suffrage.canVote() {
+			return fmt.Errorf("non-voter in outgoing configuration: %v", server)
+		}
+		if outgoingSet[server.ID] {
+			return fmt.Errorf("found duplicate ID in outgoing configuration: %v", server.ID)
+		}
+		outgoingSet[server.ID] = true
+		if !idSet[server.ID] && addressSet[server.Address] {
+			return fmt.Errorf("found duplicate address in configuration: %v", server.Address)
+		}
+	}
 	return nil
 }
 
@@ -226,20 +494,120 @@ func nextConfiguration(current Configuration, currentIndex uint64, change config
 		return Configuration{}, fmt.Errorf("configuration changed since %v (latest is %v)", change.prevIndex, currentIndex)
 	}
 
+	if inJointConsensus(current) && change.command != LeaveJoint {
+		return Configuration{}, fmt.Errorf("joint consensus change in progress")
+	}
+
 	configuration := current.Clone()
 	switch change.command {
+	case ChangeMembership:
+		if len(change.changes) == 0 {
+			return Configuration{}, fmt.Errorf("no membership changes given")
+		}
+		seen := make(map[ServerID]bool)
+		for _, c := range change.changes {
+			switch c.Command {
+			case AddVoter, AddNonvoter, AddWitness, DemoteVoter, RemoveServer:
+			default:
+				return Configuration{}, fmt.Errorf("unsupported membership change %v for %v", c.Command, c.ID)
+			}
+			if seen[c.ID] {
+				return Configuration{}, fmt.Errorf("more than one membership change for %v", c.ID)
+			}
+			seen[c.ID] = true
+			if err := checkWitnessChange(current, c.Command, c.ID); err != nil {
+				return Configuration{}, err
+			}
+			configuration = applyConfigurationChange(configuration, c.Command, c.ID, c.Address)
+		}
+
+		// Only go through joint consensus if the voters change, otherwise
+		// the new configuration can take effect directly.
+		if !sameVoters(current, configuration) {
+			for _, server := range current.Servers {
+				if server.Suffrage.canVote() {
+					configuration.Outgoing = append(configuration.Outgoing, server)
+				}
+			}
+		}
+	case LeaveJoint:
+		configuration.Outgoing = nil
+	case SetPriority:
+		for i, server := range configuration.Servers {
+			if server.ID == change.serverID {
+				configuration.Servers[i].Priority = change.priority
+				break
+			}
+		}
+	default:
+		if err := checkWitnessChange(current, change.command, change.serverID); err != nil {
+			return Configuration{}, err
+		}
+		configuration = applyConfigurationChange(configuration, change.command, change.serverID, change.serverAddress)
+	}
+
+	// Make sure we didn't do something bad like remove the last voter
+	if err := checkConfiguration(configuration); err != nil {
+		return Configuration{}, err
+	}
+
+	return configuration, nil
+}
+
+// sameVoters returns true if both configurations have the same voters.
+func sameVoters(a, b Configuration) bool {
+	voters := make(map[ServerID]bool)
+	for _, server := range a.Servers {
+		if server.Suffrage.canVote() {
+			voters[server.ID] = true
+		}
+	}
+	for _, server := range b.Servers {
+		if server.Suffrage.canVote() {
+			if !voters[server.ID] {
+				return false
+			}
+			delete(voters, server.ID)
+		}
+	}
+	return len(voters) == 0
+}
+
+// checkWitnessChange returns an error if the change would turn a Witness into
+// a full replica or the other way around. A Witness has no entry data to
+// serve, and a replica's data would be wasted on a Witness, so the server has
+// to be removed and added again instead.
+func checkWitnessChange(configuration Configuration, command ConfigurationChangeCommand, id ServerID) error {
+	if !inConfiguration(Configuration{Servers: configuration.Servers}, id) {
+		return nil
+	}
+	witness := isWitness(configuration, id)
+	switch {
+	case witness && (command == AddVoter || command == DemoteVoter):
+		return fmt.Errorf("witness %v must be removed before changing its suffrage", id)
+	case !witness && command == AddWitness:
+		return fmt.Errorf("server %v must be removed before being added as a witness", id)
+	}
+	return nil
+}
+
+// applyConfigurationChange applies a single-server change to the given
+// configuration, which it may modify, and returns the result.
+func applyConfigurationChange(configuration Configuration, command ConfigurationChangeCommand, id ServerID, address ServerAddress) Configuration {
+	switch command {
 	case AddVoter:
 		newServer := Server{
 			Suffrage: Voter,
-			ID:       change.serverID,
-			Address:  change.serverAddress,
+			ID:       id,
+			Address:  address,
 		}
 		found := false
 		for i, server := range configuration.Servers {
-			if server.ID == change.serverID {
+			if server.ID == id {
 				if server.Suffrage == Voter {
-					configuration.Servers[i].Address = change.serverAddress
+					configuration.Servers[i].Address = address
 				} else {
+					newServer.Priority = server.Priority
 					configuration.Servers[i] = newServer
 				}
 				found = true
@@ -252,15 +620,16 @@ func nextConfiguration(current Configuration, currentIndex uint64, change config
 	case AddNonvoter:
 		newServer := Server{
 			Suffrage: Nonvoter,
-			ID:       change.serverID,
-			Address:  change.serverAddress,
+			ID:       id,
+			Address:  address,
 		}
 		found := false
 		for i, server := range configuration.Servers {
-			if server.ID == change.serverID {
+			if server.ID == id {
 				if server.Suffrage != Nonvoter {
-					configuration.Servers[i].Address = change.serverAddress
+					configuration.Servers[i].Address = address
 				} else {
+					newServer.Priority = server.Priority
 					configuration.Servers[i] = newServer
 				}
 				found = true
@@ -270,35 +639,45 @@ func nextConfiguration(current Configuration, currentIndex uint64, change config
 		if !found {
 			configuration.Servers = append(configuration.Servers, newServer)
 		}
+	case AddWitness:
+		found := false
+		for i, server := range configuration.Servers {
+			if server.ID == id {
+				configuration.Servers[i].Address = address
+				found = true
+				break
+			}
+		}
+		if !found {
+			configuration.Servers = append(configuration.Servers, Server{
+				Suffrage: Witness,
+				ID:       id,
+				Address:  address,
+			})
+		}
 	case DemoteVoter:
 		for i, server := range configuration.Servers {
-			if server.ID == change.serverID {
+			if server.ID == id {
 				configuration.Servers[i].Suffrage = Nonvoter
 				break
 			}
 		}
 	case RemoveServer:
 		for i, server := range configuration.Servers {
-			if server.ID == change.serverID {
+			if server.ID == id {
 				configuration.Servers = append(configuration.Servers[:i], configuration.Servers[i+1:]...)
 				break
 			}
 		}
 	case Promote:
 		for i, server := range configuration.Servers {
-			if server.ID == change.serverID && server.Suffrage == Staging {
+			if server.ID == id && server.Suffrage == Staging {
 				configuration.Servers[i].Suffrage = Voter
 				break
 			}
 		}
 	}
-
-	// Make sure we didn't do something bad like remove the last voter
-	if err := checkConfiguration(configuration); err != nil {
-		return Configuration{}, err
-	}
-
-	return configuration, nil
+	return configuration
 }
 
 // encodePeers is used to serialize a Configuration into the old peers format.
@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -298,6 +299,168 @@ func TestConfiguration_nextConfiguration_checkConfiguration(t *testing.T) {
 	}
 }
 
+func TestConfiguration_nextConfiguration_witness(t *testing.T) {
+	current := makeConfiguration([]string{"a", "b"})
+	next, err := nextConfiguration(current, 1, configurationChangeRequest{
+		command:       AddWitness,
+		serverID:      ServerID("w"),
+		serverAddress: ServerAddress("waddr"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "{[{Voter a aaddr} {Voter b baddr} {Witness w waddr}]}", next.String())
+	require.True(t, hasVote(next, "w"))
+	require.True(t, isWitness(next, "w"))
+	require.False(t, isWitness(next, "a"))
+
+	// A witness's vote counts towards a quorum
+	tally := newVoteTally(next)
+	tally.grant("a")
+	require.False(t, tally.quorum())
+	tally.grant("w")
+	require.True(t, tally.quorum())
+
+	// Updating the address is fine, but changing suffrage either way isn't
+	next, err = nextConfiguration(next, 2, configurationChangeRequest{
+		command:       AddWitness,
+		serverID:      ServerID("w"),
+		serverAddress: ServerAddress("waddr2"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "{[{Voter a aaddr} {Voter b baddr} {Witness w waddr2}]}", next.String())
+	for _, command := range []ConfigurationChangeCommand{AddVoter, DemoteVoter} {
+		_, err = nextConfiguration(next, 3, configurationChangeRequest{command: command, serverID: "w", serverAddress: "waddr2"})
+		require.ErrorContains(t, err, "must be removed before changing its suffrage")
+	}
+	_, err = nextConfiguration(next, 3, configurationChangeRequest{command: AddWitness, serverID: "a", serverAddress: "aaddr"})
+	require.ErrorContains(t, err, "must be removed before being added as a witness")
+
+	// A witness alone can't make a configuration valid
+	_, err = nextConfiguration(makeConfiguration([]string{"a"}), 1, configurationChangeRequest{
+		command: ChangeMembership,
+		changes: []ConfigurationChange{
+			{Command: AddWitness, ID: "w", Address: "waddr"},
+			{Command: RemoveServer, ID: "a"},
+		},
+	})
+	require.ErrorContains(t, err, "need at least one voter")
+}
+
+func TestConfiguration_nextConfiguration_priority(t *testing.T) {
+	current := makeConfiguration([]string{"a", "b"})
+	next, err := nextConfiguration(current, 1, configurationChangeRequest{
+		command:  SetPriority,
+		serverID: ServerID("b"),
+		priority: 5,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "{[{Voter a aaddr} {Voter b baddr 5}]}", next.String())
+
+	// The priority sticks when the server's suffrage changes
+	next, err = nextConfiguration(next, 2, configurationChangeRequest{command: DemoteVoter, serverID: "b"})
+	require.NoError(t, err)
+	next, err = nextConfiguration(next, 3, configurationChangeRequest{command: AddVoter, serverID: "b", serverAddress: "baddr"})
+	require.NoError(t, err)
+	require.Equal(t, "{[{Voter a aaddr} {Voter b baddr 5}]}", next.String())
+}
+
+func TestConfiguration_electionDelay(t *testing.T) {
+	configuration := makeConfiguration([]string{"a", "b", "c", "d", "e"})
+	configuration.Servers[0].Priority = 10
+	configuration.Servers[1].Priority = 10
+	configuration.Servers[2].Priority = 5
+	configuration.Servers[4].Suffrage = Nonvoter
+	configuration.Servers[4].Priority = 20
+
+	// Nonvoters can't be elected, so they don't hold anyone back
+	require.Equal(t, time.Duration(0), electionDelay(configuration, "a", time.Second))
+	require.Equal(t, time.Duration(0), electionDelay(configuration, "b", time.Second))
+	require.Equal(t, time.Second, electionDelay(configuration, "c", time.Second))
+	require.Equal(t, 2*time.Second, electionDelay(configuration, "d", time.Second))
+}
+
+func TestConfiguration_nextConfiguration_changeMembership(t *testing.T) {
+	current := makeConfiguration([]string{"a", "b", "c"})
+	req := configurationChangeRequest{
+		command: ChangeMembership,
+		changes: []ConfigurationChange{
+			{Command: AddVoter, ID: "d", Address: "daddr"},
+			{Command: AddVoter, ID: "e", Address: "eaddr"},
+			{Command: RemoveServer, ID: "a"},
+			{Command: RemoveServer, ID: "b"},
+		},
+	}
+	joint, err := nextConfiguration(current, 1, req)
+	require.NoError(t, err)
+	require.Equal(t, "{[{Voter c caddr} {Voter d daddr} {Voter e eaddr}] outgoing:[{Voter a aaddr} {Voter b baddr} {Voter c caddr}]}", joint.String())
+
+	// Outgoing voters keep their vote and receive logs until joint
+	// consensus is left
+	require.True(t, hasVote(joint, "a"))
+	require.True(t, inConfiguration(joint, "a"))
+	require.Len(t, configurationServers(joint), 5)
+	require.Len(t, configurationVoters(joint), 5)
+
+	// Nothing else can change in the meantime
+	_, err = nextConfiguration(joint, 2, configurationChangeRequest{command: AddNonvoter, serverID: "f", serverAddress: "faddr"})
+	require.ErrorContains(t, err, "joint consensus change in progress")
+
+	final, err := nextConfiguration(joint, 2, configurationChangeRequest{command: LeaveJoint})
+	require.NoError(t, err)
+	require.Equal(t, "{[{Voter c caddr} {Voter d daddr} {Voter e eaddr}]}", final.String())
+	require.False(t, hasVote(final, "a"))
+}
+
+func TestConfiguration_nextConfiguration_changeMembershipSameVoters(t *testing.T) {
+	// Changes that leave the voters alone don't need joint consensus
+	current := makeConfiguration([]string{"a", "b", "c"})
+	req := configurationChangeRequest{
+		command: ChangeMembership,
+		changes: []ConfigurationChange{
+			{Command: AddNonvoter, ID: "d", Address: "daddr"},
+			{Command: AddNonvoter, ID: "e", Address: "eaddr"},
+		},
+	}
+	next, err := nextConfiguration(current, 1, req)
+	require.NoError(t, err)
+	require.False(t, inJointConsensus(next))
+	require.Len(t, next.Servers, 5)
+}
+
+func TestConfiguration_nextConfiguration_changeMembershipInvalid(t *testing.T) {
+	current := makeConfiguration([]string{"a", "b", "c"})
+	cases := map[string][]ConfigurationChange{
+		"no membership changes": nil,
+		"unsupported":           {{Command: Promote, ID: "a"}},
+		"more than one":         {{Command: DemoteVoter, ID: "a"}, {Command: RemoveServer, ID: "a"}},
+		"at least one voter":    {{Command: RemoveServer, ID: "a"}, {Command: RemoveServer, ID: "b"}, {Command: RemoveServer, ID: "c"}},
+	}
+	for want, changes := range cases {
+		_, err := nextConfiguration(current, 1, configurationChangeRequest{command: ChangeMembership, changes: changes})
+		require.ErrorContains(t, err, want)
+	}
+}
+
+func TestConfiguration_voteTally(t *testing.T) {
+	tally := newVoteTally(makeConfiguration([]string{"a", "b", "c"}))
+	tally.grant("a")
+	tally.grant("nonvoter")
+	require.False(t, tally.quorum())
+	tally.grant("b")
+	require.True(t, tally.quorum())
+
+	// Joint consensus needs a majority of both sets
+	joint := makeConfiguration([]string{"c", "d", "e"})
+	joint.Outgoing = makeConfiguration([]string{"a", "b", "c"}).Servers
+	tally = newVoteTally(joint)
+	tally.grant("a")
+	tally.grant("b")
+	require.False(t, tally.quorum())
+	tally.grant("d")
+	require.False(t, tally.quorum())
+	tally.grant("c")
+	require.True(t, tally.quorum())
+}
+
 func TestConfiguration_encodeDecodePeers(t *testing.T) {
 	// Set up configuration.
 	var configuration Configuration
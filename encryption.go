@@ -0,0 +1,602 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// encryptionVersion is the first byte of encrypted data, so the format
+	// can change later.
+	encryptionVersion = 1
+
+	// encryptedFrameSize is how much of a snapshot is sealed at a time.
+	encryptedFrameSize = 64 * 1024
+
+	// encryptedFrameOverhead is the length prefix and GCM tag of each frame.
+	encryptedFrameOverhead = 4 + 16
+)
+
+var (
+	// ErrDecrypt is returned when encrypted data can't be authenticated, for
+	// example because it was modified or the key is wrong.
+	ErrDecrypt = errors.New("failed to decrypt data")
+
+	// ErrUnknownKey is returned by a KeyProvider for a key ID it doesn't have.
+	ErrUnknownKey = errors.New("unknown encryption key")
+)
+
+// KeyProvider provides the keys used to encrypt logs and snapshots at rest.
+// Keys must be 16, 24 or 32 bytes long, to select AES-128, AES-192 or
+// AES-256. To rotate keys, switch the current key and keep providing the old
+// ones by ID until no data encrypted with them remains: logs are rewritten as
+// they're compacted, and snapshots as new ones are taken.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new data with, and its ID.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the key with the given ID, to decrypt data with. It
+	// returns ErrUnknownKey if there is none.
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider that holds its keys in memory.
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+	lock    sync.RWMutex
+}
+
+// NewKeyRing returns a KeyRing using the given key.
+func NewKeyRing(id string, key []byte) (*KeyRing, error) {
+	k := &KeyRing{keys: make(map[string][]byte)}
+	if err := k.Rotate(id, key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate adds a key and makes it the current one. Keys that were added
+// before can still be used to decrypt.
+func (k *KeyRing) Rotate(id string, key []byte) error {
+	if id == "" || len(id) > 255 {
+		return fmt.Errorf("key ID must be 1 to 255 bytes long")
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if old, ok := k.keys[id]; ok && string(old) != string(key) {
+		return fmt.Errorf("key %q already exists", id)
+	}
+	k.keys[id] = append([]byte(nil), key...)
+	k.current = id
+	return nil
+}
+
+// Remove removes a key that is no longer used. The current key can't be
+// removed.
+func (k *KeyRing) Remove(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if id == k.current {
+		return fmt.Errorf("can't remove the current key")
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+// CurrentKey implements the KeyProvider interface.
+func (k *KeyRing) CurrentKey() (string, []byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.current, k.keys[k.current], nil
+}
+
+// Key implements the KeyProvider interface.
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// currentAEAD returns the cipher for the current key, and its ID.
+func currentAEAD(keys KeyProvider) (string, cipher.AEAD, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return "", nil, err
+	}
+	if id == "" || len(id) > 255 {
+		return "", nil, fmt.Errorf("key ID must be 1 to 255 bytes long")
+	}
+	aead, err := newAEAD(key)
+	return id, aead, err
+}
+
+// keyAEAD returns the cipher for the key with the given ID.
+func keyAEAD(keys KeyProvider, id string) (cipher.AEAD, error) {
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptionHeader returns the header of encrypted data, which identifies the
+// key and is followed by a nonce.
+func encryptionHeader(id string, aead cipher.AEAD) ([]byte, error) {
+	header := make([]byte, 2+len(id)+aead.NonceSize())
+	header[0] = encryptionVersion
+	header[1] = byte(len(id))
+	copy(header[2:], id)
+	if _, err := rand.Read(header[2+len(id):]); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// readEncryptionHeader reads the header written by encryptionHeader, and
+// returns the cipher for its key, the nonce and the size of the header.
+func readEncryptionHeader(keys KeyProvider, r io.Reader) (cipher.AEAD, []byte, int, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, nil, 0, headerReadError(err)
+	}
+	if prefix[0] != encryptionVersion {
+		return nil, nil, 0, fmt.Errorf("%w: unsupported version %d", ErrDecrypt, prefix[0])
+	}
+	id := make([]byte, prefix[1])
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, nil, 0, headerReadError(err)
+	}
+	aead, err := keyAEAD(keys, string(id))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, nil, 0, headerReadError(err)
+	}
+	return aead, nonce, len(prefix) + len(id) + len(nonce), nil
+}
+
+// headerReadError reports a header that's cut short as not decrypting.
+func headerReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated header", ErrDecrypt)
+	}
+	return err
+}
+
+// EncryptedLogStore wraps a LogStore to encrypt the Data and Extensions of
+// logs with AEAD. Each is bound to the index, term and type of its log, so
+// logs can't be swapped around undetected. The commit index of a
+// CommitTrackingLogStore is passed through unencrypted.
+type EncryptedLogStore struct {
+	store LogStore
+	keys  KeyProvider
+}
+
+// NewEncryptedLogStore returns an EncryptedLogStore wrapping store.
+func NewEncryptedLogStore(store LogStore, keys KeyProvider) *EncryptedLogStore {
+	return &EncryptedLogStore{
+		store: store,
+		keys:  keys,
+	}
+}
+
+// IsMonotonic implements the MonotonicLogStore interface, for the underlying
+// store.
+func (e *EncryptedLogStore) IsMonotonic() bool {
+	if store, ok := e.store.(MonotonicLogStore); ok {
+		return store.IsMonotonic()
+	}
+	return false
+}
+
+// FirstIndex implements the LogStore interface.
+func (e *EncryptedLogStore) FirstIndex() (uint64, error) {
+	return e.store.FirstIndex()
+}
+
+// LastIndex implements the LogStore interface.
+func (e *EncryptedLogStore) LastIndex() (uint64, error) {
+	return e.store.LastIndex()
+}
+
+// GetLog implements the LogStore interface.
+func (e *EncryptedLogStore) GetLog(index uint64, log *Log) error {
+	if err := e.store.GetLog(index, log); err != nil {
+		return err
+	}
+	var err error
+	if log.Data, err = e.open(log, 'd', log.Data); err != nil {
+		return fmt.Errorf("log %d: %w", index, err)
+	}
+	if log.Extensions, err = e.open(log, 'e', log.Extensions); err != nil {
+		return fmt.Errorf("log %d: %w", index, err)
+	}
+	return nil
+}
+
+// StoreLog implements the LogStore interface.
+func (e *EncryptedLogStore) StoreLog(log *Log) error {
+	return e.StoreLogs([]*Log{log})
+}
+
+// StoreLogs implements the LogStore interface. The given logs are left as
+// they are, since they're still used in memory.
+func (e *EncryptedLogStore) StoreLogs(logs []*Log) error {
+	id, aead, err := currentAEAD(e.keys)
+	if err != nil {
+		return err
+	}
+	encrypted := make([]*Log, len(logs))
+	for i, log := range logs {
+		enc := *log
+		if enc.Data, err = e.seal(id, aead, log, 'd', log.Data); err != nil {
+			return err
+		}
+		if enc.Extensions, err = e.seal(id, aead, log, 'e', log.Extensions); err != nil {
+			return err
+		}
+		encrypted[i] = &enc
+	}
+	return e.store.StoreLogs(encrypted)
+}
+
+// DeleteRange implements the LogStore interface.
+func (e *EncryptedLogStore) DeleteRange(min, max uint64) error {
+	return e.store.DeleteRange(min, max)
+}
+
+// StageCommitIndex implements the CommitTrackingLogStore interface, for the
+// underlying store. It returns ErrIncompatibleLogStore if that store doesn't
+// track the commit index.
+func (e *EncryptedLogStore) StageCommitIndex(index uint64) error {
+	store, ok := e.store.(CommitTrackingLogStore)
+	if !ok {
+		return ErrIncompatibleLogStore
+	}
+	return store.StageCommitIndex(index)
+}
+
+// GetCommitIndex implements the CommitTrackingLogStore interface, for the
+// underlying store. It returns ErrIncompatibleLogStore if that store doesn't
+// track the commit index.
+func (e *EncryptedLogStore) GetCommitIndex() (uint64, error) {
+	store, ok := e.store.(CommitTrackingLogStore)
+	if !ok {
+		return 0, ErrIncompatibleLogStore
+	}
+	return store.GetCommitIndex()
+}
+
+// logAdditionalData binds a field of a log to its position in the log.
+func logAdditionalData(log *Log, field byte) []byte {
+	ad := make([]byte, 18)
+	binary.BigEndian.PutUint64(ad, log.Index)
+	binary.BigEndian.PutUint64(ad[8:], log.Term)
+	ad[16] = byte(log.Type)
+	ad[17] = field
+	return ad
+}
+
+// seal encrypts a field of a log. Empty fields are left empty.
+func (e *EncryptedLogStore) seal(id string, aead cipher.AEAD, log *Log, field byte, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	header, err := encryptionHeader(id, aead)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[len(header)-aead.NonceSize():]
+	return aead.Seal(header, nonce, data, logAdditionalData(log, field)), nil
+}
+
+// open decrypts a field of a log sealed by seal.
+func (e *EncryptedLogStore) open(log *Log, field byte, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	r := &byteReader{data: data}
+	aead, nonce, _, err := readEncryptionHeader(e.keys, r)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, r.data, logAdditionalData(log, field))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// byteReader reads a byte slice, leaving the unread part in data.
+type byteReader struct {
+	data []byte
+}
+
+func (b *byteReader) Read(p []byte) (int, error) {
+	if len(b.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+// EncryptedSnapshotStore wraps a SnapshotStore to encrypt snapshots with
+// AEAD. Snapshots are sealed in frames as they're written, and each frame is
+// checked as it's read, so they're never held in memory as a whole. Frames
+// are bound to the index and term of their snapshot, so one snapshot can't be
+// passed off as another undetected.
+// Encrypted data doesn't compress, so the wrapped store shouldn't compress
+// snapshots. The sizes List reports are those of the encrypted snapshots;
+// Open reports the size of the decrypted snapshot.
+type EncryptedSnapshotStore struct {
+	store SnapshotStore
+	keys  KeyProvider
+}
+
+// NewEncryptedSnapshotStore returns an EncryptedSnapshotStore wrapping store.
+func NewEncryptedSnapshotStore(store SnapshotStore, keys KeyProvider) *EncryptedSnapshotStore {
+	return &EncryptedSnapshotStore{
+		store: store,
+		keys:  keys,
+	}
+}
+
+// Create implements the SnapshotStore interface.
+func (e *EncryptedSnapshotStore) Create(version SnapshotVersion, index, term uint64,
+	configuration Configuration, configurationIndex uint64, trans Transport) (SnapshotSink, error) {
+	id, aead, err := currentAEAD(e.keys)
+	if err != nil {
+		return nil, err
+	}
+	header, err := encryptionHeader(id, aead)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := e.store.Create(version, index, term, configuration, configurationIndex, trans)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sink.Write(header); err != nil {
+		_ = sink.Cancel()
+		return nil, err
+	}
+	return &encryptingSink{
+		SnapshotSink: sink,
+		aead:         aead,
+		nonce:        header[len(header)-aead.NonceSize():],
+		index:        index,
+		term:         term,
+		frame:        make([]byte, 0, encryptedFrameSize),
+	}, nil
+}
+
+// List implements the SnapshotStore interface.
+func (e *EncryptedSnapshotStore) List() ([]*SnapshotMeta, error) {
+	snapshots, err := e.store.List()
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]*SnapshotMeta, len(snapshots))
+	for i, meta := range snapshots {
+		metas[i] = plainSnapshotMeta(meta, meta.Size)
+	}
+	return metas, nil
+}
+
+// Open implements the SnapshotStore interface.
+func (e *EncryptedSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	meta, rc, err := e.store.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(rc)
+	aead, nonce, headerSize, err := readEncryptionHeader(e.keys, br)
+	if err != nil {
+		_ = rc.Close()
+		return nil, nil, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+
+	// Every frame but the last is full, and the last one may be empty.
+	size := meta.Size - int64(headerSize)
+	frames := (size + encryptedFrameSize + encryptedFrameOverhead - 1) / (encryptedFrameSize + encryptedFrameOverhead)
+	size -= frames * encryptedFrameOverhead
+
+	return plainSnapshotMeta(meta, size), &decryptingReader{
+		r:     br,
+		rc:    rc,
+		aead:  aead,
+		nonce: nonce,
+		index: meta.Index,
+		term:  meta.Term,
+	}, nil
+}
+
+// plainSnapshotMeta returns a copy of the meta of an encrypted snapshot with
+// the given size, dropping what describes the encrypted data.
+func plainSnapshotMeta(meta *SnapshotMeta, size int64) *SnapshotMeta {
+	plain := *meta
+	plain.Size = size
+	plain.Checksum = nil
+	plain.Compression = ""
+	return &plain
+}
+
+// lastFrame is set in the length prefix of the last frame of a snapshot. The
+// prefix is authenticated with the frame, so a truncated snapshot is caught.
+const lastFrame = 1 << 31
+
+// frameAdditionalData binds a frame to its length prefix and to the index
+// and term of its snapshot.
+func frameAdditionalData(dst []byte, prefix uint32, index, term uint64) []byte {
+	dst = binary.BigEndian.AppendUint32(dst[:0], prefix)
+	dst = binary.BigEndian.AppendUint64(dst, index)
+	return binary.BigEndian.AppendUint64(dst, term)
+}
+
+// frameNonce returns the nonce of the given frame, derived from the
+// snapshot's nonce.
+func frameNonce(dst, nonce []byte, frame uint64) []byte {
+	dst = append(dst[:0], nonce...)
+	tail := dst[len(dst)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^frame)
+	return dst
+}
+
+// encryptingSink seals a snapshot in frames.
+type encryptingSink struct {
+	SnapshotSink
+	aead   cipher.AEAD
+	nonce  []byte
+	index  uint64
+	term   uint64
+	frame  []byte
+	count  uint64
+	buf    []byte
+	ad     []byte
+	sealed []byte
+}
+
+func (s *encryptingSink) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.frame) == encryptedFrameSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.frame[len(s.frame):encryptedFrameSize], p)
+		s.frame = s.frame[:len(s.frame)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// flush seals the buffered frame and writes it out.
+func (s *encryptingSink) flush(last bool) error {
+	prefix := uint32(len(s.frame) + s.aead.Overhead())
+	if last {
+		prefix |= lastFrame
+	}
+	s.sealed = binary.BigEndian.AppendUint32(s.sealed[:0], prefix)
+	s.buf = frameNonce(s.buf, s.nonce, s.count)
+	s.ad = frameAdditionalData(s.ad, prefix, s.index, s.term)
+	s.sealed = s.aead.Seal(s.sealed, s.buf, s.frame, s.ad)
+	s.count++
+	s.frame = s.frame[:0]
+	_, err := s.SnapshotSink.Write(s.sealed)
+	return err
+}
+
+// Close seals the last frame and closes the snapshot.
+func (s *encryptingSink) Close() error {
+	if err := s.flush(true); err != nil {
+		_ = s.SnapshotSink.Cancel()
+		return err
+	}
+	return s.SnapshotSink.Close()
+}
+
+// decryptingReader opens a snapshot sealed by encryptingSink.
+type decryptingReader struct {
+	r     *bufio.Reader
+	rc    io.ReadCloser
+	aead  cipher.AEAD
+	nonce []byte
+	index uint64
+	term  uint64
+	count uint64
+	buf   []byte
+	ad    []byte
+	frame []byte
+	plain []byte
+	done  bool
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the next frame.
+func (d *decryptingReader) next() error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(d.r, prefix[:]); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(prefix[:]) &^ lastFrame
+	if size > encryptedFrameSize+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("%w: frame too large", ErrDecrypt)
+	}
+	if cap(d.frame) < int(size) {
+		d.frame = make([]byte, size)
+	}
+	d.frame = d.frame[:size]
+	if _, err := io.ReadFull(d.r, d.frame); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	d.buf = frameNonce(d.buf, d.nonce, d.count)
+	d.ad = frameAdditionalData(d.ad, binary.BigEndian.Uint32(prefix[:]), d.index, d.term)
+	plain, err := d.aead.Open(d.frame[:0], d.buf, d.frame, d.ad)
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.count++
+	d.plain = plain
+	if binary.BigEndian.Uint32(prefix[:])&lastFrame != 0 {
+		d.done = true
+		if _, err := d.r.ReadByte(); err != io.EOF {
+			return fmt.Errorf("%w: data after the last frame", ErrDecrypt)
+		}
+	}
+	return nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.rc.Close()
+}
@@ -0,0 +1,140 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedLogStore(t *testing.T) {
+	keys, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	inner := NewInmemStore()
+	store := NewEncryptedLogStore(inner, keys)
+
+	logs := []*Log{
+		{Index: 1, Term: 1, Type: LogCommand, Data: []byte("first"), Extensions: []byte("ext")},
+		{Index: 2, Term: 1, Type: LogCommand, Data: []byte("second")},
+		{Index: 3, Term: 1, Type: LogNoop},
+	}
+	require.NoError(t, store.StoreLogs(logs))
+	require.Equal(t, []byte("first"), logs[0].Data)
+
+	// The underlying store only holds ciphertext.
+	var raw Log
+	require.NoError(t, inner.GetLog(1, &raw))
+	require.NotContains(t, string(raw.Data), "first")
+	require.NotContains(t, string(raw.Extensions), "ext")
+
+	for _, want := range logs {
+		var got Log
+		require.NoError(t, store.GetLog(want.Index, &got))
+		require.Equal(t, *want, got)
+	}
+
+	// Logs written before a rotation can still be read.
+	require.NoError(t, keys.Rotate("k2", bytes.Repeat([]byte{2}, 16)))
+	require.NoError(t, store.StoreLog(&Log{Index: 4, Term: 2, Type: LogCommand, Data: []byte("fourth")}))
+	var got Log
+	require.NoError(t, store.GetLog(1, &got))
+	require.Equal(t, []byte("first"), got.Data)
+	require.NoError(t, store.GetLog(4, &got))
+	require.Equal(t, []byte("fourth"), got.Data)
+
+	// Data moved to another log doesn't decrypt.
+	require.NoError(t, inner.GetLog(2, &raw))
+	raw.Index = 5
+	require.NoError(t, inner.StoreLog(&raw))
+	require.ErrorIs(t, store.GetLog(5, &got), ErrDecrypt)
+
+	// Nor does data encrypted with a removed key.
+	require.Error(t, keys.Remove("k2"))
+	require.NoError(t, keys.Remove("k1"))
+	require.ErrorIs(t, store.GetLog(1, &got), ErrUnknownKey)
+}
+
+func TestEncryptedLogStore_CommitTracking(t *testing.T) {
+	keys, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+
+	// The commit index is tracked by the underlying store.
+	store := NewEncryptedLogStore(NewInmemCommitTrackingStore(), keys)
+	require.NoError(t, store.StageCommitIndex(3))
+	require.NoError(t, store.StoreLog(&Log{Index: 3, Term: 1, Type: LogCommand, Data: []byte("third")}))
+	index, err := store.GetCommitIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), index)
+
+	// Unless it can't.
+	store = NewEncryptedLogStore(NewInmemStore(), keys)
+	require.ErrorIs(t, store.StageCommitIndex(3), ErrIncompatibleLogStore)
+	_, err = store.GetCommitIndex()
+	require.ErrorIs(t, err, ErrIncompatibleLogStore)
+}
+
+func TestEncryptedSnapshotStore(t *testing.T) {
+	keys, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	inner := NewInmemSnapshotStore()
+	store := NewEncryptedSnapshotStore(inner, keys)
+	_, trans := NewInmemTransport(NewInmemAddr())
+
+	create := func(data []byte) {
+		sink, err := store.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans)
+		require.NoError(t, err)
+		_, err = sink.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+	}
+	read := func() ([]byte, error) {
+		snaps, err := store.List()
+		require.NoError(t, err)
+		require.Len(t, snaps, 1)
+		meta, r, err := store.Open(snaps[0].ID)
+		require.NoError(t, err)
+		defer func() { _ = r.Close() }()
+		data, err := io.ReadAll(r)
+		if err == nil {
+			require.Equal(t, int64(len(data)), meta.Size)
+		}
+		return data, err
+	}
+
+	for _, size := range []int{0, 5, encryptedFrameSize, 2*encryptedFrameSize + 5} {
+		data := bytes.Repeat([]byte("x"), size)
+		create(data)
+		got, err := read()
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+	}
+	require.NotContains(t, inner.latest.contents.String(), "xxxx")
+
+	// Corrupt or truncated snapshots don't decrypt.
+	contents := inner.latest.contents.Bytes()
+	contents[len(contents)/2] ^= 0xff
+	_, err = read()
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	// Nor does a snapshot passed off as one with another index.
+	create(bytes.Repeat([]byte("x"), 5))
+	contents = append([]byte(nil), inner.latest.contents.Bytes()...)
+	sink, err := store.Create(SnapshotVersionMax, 11, 3, Configuration{}, 2, trans)
+	require.NoError(t, err)
+	_, err = sink.Write(bytes.Repeat([]byte("y"), 5))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	inner.latest.contents.Reset()
+	inner.latest.contents.Write(contents)
+	_, err = read()
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	create(bytes.Repeat([]byte("x"), 2*encryptedFrameSize+5))
+	inner.latest.contents.Truncate(inner.latest.contents.Len() - (5 + encryptedFrameOverhead))
+	_, err = read()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
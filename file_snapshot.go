@@ -32,13 +32,19 @@ const (
 // FileSnapshotStore implements the SnapshotStore interface and allows
 // snapshots to be made on the local disk.
 type FileSnapshotStore struct {
-	path   string
-	retain int
-	logger hclog.Logger
+	path       string
+	retain     int
+	logger     hclog.Logger
+	compressor SnapshotCompressor
 
 	// noSync, if true, skips crash-safe file fsync api calls.
 	// It's a private field, only used in testing
 	noSync bool
+
+	// pinned, if set, reports the snapshots that mustn't be reaped yet, even
+	// past the retain count. It's set by a TieredSnapshotStore, to keep the
+	// snapshots it hasn't archived.
+	pinned func(id string) bool
 }
 
 type snapMetaSlice []*fileSnapshotMeta
@@ -57,14 +63,41 @@ type FileSnapshotSink struct {
 	stateHash hash.Hash64
 	buffered  *bufio.Writer
 
+	// compressed compresses the snapshot into buffered, unless it's written
+	// already compressed by CreateRaw, in which case raw is set.
+	compressor SnapshotCompressor
+	compressed io.WriteCloser
+	plainHash  hash.Hash64
+	plainSize  int64
+	raw        bool
+
 	closed bool
 }
 
 // fileSnapshotMeta is stored on disk. We also put a CRC
-// on disk so that we can verify the snapshot.
+// on disk so that we can verify the snapshot. CRC and
+// StoredSize describe the state file, which is compressed
+// if Compression is set.
 type fileSnapshotMeta struct {
 	SnapshotMeta
-	CRC []byte
+	CRC        []byte
+	StoredSize int64
+}
+
+// FileSnapshotStoreConfig encapsulates configuration for a FileSnapshotStore.
+type FileSnapshotStoreConfig struct {
+	// Retain controls how many snapshots are retained. Must be at least 1.
+	Retain int
+
+	// Logger is used to log snapshot operations. If nil, a default logger
+	// is used.
+	Logger hclog.Logger
+
+	// Compressor, if set, compresses new snapshots on disk, and they're sent
+	// to other servers compressed. Older versions can't install compressed
+	// snapshots, so only set this once all servers have been upgraded.
+	// Snapshots that are already stored can be read regardless.
+	Compressor SnapshotCompressor
 }
 
 // bufferedFile is returned when we open a snapshot. This way
@@ -86,9 +119,19 @@ func (b *bufferedFile) Close() error {
 // on a base directory. The `retain` parameter controls how many
 // snapshots are retained. Must be at least 1.
 func NewFileSnapshotStoreWithLogger(base string, retain int, logger hclog.Logger) (*FileSnapshotStore, error) {
-	if retain < 1 {
+	return NewFileSnapshotStoreWithConfig(base, &FileSnapshotStoreConfig{
+		Retain: retain,
+		Logger: logger,
+	})
+}
+
+// NewFileSnapshotStoreWithConfig creates a new FileSnapshotStore based
+// on a base directory, using the given config struct.
+func NewFileSnapshotStoreWithConfig(base string, config *FileSnapshotStoreConfig) (*FileSnapshotStore, error) {
+	if config.Retain < 1 {
 		return nil, fmt.Errorf("must retain at least one snapshot")
 	}
+	logger := config.Logger
 	if logger == nil {
 		logger = hclog.New(&hclog.LoggerOptions{
 			Name:   "snapshot",
@@ -105,9 +148,10 @@ func NewFileSnapshotStoreWithLogger(base string, retain int, logger hclog.Logger
 
 	// Setup the store
 	store := &FileSnapshotStore{
-		path:   path,
-		retain: retain,
-		logger: logger,
+		path:       path,
+		retain:     config.Retain,
+		logger:     logger,
+		compressor: config.Compressor,
 	}
 
 	// Do a permissions test
@@ -156,9 +200,67 @@ func snapshotName(term, index uint64) string {
 	return fmt.Sprintf("%d-%d-%d", term, index, msec)
 }
 
+// compressorFor returns the compressor with the given name, or nil if it isn't
+// known.
+func (f *FileSnapshotStore) compressorFor(name string) SnapshotCompressor {
+	if f.compressor != nil && f.compressor.Name() == name {
+		return f.compressor
+	}
+	return builtinSnapshotCompressor(name)
+}
+
 // Create is used to start a new snapshot
 func (f *FileSnapshotStore) Create(version SnapshotVersion, index, term uint64,
 	configuration Configuration, configurationIndex uint64, trans Transport) (SnapshotSink, error) {
+	return f.create(version, index, term, configuration, configurationIndex, trans, f.compressor, false)
+}
+
+// CreateRaw implements the RawSnapshotStore interface. The snapshot is checked
+// to decompress when the sink is closed.
+func (f *FileSnapshotStore) CreateRaw(version SnapshotVersion, index, term uint64,
+	configuration Configuration, configurationIndex uint64, trans Transport, compression string) (SnapshotSink, error) {
+	if compression == "" {
+		return f.create(version, index, term, configuration, configurationIndex, trans, nil, false)
+	}
+	compressor := f.compressorFor(compression)
+	if compressor == nil {
+		return nil, fmt.Errorf("unknown snapshot compression %q", compression)
+	}
+	return f.create(version, index, term, configuration, configurationIndex, trans, compressor, true)
+}
+
+// CreateDelta implements the DeltaSnapshotStore interface.
+func (f *FileSnapshotStore) CreateDelta(parentID string, version SnapshotVersion, index, term uint64,
+	configuration Configuration, configurationIndex uint64, trans Transport) (SnapshotSink, error) {
+	if _, err := f.readMeta(parentID); err != nil {
+		f.logger.Error("failed to read parent snapshot", "parent", parentID, "error", err)
+		return nil, err
+	}
+	sink, err := f.create(version, index, term, configuration, configurationIndex, trans, f.compressor, false)
+	if err != nil {
+		return nil, err
+	}
+	sink.(*FileSnapshotSink).meta.ParentID = parentID
+	return sink, nil
+}
+
+// CreateChain implements the DeltaSnapshotStore interface. The chain is
+// stored as a single snapshot.
+func (f *FileSnapshotStore) CreateChain(chain int, version SnapshotVersion, index, term uint64,
+	configuration Configuration, configurationIndex uint64, trans Transport) (SnapshotSink, error) {
+	sink, err := f.create(version, index, term, configuration, configurationIndex, trans, f.compressor, false)
+	if err != nil {
+		return nil, err
+	}
+	sink.(*FileSnapshotSink).meta.Chain = chain
+	return sink, nil
+}
+
+// create starts a new snapshot compressed with the given compressor, if any.
+// If raw is set, it's written already compressed.
+func (f *FileSnapshotStore) create(version SnapshotVersion, index, term uint64,
+	configuration Configuration, configurationIndex uint64, trans Transport,
+	compressor SnapshotCompressor, raw bool) (SnapshotSink, error) {
 	// We only support version 1 snapshots at this time.
 	if version != 1 {
 		return nil, fmt.Errorf("unsupported snapshot version %d", version)
@@ -177,11 +279,13 @@ func (f *FileSnapshotStore) Create(version SnapshotVersion, index, term uint64,
 
 	// Create the sink
 	sink := &FileSnapshotSink{
-		store:     f,
-		logger:    f.logger,
-		dir:       path,
-		parentDir: f.path,
-		noSync:    f.noSync,
+		store:      f,
+		logger:     f.logger,
+		dir:        path,
+		parentDir:  f.path,
+		noSync:     f.noSync,
+		compressor: compressor,
+		raw:        raw,
 		meta: fileSnapshotMeta{
 			SnapshotMeta: SnapshotMeta{
 				Version:            version,
@@ -218,6 +322,21 @@ func (f *FileSnapshotStore) Create(version SnapshotVersion, index, term uint64,
 	multi := io.MultiWriter(sink.stateFile, sink.stateHash)
 	sink.buffered = bufio.NewWriter(multi)
 
+	// Compress into the buffer, unless it's already compressed
+	if compressor != nil {
+		sink.meta.Compression = compressor.Name()
+		if !raw {
+			sink.compressed, err = compressor.NewWriter(sink.buffered)
+			if err != nil {
+				f.logger.Error("failed to create compressor", "error", err)
+				_ = fh.Close()
+				_ = os.RemoveAll(path)
+				return nil, err
+			}
+			sink.plainHash = crc64.New(snapshotCRCTable)
+		}
+	}
+
 	// Done
 	return sink, nil
 }
@@ -282,12 +401,50 @@ func (f *FileSnapshotStore) getSnapshots() ([]*fileSnapshotMeta, error) {
 		snapMeta = append(snapMeta, meta)
 	}
 
+	// Count the snapshots Open chains together for delta snapshots, and
+	// ignore any whose parents are missing
+	byID := make(map[string]*fileSnapshotMeta, len(snapMeta))
+	for _, meta := range snapMeta {
+		byID[meta.ID] = meta
+	}
+	complete := snapMeta[:0]
+	for _, meta := range snapMeta {
+		if meta.ParentID != "" {
+			chain, err := chainLength(meta, byID)
+			if err != nil {
+				f.logger.Warn("ignoring delta snapshot", "name", meta.ID, "error", err)
+				continue
+			}
+			meta.Chain = chain
+		}
+		complete = append(complete, meta)
+	}
+	snapMeta = complete
+
 	// Sort the snapshot, reverse so we get new -> old
 	sort.Sort(sort.Reverse(snapMetaSlice(snapMeta)))
 
 	return snapMeta, nil
 }
 
+// chainLength returns the number of snapshots Open chains together for a
+// delta snapshot, looking its parents up in the given snapshots.
+func chainLength(meta *fileSnapshotMeta, snapshots map[string]*fileSnapshotMeta) (int, error) {
+	deltas := 0
+	for meta.ParentID != "" {
+		parent, ok := snapshots[meta.ParentID]
+		if !ok || deltas == len(snapshots) {
+			return 0, fmt.Errorf("missing parent snapshot %v", meta.ParentID)
+		}
+		meta = parent
+		deltas++
+	}
+	if meta.Chain > 0 {
+		return meta.Chain + deltas, nil
+	}
+	return 1 + deltas, nil
+}
+
 // readMeta is used to read the meta data for a given named backup
 func (f *FileSnapshotStore) readMeta(name string) (*fileSnapshotMeta, error) {
 	// Open the meta file
@@ -307,11 +464,125 @@ func (f *FileSnapshotStore) readMeta(name string) (*fileSnapshotMeta, error) {
 	if err := dec.Decode(meta); err != nil {
 		return nil, err
 	}
+
+	// Snapshots from before compression was supported are stored as is
+	if meta.Compression == "" {
+		if meta.Checksum == nil {
+			meta.Checksum = meta.CRC
+		}
+		if meta.StoredSize == 0 {
+			meta.StoredSize = meta.Size
+		}
+	}
 	return meta, nil
 }
 
-// Open takes a snapshot ID and returns a ReadCloser for that snapshot.
+// Open takes a snapshot ID and returns a ReadCloser for that snapshot. A
+// delta snapshot is chained after its parents.
 func (f *FileSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	meta, err := f.readMeta(id)
+	if err != nil {
+		f.logger.Error("failed to get meta data to open snapshot", "error", err)
+		return nil, nil, err
+	}
+	if meta.ParentID != "" {
+		return f.openChain(meta)
+	}
+	return f.openLink(id)
+}
+
+// openChain opens a delta snapshot chained after its parents.
+func (f *FileSnapshotStore) openChain(meta *fileSnapshotMeta) (*SnapshotMeta, io.ReadCloser, error) {
+	// Find the parents, back to the full snapshot
+	links := []*fileSnapshotMeta{meta}
+	seen := map[string]bool{meta.ID: true}
+	for meta.ParentID != "" {
+		if seen[meta.ParentID] {
+			return nil, nil, fmt.Errorf("snapshot %v is its own parent", meta.ParentID)
+		}
+		seen[meta.ParentID] = true
+		parent, err := f.readMeta(meta.ParentID)
+		if err != nil {
+			f.logger.Error("failed to get meta data of parent snapshot", "parent", meta.ParentID, "error", err)
+			return nil, nil, err
+		}
+		links = append(links, parent)
+		meta = parent
+	}
+
+	// Open them oldest first, with each one's size before it, unless it's
+	// already a chain
+	chained := *links[0]
+	chained.Size, chained.Chain = 0, 0
+	chained.Checksum, chained.Compression = nil, ""
+	reader := &snapshotChainReader{}
+	var readers []io.Reader
+	for i := len(links) - 1; i >= 0; i-- {
+		linkMeta, source, err := f.openLink(links[i].ID)
+		if err != nil {
+			_ = reader.Close()
+			return nil, nil, err
+		}
+		reader.closers = append(reader.closers, source)
+		if linkMeta.Chain > 0 {
+			chained.Chain += linkMeta.Chain
+		} else {
+			readers = append(readers, bytes.NewReader(snapshotChainHeader(linkMeta.Size)))
+			chained.Size += snapshotChainHeaderSize
+			chained.Chain++
+		}
+		readers = append(readers, source)
+		chained.Size += linkMeta.Size
+	}
+	reader.Reader = io.MultiReader(readers...)
+	return &chained.SnapshotMeta, reader, nil
+}
+
+// openLink opens a single snapshot as it's stored, decompressing it if
+// needed.
+func (f *FileSnapshotStore) openLink(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	meta, buffered, err := f.openState(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.Compression == "" {
+		return &meta.SnapshotMeta, buffered, nil
+	}
+
+	// Decompress the state file
+	compressor := f.compressorFor(meta.Compression)
+	if compressor == nil {
+		_ = buffered.Close()
+		return nil, nil, fmt.Errorf("unknown snapshot compression %q", meta.Compression)
+	}
+	dec, err := compressor.NewReader(buffered)
+	if err != nil {
+		f.logger.Error("failed to decompress state file", "error", err)
+		_ = buffered.Close()
+		return nil, nil, err
+	}
+	return &meta.SnapshotMeta, &decompressingReader{ReadCloser: dec, underlying: buffered}, nil
+}
+
+// OpenRaw implements the RawSnapshotStore interface. A delta snapshot is
+// chained after its parents, uncompressed, as Open does.
+func (f *FileSnapshotStore) OpenRaw(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	meta, buffered, err := f.openState(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.ParentID != "" {
+		_ = buffered.Close()
+		return f.openChain(meta)
+	}
+	rawMeta := meta.SnapshotMeta
+	rawMeta.Size = meta.StoredSize
+	rawMeta.Checksum = meta.CRC
+	return &rawMeta, buffered, nil
+}
+
+// openState opens the state file of a snapshot as stored, after verifying it.
+func (f *FileSnapshotStore) openState(id string) (*fileSnapshotMeta, *bufferedFile, error) {
 	// Get the metadata
 	meta, err := f.readMeta(id)
 	if err != nil {
@@ -359,10 +630,11 @@ func (f *FileSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error
 		fh: fh,
 	}
 
-	return &meta.SnapshotMeta, buffered, nil
+	return meta, buffered, nil
 }
 
-// ReapSnapshots reaps any snapshots beyond the retain count.
+// ReapSnapshots reaps any snapshots beyond the retain count, unless they're
+// pinned.
 func (f *FileSnapshotStore) ReapSnapshots() error {
 	snapshots, err := f.getSnapshots()
 	if err != nil {
@@ -370,7 +642,26 @@ func (f *FileSnapshotStore) ReapSnapshots() error {
 		return err
 	}
 
+	// Keep the retained and pinned snapshots, and the parents of the delta
+	// snapshots among them
+	byID := make(map[string]*fileSnapshotMeta, len(snapshots))
+	for _, meta := range snapshots {
+		byID[meta.ID] = meta
+	}
+	keep := make(map[string]bool)
+	for i, snapshot := range snapshots {
+		if i >= f.retain && (f.pinned == nil || !f.pinned(snapshot.ID)) {
+			continue
+		}
+		for meta := snapshot; meta != nil && !keep[meta.ID]; meta = byID[meta.ParentID] {
+			keep[meta.ID] = true
+		}
+	}
+
 	for i := f.retain; i < len(snapshots); i++ {
+		if keep[snapshots[i].ID] {
+			continue
+		}
 		path := filepath.Join(f.path, snapshots[i].ID)
 		f.logger.Info("reaping snapshot", "path", path)
 		if err := os.RemoveAll(path); err != nil {
@@ -390,7 +681,13 @@ func (s *FileSnapshotSink) ID() string {
 // Write is used to append to the state file. We write to the
 // buffered IO object to reduce the amount of context switches.
 func (s *FileSnapshotSink) Write(b []byte) (int, error) {
-	return s.buffered.Write(b)
+	if s.compressed == nil {
+		return s.buffered.Write(b)
+	}
+	n, err := s.compressed.Write(b)
+	s.plainHash.Write(b[:n])
+	s.plainSize += int64(n)
+	return n, err
 }
 
 // Close is used to indicate a successful end.
@@ -401,8 +698,18 @@ func (s *FileSnapshotSink) Close() error {
 	}
 	s.closed = true
 
-	// Close the open handles
-	if err := s.finalize(); err != nil {
+	// Close the open handles, and check a raw snapshot decompresses
+	err := s.finalize()
+	if err == nil && s.raw {
+		err = s.measureRaw()
+	}
+	if err == nil && s.meta.ParentID != "" {
+		// Make sure the parent of a delta wasn't reaped meanwhile
+		if _, parentErr := s.store.readMeta(s.meta.ParentID); parentErr != nil {
+			err = fmt.Errorf("failed to read parent snapshot: %w", parentErr)
+		}
+	}
+	if err != nil {
 		s.logger.Error("failed to finalize snapshot", "error", err)
 		if delErr := os.RemoveAll(s.dir); delErr != nil {
 			s.logger.Error("failed to delete temporary snapshot directory", "path", s.dir, "error", delErr)
@@ -466,6 +773,13 @@ func (s *FileSnapshotSink) Cancel() error {
 
 // finalize is used to close all of our resources.
 func (s *FileSnapshotSink) finalize() error {
+	// Finish compressing
+	if s.compressed != nil {
+		if err := s.compressed.Close(); err != nil {
+			return err
+		}
+	}
+
 	// Flush any remaining data
 	if err := s.buffered.Flush(); err != nil {
 		return err
@@ -490,10 +804,46 @@ func (s *FileSnapshotSink) finalize() error {
 	if statErr != nil {
 		return statErr
 	}
-	s.meta.Size = stat.Size()
+	s.meta.StoredSize = stat.Size()
 
 	// Set the CRC
 	s.meta.CRC = s.stateHash.Sum(nil)
+
+	// Set the size and checksum of the uncompressed snapshot, which
+	// measureRaw does for a raw one
+	switch {
+	case s.compressed != nil:
+		s.meta.Size = s.plainSize
+		s.meta.Checksum = s.plainHash.Sum(nil)
+	case !s.raw:
+		s.meta.Size = s.meta.StoredSize
+		s.meta.Checksum = s.meta.CRC
+	}
+	return nil
+}
+
+// measureRaw sets the uncompressed size and checksum of a snapshot written
+// by CreateRaw, which also checks that it decompresses.
+func (s *FileSnapshotSink) measureRaw() error {
+	fh, err := os.Open(filepath.Join(s.dir, stateFilePath))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fh.Close() }()
+
+	dec, err := s.compressor.NewReader(bufio.NewReader(fh))
+	if err != nil {
+		return fmt.Errorf("failed to decompress snapshot: %w", err)
+	}
+	defer func() { _ = dec.Close() }()
+
+	plainHash := crc64.New(snapshotCRCTable)
+	n, err := io.Copy(plainHash, dec)
+	if err != nil {
+		return fmt.Errorf("failed to decompress snapshot: %w", err)
+	}
+	s.meta.Size = n
+	s.meta.Checksum = plainHash.Sum(nil)
 	return nil
 }
 
@@ -5,11 +5,15 @@ package raft
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/crc64"
 	"io"
 	"os"
 	"reflect"
 	"runtime"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestFileSnapshotStoreImpl(t *testing.T) {
@@ -344,3 +348,149 @@ func TestFileSS_Ordering(t *testing.T) {
 		t.Fatalf("bad snap: %#v", *snaps[1])
 	}
 }
+
+func TestFileSS_Compression(t *testing.T) {
+	snap, err := NewFileSnapshotStoreWithConfig(t.TempDir(), &FileSnapshotStoreConfig{
+		Retain:     1,
+		Logger:     newTestLogger(t),
+		Compressor: &GzipCompressor{},
+	})
+	require.NoError(t, err)
+
+	_, trans := NewInmemTransport(NewInmemAddr())
+	data := bytes.Repeat([]byte("compress me\n"), 1000)
+	sink, err := snap.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans)
+	require.NoError(t, err)
+	_, err = sink.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	// The snapshot reads back uncompressed.
+	meta, r, err := snap.Open(sink.ID())
+	require.NoError(t, err)
+	read, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, data, read)
+	require.Equal(t, SnapshotCompressionGzip, meta.Compression)
+	require.Equal(t, int64(len(data)), meta.Size)
+	require.Equal(t, crc64.Checksum(data, snapshotCRCTable), binary.BigEndian.Uint64(meta.Checksum))
+
+	// It's stored compressed, and can be copied to another store as is.
+	rawMeta, r, err := snap.OpenRaw(sink.ID())
+	require.NoError(t, err)
+	raw, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Less(t, rawMeta.Size, meta.Size)
+	require.Equal(t, int64(len(raw)), rawMeta.Size)
+	require.Equal(t, crc64.Checksum(raw, snapshotCRCTable), binary.BigEndian.Uint64(rawMeta.Checksum))
+
+	other, err := NewFileSnapshotStoreWithLogger(t.TempDir(), 1, newTestLogger(t))
+	require.NoError(t, err)
+	rawSink, err := other.CreateRaw(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans, SnapshotCompressionGzip)
+	require.NoError(t, err)
+	_, err = rawSink.Write(raw)
+	require.NoError(t, err)
+	require.NoError(t, rawSink.Close())
+	copied, r, err := other.Open(rawSink.ID())
+	require.NoError(t, err)
+	read, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, data, read)
+	require.Equal(t, meta.Size, copied.Size)
+	require.Equal(t, meta.Checksum, copied.Checksum)
+
+	// Data that doesn't decompress is discarded.
+	rawSink, err = other.CreateRaw(SnapshotVersionMax, 11, 3, Configuration{}, 2, trans, SnapshotCompressionGzip)
+	require.NoError(t, err)
+	_, err = rawSink.Write(raw[:len(raw)/2])
+	require.NoError(t, err)
+	require.Error(t, rawSink.Close())
+	snaps, err := other.List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 1)
+	require.Equal(t, copied.ID, snaps[0].ID)
+
+	_, err = other.CreateRaw(SnapshotVersionMax, 12, 3, Configuration{}, 2, trans, "unknown")
+	require.Error(t, err)
+}
+
+func TestFileSS_Delta(t *testing.T) {
+	snap, err := NewFileSnapshotStoreWithLogger(t.TempDir(), 1, newTestLogger(t))
+	require.NoError(t, err)
+	_, trans := NewInmemTransport(NewInmemAddr())
+
+	write := func(data string) func(SnapshotSink, error) string {
+		return func(sink SnapshotSink, err error) string {
+			require.NoError(t, err)
+			_, err = sink.Write([]byte(data))
+			require.NoError(t, err)
+			require.NoError(t, sink.Close())
+			return sink.ID()
+		}
+	}
+	read := func(store *FileSnapshotStore, id string) (*SnapshotMeta, []byte) {
+		meta, r, err := store.Open(id)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, int64(len(data)), meta.Size)
+		return meta, data
+	}
+	chain := func(links ...string) []byte {
+		var data []byte
+		for _, link := range links {
+			data = append(data, snapshotChainHeader(int64(len(link)))...)
+			data = append(data, link...)
+		}
+		return data
+	}
+
+	base := write("base")(snap.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans))
+	delta1 := write("delta1")(snap.CreateDelta(base, SnapshotVersionMax, 20, 3, Configuration{}, 2, trans))
+	delta2 := write("delta2")(snap.CreateDelta(delta1, SnapshotVersionMax, 30, 3, Configuration{}, 2, trans))
+
+	// The latest delta is listed, and opens chained after its parents, which
+	// aren't reaped.
+	snaps, err := snap.List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 1)
+	require.Equal(t, delta2, snaps[0].ID)
+	require.Equal(t, 3, snaps[0].Chain)
+	meta, data := read(snap, delta2)
+	require.Equal(t, 3, meta.Chain)
+	require.Equal(t, delta1, meta.ParentID)
+	require.Equal(t, chain("base", "delta1", "delta2"), data)
+	rawMeta, r, err := snap.OpenRaw(delta2)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, meta, rawMeta)
+
+	// A chain can be stored whole, as another server does when it's sent
+	// one, and deltas can build on it.
+	other, err := NewFileSnapshotStoreWithLogger(t.TempDir(), 1, newTestLogger(t))
+	require.NoError(t, err)
+	copied := write(string(data))(other.CreateChain(3, SnapshotVersionMax, 30, 3, Configuration{}, 2, trans))
+	meta, read2 := read(other, copied)
+	require.Equal(t, 3, meta.Chain)
+	require.Equal(t, data, read2)
+	delta3 := write("delta3")(other.CreateDelta(copied, SnapshotVersionMax, 40, 3, Configuration{}, 2, trans))
+	meta, data = read(other, delta3)
+	require.Equal(t, 4, meta.Chain)
+	require.Equal(t, chain("base", "delta1", "delta2", "delta3"), data)
+
+	// A full snapshot lets the chain be reaped.
+	full := write("full")(snap.Create(SnapshotVersionMax, 40, 3, Configuration{}, 2, trans))
+	meta, data = read(snap, full)
+	require.Equal(t, 0, meta.Chain)
+	require.Equal(t, []byte("full"), data)
+	for _, id := range []string{base, delta1, delta2} {
+		_, _, err := snap.Open(id)
+		require.Error(t, err)
+	}
+	_, err = snap.CreateDelta(base, SnapshotVersionMax, 50, 3, Configuration{}, 2, trans)
+	require.Error(t, err)
+}
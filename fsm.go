@@ -4,6 +4,7 @@
 package raft
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -29,7 +30,10 @@ type FSM interface {
 	// The Snapshot implementation should return quickly, because Apply can not
 	// be called while Snapshot is running. Generally this means Snapshot should
 	// only capture a pointer to the state, and any expensive IO should happen
-	// as part of FSMSnapshot.Persist.
+	// as part of FSMSnapshot.Persist. How long Apply is held up is measured as
+	// raft.fsm.snapshot. An FSM that can capture a point-in-time view cheaply
+	// can implement ConcurrentSnapshotFSM to build the FSMSnapshot from the
+	// view while Apply keeps running.
 	//
 	// Apply and Snapshot are always called from the same thread, but Apply will
 	// be called concurrently with FSMSnapshot.Persist. This means the FSM should
@@ -68,6 +72,57 @@ type BatchingFSM interface {
 	FSM
 }
 
+// IncrementalFSM extends the FSM interface to take delta snapshots, which only
+// hold what changed since an earlier snapshot, so that a large FSM where little
+// changes between snapshots doesn't have to write all of its state every time.
+// Delta snapshots are only taken when Config.MaxSnapshotDeltas is set and the
+// SnapshotStore implements DeltaSnapshotStore.
+type IncrementalFSM interface {
+	FSM
+
+	// SnapshotDelta is like Snapshot, but the returned FSMSnapshot only
+	// needs to persist what changed since the FSM's previous call to
+	// Snapshot, SnapshotDelta or Restore, or RestoreDelta if it was restored
+	// from a chain of snapshots. Raft only calls it when the state then is
+	// that of its latest snapshot, which is at sinceIndex. If the FSM can't
+	// tell what changed, it may return ErrSnapshotDeltaUnavailable, and Raft
+	// takes a full snapshot instead.
+	SnapshotDelta(sinceIndex uint64) (FSMSnapshot, error)
+
+	// RestoreDelta applies a delta snapshot on top of the state restored so
+	// far, which is that of the snapshot the delta was taken since. It's
+	// called after Restore for each delta in a chain of snapshots, and not
+	// concurrently with any other command.
+	RestoreDelta(delta io.ReadCloser) error
+}
+
+// ConcurrentSnapshotFSM extends the FSM interface for FSMs that can capture a
+// point-in-time view of their state cheaply, such as an MVCC read transaction
+// or a copy-on-write fork. Only capturing the view holds up Apply; the
+// FSMSnapshot is built from it afterwards, while Apply keeps running.
+type ConcurrentSnapshotFSM interface {
+	FSM
+
+	// PrepareSnapshot is called instead of Snapshot, from the same thread as
+	// Apply, and must capture the state as of the last applied log so that
+	// later calls to Apply don't change what the returned view holds. Delta
+	// snapshots of an IncrementalFSM are still taken with SnapshotDelta.
+	PrepareSnapshot() (PreparedSnapshot, error)
+}
+
+// PreparedSnapshot is a point-in-time view of the state of a
+// ConcurrentSnapshotFSM. Raft calls exactly one of its methods, concurrently
+// with Apply.
+type PreparedSnapshot interface {
+	// Snapshot returns an FSMSnapshot of the view, which is persisted and
+	// released like one returned by FSM.Snapshot.
+	Snapshot() (FSMSnapshot, error)
+
+	// Discard is called instead of Snapshot if the snapshot isn't needed
+	// after all, so that the view can be released.
+	Discard()
+}
+
 // FSMSnapshot is returned by an FSM in response to a Snapshot
 // It must be safe to invoke FSMSnapshot methods with concurrent
 // calls to Apply.
@@ -86,6 +141,13 @@ type FSMSnapshot interface {
 func (r *Raft) runFSM() {
 	var lastIndex, lastTerm uint64
 
+	// deltaBase is the index of the state an IncrementalFSM tracks changes
+	// since, which is its latest snapshot or restore, or zero if unknown.
+	var deltaBase uint64
+	if !r.config().NoSnapshotRestoreOnStart {
+		deltaBase, _ = r.getLastSnapshot()
+	}
+
 	batchingFSM, batchingEnabled := r.fsm.(BatchingFSM)
 	configStore, configStoreEnabled := r.fsm.(ConfigurationStore)
 
@@ -202,7 +264,8 @@ func (r *Raft) runFSM() {
 		)
 
 		// Attempt to restore
-		if err := fsmRestoreAndMeasure(snapLogger, r.fsm, source, meta.Size); err != nil {
+		if err := fsmRestoreAndMeasure(snapLogger, r.fsm, source, meta.Size, meta.Chain); err != nil {
+			deltaBase = 0
 			req.respond(fmt.Errorf("failed to restore snapshot %v: %v", req.ID, err))
 			return
 		}
@@ -210,6 +273,7 @@ func (r *Raft) runFSM() {
 		// Update the last index and term
 		lastIndex = meta.Index
 		lastTerm = meta.Term
+		deltaBase = meta.Index
 		req.respond(nil)
 	}
 
@@ -220,15 +284,39 @@ func (r *Raft) runFSM() {
 			return
 		}
 
-		// Start a snapshot
+		// Start a snapshot, which holds up Apply until it returns. It's a
+		// delta if one was asked for and the FSM can take it, and a
+		// ConcurrentSnapshotFSM only prepares a view here, which
+		// takeSnapshot turns into a snapshot.
 		start := time.Now()
-		snap, err := r.fsm.Snapshot()
+		full := func() (err error) {
+			req.sinceIndex = 0
+			if concurrent, ok := r.fsm.(ConcurrentSnapshotFSM); ok {
+				req.prepared, err = concurrent.PrepareSnapshot()
+			} else {
+				req.snapshot, err = r.fsm.Snapshot()
+			}
+			return err
+		}
+		var err error
+		if incremental, ok := r.fsm.(IncrementalFSM); ok && req.sinceIndex > 0 && req.sinceIndex == deltaBase {
+			req.snapshot, err = incremental.SnapshotDelta(req.sinceIndex)
+			if errors.Is(err, ErrSnapshotDeltaUnavailable) {
+				err = full()
+			}
+		} else {
+			err = full()
+		}
 		metrics.MeasureSince([]string{"raft", "fsm", "snapshot"}, start)
+		if err != nil {
+			deltaBase = 0
+		} else {
+			deltaBase = lastIndex
+		}
 
 		// Respond to the request
 		req.index = lastIndex
 		req.term = lastTerm
-		req.snapshot = snap
 		req.respond(err)
 	}
 
@@ -265,8 +353,9 @@ func (r *Raft) runFSM() {
 
 // fsmRestoreAndMeasure wraps the Restore call on an FSM to consistently measure
 // and report timing metrics. The caller is still responsible for calling Close
-// on the source in all cases.
-func fsmRestoreAndMeasure(logger hclog.Logger, fsm FSM, source io.ReadCloser, snapshotSize int64) error {
+// on the source in all cases. A chain of snapshots is restored with
+// restoreSnapshotChain.
+func fsmRestoreAndMeasure(logger hclog.Logger, fsm FSM, source io.ReadCloser, snapshotSize int64, chain int) error {
 	start := time.Now()
 
 	crc := newCountingReadCloser(source)
@@ -274,7 +363,7 @@ func fsmRestoreAndMeasure(logger hclog.Logger, fsm FSM, source io.ReadCloser, sn
 	monitor := startSnapshotRestoreMonitor(logger, crc, snapshotSize, false)
 	defer monitor.StopAndWait()
 
-	if err := fsm.Restore(crc); err != nil {
+	if err := restoreSnapshotChain(fsm, crc, chain); err != nil {
 		return err
 	}
 	metrics.MeasureSince([]string{"raft", "fsm", "restore"}, start)
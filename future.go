@@ -4,6 +4,7 @@
 package raft
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync"
@@ -87,6 +88,60 @@ func (e errorFuture) Index() uint64 {
 	return 0
 }
 
+// contextFuture wraps a Future so that Error gives up waiting and returns
+// ctx.Err() once ctx is done. It is returned by the *Context variants of the
+// Raft API.
+type contextFuture struct {
+	Future
+	ctx context.Context
+}
+
+func (c contextFuture) Error() error {
+	return futureErrorContext(c.ctx, c.Future)
+}
+
+// contextIndexFuture is a contextFuture for an IndexFuture.
+type contextIndexFuture struct {
+	IndexFuture
+	ctx context.Context
+}
+
+func (c contextIndexFuture) Error() error {
+	return futureErrorContext(c.ctx, c.IndexFuture)
+}
+
+// contextApplyFuture is a contextFuture for an ApplyFuture.
+type contextApplyFuture struct {
+	ApplyFuture
+	ctx context.Context
+}
+
+func (c contextApplyFuture) Error() error {
+	return futureErrorContext(c.ctx, c.ApplyFuture)
+}
+
+// contextSnapshotFuture is a contextFuture for a SnapshotFuture.
+type contextSnapshotFuture struct {
+	SnapshotFuture
+	ctx context.Context
+}
+
+func (c contextSnapshotFuture) Error() error {
+	return futureErrorContext(c.ctx, c.SnapshotFuture)
+}
+
+// futureErrorContext waits for f like f.Error, but returns ctx.Err() if ctx is
+// done first. Futures that are already resolved, such as errorFuture, are
+// waited on directly.
+func futureErrorContext(ctx context.Context, f Future) error {
+	if df, ok := f.(interface {
+		errorContext(context.Context) error
+	}); ok {
+		return df.errorContext(ctx)
+	}
+	return f.Error()
+}
+
 // deferError can be embedded to allow a future
 // to provide an error in the future.
 type deferError struct {
@@ -118,6 +173,26 @@ func (d *deferError) Error() error {
 	return d.err
 }
 
+// errorContext behaves like Error but gives up waiting and returns ctx.Err()
+// if the context is done before the future arrives. The future may still be
+// responded to later, which is harmless since errCh is buffered.
+func (d *deferError) errorContext(ctx context.Context) error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.errCh == nil {
+		panic("waiting for response on nil channel")
+	}
+	select {
+	case d.err = <-d.errCh:
+	case <-d.ShutdownCh:
+		d.err = ErrRaftShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return d.err
+}
+
 func (d *deferError) respond(err error) {
 	if d.errCh == nil {
 		return
@@ -220,10 +295,16 @@ type userRestoreFuture struct {
 type reqSnapshotFuture struct {
 	deferError
 
-	// snapshot details provided by the FSM runner before responding
+	// sinceIndex asks for a delta snapshot since the snapshot at that index,
+	// if set. The FSM runner clears it if it takes a full snapshot instead.
+	sinceIndex uint64
+
+	// snapshot details provided by the FSM runner before responding. For a
+	// ConcurrentSnapshotFSM, prepared is provided instead of snapshot.
 	index    uint64
 	term     uint64
 	snapshot FSMSnapshot
+	prepared PreparedSnapshot
 }
 
 // restoreFuture is used for requesting an FSM to perform a
@@ -237,10 +318,20 @@ type restoreFuture struct {
 // the leader. This is to prevent a stale read.
 type verifyFuture struct {
 	deferError
-	notifyCh   chan *verifyFuture
-	quorumSize int
-	votes      int
-	voteLock   sync.Mutex
+	notifyCh chan *verifyFuture
+	votes    *voteTally
+	voteLock sync.Mutex
+
+	// readIndexReq is set for ReadIndex requests, which need the leader's
+	// commit index captured before the heartbeat round starts. readIndex
+	// holds that index once the future has been responded to.
+	readIndexReq bool
+	readIndex    uint64
+
+	// leaseRead is set for LeaseRead requests, which are answered from the
+	// leader's lease without a heartbeat round. readIndex is also set for
+	// these.
+	leaseRead bool
 }
 
 // leadershipTransferFuture is used to track the progress of a leadership
@@ -271,7 +362,7 @@ func (c *configurationsFuture) Index() uint64 {
 
 // vote is used to respond to a verifyFuture.
 // This may block when responding on the notifyCh.
-func (v *verifyFuture) vote(leader bool) {
+func (v *verifyFuture) vote(id ServerID, leader bool) {
 	v.voteLock.Lock()
 	defer v.voteLock.Unlock()
 
@@ -281,8 +372,8 @@ func (v *verifyFuture) vote(leader bool) {
 	}
 
 	if leader {
-		v.votes++
-		if v.votes >= v.quorumSize {
+		v.votes.grant(id)
+		if v.votes.quorum() {
 			v.notifyCh <- v
 			v.notifyCh = nil
 		}
@@ -292,6 +383,13 @@ func (v *verifyFuture) vote(leader bool) {
 	}
 }
 
+// quorumReached returns true if a quorum has confirmed our leadership.
+func (v *verifyFuture) quorumReached() bool {
+	v.voteLock.Lock()
+	defer v.voteLock.Unlock()
+	return v.votes.quorum()
+}
+
 // appendFuture is used for waiting on a pipelined append
 // entries RPC.
 type appendFuture struct {
@@ -4,6 +4,7 @@
 package raft
 
 import (
+	"context"
 	"errors"
 	"testing"
 )
@@ -43,3 +44,40 @@ func TestDeferFutureConcurrent(t *testing.T) {
 		t.Errorf("unexpected error result; got %#v want %#v", got, want)
 	}
 }
+
+func TestDeferFutureErrorContext(t *testing.T) {
+	var f deferError
+	f.init()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := f.errorContext(ctx); got != context.Canceled {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, context.Canceled)
+	}
+
+	// A response that arrives later is still seen
+	want := errors.New("x")
+	f.respond(want)
+	if got := f.Error(); got != want {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, want)
+	}
+}
+
+func TestContextFuture(t *testing.T) {
+	want := errors.New("x")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Static futures are returned as-is
+	f := contextFuture{errorFuture{want}, ctx}
+	if got := f.Error(); got != want {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, want)
+	}
+
+	// Pending futures give up once the context is done
+	lf := &logFuture{}
+	lf.init()
+	af := contextApplyFuture{lf, ctx}
+	if got := af.Error(); got != context.Canceled {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, context.Canceled)
+	}
+}
@@ -6,6 +6,7 @@ package raft
 import (
 	"bytes"
 	"fmt"
+	"hash/crc64"
 	"io"
 	"sync"
 )
@@ -97,8 +98,11 @@ func (s *InmemSnapshotSink) Write(p []byte) (n int, err error) {
 	return written, err
 }
 
-// Close updates the Size and is otherwise a no-op
+// Close sets the Checksum and is otherwise a no-op
 func (s *InmemSnapshotSink) Close() error {
+	hash := crc64.New(snapshotCRCTable)
+	_, _ = hash.Write(s.contents.Bytes())
+	s.meta.Checksum = hash.Sum(nil)
 	return nil
 }
 
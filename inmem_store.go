@@ -88,10 +88,10 @@ func (i *InmemStore) DeleteRange(min, max uint64) error {
 	for j := min; j <= max; j++ {
 		delete(i.logs, j)
 	}
-	if min <= i.lowIndex {
+	if min <= i.lowIndex && max >= i.lowIndex {
 		i.lowIndex = max + 1
 	}
-	if max >= i.highIndex {
+	if max >= i.highIndex && min <= i.highIndex {
 		i.highIndex = min - 1
 	}
 	if i.lowIndex > i.highIndex {
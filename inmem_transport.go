@@ -163,6 +163,45 @@ func (i *InmemTransport) TimeoutNow(id ServerID, target ServerAddress, args *Tim
 	return nil
 }
 
+// ReadIndex implements the WithReadIndex interface.
+func (i *InmemTransport) ReadIndex(id ServerID, target ServerAddress, args *ReadIndexRequest, resp *ReadIndexResponse) error {
+	rpcResp, err := i.makeRPC(target, args, nil, i.timeout)
+	if err != nil {
+		return err
+	}
+
+	// Copy the result back
+	out := rpcResp.Response.(*ReadIndexResponse)
+	*resp = *out
+	return nil
+}
+
+// CatchUp implements the WithCatchUp interface.
+func (i *InmemTransport) CatchUp(id ServerID, target ServerAddress, args *CatchUpRequest, resp *CatchUpResponse) error {
+	rpcResp, err := i.makeRPC(target, args, nil, i.timeout)
+	if err != nil {
+		return err
+	}
+
+	// Copy the result back
+	out := rpcResp.Response.(*CatchUpResponse)
+	*resp = *out
+	return nil
+}
+
+// HeartbeatBatch implements the WithHeartbeatBatch interface.
+func (i *InmemTransport) HeartbeatBatch(id ServerID, target ServerAddress, args *HeartbeatBatchRequest, resp *HeartbeatBatchResponse) error {
+	rpcResp, err := i.makeRPC(target, args, nil, i.timeout)
+	if err != nil {
+		return err
+	}
+
+	// Copy the result back
+	out := rpcResp.Response.(*HeartbeatBatchResponse)
+	*resp = *out
+	return nil
+}
+
 func (i *InmemTransport) makeRPC(target ServerAddress, args interface{}, r io.Reader, timeout time.Duration) (rpcResp RPCResponse, err error) {
 	i.RLock()
 	peer, ok := i.peers[target]
@@ -282,7 +321,9 @@ func (i *inmemPipeline) decodeResponses() {
 			select {
 			case rpcResp := <-inp.respCh:
 				// Copy the result back
-				*inp.future.resp = *rpcResp.Response.(*AppendEntriesResponse)
+				if resp, ok := rpcResp.Response.(*AppendEntriesResponse); ok {
+					*inp.future.resp = *resp
+				}
 				inp.future.respond(rpcResp.Error)
 
 				select {
@@ -0,0 +1,101 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+// logArchiveBatchSize is how many logs LogStoreArchiver copies at a time.
+const logArchiveBatchSize = 64
+
+// LogArchiver is used to keep a durable copy of logs before they're compacted
+// away, such as for an audit trail of every committed command, or to replay
+// them with RecoverToIndex.
+//
+// Only committed logs are given to the archiver. When the server replaces its
+// log with a snapshot, after installing one from the leader or restoring a
+// user snapshot, the logs that snapshot covers were never on this server, so
+// the next range may start after a gap.
+type LogArchiver interface {
+	// ArchiveLogs is called with the logs from first to last, inclusive, in
+	// the store before they're deleted. It must only return once they're
+	// stored durably. The same range may be given again if Raft fails before
+	// deleting it.
+	ArchiveLogs(store LogStore, first, last uint64) error
+}
+
+// LogStoreArchiver is a LogArchiver which copies logs into another LogStore,
+// which can be given to RecoverToIndex.
+//
+// As ranges may follow a gap, the archive must accept logs that don't follow
+// on from the last one it holds, as InmemStore does. A WALStore only appends
+// consecutive logs, so it can't be used as the archive.
+type LogStoreArchiver struct {
+	archive LogStore
+}
+
+// NewLogStoreArchiver returns a LogStoreArchiver which copies logs into the
+// given LogStore.
+func NewLogStoreArchiver(archive LogStore) *LogStoreArchiver {
+	return &LogStoreArchiver{archive: archive}
+}
+
+// ArchiveLogs implements the LogArchiver interface. Logs already in the
+// archive aren't copied again. If the archive holds a log from a different
+// term at the same index, it's replaced, and the logs after it are removed
+// from the archive, as they followed on from the replaced one.
+func (a *LogStoreArchiver) ArchiveLogs(store LogStore, first, last uint64) error {
+	archived, err := a.archive.LastIndex()
+	if err != nil {
+		return fmt.Errorf("failed to get last archived index: %w", err)
+	}
+	gap := archived != 0 && first > archived+1
+
+	batch := make([]*Log, 0, logArchiveBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		from, to := batch[0].Index, batch[len(batch)-1].Index
+		if err := a.archive.StoreLogs(batch); err != nil {
+			if gap {
+				return fmt.Errorf("failed to archive logs %d to %d after a gap from index %d: %w", from, to, archived, err)
+			}
+			return fmt.Errorf("failed to archive logs %d to %d: %w", from, to, err)
+		}
+		batch = batch[:0]
+		gap = false
+		return nil
+	}
+	for index := first; index <= last; index++ {
+		entry := new(Log)
+		if err := store.GetLog(index, entry); err != nil {
+			return fmt.Errorf("failed to get log at index %d: %w", index, err)
+		}
+		if index <= archived {
+			var existing Log
+			err := a.archive.GetLog(index, &existing)
+			switch {
+			case err == nil && existing.Term == entry.Term:
+				continue
+			case err == nil:
+				if err := a.archive.DeleteRange(index, archived); err != nil {
+					return fmt.Errorf("failed to remove replaced logs %d to %d from the archive: %w", index, archived, err)
+				}
+				archived = index - 1
+			case !errors.Is(err, ErrLogNotFound):
+				return fmt.Errorf("failed to get archived log at index %d: %w", index, err)
+			}
+		}
+		batch = append(batch, entry)
+		if len(batch) == cap(batch) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
@@ -0,0 +1,210 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+	"github.com/stretchr/testify/require"
+)
+
+type failingLogArchiver struct{}
+
+func (failingLogArchiver) ArchiveLogs(LogStore, uint64, uint64) error {
+	return errors.New("archive unavailable")
+}
+
+func TestLogStoreArchiver(t *testing.T) {
+	store := NewInmemStore()
+	for i := uint64(1); i <= 100; i++ {
+		require.NoError(t, store.StoreLog(&Log{Index: i, Term: 1, Data: []byte(fmt.Sprintf("log %d", i))}))
+	}
+	archive := NewInmemStore()
+	archiver := NewLogStoreArchiver(archive)
+
+	// A range given again, after a failure, isn't copied twice.
+	require.NoError(t, archiver.ArchiveLogs(store, 1, 70))
+	require.NoError(t, archiver.ArchiveLogs(store, 50, 90))
+	first, err := archive.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	last, err := archive.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(90), last)
+	for i := uint64(1); i <= 90; i++ {
+		var entry Log
+		require.NoError(t, archive.GetLog(i, &entry))
+		require.Equal(t, []byte(fmt.Sprintf("log %d", i)), entry.Data)
+	}
+
+	// Logs replaced in the store since are replaced in the archive, and the
+	// ones after them are removed.
+	for i := uint64(80); i <= 85; i++ {
+		require.NoError(t, store.StoreLog(&Log{Index: i, Term: 2, Data: []byte(fmt.Sprintf("new log %d", i))}))
+	}
+	require.NoError(t, archiver.ArchiveLogs(store, 75, 85))
+	last, err = archive.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(85), last)
+	var entry Log
+	require.NoError(t, archive.GetLog(79, &entry))
+	require.Equal(t, []byte("log 79"), entry.Data)
+	require.NoError(t, archive.GetLog(80, &entry))
+	require.Equal(t, uint64(2), entry.Term)
+	require.Equal(t, []byte("new log 80"), entry.Data)
+
+	// A range after a gap is archived if the archive accepts it.
+	require.NoError(t, archiver.ArchiveLogs(store, 95, 100))
+	require.ErrorIs(t, archive.GetLog(90, &entry), ErrLogNotFound)
+	require.NoError(t, archive.GetLog(95, &entry))
+
+	require.Error(t, archiver.ArchiveLogs(store, 95, 110))
+
+	// A WALStore doesn't accept one.
+	wal, err := NewWALStore(t.TempDir())
+	require.NoError(t, err)
+	defer func() { _ = wal.Close() }()
+	archiver = NewLogStoreArchiver(wal)
+	require.NoError(t, archiver.ArchiveLogs(store, 1, 10))
+	require.ErrorContains(t, archiver.ArchiveLogs(store, 20, 30), "after a gap from index 10")
+}
+
+func TestRaft_LogArchiver(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 10
+	archive := NewInmemStore()
+	conf.LogArchiver = NewLogStoreArchiver(archive)
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0).Error())
+	}
+	require.NoError(t, leader.Snapshot().Error())
+
+	// Every compacted log is in the archive.
+	first, err := c.stores[0].FirstIndex()
+	require.NoError(t, err)
+	require.Greater(t, first, uint64(1))
+	last, err := archive.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, first-1, last)
+	for i := uint64(1); i < first; i++ {
+		require.NoError(t, archive.GetLog(i, new(Log)))
+	}
+
+	// Logs aren't compacted if they can't be archived.
+	conf = inmemConfig(t)
+	conf.TrailingLogs = 10
+	conf.LogArchiver = failingLogArchiver{}
+	c2 := MakeCluster(1, t, conf)
+	defer c2.Close()
+	leader = c2.Leader()
+	for i := 0; i < 50; i++ {
+		require.NoError(t, leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0).Error())
+	}
+	require.ErrorContains(t, leader.Snapshot().Error(), "archive unavailable")
+	first, err = c2.stores[0].FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+}
+
+func TestRaft_LogArchiver_InstallSnapshot(t *testing.T) {
+	cases := []struct {
+		name      string
+		monotonic bool
+		fail      bool
+	}{
+		{name: "compact"},
+		{name: "monotonic", monotonic: true},
+		{name: "monotonic archive fails", monotonic: true, fail: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := inmemConfig(t)
+			conf.TrailingLogs = 0
+			archive := NewInmemStore()
+			conf.LogArchiver = NewLogStoreArchiver(archive)
+			if tc.fail {
+				conf.LogArchiver = failingLogArchiver{}
+			}
+			c := MakeClusterNoBootstrap(1, t, conf)
+			defer c.Close()
+			r := c.rafts[0]
+			if tc.monotonic {
+				r.logs = &MockMonotonicLogStore{s: r.logs}
+			}
+
+			_, trans := NewInmemTransport("")
+			trans.Connect(r.localAddr, c.trans[0])
+			header := RPCHeader{ProtocolVersion: ProtocolVersionMax, ID: []byte("leader"), Addr: []byte(trans.LocalAddr())}
+			configuration := Configuration{Servers: []Server{
+				{Suffrage: Voter, ID: r.localID, Address: r.localAddr},
+				{Suffrage: Voter, ID: "leader", Address: trans.LocalAddr()},
+			}}
+
+			// The follower has ten logs, but only knows the first five are
+			// committed.
+			entries := []*Log{{Index: 1, Term: 1, Type: LogConfiguration, Data: EncodeConfiguration(configuration)}}
+			for i := uint64(2); i <= 10; i++ {
+				entries = append(entries, &Log{Index: i, Term: 1, Type: LogCommand, Data: []byte(fmt.Sprintf("test%d", i))})
+			}
+			appendReq := &AppendEntriesRequest{
+				RPCHeader:         header,
+				Term:              1,
+				Entries:           entries,
+				LeaderCommitIndex: 5,
+			}
+			var appendResp AppendEntriesResponse
+			require.NoError(t, trans.AppendEntries(r.localID, r.localAddr, appendReq, &appendResp))
+			require.True(t, appendResp.Success)
+			require.Equal(t, uint64(5), r.getCommitIndex())
+
+			// The leader sends a snapshot of all of them.
+			var data []byte
+			require.NoError(t, codec.NewEncoderBytes(&data, &codec.MsgpackHandle{}).Encode([][]byte{[]byte("snapshot")}))
+			installReq := &InstallSnapshotRequest{
+				RPCHeader:          header,
+				SnapshotVersion:    SnapshotVersionMax,
+				Term:               1,
+				LastLogIndex:       10,
+				LastLogTerm:        1,
+				Configuration:      EncodeConfiguration(configuration),
+				ConfigurationIndex: 1,
+				Size:               int64(len(data)),
+			}
+			var installResp InstallSnapshotResponse
+			err := trans.InstallSnapshot(r.localID, r.localAddr, installReq, &installResp, bytes.NewReader(data))
+
+			// If the logs can't be archived, they're kept and the install
+			// fails so that the leader retries it.
+			last, lastErr := r.logs.LastIndex()
+			require.NoError(t, lastErr)
+			if tc.fail {
+				require.ErrorContains(t, err, "archive unavailable")
+				require.Equal(t, uint64(10), last)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, installResp.Success)
+			require.Zero(t, last)
+
+			// Every log up to the snapshot was archived, without a gap.
+			first, err := archive.FirstIndex()
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), first)
+			last, err = archive.LastIndex()
+			require.NoError(t, err)
+			require.Equal(t, uint64(10), last)
+			for i := first; i <= last; i++ {
+				require.NoError(t, archive.GetLog(i, new(Log)))
+			}
+		})
+	}
+}
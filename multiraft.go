@@ -0,0 +1,721 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// groupConsumeBuffer is how many RPCs may queue up for a group before
+	// the host hands further ones off to a goroutine, so a busy group doesn't
+	// hold up the others.
+	groupConsumeBuffer = 64
+)
+
+var (
+	// ErrUnknownGroup is returned when an RPC is received for a raft group
+	// that isn't hosted by the MultiRaft.
+	ErrUnknownGroup = errors.New("unknown raft group")
+
+	// ErrGroupExists is returned when adding a raft group to a MultiRaft
+	// that already hosts a group with the same ID.
+	ErrGroupExists = errors.New("raft group already exists")
+
+	// ErrMultiRaftShutdown is returned when operations on a MultiRaft are
+	// invoked after it's been shut down.
+	ErrMultiRaftShutdown = errors.New("multiraft is shutdown")
+)
+
+// MultiRaft hosts many independent raft groups in one process, sharing a
+// single Transport and listener. Each group's requests carry its ID in
+// RPCHeader.GroupID, and the host routes the RPCs it receives to the group
+// with that ID. A group must have the same ID on every host that runs one of
+// its servers.
+//
+// The host doesn't cut down the goroutines each group runs, apart from
+// heartbeats. Each group is a full Raft, with its own run, FSM and snapshot
+// goroutines, and its own replication goroutine per follower while it leads,
+// so the number of goroutines still grows with the number of groups. What
+// the host shares is the transport, and with it the listener and
+// connections.
+//
+// With a NetworkTransport, enabling NetworkTransportConfig.Multiplex keeps the
+// connections between two hosts down to one, however many groups they share.
+// The host sends the heartbeats of all of its groups from one ticker, rather
+// than each follower of each group having a heartbeat goroutine. If the
+// transport implements WithHeartbeatBatch, the heartbeats due to the same
+// address are coalesced into one RPC.
+type MultiRaft struct {
+	trans  Transport
+	logger hclog.Logger
+
+	groups     map[string]*multiRaftGroup
+	groupsLock sync.RWMutex
+
+	// heartbeats holds the followers the groups send heartbeats to.
+	heartbeats     map[*hostHeartbeat]struct{}
+	heartbeatsLock sync.Mutex
+	// heartbeatCh wakes up the heartbeat ticker to reschedule.
+	heartbeatCh chan struct{}
+
+	shutdown     bool
+	shutdownCh   chan struct{}
+	shutdownLock sync.Mutex
+}
+
+// multiRaftGroup is a raft group hosted by a MultiRaft.
+type multiRaftGroup struct {
+	raft  *Raft
+	trans *groupTransport
+}
+
+// MultiRaftConfig configures a MultiRaft.
+type MultiRaftConfig struct {
+	// Transport is shared by all groups. The MultiRaft consumes all RPCs from
+	// it, so it must not be used for anything else, and doesn't close it on
+	// shutdown.
+	Transport Transport
+
+	// Logger is used to log messages. If nil, a default logger is used.
+	Logger hclog.Logger
+}
+
+// NewMultiRaft returns a MultiRaft that hosts raft groups on trans. The
+// MultiRaft consumes all RPCs from trans, which must not be used for anything
+// else, and doesn't close it on shutdown.
+func NewMultiRaft(trans Transport, logger hclog.Logger) *MultiRaft {
+	return NewMultiRaftWithConfig(&MultiRaftConfig{
+		Transport: trans,
+		Logger:    logger,
+	})
+}
+
+// NewMultiRaftWithConfig returns a MultiRaft using the given config struct.
+func NewMultiRaftWithConfig(config *MultiRaftConfig) *MultiRaft {
+	trans, logger := config.Transport, config.Logger
+	if logger == nil {
+		logger = hclog.New(&hclog.LoggerOptions{
+			Name:   "raft-multi",
+			Output: hclog.DefaultOutput,
+			Level:  hclog.DefaultLevel,
+		})
+	}
+	m := &MultiRaft{
+		trans:       trans,
+		logger:      logger,
+		groups:      make(map[string]*multiRaftGroup),
+		heartbeats:  make(map[*hostHeartbeat]struct{}),
+		heartbeatCh: make(chan struct{}, 1),
+		shutdownCh:  make(chan struct{}),
+	}
+	trans.SetHeartbeatHandler(m.processHeartbeat)
+	go m.run()
+	go m.runHeartbeats()
+	return m
+}
+
+// AddGroup starts a raft group with the given ID on the host, using the
+// given config and stores like NewRaft. The group runs the same goroutines as
+// a Raft of its own, except for heartbeats, which the host sends. Pre-vote is
+// disabled if the shared transport doesn't support it.
+func (m *MultiRaft) AddGroup(groupID string, conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps SnapshotStore) (*Raft, error) {
+	if groupID == "" {
+		return nil, fmt.Errorf("group ID must not be empty")
+	}
+
+	m.shutdownLock.Lock()
+	defer m.shutdownLock.Unlock()
+	if m.shutdown {
+		return nil, ErrMultiRaftShutdown
+	}
+
+	trans := newGroupTransport(m, groupID)
+	m.groupsLock.Lock()
+	if _, ok := m.groups[groupID]; ok {
+		m.groupsLock.Unlock()
+		return nil, ErrGroupExists
+	}
+	group := &multiRaftGroup{trans: trans}
+	m.groups[groupID] = group
+	m.groupsLock.Unlock()
+
+	groupConf := *conf
+	if _, ok := m.trans.(WithPreVote); !ok {
+		groupConf.PreVoteDisabled = true
+	}
+	r, err := NewRaft(&groupConf, fsm, logs, stable, snaps, trans)
+	if err != nil {
+		m.removeGroup(groupID)
+		return nil, err
+	}
+
+	m.groupsLock.Lock()
+	group.raft = r
+	m.groupsLock.Unlock()
+	return r, nil
+}
+
+// Group returns the Raft of the group with the given ID, or nil if the host
+// doesn't run it.
+func (m *MultiRaft) Group(groupID string) *Raft {
+	m.groupsLock.RLock()
+	defer m.groupsLock.RUnlock()
+	if group, ok := m.groups[groupID]; ok {
+		return group.raft
+	}
+	return nil
+}
+
+// Groups returns the IDs of the groups the host runs, sorted.
+func (m *MultiRaft) Groups() []string {
+	m.groupsLock.RLock()
+	defer m.groupsLock.RUnlock()
+	ids := make([]string, 0, len(m.groups))
+	for id, group := range m.groups {
+		if group.raft != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RemoveGroup shuts down the group with the given ID and removes it from the
+// host. Its stores are left as they are.
+func (m *MultiRaft) RemoveGroup(groupID string) error {
+	m.groupsLock.RLock()
+	group, ok := m.groups[groupID]
+	m.groupsLock.RUnlock()
+	if !ok || group.raft == nil {
+		return ErrUnknownGroup
+	}
+
+	err := group.raft.Shutdown().Error()
+	m.removeGroup(groupID)
+	return err
+}
+
+// removeGroup stops routing RPCs to a group.
+func (m *MultiRaft) removeGroup(groupID string) {
+	m.groupsLock.Lock()
+	group, ok := m.groups[groupID]
+	delete(m.groups, groupID)
+	m.groupsLock.Unlock()
+	if ok {
+		_ = group.trans.Close()
+	}
+}
+
+// Shutdown shuts down every group on the host and stops consuming RPCs from
+// the transport.
+func (m *MultiRaft) Shutdown() error {
+	m.shutdownLock.Lock()
+	defer m.shutdownLock.Unlock()
+	if m.shutdown {
+		return nil
+	}
+	m.shutdown = true
+
+	var errs []error
+	for _, id := range m.Groups() {
+		if err := m.RemoveGroup(id); err != nil {
+			errs = append(errs, fmt.Errorf("failed to shut down group %q: %w", id, err))
+		}
+	}
+	m.trans.SetHeartbeatHandler(nil)
+	close(m.shutdownCh)
+	return errors.Join(errs...)
+}
+
+// run routes RPCs from the shared transport to their groups.
+func (m *MultiRaft) run() {
+	for {
+		select {
+		case rpc := <-m.trans.Consumer():
+			if _, ok := rpc.Command.(*HeartbeatBatchRequest); ok {
+				go m.processHeartbeatBatch(rpc)
+				continue
+			}
+			if group := m.route(rpc); group != nil {
+				group.dispatch(rpc)
+			}
+		case <-m.shutdownCh:
+			return
+		}
+	}
+}
+
+// processHeartbeat routes a heartbeat to its group's fast path.
+func (m *MultiRaft) processHeartbeat(rpc RPC) {
+	if _, ok := rpc.Command.(*HeartbeatBatchRequest); ok {
+		m.processHeartbeatBatch(rpc)
+		return
+	}
+	group := m.route(rpc)
+	if group == nil {
+		return
+	}
+	group.heartbeatFnLock.Lock()
+	fn := group.heartbeatFn
+	group.heartbeatFnLock.Unlock()
+	if fn != nil {
+		fn(rpc)
+		return
+	}
+	group.dispatch(rpc)
+}
+
+// processHeartbeatBatch hands each heartbeat in a batch to its group, and
+// responds with all of their responses at once.
+func (m *MultiRaft) processHeartbeatBatch(rpc RPC) {
+	batch := rpc.Command.(*HeartbeatBatchRequest)
+	resp := &HeartbeatBatchResponse{
+		Responses: make([]*AppendEntriesResponse, len(batch.Heartbeats)),
+		Errors:    make([]string, len(batch.Heartbeats)),
+	}
+	if trans, ok := m.trans.(WithCodecs); ok {
+		resp.Codecs = trans.Codecs()
+	}
+
+	for i, hb := range batch.Heartbeats {
+		out := m.processBatchedHeartbeat(hb)
+		if out.Error != nil {
+			resp.Errors[i] = out.Error.Error()
+		}
+		if r, ok := out.Response.(*AppendEntriesResponse); ok && r != nil {
+			resp.Responses[i] = r
+		} else {
+			resp.Responses[i] = &AppendEntriesResponse{}
+		}
+	}
+	rpc.Respond(resp, nil)
+}
+
+// processBatchedHeartbeat hands a heartbeat from a batch to its group and
+// returns the group's response.
+func (m *MultiRaft) processBatchedHeartbeat(hb *AppendEntriesRequest) RPCResponse {
+	respCh := make(chan RPCResponse, 1)
+	rpc := RPC{Command: hb, RespChan: respCh}
+	group := m.route(rpc)
+	if group == nil {
+		return <-respCh
+	}
+
+	group.heartbeatFnLock.Lock()
+	fn := group.heartbeatFn
+	group.heartbeatFnLock.Unlock()
+	if fn != nil {
+		// The handler responds before returning, unless the group has shut
+		// down.
+		fn(rpc)
+		select {
+		case out := <-respCh:
+			return out
+		default:
+			return RPCResponse{Error: ErrRaftShutdown}
+		}
+	}
+
+	group.dispatch(rpc)
+	select {
+	case out := <-respCh:
+		return out
+	case <-group.shutdownCh:
+		return RPCResponse{Error: ErrRaftShutdown}
+	case <-m.shutdownCh:
+		return RPCResponse{Error: ErrMultiRaftShutdown}
+	}
+}
+
+// hostHeartbeat is a follower of a group that the host sends heartbeats to.
+type hostHeartbeat struct {
+	host *MultiRaft
+	task *heartbeatTask
+
+	// sending tracks the outstanding heartbeat, so that stop can wait for it.
+	sending sync.WaitGroup
+
+	// The fields below are protected by the host's heartbeatsLock.
+
+	// last is when the last heartbeat was sent.
+	last time.Time
+	// backoffUntil is when the backoff after a failed heartbeat ends.
+	backoffUntil time.Time
+	// triggered is set when a heartbeat should be sent right away.
+	triggered bool
+	// inflight is set while a heartbeat is outstanding.
+	inflight bool
+}
+
+// trigger implements the heartbeatSchedule interface.
+func (h *hostHeartbeat) trigger() {
+	h.host.heartbeatsLock.Lock()
+	h.triggered = true
+	h.host.heartbeatsLock.Unlock()
+	asyncNotifyCh(h.host.heartbeatCh)
+}
+
+// stop implements the heartbeatSchedule interface. It waits for the
+// outstanding heartbeat, if any, to be handed to the group.
+func (h *hostHeartbeat) stop() {
+	h.host.heartbeatsLock.Lock()
+	delete(h.host.heartbeats, h)
+	h.host.heartbeatsLock.Unlock()
+	h.sending.Wait()
+}
+
+// due returns when the next heartbeat to the follower must be sent, or the
+// zero time if one is outstanding.
+func (h *hostHeartbeat) due() time.Time {
+	if h.inflight {
+		return time.Time{}
+	}
+	due := h.last.Add(h.task.interval())
+	if h.triggered {
+		due = h.last
+	}
+	if due.Before(h.backoffUntil) {
+		due = h.backoffUntil
+	}
+	return due
+}
+
+// scheduleHeartbeats starts sending the heartbeats of a task from the host's
+// heartbeat ticker.
+func (m *MultiRaft) scheduleHeartbeats(task *heartbeatTask) heartbeatSchedule {
+	h := &hostHeartbeat{host: m, task: task, last: time.Now()}
+	m.heartbeatsLock.Lock()
+	m.heartbeats[h] = struct{}{}
+	m.heartbeatsLock.Unlock()
+	asyncNotifyCh(m.heartbeatCh)
+	return h
+}
+
+// runHeartbeats is the host's heartbeat ticker. It wakes up when the next
+// heartbeat of any group is due, or one is triggered, and sends them.
+func (m *MultiRaft) runHeartbeats() {
+	for {
+		var timer *time.Timer
+		var timerCh <-chan time.Time
+		if next := m.sendHeartbeats(time.Now()); !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			timerCh = timer.C
+		}
+
+		select {
+		case <-timerCh:
+		case <-m.heartbeatCh:
+		case <-m.shutdownCh:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-m.shutdownCh:
+			return
+		default:
+		}
+	}
+}
+
+// sendHeartbeats sends the heartbeats that are due, and returns when the
+// next one is, or the zero time if none are scheduled.
+//
+// When a heartbeat to an address is due, the heartbeats to that address that
+// are at least halfway through their interval are sent with it. This brings
+// the heartbeats of the groups into step, so that they can be sent together.
+func (m *MultiRaft) sendHeartbeats(now time.Time) time.Time {
+	m.heartbeatsLock.Lock()
+	defer m.heartbeatsLock.Unlock()
+
+	var next time.Time
+	dueTo := make(map[ServerAddress]bool)
+	peers := make(map[*hostHeartbeat]Server, len(m.heartbeats))
+	for h := range m.heartbeats {
+		due := h.due()
+		if due.IsZero() {
+			continue
+		}
+		peer := h.task.peer()
+		peers[h] = peer
+		if !due.After(now) {
+			dueTo[peer.Address] = true
+		} else if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	if len(dueTo) == 0 {
+		return next
+	}
+
+	batches := make(map[ServerAddress][]*hostHeartbeat)
+	for h, peer := range peers {
+		if !dueTo[peer.Address] || now.Before(h.backoffUntil) {
+			continue
+		}
+		if !h.triggered && now.Sub(h.last) < h.task.interval()/2 {
+			continue
+		}
+		h.inflight = true
+		h.sending.Add(1)
+		h.triggered = false
+		h.last = now
+		batches[peer.Address] = append(batches[peer.Address], h)
+	}
+
+	for target, batch := range batches {
+		hbPeers := make([]Server, len(batch))
+		for i, h := range batch {
+			hbPeers[i] = peers[h]
+		}
+		if _, ok := m.trans.(WithHeartbeatBatch); ok && len(batch) > 1 {
+			go m.sendHeartbeatBatch(target, batch, hbPeers)
+			continue
+		}
+		for i, h := range batch {
+			go m.sendHeartbeat(h, hbPeers[i])
+		}
+	}
+
+	// The heartbeats just sent are rescheduled once they're done.
+	next = time.Time{}
+	for h := range m.heartbeats {
+		if due := h.due(); !due.IsZero() && (next.IsZero() || due.Before(next)) {
+			next = due
+		}
+	}
+	return next
+}
+
+// sendHeartbeat sends a single heartbeat.
+func (m *MultiRaft) sendHeartbeat(h *hostHeartbeat, peer Server) {
+	start := time.Now()
+	var resp AppendEntriesResponse
+	err := m.trans.AppendEntries(peer.ID, peer.Address, h.task.req, &resp)
+	m.heartbeatDone(h, peer, start, &resp, err)
+}
+
+// sendHeartbeatBatch sends the heartbeats to the same address as one batch.
+func (m *MultiRaft) sendHeartbeatBatch(target ServerAddress, batch []*hostHeartbeat, peers []Server) {
+	// The batch is sent with the header of the first heartbeat, less its
+	// group, since each heartbeat carries its own.
+	args := HeartbeatBatchRequest{
+		RPCHeader:  batch[0].task.req.RPCHeader,
+		Heartbeats: make([]*AppendEntriesRequest, len(batch)),
+	}
+	args.GroupID = nil
+	for i, h := range batch {
+		args.Heartbeats[i] = h.task.req
+	}
+
+	start := time.Now()
+	var resp HeartbeatBatchResponse
+	err := m.trans.(WithHeartbeatBatch).HeartbeatBatch(peers[0].ID, target, &args, &resp)
+
+	for i, h := range batch {
+		hbErr := err
+		var hbResp *AppendEntriesResponse
+		switch {
+		case err != nil:
+		case i >= len(resp.Responses) || resp.Responses[i] == nil:
+			hbErr = fmt.Errorf("missing response in heartbeat batch")
+		case i < len(resp.Errors) && resp.Errors[i] != "":
+			hbErr = errors.New(resp.Errors[i])
+		default:
+			hbResp = resp.Responses[i]
+		}
+		m.heartbeatDone(h, peers[i], start, hbResp, hbErr)
+	}
+}
+
+// heartbeatDone hands the outcome of a heartbeat to its group, and
+// reschedules the follower.
+func (m *MultiRaft) heartbeatDone(h *hostHeartbeat, peer Server, start time.Time, resp *AppendEntriesResponse, err error) {
+	defer h.sending.Done()
+	backoff := h.task.done(peer, start, resp, err)
+
+	m.heartbeatsLock.Lock()
+	h.inflight = false
+	if backoff > 0 {
+		h.backoffUntil = time.Now().Add(backoff)
+	}
+	m.heartbeatsLock.Unlock()
+	asyncNotifyCh(m.heartbeatCh)
+}
+
+// route returns the transport of the group an RPC is for. If there is no
+// such group, it responds to the RPC with an error and returns nil.
+func (m *MultiRaft) route(rpc RPC) *groupTransport {
+	var groupID string
+	if cmd, ok := rpc.Command.(WithRPCHeader); ok {
+		groupID = string(cmd.GetRPCHeader().GroupID)
+	}
+
+	m.groupsLock.RLock()
+	group, ok := m.groups[groupID]
+	m.groupsLock.RUnlock()
+	if !ok {
+		m.logger.Debug("rejecting rpc for unknown group", "group", groupID)
+		rpc.Respond(nil, fmt.Errorf("%w %q", ErrUnknownGroup, groupID))
+		return nil
+	}
+	return group.trans
+}
+
+// groupTransport is the Transport of a single group on a MultiRaft. It
+// provides the group ID for the headers of outgoing requests and receives the
+// RPCs the host routes to the group.
+type groupTransport struct {
+	host    *MultiRaft
+	groupID []byte
+
+	consumeCh chan RPC
+
+	heartbeatFn     func(RPC)
+	heartbeatFnLock sync.Mutex
+
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+}
+
+func newGroupTransport(host *MultiRaft, groupID string) *groupTransport {
+	return &groupTransport{
+		host:       host,
+		groupID:    []byte(groupID),
+		consumeCh:  make(chan RPC, groupConsumeBuffer),
+		shutdownCh: make(chan struct{}),
+	}
+}
+
+// dispatch hands an RPC to the group without blocking the host.
+func (g *groupTransport) dispatch(rpc RPC) {
+	select {
+	case g.consumeCh <- rpc:
+	default:
+		go func() {
+			select {
+			case g.consumeCh <- rpc:
+			case <-g.shutdownCh:
+				rpc.Respond(nil, ErrRaftShutdown)
+			}
+		}()
+	}
+}
+
+// Consumer implements the Transport interface.
+func (g *groupTransport) Consumer() <-chan RPC {
+	return g.consumeCh
+}
+
+// LocalAddr implements the Transport interface.
+func (g *groupTransport) LocalAddr() ServerAddress {
+	return g.host.trans.LocalAddr()
+}
+
+// AppendEntriesPipeline implements the Transport interface.
+func (g *groupTransport) AppendEntriesPipeline(id ServerID, target ServerAddress) (AppendPipeline, error) {
+	pipeline, err := g.host.trans.AppendEntriesPipeline(id, target)
+	if err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+// AppendEntries implements the Transport interface.
+func (g *groupTransport) AppendEntries(id ServerID, target ServerAddress, args *AppendEntriesRequest, resp *AppendEntriesResponse) error {
+	return g.host.trans.AppendEntries(id, target, args, resp)
+}
+
+// RequestVote implements the Transport interface.
+func (g *groupTransport) RequestVote(id ServerID, target ServerAddress, args *RequestVoteRequest, resp *RequestVoteResponse) error {
+	return g.host.trans.RequestVote(id, target, args, resp)
+}
+
+// InstallSnapshot implements the Transport interface.
+func (g *groupTransport) InstallSnapshot(id ServerID, target ServerAddress, args *InstallSnapshotRequest, resp *InstallSnapshotResponse, data io.Reader) error {
+	return g.host.trans.InstallSnapshot(id, target, args, resp, data)
+}
+
+// EncodePeer implements the Transport interface.
+func (g *groupTransport) EncodePeer(id ServerID, addr ServerAddress) []byte {
+	return g.host.trans.EncodePeer(id, addr)
+}
+
+// DecodePeer implements the Transport interface.
+func (g *groupTransport) DecodePeer(buf []byte) ServerAddress {
+	return g.host.trans.DecodePeer(buf)
+}
+
+// SetHeartbeatHandler implements the Transport interface.
+func (g *groupTransport) SetHeartbeatHandler(cb func(rpc RPC)) {
+	g.heartbeatFnLock.Lock()
+	defer g.heartbeatFnLock.Unlock()
+	g.heartbeatFn = cb
+}
+
+// scheduleHeartbeats implements the heartbeatScheduler interface.
+func (g *groupTransport) scheduleHeartbeats(task *heartbeatTask) heartbeatSchedule {
+	return g.host.scheduleHeartbeats(task)
+}
+
+// TimeoutNow implements the Transport interface.
+func (g *groupTransport) TimeoutNow(id ServerID, target ServerAddress, args *TimeoutNowRequest, resp *TimeoutNowResponse) error {
+	return g.host.trans.TimeoutNow(id, target, args, resp)
+}
+
+// RequestPreVote implements the WithPreVote interface.
+func (g *groupTransport) RequestPreVote(id ServerID, target ServerAddress, args *RequestPreVoteRequest, resp *RequestPreVoteResponse) error {
+	trans, ok := g.host.trans.(WithPreVote)
+	if !ok {
+		return ErrUnsupportedProtocol
+	}
+	return trans.RequestPreVote(id, target, args, resp)
+}
+
+// ReadIndex implements the WithReadIndex interface.
+func (g *groupTransport) ReadIndex(id ServerID, target ServerAddress, args *ReadIndexRequest, resp *ReadIndexResponse) error {
+	trans, ok := g.host.trans.(WithReadIndex)
+	if !ok {
+		return ErrUnsupportedProtocol
+	}
+	return trans.ReadIndex(id, target, args, resp)
+}
+
+// CatchUp implements the WithCatchUp interface.
+func (g *groupTransport) CatchUp(id ServerID, target ServerAddress, args *CatchUpRequest, resp *CatchUpResponse) error {
+	trans, ok := g.host.trans.(WithCatchUp)
+	if !ok {
+		return ErrUnsupportedProtocol
+	}
+	return trans.CatchUp(id, target, args, resp)
+}
+
+// GroupID implements the WithGroupID interface.
+func (g *groupTransport) GroupID() []byte {
+	return g.groupID
+}
+
+// Codecs implements the WithCodecs interface.
+func (g *groupTransport) Codecs() []byte {
+	if trans, ok := g.host.trans.(WithCodecs); ok {
+		return trans.Codecs()
+	}
+	return nil
+}
+
+// Close implements the WithClose interface. It releases RPCs waiting for the
+// group, but leaves the shared transport open.
+func (g *groupTransport) Close() error {
+	g.shutdownOnce.Do(func() { close(g.shutdownCh) })
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiRaft_Groups(t *testing.T) {
+	// Three hosts sharing one transport each.
+	var hosts []*MultiRaft
+	var trans []*InmemTransport
+	for i := 0; i < 3; i++ {
+		_, tr := NewInmemTransport("")
+		trans = append(trans, tr)
+		hosts = append(hosts, NewMultiRaft(tr, newTestLogger(t)))
+	}
+	for _, t1 := range trans {
+		for _, t2 := range trans {
+			t1.Connect(t2.LocalAddr(), t2)
+		}
+	}
+	defer func() {
+		for _, h := range hosts {
+			require.NoError(t, h.Shutdown())
+		}
+	}()
+
+	var configuration Configuration
+	for i, tr := range trans {
+		configuration.Servers = append(configuration.Servers, Server{
+			Suffrage: Voter,
+			ID:       ServerID(fmt.Sprintf("server%d", i)),
+			Address:  tr.LocalAddr(),
+		})
+	}
+
+	// Run the same servers in two groups.
+	groups := []string{"a", "b"}
+	fsms := make(map[string][]*MockFSM)
+	for _, group := range groups {
+		for i, h := range hosts {
+			conf := inmemConfig(t)
+			conf.LocalID = configuration.Servers[i].ID
+			fsm := &MockFSM{}
+			r, err := h.AddGroup(group, conf, fsm, NewInmemStore(), NewInmemStore(), NewInmemSnapshotStore())
+			require.NoError(t, err)
+			require.NoError(t, r.BootstrapCluster(configuration).Error())
+			fsms[group] = append(fsms[group], fsm)
+		}
+	}
+	_, err := hosts[0].AddGroup("a", inmemConfig(t), &MockFSM{}, NewInmemStore(), NewInmemStore(), NewInmemSnapshotStore())
+	require.ErrorIs(t, err, ErrGroupExists)
+	require.Equal(t, groups, hosts[0].Groups())
+
+	// Each group elects a leader and applies its own commands.
+	for _, group := range groups {
+		var leader *Raft
+		require.Eventually(t, func() bool {
+			for _, h := range hosts {
+				if r := h.Group(group); r.State() == Leader {
+					leader = r
+					return true
+				}
+			}
+			return false
+		}, 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, leader.Apply([]byte(group), time.Second).Error())
+		require.NoError(t, leader.VerifyLeader().Error())
+	}
+	for _, group := range groups {
+		for _, fsm := range fsms[group] {
+			require.Eventually(t, func() bool {
+				logs := fsm.Logs()
+				return len(logs) == 1 && string(logs[0]) == group
+			}, 5*time.Second, 10*time.Millisecond)
+		}
+	}
+
+	// RPCs for a group a host doesn't run are rejected.
+	var resp RequestVoteResponse
+	args := RequestVoteRequest{RPCHeader: RPCHeader{GroupID: []byte("c")}, Term: 100}
+	err = trans[0].RequestVote("server1", trans[1].LocalAddr(), &args, &resp)
+	require.ErrorContains(t, err, ErrUnknownGroup.Error())
+
+	// Removing a group leaves the others running.
+	require.NoError(t, hosts[0].RemoveGroup("a"))
+	require.Nil(t, hosts[0].Group("a"))
+	require.Equal(t, []string{"b"}, hosts[0].Groups())
+	require.ErrorIs(t, hosts[0].RemoveGroup("a"), ErrUnknownGroup)
+}
+
+func TestMultiRaft_CoalescedHeartbeats(t *testing.T) {
+	_, trans1 := NewInmemTransport("")
+	_, trans2 := NewInmemTransport("")
+	trans1.Connect(trans2.LocalAddr(), trans2)
+	host := NewMultiRaft(trans1, newTestLogger(t))
+	defer func() { require.NoError(t, host.Shutdown()) }()
+
+	batchCh := make(chan *HeartbeatBatchRequest, 1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		for {
+			select {
+			case rpc := <-trans2.Consumer():
+				batch, ok := rpc.Command.(*HeartbeatBatchRequest)
+				if !ok {
+					rpc.Respond(nil, fmt.Errorf("not a batch: %#v", rpc.Command))
+					continue
+				}
+				resp := &HeartbeatBatchResponse{Errors: make([]string, len(batch.Heartbeats))}
+				for i, hb := range batch.Heartbeats {
+					resp.Responses = append(resp.Responses, &AppendEntriesResponse{Term: hb.Term, Success: true})
+					if string(hb.GroupID) == "b" {
+						resp.Errors[i] = "group b failed"
+					}
+				}
+				rpc.Respond(resp, nil)
+				select {
+				case batchCh <- batch:
+				default:
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+
+	// The groups know the server by different IDs, but their heartbeats to
+	// its address are sent together.
+	type result struct {
+		group string
+		err   error
+	}
+	resultCh := make(chan result, 2)
+	for i, group := range []string{"a", "b"} {
+		g := newGroupTransport(host, group)
+		peer := Server{ID: ServerID("server2" + group), Address: trans2.LocalAddr()}
+		term := uint64(i + 1)
+		schedule := g.scheduleHeartbeats(&heartbeatTask{
+			req:      &AppendEntriesRequest{RPCHeader: RPCHeader{GroupID: g.GroupID()}, Term: term},
+			interval: func() time.Duration { return 50 * time.Millisecond },
+			peer:     func() Server { return peer },
+			done: func(_ Server, _ time.Time, resp *AppendEntriesResponse, err error) time.Duration {
+				if err == nil && (!resp.Success || resp.Term != term) {
+					err = fmt.Errorf("bad response: %#v", resp)
+				}
+				select {
+				case resultCh <- result{group: group, err: err}:
+				default:
+				}
+				// Send no more heartbeats.
+				return time.Hour
+			},
+		})
+		defer schedule.stop()
+	}
+
+	select {
+	case batch := <-batchCh:
+		require.Len(t, batch.Heartbeats, 2)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeats sent")
+	}
+	errs := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		res := <-resultCh
+		if res.err != nil {
+			errs[res.group] = res.err.Error()
+		}
+	}
+	require.Equal(t, map[string]string{"b": "group b failed"}, errs)
+}
@@ -0,0 +1,368 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+const (
+	// msgpackCodecID identifies the default msgpack encoding on the wire. It
+	// is zero so the framing is unchanged for peers that predate codecs.
+	msgpackCodecID uint8 = 0
+
+	// binaryCodecID identifies BinaryCodec on the wire.
+	binaryCodecID uint8 = 1
+
+	// maxCodecID is the largest ID a Codec may use, since it has to fit in
+	// the upper bits of the rpc type byte.
+	maxCodecID uint8 = 15
+
+	// rpcCodecShift and rpcTypeMask split the byte framing each request into
+	// the codec ID and the rpc type.
+	rpcCodecShift = 4
+	rpcTypeMask   = 1<<rpcCodecShift - 1
+
+	// binaryNil and binaryPresent prefix the messages BinaryCodec encodes
+	// itself. binaryNil is the msgpack encoding of nil.
+	binaryNil     byte = 0xc0
+	binaryPresent byte = 0x01
+
+	// binaryMaxLen bounds the length prefixes BinaryCodec accepts, so a
+	// corrupt stream can't trigger a huge allocation.
+	binaryMaxLen = 1 << 30
+
+	// binaryMaxPrealloc bounds how many log entries are allocated up front
+	// when decoding an AppendEntries request.
+	binaryMaxPrealloc = 1024
+
+	// binaryMaxRetained is the largest scratch buffer a binary encoder keeps
+	// between messages.
+	binaryMaxRetained = 1024 * 1024
+)
+
+var (
+	// errBinaryMessage is returned when BinaryCodec can't decode a message.
+	errBinaryMessage = errors.New("malformed binary message")
+)
+
+// Codec is used by the NetworkTransport to encode and decode the messages it
+// exchanges with its peers. The transport negotiates which codec to use with
+// each peer through RPCHeader, and falls back to msgpack when a peer doesn't
+// support the configured codec.
+type Codec interface {
+	// ID identifies the codec on the wire. It must be between 1 and 15 and
+	// unique among the codecs used in a cluster; 0 is reserved for msgpack.
+	ID() uint8
+
+	// NewEncoder returns an encoder writing messages to w.
+	NewEncoder(w io.Writer) CodecEncoder
+
+	// NewDecoder returns a decoder reading messages from r. The decoder must
+	// not read past the end of a message, as the same reader is used for the
+	// next message and for streamed snapshot data.
+	NewDecoder(r *bufio.Reader) CodecDecoder
+}
+
+// CodecEncoder encodes messages for a Codec.
+type CodecEncoder interface {
+	Encode(v interface{}) error
+}
+
+// CodecDecoder decodes messages for a Codec.
+type CodecDecoder interface {
+	Decode(v interface{}) error
+}
+
+// WithCodecs is an interface that a transport may provide to advertise the
+// IDs of the codecs it can decode, beyond msgpack, to its peers through
+// RPCHeader.
+type WithCodecs interface {
+	Codecs() []byte
+}
+
+// msgpackCodec is the default Codec, and the one every peer understands.
+type msgpackCodec struct {
+	useNewTimeFormat bool
+}
+
+// ID implements the Codec interface.
+func (msgpackCodec) ID() uint8 {
+	return msgpackCodecID
+}
+
+// NewEncoder implements the Codec interface.
+func (c msgpackCodec) NewEncoder(w io.Writer) CodecEncoder {
+	mp := &codec.MsgpackHandle{}
+	mp.TimeNotBuiltin = !c.useNewTimeFormat
+	return codec.NewEncoder(w, mp)
+}
+
+// NewDecoder implements the Codec interface.
+func (msgpackCodec) NewDecoder(r *bufio.Reader) CodecDecoder {
+	return codec.NewDecoder(r, &codec.MsgpackHandle{})
+}
+
+// BinaryCodec is a Codec with a hand-written encoding for AppendEntries
+// requests and responses, which avoids the reflection msgpack relies on in
+// the replication hot path. All other messages are encoded with msgpack.
+type BinaryCodec struct{}
+
+// ID implements the Codec interface.
+func (BinaryCodec) ID() uint8 {
+	return binaryCodecID
+}
+
+// NewEncoder implements the Codec interface.
+func (BinaryCodec) NewEncoder(w io.Writer) CodecEncoder {
+	return &binaryEncoder{
+		w:  w,
+		mp: msgpackCodec{}.NewEncoder(w),
+	}
+}
+
+// NewDecoder implements the Codec interface.
+func (BinaryCodec) NewDecoder(r *bufio.Reader) CodecDecoder {
+	return &binaryDecoder{
+		r:  r,
+		mp: msgpackCodec{}.NewDecoder(r),
+	}
+}
+
+type binaryEncoder struct {
+	w   io.Writer
+	buf []byte
+	mp  CodecEncoder
+}
+
+// Encode implements the CodecEncoder interface.
+func (e *binaryEncoder) Encode(v interface{}) error {
+	buf := e.buf[:0]
+	switch v := v.(type) {
+	case string:
+		buf = appendBinaryBytes(buf, []byte(v))
+	case *AppendEntriesRequest:
+		if v == nil {
+			buf = append(buf, binaryNil)
+			break
+		}
+		buf = append(buf, binaryPresent)
+		buf = appendBinaryHeader(buf, v.RPCHeader)
+		buf = binary.AppendUvarint(buf, v.Term)
+		buf = appendBinaryBytes(buf, v.Leader)
+		buf = binary.AppendUvarint(buf, v.PrevLogEntry)
+		buf = binary.AppendUvarint(buf, v.PrevLogTerm)
+		buf = binary.AppendUvarint(buf, v.LeaderCommitIndex)
+		if v.Entries == nil {
+			buf = binary.AppendUvarint(buf, 0)
+			break
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(v.Entries))+1)
+		for _, entry := range v.Entries {
+			var err error
+			if buf, err = appendBinaryLog(buf, entry); err != nil {
+				return err
+			}
+		}
+	case *AppendEntriesResponse:
+		if v == nil {
+			buf = append(buf, binaryNil)
+			break
+		}
+		buf = append(buf, binaryPresent)
+		buf = appendBinaryHeader(buf, v.RPCHeader)
+		buf = binary.AppendUvarint(buf, v.Term)
+		buf = binary.AppendUvarint(buf, v.LastLog)
+		buf = appendBinaryBool(buf, v.Success)
+		buf = appendBinaryBool(buf, v.NoRetryBackoff)
+	default:
+		return e.mp.Encode(v)
+	}
+
+	if cap(buf) <= binaryMaxRetained {
+		e.buf = buf
+	} else {
+		e.buf = nil
+	}
+	_, err := e.w.Write(buf)
+	return err
+}
+
+func appendBinaryHeader(buf []byte, h RPCHeader) []byte {
+	buf = binary.AppendUvarint(buf, uint64(h.ProtocolVersion))
+	buf = appendBinaryBytes(buf, h.ID)
+	buf = appendBinaryBytes(buf, h.Addr)
+	buf = appendBinaryBytes(buf, h.Codecs)
+	return appendBinaryBytes(buf, h.GroupID)
+}
+
+func appendBinaryLog(buf []byte, l *Log) ([]byte, error) {
+	if l == nil {
+		return nil, fmt.Errorf("cannot encode nil log")
+	}
+	buf = binary.AppendUvarint(buf, l.Index)
+	buf = binary.AppendUvarint(buf, l.Term)
+	buf = append(buf, byte(l.Type))
+	buf = appendBinaryBytes(buf, l.Data)
+	buf = appendBinaryBytes(buf, l.Extensions)
+	if l.AppendedAt.IsZero() {
+		return binary.AppendUvarint(buf, 0), nil
+	}
+	t, err := l.AppendedAt.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return appendBinaryBytes(buf, t), nil
+}
+
+// appendBinaryBytes writes b prefixed with its length plus one, so that a nil
+// slice survives the round trip.
+func appendBinaryBytes(buf []byte, b []byte) []byte {
+	if b == nil {
+		return binary.AppendUvarint(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(b))+1)
+	return append(buf, b...)
+}
+
+func appendBinaryBool(buf []byte, b bool) []byte {
+	if b {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+type binaryDecoder struct {
+	r   *bufio.Reader
+	mp  CodecDecoder
+	err error
+}
+
+// Decode implements the CodecDecoder interface.
+func (d *binaryDecoder) Decode(v interface{}) error {
+	d.err = nil
+	switch v := v.(type) {
+	case *string:
+		*v = string(d.bytes())
+	case *AppendEntriesRequest:
+		if !d.present() {
+			break
+		}
+		v.RPCHeader = d.header()
+		v.Term = d.uvarint()
+		v.Leader = d.bytes()
+		v.PrevLogEntry = d.uvarint()
+		v.PrevLogTerm = d.uvarint()
+		v.LeaderCommitIndex = d.uvarint()
+		v.Entries = nil
+		n := d.length()
+		if n == 0 {
+			break
+		}
+		v.Entries = make([]*Log, 0, min(n-1, binaryMaxPrealloc))
+		for i := uint64(1); i < n && d.err == nil; i++ {
+			v.Entries = append(v.Entries, d.log())
+		}
+	case *AppendEntriesResponse:
+		if !d.present() {
+			break
+		}
+		v.RPCHeader = d.header()
+		v.Term = d.uvarint()
+		v.LastLog = d.uvarint()
+		v.Success = d.bool()
+		v.NoRetryBackoff = d.bool()
+	default:
+		return d.mp.Decode(v)
+	}
+	return d.err
+}
+
+// present reads the prefix of a message and reports whether it holds a value.
+func (d *binaryDecoder) present() bool {
+	b := d.byte()
+	switch {
+	case d.err != nil:
+		return false
+	case b == binaryNil:
+		return false
+	case b == binaryPresent:
+		return true
+	default:
+		d.err = errBinaryMessage
+		return false
+	}
+}
+
+func (d *binaryDecoder) header() RPCHeader {
+	return RPCHeader{
+		ProtocolVersion: ProtocolVersion(d.uvarint()),
+		ID:              d.bytes(),
+		Addr:            d.bytes(),
+		Codecs:          d.bytes(),
+		GroupID:         d.bytes(),
+	}
+}
+
+func (d *binaryDecoder) log() *Log {
+	l := &Log{
+		Index:      d.uvarint(),
+		Term:       d.uvarint(),
+		Type:       LogType(d.byte()),
+		Data:       d.bytes(),
+		Extensions: d.bytes(),
+	}
+	if t := d.bytes(); t != nil && d.err == nil {
+		d.err = l.AppendedAt.UnmarshalBinary(t)
+	}
+	return l
+}
+
+func (d *binaryDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.r.ReadByte()
+	d.err = err
+	return b
+}
+
+func (d *binaryDecoder) bool() bool {
+	return d.byte() != 0
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d.r)
+	d.err = err
+	return v
+}
+
+// length reads a length prefix written by appendBinaryBytes.
+func (d *binaryDecoder) length() uint64 {
+	n := d.uvarint()
+	if n > binaryMaxLen {
+		d.err = errBinaryMessage
+		return 0
+	}
+	return n
+}
+
+func (d *binaryDecoder) bytes() []byte {
+	n := d.length()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	b := make([]byte, n-1)
+	_, d.err = io.ReadFull(d.r, b)
+	return b
+}
@@ -0,0 +1,92 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinaryCodec_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := BinaryCodec{}.NewEncoder(&buf)
+
+	req := &AppendEntriesRequest{
+		RPCHeader: RPCHeader{
+			ProtocolVersion: ProtocolVersionMax,
+			ID:              []byte("id1"),
+			Addr:            []byte("127.0.0.1:1234"),
+			Codecs:          []byte{binaryCodecID},
+			GroupID:         []byte("group"),
+		},
+		Term:         10,
+		PrevLogEntry: 100,
+		PrevLogTerm:  4,
+		Entries: []*Log{
+			{
+				Index:      101,
+				Term:       4,
+				Type:       LogCommand,
+				Data:       []byte("hello"),
+				Extensions: []byte{},
+				AppendedAt: time.Unix(1700000000, 42).UTC(),
+			},
+			{
+				Index: 102,
+				Term:  4,
+				Type:  LogNoop,
+			},
+		},
+		LeaderCommitIndex: 90,
+	}
+	resp := &AppendEntriesResponse{
+		RPCHeader:      RPCHeader{ID: []byte("id2")},
+		Term:           4,
+		LastLog:        102,
+		NoRetryBackoff: true,
+	}
+	vote := &RequestVoteRequest{Term: 3, LastLogIndex: 7}
+	var nilResp *AppendEntriesResponse
+
+	for _, v := range []interface{}{"some error", req, resp, vote, nilResp, &AppendEntriesRequest{}} {
+		require.NoError(t, enc.Encode(v))
+	}
+
+	dec := BinaryCodec{}.NewDecoder(bufio.NewReader(&buf))
+	var errStr string
+	require.NoError(t, dec.Decode(&errStr))
+	require.Equal(t, "some error", errStr)
+
+	var outReq AppendEntriesRequest
+	require.NoError(t, dec.Decode(&outReq))
+	require.Equal(t, req, &outReq)
+
+	var outResp AppendEntriesResponse
+	require.NoError(t, dec.Decode(&outResp))
+	require.Equal(t, resp, &outResp)
+
+	var outVote RequestVoteRequest
+	require.NoError(t, dec.Decode(&outVote))
+	require.Equal(t, vote, &outVote)
+
+	// A nil response leaves the target untouched.
+	outResp = AppendEntriesResponse{Term: 1}
+	require.NoError(t, dec.Decode(&outResp))
+	require.Equal(t, AppendEntriesResponse{Term: 1}, outResp)
+
+	var empty AppendEntriesRequest
+	require.NoError(t, dec.Decode(&empty))
+	require.Equal(t, AppendEntriesRequest{}, empty)
+	require.Zero(t, buf.Len())
+}
+
+func TestBinaryCodec_Malformed(t *testing.T) {
+	dec := BinaryCodec{}.NewDecoder(bufio.NewReader(bytes.NewReader([]byte{0x07})))
+	var req AppendEntriesRequest
+	require.ErrorIs(t, dec.Decode(&req), errBinaryMessage)
+}
@@ -0,0 +1,787 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// muxMagic starts every multiplexed connection, followed by the length
+	// prefixed address the dialing side listens on.
+	muxMagic = "RAFTMUX1"
+
+	// muxHeaderSize is the size of a frame header: the frame type, the
+	// stream ID and the length.
+	muxHeaderSize = 9
+
+	// muxMaxFrame is the largest data frame we send, which bounds how long
+	// a large stream like InstallSnapshot can hold up the others.
+	muxMaxFrame = 16 * 1024
+
+	// muxWindow is how much data a stream may have in flight before the
+	// receiver reads it.
+	muxWindow = 256 * 1024
+
+	// muxHandshakeTimeout bounds how long an accepted connection has to
+	// send its preamble.
+	muxHandshakeTimeout = 10 * time.Second
+
+	// muxWriteTimeout bounds how long writing a single frame may take
+	// before the connection is considered dead.
+	muxWriteTimeout = 10 * time.Second
+)
+
+const (
+	// muxFrameOpen opens a new stream.
+	muxFrameOpen uint8 = iota
+
+	// muxFrameData carries length bytes of stream data.
+	muxFrameData
+
+	// muxFrameWindow grants the sender length more bytes of window.
+	muxFrameWindow
+
+	// muxFrameClose closes a stream in both directions.
+	muxFrameClose
+)
+
+var (
+	// errMuxClosed is returned when using a multiplexed connection that has
+	// been closed.
+	errMuxClosed = errors.New("multiplexed connection closed")
+
+	// errMuxStreamClosed is returned when writing to a stream the peer has
+	// closed.
+	errMuxStreamClosed = errors.New("stream closed by peer")
+)
+
+// muxStreamLayer is a StreamLayer that carries the connections to each peer
+// as streams over one long-lived connection from the wrapped StreamLayer. It
+// is used by the NetworkTransport when NetworkTransportConfig.Multiplex is
+// set.
+type muxStreamLayer struct {
+	stream StreamLayer
+	logger hclog.Logger
+
+	acceptCh chan net.Conn
+	errCh    chan error
+
+	// sessions holds every open session, and peers the sessions new streams
+	// to an address are opened on.
+	sessions     map[*muxSession]struct{}
+	peers        map[ServerAddress]*muxSession
+	sessionsLock sync.Mutex
+
+	// dialLocks serializes dials to each address, so concurrent RPCs share
+	// one new session.
+	dialLocks     map[ServerAddress]*sync.Mutex
+	dialLocksLock sync.Mutex
+
+	shutdown     bool
+	shutdownCh   chan struct{}
+	shutdownLock sync.Mutex
+}
+
+// newMuxStreamLayer wraps stream and starts accepting connections from it.
+func newMuxStreamLayer(stream StreamLayer, logger hclog.Logger) *muxStreamLayer {
+	m := &muxStreamLayer{
+		stream:     stream,
+		logger:     logger,
+		acceptCh:   make(chan net.Conn),
+		errCh:      make(chan error),
+		sessions:   make(map[*muxSession]struct{}),
+		peers:      make(map[ServerAddress]*muxSession),
+		dialLocks:  make(map[ServerAddress]*sync.Mutex),
+		shutdownCh: make(chan struct{}),
+	}
+	go m.acceptSessions()
+	return m
+}
+
+// Accept implements the net.Listener interface.
+func (m *muxStreamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.acceptCh:
+		return conn, nil
+	case err := <-m.errCh:
+		return nil, err
+	case <-m.shutdownCh:
+		return nil, errMuxClosed
+	}
+}
+
+// Close implements the net.Listener interface.
+func (m *muxStreamLayer) Close() error {
+	m.shutdownLock.Lock()
+	if m.shutdown {
+		m.shutdownLock.Unlock()
+		return nil
+	}
+	m.shutdown = true
+	close(m.shutdownCh)
+	m.shutdownLock.Unlock()
+
+	err := m.stream.Close()
+	m.sessionsLock.Lock()
+	sessions := make([]*muxSession, 0, len(m.sessions))
+	for s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.sessionsLock.Unlock()
+	for _, s := range sessions {
+		s.close(errMuxClosed)
+	}
+	return err
+}
+
+// Addr implements the net.Listener interface.
+func (m *muxStreamLayer) Addr() net.Addr {
+	return m.stream.Addr()
+}
+
+// Dial implements the StreamLayer interface.
+func (m *muxStreamLayer) Dial(address ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return m.DialPeer("", address, timeout)
+}
+
+// DialPeer implements the WithDialPeer interface. If the wrapped StreamLayer
+// verifies peer identities, streams are only opened on connections dialed for
+// the same ServerID.
+func (m *muxStreamLayer) DialPeer(id ServerID, address ServerAddress, timeout time.Duration) (net.Conn, error) {
+	lock := m.dialLock(address)
+	lock.Lock()
+	session := m.peerSession(id, address)
+	if session == nil {
+		var err error
+		if session, err = m.dialSession(id, address, timeout); err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+	}
+	lock.Unlock()
+	return session.openStream()
+}
+
+// dialLock returns the lock serializing dials to address.
+func (m *muxStreamLayer) dialLock(address ServerAddress) *sync.Mutex {
+	m.dialLocksLock.Lock()
+	defer m.dialLocksLock.Unlock()
+	lock, ok := m.dialLocks[address]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.dialLocks[address] = lock
+	}
+	return lock
+}
+
+// peerSession returns an open session new streams to address can use.
+func (m *muxStreamLayer) peerSession(id ServerID, address ServerAddress) *muxSession {
+	_, verifies := m.stream.(WithDialPeer)
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	s := m.peers[address]
+	if s == nil || (verifies && (!s.client || s.id != id)) {
+		return nil
+	}
+	return s
+}
+
+// dialSession dials a new connection to address and starts a session on it.
+func (m *muxStreamLayer) dialSession(id ServerID, address ServerAddress, timeout time.Duration) (*muxSession, error) {
+	var conn net.Conn
+	var err error
+	if stream, ok := m.stream.(WithDialPeer); ok {
+		conn, err = stream.DialPeer(id, address, timeout)
+	} else {
+		conn, err = m.stream.Dial(address, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Tell the peer where we listen, so it can open streams back to us on
+	// this connection.
+	local := m.Addr().String()
+	if len(local) > math.MaxUint16 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("local address too long")
+	}
+	preamble := append([]byte(muxMagic), 0, 0)
+	binary.BigEndian.PutUint16(preamble[len(muxMagic):], uint16(len(local)))
+	preamble = append(preamble, local...)
+	if timeout > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	if _, err := conn.Write(preamble); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetWriteDeadline(time.Time{})
+
+	session := newMuxSession(m, conn, bufio.NewReader(conn), true)
+	session.id = id
+	session.peer = address
+	if !m.addSession(session, true) {
+		session.close(errMuxClosed)
+		return nil, errMuxClosed
+	}
+	go session.recvLoop()
+	return session, nil
+}
+
+// acceptSessions accepts connections from the wrapped StreamLayer until the
+// layer is closed.
+func (m *muxStreamLayer) acceptSessions() {
+	for {
+		conn, err := m.stream.Accept()
+		if err != nil {
+			// Let the transport's listener report and back off
+			select {
+			case m.errCh <- err:
+				continue
+			case <-m.shutdownCh:
+				return
+			}
+		}
+		go m.handshake(conn)
+	}
+}
+
+// handshake reads the preamble of an accepted connection and starts a session
+// on it.
+func (m *muxStreamLayer) handshake(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(muxHandshakeTimeout))
+	r := bufio.NewReader(conn)
+	preamble := make([]byte, len(muxMagic)+2)
+	if _, err := io.ReadFull(r, preamble); err != nil || string(preamble[:len(muxMagic)]) != muxMagic {
+		m.logger.Error("failed to read multiplexed connection preamble", "remote-address", conn.RemoteAddr(), "error", err)
+		_ = conn.Close()
+		return
+	}
+	peer := make([]byte, binary.BigEndian.Uint16(preamble[len(muxMagic):]))
+	if _, err := io.ReadFull(r, peer); err != nil {
+		m.logger.Error("failed to read multiplexed connection preamble", "remote-address", conn.RemoteAddr(), "error", err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	session := newMuxSession(m, conn, r, false)
+	session.peer = ServerAddress(peer)
+	if !m.addSession(session, false) {
+		session.close(errMuxClosed)
+		return
+	}
+	go session.recvLoop()
+}
+
+// addSession tracks a new session, and reports false if the layer is closed.
+// Dialed sessions replace any other session to the same peer for new streams,
+// accepted ones are only used if there is none.
+func (m *muxStreamLayer) addSession(s *muxSession, replace bool) bool {
+	m.shutdownLock.Lock()
+	defer m.shutdownLock.Unlock()
+	if m.shutdown {
+		return false
+	}
+
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	m.sessions[s] = struct{}{}
+	if _, ok := m.peers[s.peer]; replace || !ok {
+		m.peers[s.peer] = s
+	}
+	return true
+}
+
+// removeSession stops tracking a closed session.
+func (m *muxStreamLayer) removeSession(s *muxSession) {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	delete(m.sessions, s)
+	if m.peers[s.peer] == s {
+		delete(m.peers, s.peer)
+	}
+}
+
+// muxSession is one connection carrying multiplexed streams.
+type muxSession struct {
+	layer *muxStreamLayer
+	conn  net.Conn
+	r     *bufio.Reader
+
+	// client is set on the dialing side, which opens odd numbered streams.
+	// The accepting side opens even numbered ones.
+	client bool
+	id     ServerID
+	peer   ServerAddress
+
+	w         *bufio.Writer
+	writeLock sync.Mutex
+
+	streams     map[uint32]*muxStream
+	nextID      uint32
+	closed      bool
+	closeErr    error
+	streamsLock sync.Mutex
+	shutdownCh  chan struct{}
+}
+
+func newMuxSession(layer *muxStreamLayer, conn net.Conn, r *bufio.Reader, client bool) *muxSession {
+	s := &muxSession{
+		layer:      layer,
+		conn:       conn,
+		r:          r,
+		client:     client,
+		w:          bufio.NewWriterSize(conn, muxHeaderSize+muxMaxFrame),
+		streams:    make(map[uint32]*muxStream),
+		nextID:     2,
+		shutdownCh: make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	return s
+}
+
+// openStream opens a new stream to the peer.
+func (s *muxSession) openStream() (*muxStream, error) {
+	s.streamsLock.Lock()
+	if s.closed {
+		s.streamsLock.Unlock()
+		return nil, errMuxClosed
+	}
+	if s.nextID > math.MaxUint32-2 {
+		// Out of stream IDs, a new session is dialed on the next attempt
+		s.streamsLock.Unlock()
+		s.close(errMuxClosed)
+		return nil, errMuxClosed
+	}
+	stream := newMuxStream(s, s.nextID)
+	s.streams[stream.id] = stream
+	s.nextID += 2
+	s.streamsLock.Unlock()
+
+	if err := s.writeFrame(muxFrameOpen, stream.id, 0, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// writeFrame sends a single frame to the peer.
+func (s *muxSession) writeFrame(typ uint8, id uint32, length uint32, data []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	select {
+	case <-s.shutdownCh:
+		return s.err()
+	default:
+	}
+
+	var hdr [muxHeaderSize]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint32(hdr[5:9], length)
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	_, _ = s.w.Write(hdr[:])
+	_, _ = s.w.Write(data)
+	if err := s.w.Flush(); err != nil {
+		s.close(err)
+		return err
+	}
+	return nil
+}
+
+// recvLoop reads frames from the peer until the connection fails.
+func (s *muxSession) recvLoop() {
+	var hdr [muxHeaderSize]byte
+	buf := make([]byte, muxMaxFrame)
+	for {
+		if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+			s.close(err)
+			return
+		}
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		length := binary.BigEndian.Uint32(hdr[5:9])
+
+		var err error
+		switch typ {
+		case muxFrameOpen:
+			err = s.acceptStream(id)
+		case muxFrameData:
+			if length > muxMaxFrame {
+				err = fmt.Errorf("frame of %d bytes exceeds maximum", length)
+				break
+			}
+			if _, err = io.ReadFull(s.r, buf[:length]); err != nil {
+				break
+			}
+			if stream := s.getStream(id); stream != nil {
+				err = stream.receive(buf[:length])
+			}
+		case muxFrameWindow:
+			if stream := s.getStream(id); stream != nil {
+				stream.grant(length)
+			}
+		case muxFrameClose:
+			if stream := s.getStream(id); stream != nil {
+				s.removeStream(id)
+				stream.remoteClose()
+			}
+		default:
+			err = fmt.Errorf("unknown frame type %d", typ)
+		}
+		if err != nil {
+			s.layer.logger.Error("failed to handle multiplexed frame", "remote-address", s.conn.RemoteAddr(), "error", err)
+			s.close(err)
+			return
+		}
+	}
+}
+
+// acceptStream registers a stream the peer opened and hands it to the
+// layer's Accept.
+func (s *muxSession) acceptStream(id uint32) error {
+	if (id%2 == 1) == s.client {
+		return fmt.Errorf("peer opened stream %d with our parity", id)
+	}
+
+	s.streamsLock.Lock()
+	if s.closed {
+		s.streamsLock.Unlock()
+		return s.closeErr
+	}
+	if _, ok := s.streams[id]; ok {
+		s.streamsLock.Unlock()
+		return fmt.Errorf("peer reopened stream %d", id)
+	}
+	stream := newMuxStream(s, id)
+	s.streams[id] = stream
+	s.streamsLock.Unlock()
+
+	select {
+	case s.layer.acceptCh <- stream:
+		return nil
+	case <-s.layer.shutdownCh:
+		return errMuxClosed
+	}
+}
+
+func (s *muxSession) getStream(id uint32) *muxStream {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) removeStream(id uint32) {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	delete(s.streams, id)
+}
+
+// err returns the error the session was closed with.
+func (s *muxSession) err() error {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	return s.closeErr
+}
+
+// close tears down the session and every stream on it.
+func (s *muxSession) close(err error) {
+	s.streamsLock.Lock()
+	if s.closed {
+		s.streamsLock.Unlock()
+		return
+	}
+	if err == nil || err == io.EOF {
+		err = errMuxClosed
+	}
+	s.closed = true
+	s.closeErr = err
+	streams := s.streams
+	s.streams = nil
+	close(s.shutdownCh)
+	s.streamsLock.Unlock()
+
+	_ = s.conn.Close()
+	for _, stream := range streams {
+		stream.notify()
+	}
+	s.layer.removeSession(s)
+}
+
+// muxStream is a net.Conn carried over a muxSession.
+type muxStream struct {
+	session *muxSession
+	id      uint32
+
+	lock sync.Mutex
+
+	// recvBuf holds data received but not yet read, and recvConsumed the
+	// bytes read since the peer was last granted more window.
+	recvBuf      bytes.Buffer
+	recvConsumed uint32
+
+	// sendWindow is how many bytes we may send before the peer grants more.
+	sendWindow uint32
+
+	localClosed   bool
+	remoteClosed  bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readCh  chan struct{}
+	writeCh chan struct{}
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		session:    session,
+		id:         id,
+		sendWindow: muxWindow,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+}
+
+// Read implements the net.Conn interface.
+func (s *muxStream) Read(b []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		if s.localClosed {
+			s.lock.Unlock()
+			return 0, net.ErrClosed
+		}
+		if s.recvBuf.Len() > 0 {
+			n, _ := s.recvBuf.Read(b)
+			s.recvConsumed += uint32(n)
+			var grant uint32
+			if s.recvConsumed >= muxWindow/2 && !s.remoteClosed {
+				grant = s.recvConsumed
+				s.recvConsumed = 0
+			}
+			s.lock.Unlock()
+
+			if grant > 0 {
+				_ = s.session.writeFrame(muxFrameWindow, s.id, grant, nil)
+			}
+			return n, nil
+		}
+		if err := s.checkClosed(io.EOF); err != nil {
+			s.lock.Unlock()
+			return 0, err
+		}
+		deadline := s.readDeadline
+		s.lock.Unlock()
+
+		if err := s.wait(s.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write implements the net.Conn interface.
+func (s *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		s.lock.Lock()
+		if err := s.checkClosed(errMuxStreamClosed); err != nil {
+			s.lock.Unlock()
+			return written, err
+		}
+		if s.sendWindow == 0 {
+			deadline := s.writeDeadline
+			s.lock.Unlock()
+			if err := s.wait(s.writeCh, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := s.sendWindow
+		if n > muxMaxFrame {
+			n = muxMaxFrame
+		}
+		if n > uint32(len(b)) {
+			n = uint32(len(b))
+		}
+		s.sendWindow -= n
+		s.lock.Unlock()
+
+		if err := s.session.writeFrame(muxFrameData, s.id, n, b[:n]); err != nil {
+			return written, err
+		}
+		written += int(n)
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// checkClosed returns an error if the stream can't be used, with remoteErr
+// returned if the peer closed it. It must be called with the lock held.
+func (s *muxStream) checkClosed(remoteErr error) error {
+	switch {
+	case s.localClosed:
+		return net.ErrClosed
+	case s.remoteClosed:
+		return remoteErr
+	}
+	select {
+	case <-s.session.shutdownCh:
+		return s.session.err()
+	default:
+		return nil
+	}
+}
+
+// wait blocks until ch is notified, the deadline passes or the session is
+// closed.
+func (s *muxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-s.session.shutdownCh:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// notify wakes up any blocked reader and writer.
+func (s *muxStream) notify() {
+	for _, ch := range []chan struct{}{s.readCh, s.writeCh} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// receive buffers data sent by the peer.
+func (s *muxStream) receive(data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.localClosed {
+		return nil
+	}
+	if s.recvBuf.Len()+len(data) > muxWindow {
+		return fmt.Errorf("peer exceeded the window of stream %d", s.id)
+	}
+	s.recvBuf.Write(data)
+	select {
+	case s.readCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// grant adds window sent by the peer.
+func (s *muxStream) grant(n uint32) {
+	s.lock.Lock()
+	s.sendWindow += n
+	s.lock.Unlock()
+	select {
+	case s.writeCh <- struct{}{}:
+	default:
+	}
+}
+
+// remoteClose marks the stream closed by the peer.
+func (s *muxStream) remoteClose() {
+	s.lock.Lock()
+	s.remoteClosed = true
+	s.lock.Unlock()
+	s.notify()
+}
+
+// Close implements the net.Conn interface.
+func (s *muxStream) Close() error {
+	s.lock.Lock()
+	if s.localClosed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	remoteClosed := s.remoteClosed
+	s.lock.Unlock()
+	s.notify()
+
+	s.session.removeStream(s.id)
+	if remoteClosed {
+		return nil
+	}
+	return s.session.writeFrame(muxFrameClose, s.id, 0, nil)
+}
+
+// LocalAddr implements the net.Conn interface.
+func (s *muxStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+// RemoteAddr implements the net.Conn interface.
+func (s *muxStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+// SetDeadline implements the net.Conn interface.
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	s.lock.Unlock()
+	s.notify()
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn interface.
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline = t
+	s.lock.Unlock()
+	s.notify()
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn interface.
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.writeDeadline = t
+	s.lock.Unlock()
+	s.notify()
+	return nil
+}
+
+// authorizeServerID implements the serverIDAuthorizer interface, deferring to
+// the connection the stream is carried over.
+func (s *muxStream) authorizeServerID(id ServerID) error {
+	if auth, ok := s.session.conn.(serverIDAuthorizer); ok {
+		return auth.authorizeServerID(id)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// makeMuxTransport returns a multiplexed transport. Sessions log from their
+// own goroutines, which can outlive the test, so it doesn't log to t.
+func makeMuxTransport(t *testing.T) (*NetworkTransport, *muxStreamLayer) {
+	t.Helper()
+	trans, err := NewTCPTransportWithConfig("localhost:0", nil, &NetworkTransportConfig{
+		MaxPool:   2,
+		Timeout:   time.Second,
+		Logger:    hclog.NewNullLogger(),
+		Multiplex: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = trans.Close() })
+	return trans, trans.stream.(*muxStreamLayer)
+}
+
+func (m *muxStreamLayer) numSessions() int {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	return len(m.sessions)
+}
+
+func TestNetworkTransport_Multiplex(t *testing.T) {
+	trans1, mux1 := makeMuxTransport(t)
+	trans2, mux2 := makeMuxTransport(t)
+	go respondVotes(trans1)
+	go respondVotes(trans2)
+
+	// Concurrent RPCs share a single connection.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var resp RequestVoteResponse
+			if err := trans2.RequestVote("id1", trans1.LocalAddr(), &RequestVoteRequest{Term: 10}, &resp); err != nil {
+				t.Errorf("err: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, mux1.numSessions())
+	require.Equal(t, 1, mux2.numSessions())
+
+	// RPCs in the other direction reuse it as well.
+	var resp RequestVoteResponse
+	require.NoError(t, trans1.RequestVote("id2", trans2.LocalAddr(), &RequestVoteRequest{Term: 10}, &resp))
+	require.True(t, resp.Granted)
+	require.Equal(t, 1, mux1.numSessions())
+	require.Equal(t, 1, mux2.numSessions())
+
+	// Deadlines apply to each stream.
+	conn, err := mux2.Dial(trans1.LocalAddr(), time.Second)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NoError(t, conn.Close())
+
+	// Closing a transport tears down the connection.
+	require.NoError(t, trans1.Close())
+	require.Eventually(t, func() bool { return mux2.numSessions() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestNetworkTransport_Multiplex_SnapshotDoesNotBlockHeartbeat(t *testing.T) {
+	trans1, _ := makeMuxTransport(t)
+	trans2, _ := makeMuxTransport(t)
+
+	trans1.SetHeartbeatHandler(func(rpc RPC) {
+		rpc.Respond(&AppendEntriesResponse{Success: true}, nil)
+	})
+
+	// Hold on to the snapshot without reading it until released.
+	release := make(chan struct{})
+	go func() {
+		rpc := <-trans1.Consumer()
+		<-release
+		n, err := io.Copy(io.Discard, rpc.Reader)
+		if err != nil || n != rpc.Command.(*InstallSnapshotRequest).Size {
+			t.Errorf("bad snapshot read: %d %v", n, err)
+		}
+		rpc.Respond(&InstallSnapshotResponse{Success: true}, nil)
+	}()
+
+	data := bytes.Repeat([]byte("x"), 4*muxWindow)
+	errCh := make(chan error, 1)
+	go func() {
+		args := InstallSnapshotRequest{Term: 10, LastLogIndex: 100, Size: int64(len(data))}
+		var resp InstallSnapshotResponse
+		errCh <- trans2.InstallSnapshot("id1", trans1.LocalAddr(), &args, &resp, bytes.NewReader(data))
+	}()
+
+	// Heartbeats get through while the snapshot stream is stalled.
+	for i := 0; i < 5; i++ {
+		args := AppendEntriesRequest{Term: 10, RPCHeader: RPCHeader{Addr: []byte("id2")}}
+		var resp AppendEntriesResponse
+		require.NoError(t, trans2.AppendEntries("id1", trans1.LocalAddr(), &args, &resp))
+		require.True(t, resp.Success)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("snapshot finished early: %v", err)
+	default:
+	}
+
+	close(release)
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
@@ -5,6 +5,7 @@ package raft
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -16,7 +17,6 @@ import (
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-metrics/compat"
-	"github.com/hashicorp/go-msgpack/v2/codec"
 )
 
 const (
@@ -25,6 +25,9 @@ const (
 	rpcInstallSnapshot
 	rpcTimeoutNow
 	rpcRequestPreVote
+	rpcReadIndex
+	rpcHeartbeatBatch
+	rpcCatchUp
 
 	// DefaultTimeoutScale is the default TimeoutScale in a NetworkTransport.
 	DefaultTimeoutScale = 256 * 1024 // 256KB
@@ -69,11 +72,12 @@ var (
 // be simple TCP, TLS, etc.
 //
 // This transport is very simple and lightweight. Each RPC request is
-// framed by sending a byte that indicates the message type, followed
-// by the MsgPack encoded request.
+// framed by sending a byte that indicates the message type and codec,
+// followed by the encoded request.
 //
 // The response is an error string followed by the response object,
-// both are encoded using MsgPack.
+// both are encoded using the codec of the request. MsgPack is used
+// unless the peer has advertised support for the configured Codec.
 //
 // InstallSnapshot is special, in that after the RPC request we stream
 // the entire state. That socket is not re-used as the connection state
@@ -109,7 +113,13 @@ type NetworkTransport struct {
 	timeout      time.Duration
 	TimeoutScale int
 
-	msgpackUseNewTimeFormat bool
+	msgpack Codec
+	codec   Codec
+
+	// peerCodecs records, by target address, whether the peer has
+	// advertised support for codec.
+	peerCodecs     map[ServerAddress]bool
+	peerCodecsLock sync.Mutex
 }
 
 // NetworkTransportConfig encapsulates configuration for the network transport layer.
@@ -167,6 +177,18 @@ type NetworkTransportConfig struct {
 	// go-msgpack v1.1.5 by default). Decoding is not affected, as all
 	// go-msgpack v2.1.0+ decoders know how to decode both formats.
 	MsgpackUseNewTimeFormat bool
+
+	// Codec, if set, is used instead of msgpack to talk to peers that also
+	// support it, which is negotiated through RPCHeader. BinaryCodec avoids
+	// the cost of msgpack reflection for AppendEntries.
+	Codec Codec
+
+	// Multiplex carries all RPCs to a peer as streams over one long-lived
+	// connection from Stream, instead of a connection each. Each stream has
+	// its own flow control, so heartbeats don't get stuck behind a large
+	// InstallSnapshot, and MaxPool only limits cheap idle streams. All
+	// servers in the cluster must enable it.
+	Multiplex bool
 }
 
 // ServerAddressProvider is a target address to which we invoke an RPC when establishing a connection
@@ -183,18 +205,45 @@ type StreamLayer interface {
 	Dial(address ServerAddress, timeout time.Duration) (net.Conn, error)
 }
 
+// WithDialPeer is an interface that a StreamLayer may provide to learn the
+// ServerID of the peer it dials, for example to verify the peer's identity.
+// When provided, the NetworkTransport uses it instead of Dial.
+type WithDialPeer interface {
+	DialPeer(id ServerID, address ServerAddress, timeout time.Duration) (net.Conn, error)
+}
+
+// serverIDAuthorizer is implemented by connections that authenticate the
+// peer, so the transport can check that every request it receives comes from
+// a ServerID the peer is allowed to speak for.
+type serverIDAuthorizer interface {
+	authorizeServerID(id ServerID) error
+}
+
 type netConn struct {
+	id     ServerID
 	target ServerAddress
 	conn   net.Conn
+	r      *bufio.Reader
 	w      *bufio.Writer
-	dec    *codec.Decoder
-	enc    *codec.Encoder
+	codec  Codec
+	dec    CodecDecoder
+	enc    CodecEncoder
 }
 
 func (n *netConn) Release() error {
 	return n.conn.Close()
 }
 
+// setCodec switches the codec used for the next RPC on the connection.
+func (n *netConn) setCodec(c Codec) {
+	if n.codec != nil && n.codec.ID() == c.ID() {
+		return
+	}
+	n.codec = c
+	n.dec = c.NewDecoder(n.r)
+	n.enc = c.NewEncoder(n.w)
+}
+
 type netPipeline struct {
 	conn  *netConn
 	trans *NetworkTransport
@@ -223,18 +272,30 @@ func NewNetworkTransportWithConfig(
 		// Default zero value
 		maxInFlight = DefaultMaxRPCsInFlight
 	}
+	stream := config.Stream
+	if config.Multiplex {
+		stream = newMuxStreamLayer(stream, config.Logger)
+	}
 	trans := &NetworkTransport{
-		connPool:                make(map[ServerAddress][]*netConn),
-		consumeCh:               make(chan RPC),
-		logger:                  config.Logger,
-		maxPool:                 config.MaxPool,
-		maxInFlight:             maxInFlight,
-		shutdownCh:              make(chan struct{}),
-		stream:                  config.Stream,
-		timeout:                 config.Timeout,
-		TimeoutScale:            DefaultTimeoutScale,
-		serverAddressProvider:   config.ServerAddressProvider,
-		msgpackUseNewTimeFormat: config.MsgpackUseNewTimeFormat,
+		connPool:              make(map[ServerAddress][]*netConn),
+		consumeCh:             make(chan RPC),
+		logger:                config.Logger,
+		maxPool:               config.MaxPool,
+		maxInFlight:           maxInFlight,
+		shutdownCh:            make(chan struct{}),
+		stream:                stream,
+		timeout:               config.Timeout,
+		TimeoutScale:          DefaultTimeoutScale,
+		serverAddressProvider: config.ServerAddressProvider,
+		msgpack:               msgpackCodec{useNewTimeFormat: config.MsgpackUseNewTimeFormat},
+		peerCodecs:            make(map[ServerAddress]bool),
+	}
+	if c := config.Codec; c != nil {
+		if id := c.ID(); id == msgpackCodecID || id > maxCodecID {
+			config.Logger.Error("ignoring codec with invalid id", "id", id)
+		} else {
+			trans.codec = c
+		}
 	}
 
 	// Create the connection context and then start our listener.
@@ -382,7 +443,7 @@ func (n *NetworkTransport) getPooledConn(target ServerAddress) *netConn {
 // getConnFromAddressProvider returns a connection from the server address provider if available, or defaults to a connection using the target server address
 func (n *NetworkTransport) getConnFromAddressProvider(id ServerID, target ServerAddress) (*netConn, error) {
 	address := n.getProviderAddressOrFallback(id, target)
-	return n.getConn(address)
+	return n.getConn(id, address)
 }
 
 func (n *NetworkTransport) getProviderAddressOrFallback(id ServerID, target ServerAddress) ServerAddress {
@@ -400,34 +461,80 @@ func (n *NetworkTransport) getProviderAddressOrFallback(id ServerID, target Serv
 }
 
 // getConn is used to get a connection from the pool.
-func (n *NetworkTransport) getConn(target ServerAddress) (*netConn, error) {
-	// Check for a pooled conn
+func (n *NetworkTransport) getConn(id ServerID, target ServerAddress) (*netConn, error) {
+	// Check for a pooled conn, which must have been dialed for the same
+	// server if the stream layer verifies identities
+	stream, dialPeer := n.stream.(WithDialPeer)
 	if conn := n.getPooledConn(target); conn != nil {
-		return conn, nil
+		if !dialPeer || conn.id == id {
+			return conn, nil
+		}
+		_ = conn.Release()
 	}
 
 	// Dial a new connection
-	conn, err := n.stream.Dial(target, n.timeout)
+	var conn net.Conn
+	var err error
+	if dialPeer {
+		conn, err = stream.DialPeer(id, target, n.timeout)
+	} else {
+		conn, err = n.stream.Dial(target, n.timeout)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// Wrap the conn
 	netConn := &netConn{
+		id:     id,
 		target: target,
 		conn:   conn,
-		dec:    codec.NewDecoder(bufio.NewReader(conn), &codec.MsgpackHandle{}),
+		r:      bufio.NewReader(conn),
 		w:      bufio.NewWriterSize(conn, connSendBufferSize),
 	}
-
-	mp := &codec.MsgpackHandle{}
-	mp.TimeNotBuiltin = !n.msgpackUseNewTimeFormat
-	netConn.enc = codec.NewEncoder(netConn.w, mp)
+	netConn.setCodec(n.peerCodec(target))
 
 	// Done
 	return netConn, nil
 }
 
+// Codecs implements the WithCodecs interface.
+func (n *NetworkTransport) Codecs() []byte {
+	if n.codec == nil {
+		return nil
+	}
+	return []byte{n.codec.ID()}
+}
+
+// peerCodec returns the codec to use for RPCs to the given target.
+func (n *NetworkTransport) peerCodec(target ServerAddress) Codec {
+	if n.codec == nil {
+		return n.msgpack
+	}
+	n.peerCodecsLock.Lock()
+	defer n.peerCodecsLock.Unlock()
+	if n.peerCodecs[target] {
+		return n.codec
+	}
+	return n.msgpack
+}
+
+// updatePeerCodec records whether the target supports our codec, based on
+// the RPC header of a response it sent. Passing nil, after a failed RPC,
+// falls back to msgpack until the peer advertises the codec again.
+func (n *NetworkTransport) updatePeerCodec(target ServerAddress, resp interface{}) {
+	if n.codec == nil {
+		return
+	}
+	supported := false
+	if resp, ok := resp.(WithRPCHeader); ok {
+		supported = bytes.IndexByte(resp.GetRPCHeader().Codecs, n.codec.ID()) >= 0
+	}
+	n.peerCodecsLock.Lock()
+	defer n.peerCodecsLock.Unlock()
+	n.peerCodecs[target] = supported
+}
+
 // returnConn returns a connection back to the pool.
 func (n *NetworkTransport) returnConn(conn *netConn) {
 	n.connPoolLock.Lock()
@@ -458,7 +565,8 @@ func (n *NetworkTransport) AppendEntriesPipeline(id ServerID, target ServerAddre
 		return nil, err
 	}
 
-	// Create the pipeline
+	// Create the pipeline, the codec is fixed for its lifetime
+	conn.setCodec(n.peerCodec(conn.target))
 	return newNetPipeline(n, conn, n.maxInFlight), nil
 }
 
@@ -491,14 +599,19 @@ func (n *NetworkTransport) genericRPC(id ServerID, target ServerAddress, rpcType
 	}
 
 	// Send the RPC
+	conn.setCodec(n.peerCodec(conn.target))
 	if err = sendRPC(conn, rpcType, args); err != nil {
+		n.updatePeerCodec(conn.target, nil)
 		return err
 	}
 
 	// Decode the response
 	canReturn, err := decodeResponse(conn, resp)
 	if canReturn {
+		n.updatePeerCodec(conn.target, resp)
 		n.returnConn(conn)
+	} else {
+		n.updatePeerCodec(conn.target, nil)
 	}
 	return err
 }
@@ -514,7 +627,7 @@ func (n *NetworkTransport) InstallSnapshot(id ServerID, target ServerAddress, ar
 
 	// Set a deadline, scaled by request size
 	if n.timeout > 0 {
-		timeout := n.timeout * time.Duration(args.Size/int64(n.TimeoutScale))
+		timeout := n.timeout * time.Duration(args.dataSize()/int64(n.TimeoutScale))
 		if timeout < n.timeout {
 			timeout = n.timeout
 		}
@@ -522,6 +635,7 @@ func (n *NetworkTransport) InstallSnapshot(id ServerID, target ServerAddress, ar
 	}
 
 	// Send the RPC
+	conn.setCodec(n.peerCodec(conn.target))
 	if err = sendRPC(conn, rpcInstallSnapshot, args); err != nil {
 		return err
 	}
@@ -557,6 +671,21 @@ func (n *NetworkTransport) TimeoutNow(id ServerID, target ServerAddress, args *T
 	return n.genericRPC(id, target, rpcTimeoutNow, args, resp)
 }
 
+// ReadIndex implements the WithReadIndex interface.
+func (n *NetworkTransport) ReadIndex(id ServerID, target ServerAddress, args *ReadIndexRequest, resp *ReadIndexResponse) error {
+	return n.genericRPC(id, target, rpcReadIndex, args, resp)
+}
+
+// CatchUp implements the WithCatchUp interface.
+func (n *NetworkTransport) CatchUp(id ServerID, target ServerAddress, args *CatchUpRequest, resp *CatchUpResponse) error {
+	return n.genericRPC(id, target, rpcCatchUp, args, resp)
+}
+
+// HeartbeatBatch implements the WithHeartbeatBatch interface.
+func (n *NetworkTransport) HeartbeatBatch(id ServerID, target ServerAddress, args *HeartbeatBatchRequest, resp *HeartbeatBatchResponse) error {
+	return n.genericRPC(id, target, rpcHeartbeatBatch, args, resp)
+}
+
 // listen is used to handling incoming connections.
 func (n *NetworkTransport) listen() {
 	const baseDelay = 5 * time.Millisecond
@@ -605,11 +734,16 @@ func (n *NetworkTransport) handleConn(connCtx context.Context, conn net.Conn) {
 	defer func() { _ = conn.Close() }()
 	r := bufio.NewReaderSize(conn, connReceiveBufferSize)
 	w := bufio.NewWriter(conn)
-	dec := codec.NewDecoder(r, &codec.MsgpackHandle{})
 
-	mp := &codec.MsgpackHandle{}
-	mp.TimeNotBuiltin = !n.msgpackUseNewTimeFormat
-	enc := codec.NewEncoder(w, mp)
+	// Peers pick the codec per request, so keep a pair for each one we
+	// support.
+	codecs := map[uint8]connCodec{
+		msgpackCodecID: {dec: n.msgpack.NewDecoder(r), enc: n.msgpack.NewEncoder(w)},
+	}
+	if n.codec != nil {
+		codecs[n.codec.ID()] = connCodec{dec: n.codec.NewDecoder(r), enc: n.codec.NewEncoder(w)}
+	}
+	auth, _ := conn.(serverIDAuthorizer)
 
 	for {
 		select {
@@ -619,7 +753,7 @@ func (n *NetworkTransport) handleConn(connCtx context.Context, conn net.Conn) {
 		default:
 		}
 
-		if err := n.handleCommand(r, dec, enc); err != nil {
+		if err := n.handleCommand(r, codecs, auth); err != nil {
 			if err != io.EOF {
 				n.logger.Error("failed to decode incoming command", "error", err)
 			}
@@ -632,15 +766,29 @@ func (n *NetworkTransport) handleConn(connCtx context.Context, conn net.Conn) {
 	}
 }
 
-// handleCommand is used to decode and dispatch a single command.
-func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, enc *codec.Encoder) error {
+// connCodec holds the decoder and encoder of an inbound connection for one
+// codec.
+type connCodec struct {
+	dec CodecDecoder
+	enc CodecEncoder
+}
+
+// handleCommand is used to decode and dispatch a single command. If auth is
+// set, commands from a ServerID the peer isn't authorized for are rejected.
+func (n *NetworkTransport) handleCommand(r *bufio.Reader, codecs map[uint8]connCodec, auth serverIDAuthorizer) error {
 	getTypeStart := time.Now()
 
-	// Get the rpc type
-	rpcType, err := r.ReadByte()
+	// Get the rpc type and the codec it was encoded with
+	b, err := r.ReadByte()
 	if err != nil {
 		return err
 	}
+	rpcType := b & rpcTypeMask
+	cc, ok := codecs[b>>rpcCodecShift]
+	if !ok {
+		return fmt.Errorf("unknown codec %d", b>>rpcCodecShift)
+	}
+	dec, enc := cc.dec, cc.enc
 
 	// measuring the time to get the first byte separately because the heartbeat conn will hang out here
 	// for a good while waiting for a heartbeat whereas the append entries/rpc conn should not.
@@ -701,7 +849,7 @@ func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, en
 			return err
 		}
 		rpc.Command = &req
-		rpc.Reader = io.LimitReader(r, req.Size)
+		rpc.Reader = io.LimitReader(r, req.dataSize())
 		labels = []metrics.Label{{Name: "rpcType", Value: "InstallSnapshot"}}
 	case rpcTimeoutNow:
 		var req TimeoutNowRequest
@@ -710,12 +858,48 @@ func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, en
 		}
 		rpc.Command = &req
 		labels = []metrics.Label{{Name: "rpcType", Value: "TimeoutNow"}}
+	case rpcReadIndex:
+		var req ReadIndexRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+		labels = []metrics.Label{{Name: "rpcType", Value: "ReadIndex"}}
+	case rpcCatchUp:
+		var req CatchUpRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+		labels = []metrics.Label{{Name: "rpcType", Value: "CatchUp"}}
+	case rpcHeartbeatBatch:
+		var req HeartbeatBatchRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+		isHeartbeat = true
+		labels = []metrics.Label{{Name: "rpcType", Value: "HeartbeatBatch"}}
 	default:
 		return fmt.Errorf("unknown rpc type %d", rpcType)
 	}
 
 	metrics.MeasureSinceWithLabels([]string{"raft", "net", "rpcDecode"}, decodeStart, labels)
 
+	// Check the sender is who the connection authenticated as
+	if cmd, ok := rpc.Command.(WithRPCHeader); ok && auth != nil {
+		if err := auth.authorizeServerID(ServerID(cmd.GetRPCHeader().ID)); err != nil {
+			return err
+		}
+		if batch, ok := cmd.(*HeartbeatBatchRequest); ok {
+			for _, hb := range batch.Heartbeats {
+				if err := auth.authorizeServerID(ServerID(hb.ID)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
 	processStart := time.Now()
 
 	// Check for heartbeat fast-path
@@ -788,8 +972,8 @@ func decodeResponse(conn *netConn, resp interface{}) (bool, error) {
 
 // sendRPC is used to encode and send the RPC.
 func sendRPC(conn *netConn, rpcType uint8, args interface{}) error {
-	// Write the request type
-	if err := conn.w.WriteByte(rpcType); err != nil {
+	// Write the request type and codec
+	if err := conn.w.WriteByte(conn.codec.ID()<<rpcCodecShift | rpcType); err != nil {
 		_ = conn.Release()
 		return err
 	}
@@ -200,6 +200,41 @@ func TestNetworkTransport_Heartbeat_FastPath(t *testing.T) {
 	}
 }
 
+func TestNetworkTransport_HeartbeatBatch(t *testing.T) {
+	trans1, err := NewTCPTransportWithLogger("localhost:0", nil, 2, time.Second, newTestLogger(t))
+	require.NoError(t, err)
+	defer func() { _ = trans1.Close() }()
+
+	args := HeartbeatBatchRequest{
+		RPCHeader: RPCHeader{ProtocolVersion: ProtocolVersionMax, Addr: []byte("cartman")},
+		Heartbeats: []*AppendEntriesRequest{
+			{RPCHeader: RPCHeader{Addr: []byte("cartman"), GroupID: []byte("a")}, Term: 10},
+			{RPCHeader: RPCHeader{Addr: []byte("cartman"), GroupID: []byte("b")}, Term: 11},
+		},
+	}
+	resp := HeartbeatBatchResponse{
+		Responses: []*AppendEntriesResponse{{Term: 10, Success: true}, {Term: 11}},
+		Errors:    []string{"", "failed"},
+	}
+
+	// Batches take the heartbeat fast path.
+	trans1.SetHeartbeatHandler(func(rpc RPC) {
+		req := rpc.Command.(*HeartbeatBatchRequest)
+		if !reflect.DeepEqual(req, &args) {
+			t.Errorf("command mismatch: %#v %#v", *req, args)
+		}
+		rpc.Respond(&resp, nil)
+	})
+
+	trans2, err := NewTCPTransportWithLogger("localhost:0", nil, 2, time.Second, newTestLogger(t))
+	require.NoError(t, err)
+	defer func() { _ = trans2.Close() }()
+
+	var out HeartbeatBatchResponse
+	require.NoError(t, trans2.HeartbeatBatch("id1", trans1.LocalAddr(), &args, &out))
+	require.Equal(t, resp, out)
+}
+
 func makeAppendRPC() AppendEntriesRequest {
 	return AppendEntriesRequest{
 		Term:         10,
@@ -536,6 +571,65 @@ func TestNetworkTransport_AppendEntriesPipeline_MaxRPCsInFlight(t *testing.T) {
 	}
 }
 
+func TestNetworkTransport_Codec(t *testing.T) {
+	for _, peerCodec := range []Codec{BinaryCodec{}, nil} {
+		// Transport 1 is consumer
+		config := &NetworkTransportConfig{MaxPool: 2, Timeout: time.Second, Logger: newTestLogger(t), Codec: peerCodec}
+		trans1, err := NewTCPTransportWithConfig("localhost:0", nil, config)
+		require.NoError(t, err)
+		defer func() { _ = trans1.Close() }()
+		rpcCh := trans1.Consumer()
+
+		args := makeAppendRPC()
+		args.Entries[0].Data = []byte("data")
+		resp := makeAppendRPCResponse()
+		resp.Codecs = trans1.Codecs()
+
+		// Listen for requests
+		go func() {
+			for {
+				select {
+				case rpc := <-rpcCh:
+					req := rpc.Command.(*AppendEntriesRequest)
+					if !reflect.DeepEqual(req, &args) {
+						t.Errorf("command mismatch: %#v %#v", *req, args)
+						return
+					}
+					rpc.Respond(&resp, nil)
+				case <-trans1.shutdownCh:
+					return
+				}
+			}
+		}()
+
+		// Transport 2 makes outbound requests
+		config = &NetworkTransportConfig{MaxPool: 2, Timeout: time.Second, Logger: newTestLogger(t), Codec: BinaryCodec{}}
+		trans2, err := NewTCPTransportWithConfig("localhost:0", nil, config)
+		require.NoError(t, err)
+		defer func() { _ = trans2.Close() }()
+
+		// The first request uses msgpack, and learns what the peer supports.
+		addr := trans1.LocalAddr()
+		require.Equal(t, msgpackCodecID, trans2.peerCodec(addr).ID())
+		var out AppendEntriesResponse
+		require.NoError(t, trans2.AppendEntries("id1", addr, &args, &out))
+		require.Equal(t, resp, out)
+
+		expected := msgpackCodecID
+		if peerCodec != nil {
+			expected = binaryCodecID
+		}
+		require.Equal(t, expected, trans2.peerCodec(addr).ID())
+
+		// The pooled connection switches to the negotiated codec.
+		out = AppendEntriesResponse{}
+		require.NoError(t, trans2.AppendEntries("id1", addr, &args, &out))
+		require.Equal(t, resp, out)
+		require.Len(t, trans2.connPool[addr], 1)
+		require.Equal(t, expected, trans2.connPool[addr][0].codec.ID())
+	}
+}
+
 func TestNetworkTransport_RequestVote(t *testing.T) {
 	for _, useAddrProvider := range []bool{true, false} {
 		// Transport 1 is consumer
@@ -597,6 +691,63 @@ func TestNetworkTransport_RequestVote(t *testing.T) {
 	}
 }
 
+func TestNetworkTransport_ReadIndex(t *testing.T) {
+	for _, useAddrProvider := range []bool{true, false} {
+		// Transport 1 is consumer
+		trans1, err := makeTransport(t, useAddrProvider, "localhost:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer func() { _ = trans1.Close() }()
+		rpcCh := trans1.Consumer()
+
+		// Make the RPC request
+		args := ReadIndexRequest{
+			RPCHeader: RPCHeader{Addr: []byte("kenny")},
+		}
+
+		resp := ReadIndexResponse{
+			Term:      7,
+			ReadIndex: 42,
+		}
+
+		// Listen for a request
+		go func() {
+			select {
+			case rpc := <-rpcCh:
+				// Verify the command
+				req := rpc.Command.(*ReadIndexRequest)
+				if !reflect.DeepEqual(req, &args) {
+					t.Errorf("command mismatch: %#v %#v", *req, args)
+					return
+				}
+
+				rpc.Respond(&resp, nil)
+
+			case <-time.After(200 * time.Millisecond):
+				t.Errorf("timeout")
+				return
+			}
+		}()
+
+		// Transport 2 makes outbound request
+		trans2, err := makeTransport(t, useAddrProvider, string(trans1.LocalAddr()))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer func() { _ = trans2.Close() }()
+		var out ReadIndexResponse
+		if err := trans2.ReadIndex("id1", trans1.LocalAddr(), &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Verify the response
+		if !reflect.DeepEqual(resp, out) {
+			t.Fatalf("command mismatch: %#v %#v", resp, out)
+		}
+	}
+}
+
 func TestNetworkTransport_InstallSnapshot(t *testing.T) {
 	for _, useAddrProvider := range []bool{true, false} {
 		// Transport 1 is consumer
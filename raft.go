@@ -6,8 +6,10 @@ package raft
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"strings"
 	"sync/atomic"
@@ -25,6 +27,13 @@ const (
 )
 
 var (
+	// ErrSnapshotChunkChecksum is returned when a chunk of a snapshot being
+	// installed doesn't match its checksum.
+	ErrSnapshotChunkChecksum = errors.New("snapshot chunk checksum mismatch")
+
+	// snapshotChunkTable is used to checksum the chunks of a snapshot.
+	snapshotChunkTable = crc32.MakeTable(crc32.Castagnoli)
+
 	keyCurrentTerm  = []byte("CurrentTerm")
 	keyLastVoteTerm = []byte("LastVoteTerm")
 	keyLastVoteCand = []byte("LastVoteCand")
@@ -34,11 +43,18 @@ var (
 // Raft instance. This structure is sent along with RPC requests and
 // responses.
 func (r *Raft) getRPCHeader() RPCHeader {
-	return RPCHeader{
+	header := RPCHeader{
 		ProtocolVersion: r.config().ProtocolVersion,
 		ID:              []byte(r.config().LocalID),
 		Addr:            r.trans.EncodePeer(r.config().LocalID, r.localAddr),
 	}
+	if trans, ok := r.trans.(WithCodecs); ok {
+		header.Codecs = trans.Codecs()
+	}
+	if trans, ok := r.trans.(WithGroupID); ok {
+		header.GroupID = trans.GroupID()
+	}
+	return header
 }
 
 // checkRPCHeader houses logic about whether this instance of Raft can process
@@ -95,6 +111,24 @@ type leaderState struct {
 	replState                    map[ServerID]*followerReplication
 	notify                       map[*verifyFuture]struct{}
 	stepDown                     chan struct{}
+
+	// pendingReadIndex holds ReadIndex requests that arrived before this
+	// leader committed an entry in its term. They are started once the
+	// commit index reaches commitment.startIndex.
+	pendingReadIndex []*verifyFuture
+
+	// jointChange is the future of a ChangeMembership call that entered
+	// joint consensus. It is responded to once the final configuration that
+	// leaves joint consensus is committed.
+	jointChange *configurationChangeFuture
+
+	// caughtUpSince records when each Nonvoter last came within
+	// NonvoterPromotionMaxLag of our log, for AutoPromoteNonvoters.
+	caughtUpSince map[ServerID]time.Time
+
+	// priorityTransferAt is when we last started handing leadership to a
+	// server with a higher priority.
+	priorityTransferAt time.Time
 }
 
 // setLeader is used to modify the current leader Address and ID of the cluster
@@ -132,6 +166,23 @@ func (r *Raft) requestConfigChange(req configurationChangeRequest, timeout time.
 	}
 }
 
+// requestConfigChangeContext is like requestConfigChange, but gives up when
+// ctx is done instead of after a timeout. The returned future does the same.
+func (r *Raft) requestConfigChangeContext(ctx context.Context, req configurationChangeRequest) IndexFuture {
+	future := &configurationChangeFuture{
+		req: req,
+	}
+	future.init()
+	select {
+	case <-ctx.Done():
+		return errorFuture{ctx.Err()}
+	case r.configurationChangeCh <- future:
+		return contextIndexFuture{future, ctx}
+	case <-r.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	}
+}
+
 // run the main thread that handles leadership and RPC requests.
 func (r *Raft) run() {
 	for {
@@ -140,6 +191,7 @@ func (r *Raft) run() {
 		case <-r.shutdownCh:
 			// Clear the leader to prevent forwarding
 			r.setLeader("", "")
+			r.cancelSnapshotTransfer()
 			return
 		default:
 		}
@@ -217,9 +269,10 @@ func (r *Raft) runFollower() {
 			hbTimeout := r.config().HeartbeatTimeout
 			heartbeatTimer = randomTimeout(hbTimeout)
 
-			// Check if we have had a successful contact
+			// Check if we have had a successful contact. Servers with a lower
+			// priority wait longer, to give the preferred ones a head start.
 			lastContact := r.LastContact()
-			if time.Since(lastContact) < hbTimeout {
+			if time.Since(lastContact) < hbTimeout+electionDelay(r.configurations.latest, r.localID, hbTimeout) {
 				continue
 			}
 
@@ -240,7 +293,12 @@ func (r *Raft) runFollower() {
 				}
 			} else {
 				metrics.IncrCounter([]string{"raft", "transition", "heartbeat_timeout"}, 1)
-				if hasVote(r.configurations.latest, r.localID) {
+				if isWitness(r.configurations.latest, r.localID) {
+					if !didWarn {
+						r.logger.Warn("heartbeat timeout reached, not triggering a leader election as a witness")
+						didWarn = true
+					}
+				} else if hasVote(r.configurations.latest, r.localID) {
 					r.logger.Warn("heartbeat timeout reached, starting election", "last-leader-addr", lastLeaderAddr, "last-leader-id", lastLeaderID)
 					r.setState(Candidate)
 					return
@@ -310,12 +368,12 @@ func (r *Raft) runCandidate() {
 	electionTimeout := r.config().ElectionTimeout
 	electionTimer := randomTimeout(electionTimeout)
 
-	// Tally the votes, need a simple majority
-	preVoteGrantedVotes := 0
-	preVoteRefusedVotes := 0
-	grantedVotes := 0
-	votesNeeded := r.quorumSize()
-	r.logger.Debug("calculated votes needed", "needed", votesNeeded, "term", term)
+	// Tally the votes, need a simple majority (of both the incoming and
+	// outgoing voters during a joint consensus change)
+	preVoteGranted := newVoteTally(r.configurations.latest)
+	preVoteRefused := newVoteTally(r.configurations.latest)
+	granted := newVoteTally(r.configurations.latest)
+	r.logger.Debug("calculated votes needed", "tally", granted, "term", term)
 
 	for r.getState() == Candidate {
 		r.mainThreadSaturation.sleeping()
@@ -327,7 +385,7 @@ func (r *Raft) runCandidate() {
 		case preVote := <-prevoteCh:
 			// This a pre-vote case it should trigger a "real" election if the pre-vote is won.
 			r.mainThreadSaturation.working()
-			r.logger.Debug("pre-vote received", "from", preVote.voterID, "term", preVote.Term, "tally", preVoteGrantedVotes)
+			r.logger.Debug("pre-vote received", "from", preVote.voterID, "term", preVote.Term, "tally", preVoteGranted)
 			// Check if the term is greater than ours, bail
 			if preVote.Term > term {
 				r.logger.Debug("pre-vote denied: found newer term, falling back to follower", "term", preVote.Term)
@@ -338,28 +396,28 @@ func (r *Raft) runCandidate() {
 
 			// Check if the preVote is granted
 			if preVote.Granted {
-				preVoteGrantedVotes++
-				r.logger.Debug("pre-vote granted", "from", preVote.voterID, "term", preVote.Term, "tally", preVoteGrantedVotes)
+				preVoteGranted.grant(preVote.voterID)
+				r.logger.Debug("pre-vote granted", "from", preVote.voterID, "term", preVote.Term, "tally", preVoteGranted)
 			} else {
-				preVoteRefusedVotes++
-				r.logger.Debug("pre-vote denied", "from", preVote.voterID, "term", preVote.Term, "tally", preVoteGrantedVotes)
+				preVoteRefused.grant(preVote.voterID)
+				r.logger.Debug("pre-vote denied", "from", preVote.voterID, "term", preVote.Term, "tally", preVoteGranted)
 			}
 
 			// Check if we've won the pre-vote and proceed to election if so
-			if preVoteGrantedVotes >= votesNeeded {
+			if preVoteGranted.quorum() {
 				r.logger.Info("pre-vote successful, starting election", "term", preVote.Term,
-					"tally", preVoteGrantedVotes, "refused", preVoteRefusedVotes, "votesNeeded", votesNeeded)
-				preVoteGrantedVotes = 0
-				preVoteRefusedVotes = 0
+					"tally", preVoteGranted, "refused", preVoteRefused)
+				preVoteGranted = newVoteTally(r.configurations.latest)
+				preVoteRefused = newVoteTally(r.configurations.latest)
 				electionTimer = randomTimeout(electionTimeout)
 				prevoteCh = nil
 				voteCh = r.electSelf()
 			}
 			// Check if we've lost the pre-vote and wait for the election to timeout so we can do another time of
 			// prevote.
-			if preVoteRefusedVotes >= votesNeeded {
+			if preVoteRefused.quorum() {
 				r.logger.Info("pre-vote campaign failed, waiting for election timeout", "term", preVote.Term,
-					"tally", preVoteGrantedVotes, "refused", preVoteRefusedVotes, "votesNeeded", votesNeeded)
+					"tally", preVoteGranted, "refused", preVoteRefused)
 			}
 		case vote := <-voteCh:
 			r.mainThreadSaturation.working()
@@ -373,13 +431,13 @@ func (r *Raft) runCandidate() {
 
 			// Check if the vote is granted
 			if vote.Granted {
-				grantedVotes++
-				r.logger.Debug("vote granted", "from", vote.voterID, "term", vote.Term, "tally", grantedVotes)
+				granted.grant(vote.voterID)
+				r.logger.Debug("vote granted", "from", vote.voterID, "term", vote.Term, "tally", granted)
 			}
 
 			// Check if we've become the leader
-			if grantedVotes >= votesNeeded {
-				r.logger.Info("election won", "term", vote.Term, "tally", grantedVotes)
+			if granted.quorum() {
+				r.logger.Info("election won", "term", vote.Term, "tally", granted)
 				r.setState(Leader)
 				r.setLeader(r.localAddr, r.localID)
 				return
@@ -462,6 +520,10 @@ func (r *Raft) setupLeaderState() {
 	r.leaderState.replState = make(map[ServerID]*followerReplication)
 	r.leaderState.notify = make(map[*verifyFuture]struct{})
 	r.leaderState.stepDown = make(chan struct{}, 1)
+	r.leaderState.pendingReadIndex = nil
+	r.leaderState.jointChange = nil
+	r.leaderState.caughtUpSince = make(map[ServerID]time.Time)
+	r.leaderState.priorityTransferAt = time.Time{}
 }
 
 // runLeader runs the main loop while in leader state. Do the setup here and drop into
@@ -524,6 +586,12 @@ func (r *Raft) runLeader() {
 		for future := range r.leaderState.notify {
 			future.respond(ErrLeadershipLost)
 		}
+		for _, future := range r.leaderState.pendingReadIndex {
+			future.respond(ErrLeadershipLost)
+		}
+		if r.leaderState.jointChange != nil {
+			r.leaderState.jointChange.respond(ErrLeadershipLost)
+		}
 
 		// Clear all the state
 		r.leaderState.commitCh = nil
@@ -532,6 +600,9 @@ func (r *Raft) runLeader() {
 		r.leaderState.replState = nil
 		r.leaderState.notify = nil
 		r.leaderState.stepDown = nil
+		r.leaderState.pendingReadIndex = nil
+		r.leaderState.jointChange = nil
+		r.leaderState.caughtUpSince = nil
 
 		// If we are stepping down for some reason, no known leader.
 		// We may have stepped down due to an RPC call, which would
@@ -581,11 +652,12 @@ func (r *Raft) runLeader() {
 // it'll instruct the replication routines to try to replicate to the current
 // index. This must only be called from the main thread.
 func (r *Raft) startStopReplication() {
-	inConfig := make(map[ServerID]bool, len(r.configurations.latest.Servers))
+	servers := configurationServers(r.configurations.latest)
+	inConfig := make(map[ServerID]bool, len(servers))
 	lastIdx := r.getLastIndex()
 
 	// Start replication goroutines that need starting
-	for _, server := range r.configurations.latest.Servers {
+	for _, server := range servers {
 		if server.ID == r.localID {
 			continue
 		}
@@ -609,6 +681,10 @@ func (r *Raft) startStopReplication() {
 				stepDown:            r.leaderState.stepDown,
 			}
 
+			if scheduler, ok := r.trans.(heartbeatScheduler); ok {
+				s.heartbeats = scheduler.scheduleHeartbeats(r.heartbeatTask(s))
+			}
+
 			r.leaderState.replState[server.ID] = s
 			r.goFunc(func() { r.replicate(s) })
 			asyncNotifyCh(s.triggerCh)
@@ -780,6 +856,10 @@ func (r *Raft) leaderLoop() {
 				doneCh <- fmt.Errorf("cannot find replication state for %v", id)
 				continue
 			}
+			if isWitness(r.configurations.latest, *id) {
+				doneCh <- fmt.Errorf("cannot transfer leadership to witness %v", *id)
+				continue
+			}
 			r.setLeadershipTransferInProgress(true)
 			go r.leadershipTransfer(*id, *address, state, stopCh, doneCh)
 
@@ -800,6 +880,11 @@ func (r *Raft) leaderLoop() {
 				}
 			}
 
+			// Once a joint configuration is committed, move on to the final
+			// configuration straight away. This also finishes changes left
+			// over by a previous leader.
+			r.leaveJointConsensus()
+
 			start := time.Now()
 			var groupReady []*list.Element
 			groupFutures := make(map[uint64]*logFuture)
@@ -830,6 +915,17 @@ func (r *Raft) leaderLoop() {
 				}
 			}
 
+			// Start any ReadIndex requests that were waiting for this
+			// leader to commit an entry in its term.
+			if len(r.leaderState.pendingReadIndex) > 0 && commitIndex >= r.leaderState.commitment.startIndex {
+				pending := r.leaderState.pendingReadIndex
+				r.leaderState.pendingReadIndex = nil
+				for _, v := range pending {
+					v.readIndex = commitIndex
+					r.verifyLeader(v)
+				}
+			}
+
 			// Measure the time to enqueue batch of logs for FSM to apply
 			metrics.MeasureSince([]string{"raft", "fsm", "enqueue"}, start)
 
@@ -848,10 +944,17 @@ func (r *Raft) leaderLoop() {
 
 		case v := <-r.verifyCh:
 			r.mainThreadSaturation.working()
-			if v.quorumSize == 0 {
+			if v.votes == nil {
 				// Just dispatched, start the verification
-				r.verifyLeader(v)
-			} else if v.votes < v.quorumSize {
+				switch {
+				case v.leaseRead:
+					r.leaseRead(v)
+				case v.readIndexReq:
+					r.startReadIndex(v)
+				default:
+					r.verifyLeader(v)
+				}
+			} else if !v.quorumReached() {
 				// Early return, means there must be a new leader
 				r.logger.Warn("new leader elected, stepping down")
 				r.setState(Follower)
@@ -947,9 +1050,15 @@ func (r *Raft) leaderLoop() {
 			// Renew the lease timer
 			lease = time.After(checkInterval)
 
+			if r.getState() == Leader {
+				r.leaveJointConsensus()
+				r.checkNonvoterPromotion()
+				r.checkLeaderPriority()
+			}
+
 		case <-r.leaderNotifyCh:
 			for _, repl := range r.leaderState.replState {
-				asyncNotifyCh(repl.notifyCh)
+				repl.heartbeatNow()
 			}
 
 		case <-r.followerNotifyCh:
@@ -965,11 +1074,11 @@ func (r *Raft) leaderLoop() {
 // Causes the followers to attempt an immediate heartbeat.
 func (r *Raft) verifyLeader(v *verifyFuture) {
 	// Current leader always votes for self
-	v.votes = 1
+	v.votes = newVoteTally(r.configurations.latest)
+	v.votes.grant(r.localID)
 
-	// Set the quorum size, hot-path for single node
-	v.quorumSize = r.quorumSize()
-	if v.quorumSize == 1 {
+	// Hot-path for single node
+	if v.votes.quorum() {
 		v.respond(nil)
 		return
 	}
@@ -983,8 +1092,24 @@ func (r *Raft) verifyLeader(v *verifyFuture) {
 		repl.notifyLock.Lock()
 		repl.notify[v] = struct{}{}
 		repl.notifyLock.Unlock()
-		asyncNotifyCh(repl.notifyCh)
+		repl.heartbeatNow()
+	}
+}
+
+// startReadIndex begins the ReadIndex protocol described in section 6.4 of
+// the Raft dissertation for the given request. The current commit index is
+// recorded as the read index and then leadership is confirmed with a round of
+// heartbeats. If this leader has not yet committed an entry in its term, its
+// commit index may be stale, so the request is held until it has. This must
+// only be called from the main thread.
+func (r *Raft) startReadIndex(v *verifyFuture) {
+	commitIndex := r.getCommitIndex()
+	if commitIndex < r.leaderState.commitment.startIndex {
+		r.leaderState.pendingReadIndex = append(r.leaderState.pendingReadIndex, v)
+		return
 	}
+	v.readIndex = commitIndex
+	r.verifyLeader(v)
 }
 
 // leadershipTransfer is doing the heavy lifting for the leadership transfer.
@@ -1035,9 +1160,6 @@ func (r *Raft) leadershipTransfer(id ServerID, address ServerAddress, repl *foll
 // as we may have lost connectivity. Returns the maximum duration without
 // contact. This must only be called from the main thread.
 func (r *Raft) checkLeaderLease() time.Duration {
-	// Track contacted nodes, we can always contact ourself
-	contacted := 0
-
 	// Store lease timeout for this one check invocation as we need to refer to it
 	// in the loop and would be confusing if it ever becomes reloadable and
 	// changes between iterations below.
@@ -1045,35 +1167,24 @@ func (r *Raft) checkLeaderLease() time.Duration {
 
 	// Check each follower
 	var maxDiff time.Duration
-	now := time.Now()
-	for _, server := range r.configurations.latest.Servers {
-		if server.Suffrage == Voter {
-			if server.ID == r.localID {
-				contacted++
-				continue
+	contacted := r.contactedQuorum(leaseTimeout, (*followerReplication).LastContact, func(id ServerID, diff time.Duration) {
+		if diff <= leaseTimeout {
+			if diff > maxDiff {
+				maxDiff = diff
 			}
-			f := r.leaderState.replState[server.ID]
-			diff := now.Sub(f.LastContact())
-			if diff <= leaseTimeout {
-				contacted++
-				if diff > maxDiff {
-					maxDiff = diff
-				}
+		} else {
+			// Log at least once at high value, then debug. Otherwise it gets very verbose.
+			if diff <= 3*leaseTimeout {
+				r.logger.Warn("failed to contact", "server-id", id, "time", diff)
 			} else {
-				// Log at least once at high value, then debug. Otherwise it gets very verbose.
-				if diff <= 3*leaseTimeout {
-					r.logger.Warn("failed to contact", "server-id", server.ID, "time", diff)
-				} else {
-					r.logger.Debug("failed to contact", "server-id", server.ID, "time", diff)
-				}
+				r.logger.Debug("failed to contact", "server-id", id, "time", diff)
 			}
-			metrics.AddSample([]string{"raft", "leader", "lastContact"}, float32(diff/time.Millisecond))
 		}
-	}
+		metrics.AddSample([]string{"raft", "leader", "lastContact"}, float32(diff/time.Millisecond))
+	})
 
 	// Verify we can contact a quorum
-	quorum := r.quorumSize()
-	if contacted < quorum {
+	if !contacted {
 		r.logger.Warn("failed to contact quorum of nodes, stepping down")
 		r.setState(Follower)
 		metrics.IncrCounter([]string{"raft", "transition", "leader_lease_timeout"}, 1)
@@ -1081,17 +1192,170 @@ func (r *Raft) checkLeaderLease() time.Duration {
 	return maxDiff
 }
 
-// quorumSize is used to return the quorum size. This must only be called on
-// the main thread.
-// TODO: revisit usage
-func (r *Raft) quorumSize() int {
-	voters := 0
-	for _, server := range r.configurations.latest.Servers {
-		if server.Suffrage == Voter {
-			voters++
+// contactedQuorum returns true if a quorum of voters, counting ourself, has
+// been in contact within the lease, going by the given time of contact of
+// each follower. If observe isn't nil, it's given how long it has been since
+// each other voter was in contact. This must only be called from the main
+// thread.
+func (r *Raft) contactedQuorum(lease time.Duration, contact func(*followerReplication) time.Time,
+	observe func(id ServerID, diff time.Duration),
+) bool {
+	// Track contacted nodes, we can always contact ourself
+	contacted := newVoteTally(r.configurations.latest)
+	now := time.Now()
+	for _, server := range configurationVoters(r.configurations.latest) {
+		if server.ID == r.localID {
+			contacted.grant(server.ID)
+			continue
+		}
+		f, ok := r.leaderState.replState[server.ID]
+		if !ok {
+			continue
+		}
+		diff := now.Sub(contact(f))
+		if diff <= lease {
+			contacted.grant(server.ID)
+		}
+		if observe != nil {
+			observe(server.ID, diff)
 		}
 	}
-	return voters/2 + 1
+	return contacted.quorum()
+}
+
+// checkNonvoterPromotion promotes a Nonvoter to Voter once its log has stayed
+// within NonvoterPromotionMaxLag of ours for NonvoterPromotionStabilizationTime.
+// Nothing is promoted while another configuration change is in progress, and
+// only one server is promoted per call. This must only be called from the main
+// thread.
+func (r *Raft) checkNonvoterPromotion() {
+	conf := r.config()
+	if !conf.AutoPromoteNonvoters {
+		return
+	}
+	latest := r.configurations.latest
+	if r.configurations.latestIndex != r.configurations.committedIndex || inJointConsensus(latest) {
+		return
+	}
+
+	now := time.Now()
+	lastIndex := r.getLastIndex()
+	caughtUpSince := make(map[ServerID]time.Time)
+	defer func() { r.leaderState.caughtUpSince = caughtUpSince }()
+	for _, server := range latest.Servers {
+		if server.Suffrage != Nonvoter {
+			continue
+		}
+		repl, ok := r.leaderState.replState[server.ID]
+		if !ok {
+			continue
+		}
+		matchIndex := atomic.LoadUint64(&repl.matchIndex)
+		if matchIndex+conf.NonvoterPromotionMaxLag < lastIndex ||
+			now.Sub(repl.LastContact()) > conf.LeaderLeaseTimeout {
+			continue
+		}
+		since, ok := r.leaderState.caughtUpSince[server.ID]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) < conf.NonvoterPromotionStabilizationTime {
+			caughtUpSince[server.ID] = since
+			continue
+		}
+
+		r.logger.Info("promoting caught up nonvoter", "server-id", server.ID, "match-index", matchIndex)
+		metrics.IncrCounter([]string{"raft", "leader", "nonvoterPromoted"}, 1)
+		future := &configurationChangeFuture{
+			req: configurationChangeRequest{
+				command:       AddVoter,
+				serverID:      server.ID,
+				serverAddress: server.Address,
+			},
+		}
+		future.init()
+		r.appendConfigurationEntry(future)
+		return
+	}
+}
+
+// checkLeaderPriority hands leadership to the voter with the highest Priority
+// above our own, once it has caught up with our log. Attempts are at least
+// ElectionTimeout apart, and none are made while a configuration change is in
+// progress. This must only be called from the main thread.
+func (r *Raft) checkLeaderPriority() {
+	if r.getLeadershipTransferInProgress() ||
+		time.Since(r.leaderState.priorityTransferAt) < r.config().ElectionTimeout {
+		return
+	}
+	latest := r.configurations.latest
+	if r.configurations.latestIndex != r.configurations.committedIndex || inJointConsensus(latest) {
+		return
+	}
+
+	priority := serverPriority(latest, r.localID)
+	lastIndex := r.getLastIndex()
+	var pick *Server
+	for _, server := range latest.Servers {
+		if server.ID == r.localID || server.Suffrage != Voter || server.Priority <= priority {
+			continue
+		}
+		if pick != nil && server.Priority <= pick.Priority {
+			continue
+		}
+		repl, ok := r.leaderState.replState[server.ID]
+		if !ok || atomic.LoadUint64(&repl.matchIndex) < lastIndex {
+			continue
+		}
+		tmp := server
+		pick = &tmp
+	}
+	if pick == nil {
+		return
+	}
+
+	r.logger.Info("transferring leadership to higher priority server", "id", pick.ID, "priority", pick.Priority)
+	r.leaderState.priorityTransferAt = time.Now()
+	r.initiateLeadershipTransfer(&pick.ID, &pick.Address)
+}
+
+// leaseRead answers a LeaseRead request from the leader's lease, without a
+// round of heartbeats. The commit index is returned as the read index if a
+// quorum of voters has been heard from within LeaderLeaseTimeout minus
+// LeaseReadMaxClockDrift. Until then, no other server can have been elected,
+// as followers don't grant votes while they still hear from a leader. This
+// must only be called from the main thread.
+func (r *Raft) leaseRead(v *verifyFuture) {
+	// A leadership transfer lets the target start an election while we still
+	// hold the lease, so fall back to ReadIndex until it is done.
+	if r.getLeadershipTransferInProgress() {
+		v.respond(ErrLeadershipTransferInProgress)
+		return
+	}
+
+	// As with ReadIndex, our commit index may be stale until we have
+	// committed an entry in our term.
+	commitIndex := r.getCommitIndex()
+	if commitIndex < r.leaderState.commitment.startIndex || !r.leaseValid() {
+		metrics.IncrCounter([]string{"raft", "lease_read", "expired"}, 1)
+		v.respond(ErrLeaseExpired)
+		return
+	}
+	v.readIndex = commitIndex
+	v.respond(nil)
+}
+
+// leaseValid returns true if a quorum of voters, counting ourself, has
+// acknowledged a request sent within LeaderLeaseTimeout minus
+// LeaseReadMaxClockDrift. The lease starts when the request was sent, not when
+// the response arrived, as the follower started its election timeout when it
+// got the request, which may have been as soon as it was sent. Unlike
+// checkLeaderLease it never steps down.
+// This must only be called from the main thread.
+func (r *Raft) leaseValid() bool {
+	conf := r.config()
+	lease := conf.LeaderLeaseTimeout - conf.LeaseReadMaxClockDrift
+	return r.contactedQuorum(lease, (*followerReplication).LastAckedSend, nil)
 }
 
 // restoreUserSnapshot is used to manually consume an external snapshot, such
@@ -1186,10 +1450,13 @@ func (r *Raft) restoreUserSnapshot(meta *SnapshotMeta, reader io.Reader) error {
 	r.setLastLog(lastIndex, term)
 	r.setLastApplied(lastIndex)
 	r.setLastSnapshot(lastIndex, term)
+	r.configurations.applied = r.configurations.latest
 
-	// Remove old logs if r.logs is a MonotonicLogStore. Log any errors and continue.
+	// Remove old logs if r.logs is a MonotonicLogStore. Log any errors and
+	// continue. The inflight logs were aborted above, so only the ones up to
+	// the commit index are archived.
 	if logs, ok := r.logs.(MonotonicLogStore); ok && logs.IsMonotonic() {
-		if err := r.removeOldLogs(); err != nil {
+		if err := r.removeOldLogs(r.getCommitIndex()); err != nil {
 			r.logger.Error("failed to remove old logs", "error", err)
 		}
 	}
@@ -1233,13 +1500,45 @@ func (r *Raft) appendConfigurationEntry(future *configurationChangeFuture) {
 		}
 	}
 
+	// The caller of ChangeMembership waits for the final configuration, so
+	// hold on to its future until joint consensus is left.
+	if future.req.command == ChangeMembership && inJointConsensus(configuration) {
+		r.leaderState.jointChange = future
+		future = &configurationChangeFuture{req: future.req}
+		future.init()
+		future.log = r.leaderState.jointChange.log
+	}
+
 	r.dispatchLogs([]*logFuture{&future.logFuture})
+	if r.getState() != Leader {
+		// The entry couldn't be stored, so the configuration is unchanged.
+		return
+	}
 	index := future.Index()
 	r.setLatestConfiguration(configuration, index)
 	r.leaderState.commitment.setConfiguration(configuration)
 	r.startStopReplication()
 }
 
+// leaveJointConsensus appends the configuration that ends a joint consensus
+// change, dropping the outgoing voters, once the joint configuration has been
+// committed. Besides when entries are committed, it's called on every lease
+// check, so leaving is retried if appending the entry failed. This must only
+// be called from the main thread.
+func (r *Raft) leaveJointConsensus() {
+	if !inJointConsensus(r.configurations.latest) || r.configurations.latestIndex > r.getCommitIndex() {
+		return
+	}
+	future := r.leaderState.jointChange
+	r.leaderState.jointChange = nil
+	if future == nil {
+		future = &configurationChangeFuture{}
+		future.init()
+	}
+	future.req = configurationChangeRequest{command: LeaveJoint}
+	r.appendConfigurationEntry(future)
+}
+
 // dispatchLog is called on the leader to push a log to disk, mark it
 // as inflight and begin replication of it.
 func (r *Raft) dispatchLogs(applyLogs []*logFuture) {
@@ -1319,20 +1618,39 @@ func (r *Raft) processLogs(index uint64, futures map[uint64]*logFuture) {
 
 	batch := make([]*commitTuple, 0, maxAppendEntries)
 
+	// A witness only stores the index and term of commands, so they're passed
+	// to the FSM thread as barriers to keep its index moving without
+	// applying anything. Whether an entry was stored as a witness depends on
+	// the configuration in effect at its index, not the latest one.
+	applied := r.configurations.applied
+
 	// Apply all the preceding logs
 	for idx := lastApplied + 1; idx <= index; idx++ {
 		var preparedLog *commitTuple
 		// Get the log, either from the future or from our log store
 		future, futureOk := futures[idx]
+		var entry *Log
 		if futureOk {
-			preparedLog = r.prepareLog(&future.log, future)
+			entry = &future.log
+			preparedLog = r.prepareLog(entry, future)
 		} else {
-			l := new(Log)
-			if err := r.logs.GetLog(idx, l); err != nil {
+			entry = new(Log)
+			if err := r.logs.GetLog(idx, entry); err != nil {
 				r.logger.Error("failed to get log", "index", idx, "error", err)
 				panic(err)
 			}
-			preparedLog = r.prepareLog(l, nil)
+			preparedLog = r.prepareLog(entry, nil)
+		}
+
+		if preparedLog != nil && preparedLog.log.Type == LogCommand && isWitness(applied, r.localID) {
+			preparedLog.log = &Log{
+				Index: preparedLog.log.Index,
+				Term:  preparedLog.log.Term,
+				Type:  LogBarrier,
+			}
+		}
+		if entry.Type == LogConfiguration {
+			applied = DecodeConfiguration(entry.Data)
 		}
 
 		switch {
@@ -1360,6 +1678,7 @@ func (r *Raft) processLogs(index uint64, futures map[uint64]*logFuture) {
 
 	// Update the lastApplied index and term
 	r.setLastApplied(index)
+	r.configurations.applied = applied
 }
 
 // processLog is invoked to process the application of a single committed log entry.
@@ -1422,6 +1741,10 @@ func (r *Raft) processRPC(rpc RPC) {
 		r.installSnapshot(rpc, cmd)
 	case *TimeoutNowRequest:
 		r.timeoutNow(rpc, cmd)
+	case *ReadIndexRequest:
+		r.readIndex(rpc, cmd)
+	case *CatchUpRequest:
+		r.catchUp(rpc, cmd)
 	default:
 		r.logger.Error("got unexpected command",
 			"command", hclog.Fmt("%#v", rpc.Command))
@@ -1490,6 +1813,8 @@ func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 	} else {
 		r.setLeader(r.trans.DecodePeer(a.Leader), ServerID(a.ID))
 	}
+	r.setLeaderContact()
+
 	// Verify the last log entry
 	if a.PrevLogEntry > 0 {
 		lastIdx, lastTerm := r.getLastEntry()
@@ -1677,6 +2002,11 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 			"leader-id", string(leaderID))
 		return
 	}
+	if !req.LeadershipTransfer && r.heardFromLeader(candidate) {
+		r.logger.Warn("rejecting vote request since we heard from a leader recently",
+			"from", candidate)
+		return
+	}
 
 	// Ignore an older term
 	if req.Term < r.getCurrentTerm() {
@@ -1790,6 +2120,11 @@ func (r *Raft) requestPreVote(rpc RPC, req *RequestPreVoteRequest) {
 			"leader-id", string(leaderID))
 		return
 	}
+	if r.heardFromLeader(candidate) {
+		r.logger.Warn("rejecting pre-vote request since we heard from a leader recently",
+			"from", candidate)
+		return
+	}
 
 	// Ignore an older term
 	if req.Term < r.getCurrentTerm() {
@@ -1870,58 +2205,83 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 		resp.Term = req.Term
 	}
 
-	// Save the current leader
-	if len(req.ID) > 0 {
-		r.setLeader(r.trans.DecodePeer(req.Addr), ServerID(req.ID))
-	} else {
-		r.setLeader(r.trans.DecodePeer(req.Leader), ServerID(req.ID))
+	// Save the current leader, unless a follower sent the snapshot for it
+	if !req.Relayed {
+		if len(req.ID) > 0 {
+			r.setLeader(r.trans.DecodePeer(req.Addr), ServerID(req.ID))
+		} else {
+			r.setLeader(r.trans.DecodePeer(req.Leader), ServerID(req.ID))
+		}
+		r.setLeaderContact()
+	}
+
+	// A follower may still be sending a snapshot for the leader after the
+	// leader gave up on it and sent its own, and the logs after that. Don't
+	// let it roll back the state we already have.
+	if req.Relayed {
+		lastSnapIndex, _ := r.getLastSnapshot()
+		if have := max(max(lastSnapIndex, r.getLastApplied()), r.getCommitIndex()); req.LastLogIndex <= have {
+			r.logger.Info("ignoring relayed snapshot that isn't newer than our state",
+				"index", req.LastLogIndex, "have", have)
+			return
+		}
 	}
 
-	// Create a new snapshot
+	var sink SnapshotSink
 	var reqConfiguration Configuration
 	var reqConfigurationIndex uint64
-	if req.SnapshotVersion > 0 {
-		reqConfiguration = DecodeConfiguration(req.Configuration)
-		reqConfigurationIndex = req.ConfigurationIndex
+	if req.Chunked {
+		transfer, err := r.receiveSnapshotChunk(rpc, req, resp)
+		if err != nil {
+			rpcErr = err
+			return
+		}
+		if transfer == nil {
+			// Wait for the rest of the snapshot
+			return
+		}
+		sink = transfer.sink
+		reqConfiguration = transfer.configuration
+		reqConfigurationIndex = transfer.configurationIndex
 	} else {
-		reqConfiguration, rpcErr = decodePeers(req.Peers, r.trans)
-		if rpcErr != nil {
-			r.logger.Error("failed to install snapshot", "error", rpcErr)
+		// Create a new snapshot
+		var err error
+		reqConfiguration, reqConfigurationIndex, err = r.snapshotConfiguration(req)
+		if err != nil {
+			r.logger.Error("failed to install snapshot", "error", err)
+			rpcErr = err
+			return
+		}
+		sink, err = r.createSnapshotToInstall(req, reqConfiguration, reqConfigurationIndex)
+		if err != nil {
+			r.logger.Error("failed to create snapshot to install", "error", err)
+			rpcErr = fmt.Errorf("failed to create snapshot: %v", err)
 			return
 		}
-		reqConfigurationIndex = req.LastLogIndex
-	}
-	version := getSnapshotVersion(r.protocolVersion)
-	sink, err := r.snapshots.Create(version, req.LastLogIndex, req.LastLogTerm,
-		reqConfiguration, reqConfigurationIndex, r.trans)
-	if err != nil {
-		r.logger.Error("failed to create snapshot to install", "error", err)
-		rpcErr = fmt.Errorf("failed to create snapshot: %v", err)
-		return
-	}
 
-	// Separately track the progress of streaming a snapshot over the network
-	// because this too can take a long time.
-	countingRPCReader := newCountingReader(rpc.Reader)
+		// Separately track the progress of streaming a snapshot over the network
+		// because this too can take a long time.
+		countingRPCReader := newCountingReader(rpc.Reader)
 
-	// Spill the remote snapshot to disk
-	transferMonitor := startSnapshotRestoreMonitor(r.logger, countingRPCReader, req.Size, true)
-	n, err := io.Copy(sink, countingRPCReader)
-	transferMonitor.StopAndWait()
-	if err != nil {
-		_ = sink.Cancel()
-		r.logger.Error("failed to copy snapshot", "error", err)
-		rpcErr = err
-		return
-	}
+		// Spill the remote snapshot to disk
+		transferMonitor := startSnapshotRestoreMonitor(r.logger, countingRPCReader, req.Size, true)
+		n, err := io.Copy(sink, countingRPCReader)
+		transferMonitor.StopAndWait()
+		if err != nil {
+			_ = sink.Cancel()
+			r.logger.Error("failed to copy snapshot", "error", err)
+			rpcErr = err
+			return
+		}
 
-	// Check that we received it all
-	if n != req.Size {
-		_ = sink.Cancel()
-		r.logger.Error("failed to receive whole snapshot",
-			"received", hclog.Fmt("%d / %d", n, req.Size))
-		rpcErr = fmt.Errorf("short read")
-		return
+		// Check that we received it all
+		if n != req.Size {
+			_ = sink.Cancel()
+			r.logger.Error("failed to receive whole snapshot",
+				"received", hclog.Fmt("%d / %d", n, req.Size))
+			rpcErr = fmt.Errorf("short read")
+			return
+		}
 	}
 
 	// Finalize the snapshot
@@ -1930,7 +2290,7 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 		rpcErr = err
 		return
 	}
-	r.logger.Info("copied to local snapshot", "bytes", n)
+	r.logger.Info("copied to local snapshot", "bytes", req.Size)
 
 	// Restore snapshot
 	future := &restoreFuture{ID: sink.ID()}
@@ -1959,12 +2319,19 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 	// Restore the peer set
 	r.setLatestConfiguration(reqConfiguration, reqConfigurationIndex)
 	r.setCommittedConfiguration(reqConfiguration, reqConfigurationIndex)
+	r.configurations.applied = reqConfiguration
 
 	// Clear old logs if r.logs is a MonotonicLogStore. Otherwise compact the
-	// logs. In both cases, log any errors and continue.
+	// logs. Every log up to the snapshot is committed, so all of those are
+	// archived first. If the logs can't be cleared, fail the install so that
+	// the leader sends the snapshot again, rather than leaving them behind
+	// the snapshot. Compaction errors are logged, and the logs are kept until
+	// the next compaction.
 	if mlogs, ok := r.logs.(MonotonicLogStore); ok && mlogs.IsMonotonic() {
-		if err := r.removeOldLogs(); err != nil {
+		if err := r.removeOldLogs(req.LastLogIndex); err != nil {
 			r.logger.Error("failed to reset logs", "error", err)
+			rpcErr = err
+			return
 		}
 	} else if err := r.compactLogs(req.LastLogIndex); err != nil {
 		r.logger.Error("failed to compact logs", "error", err)
@@ -1975,6 +2342,122 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 	r.setLastContact()
 }
 
+// snapshotConfiguration returns the configuration in a snapshot being
+// installed, and the index it was written at.
+func (r *Raft) snapshotConfiguration(req *InstallSnapshotRequest) (Configuration, uint64, error) {
+	if req.SnapshotVersion > 0 {
+		return DecodeConfiguration(req.Configuration), req.ConfigurationIndex, nil
+	}
+	configuration, err := decodePeers(req.Peers, r.trans)
+	if err != nil {
+		return Configuration{}, 0, err
+	}
+	return configuration, req.LastLogIndex, nil
+}
+
+// snapshotTransfer is a chunked snapshot being received from the leader.
+type snapshotTransfer struct {
+	id                 string
+	lastIndex          uint64
+	lastTerm           uint64
+	size               int64
+	configuration      Configuration
+	configurationIndex uint64
+	sink               SnapshotSink
+
+	// chunk and offset are the next chunk expected and where it starts.
+	chunk  uint64
+	offset int64
+}
+
+// receiveSnapshotChunk writes a chunk of a snapshot from the leader to the
+// snapshot being received. It returns the transfer once its last chunk is
+// written, and nil while more are expected. A chunk that fails to arrive
+// intact is not written, so the leader can send it again. This must only be
+// called from the main thread.
+func (r *Raft) receiveSnapshotChunk(rpc RPC, req *InstallSnapshotRequest, resp *InstallSnapshotResponse) (*snapshotTransfer, error) {
+	t := r.snapshotTransfer
+	if t != nil && (t.id != req.SnapshotID || t.lastIndex != req.LastLogIndex ||
+		t.lastTerm != req.LastLogTerm || t.size != req.Size) {
+		r.logger.Info("abandoning snapshot transfer", "id", t.id, "received", hclog.Fmt("%d / %d", t.offset, t.size))
+		r.cancelSnapshotTransfer()
+		t = nil
+	}
+	if t == nil {
+		if req.ChunkIndex != 0 || req.ChunkOffset != 0 {
+			// We don't have the start of this snapshot, so ask the leader
+			// to send it from the beginning.
+			return nil, nil
+		}
+		configuration, configurationIndex, err := r.snapshotConfiguration(req)
+		if err != nil {
+			r.logger.Error("failed to install snapshot", "error", err)
+			return nil, err
+		}
+		sink, err := r.createSnapshotToInstall(req, configuration, configurationIndex)
+		if err != nil {
+			r.logger.Error("failed to create snapshot to install", "error", err)
+			return nil, fmt.Errorf("failed to create snapshot: %v", err)
+		}
+		t = &snapshotTransfer{
+			id:                 req.SnapshotID,
+			lastIndex:          req.LastLogIndex,
+			lastTerm:           req.LastLogTerm,
+			size:               req.Size,
+			configuration:      configuration,
+			configurationIndex: configurationIndex,
+			sink:               sink,
+		}
+		r.snapshotTransfer = t
+		r.logger.Info("receiving snapshot", "id", t.id, "size", t.size)
+	}
+
+	resp.NextChunk, resp.NextOffset = t.chunk, t.offset
+	if req.ChunkIndex != t.chunk || req.ChunkOffset != t.offset {
+		r.logger.Info("resuming snapshot transfer", "id", t.id, "chunk", t.chunk, "offset", t.offset)
+		return nil, nil
+	}
+	if req.ChunkSize < 0 || req.ChunkSize > MaxSnapshotChunkSize || req.ChunkSize > t.size-t.offset {
+		r.cancelSnapshotTransfer()
+		return nil, fmt.Errorf("invalid snapshot chunk size %d", req.ChunkSize)
+	}
+
+	chunk := make([]byte, req.ChunkSize)
+	if _, err := io.ReadFull(rpc.Reader, chunk); err != nil {
+		r.logger.Warn("failed to receive snapshot chunk", "id", t.id, "chunk", t.chunk, "error", err)
+		return nil, err
+	}
+	if crc32.Checksum(chunk, snapshotChunkTable) != req.ChunkChecksum {
+		r.logger.Warn("received corrupt snapshot chunk", "id", t.id, "chunk", t.chunk)
+		return nil, ErrSnapshotChunkChecksum
+	}
+	if _, err := t.sink.Write(chunk); err != nil {
+		r.logger.Error("failed to write snapshot chunk", "id", t.id, "error", err)
+		r.cancelSnapshotTransfer()
+		return nil, err
+	}
+	t.chunk++
+	t.offset += req.ChunkSize
+	resp.NextChunk, resp.NextOffset = t.chunk, t.offset
+
+	if t.offset < t.size {
+		resp.Success = true
+		return nil, nil
+	}
+	r.snapshotTransfer = nil
+	return t, nil
+}
+
+// cancelSnapshotTransfer abandons the chunked snapshot being received, if
+// any. This must only be called from the main thread.
+func (r *Raft) cancelSnapshotTransfer() {
+	if r.snapshotTransfer == nil {
+		return
+	}
+	_ = r.snapshotTransfer.sink.Cancel()
+	r.snapshotTransfer = nil
+}
+
 // setLastContact is used to set the last contact time to now
 func (r *Raft) setLastContact() {
 	r.lastContactLock.Lock()
@@ -1982,6 +2465,32 @@ func (r *Raft) setLastContact() {
 	r.lastContactLock.Unlock()
 }
 
+// setLeaderContact records that we just heard from the leader of our current
+// term.
+func (r *Raft) setLeaderContact() {
+	r.lastContactLock.Lock()
+	r.leaderContact = time.Now()
+	r.lastContactLock.Unlock()
+}
+
+// heardFromLeader returns true if CheckQuorum is enabled and a leader other
+// than the given candidate has been heard from within the election timeout.
+// Vote requests are rejected while this holds, so that a server that rejoins
+// after a partition can't disrupt a healthy cluster.
+func (r *Raft) heardFromLeader(candidate ServerAddress) bool {
+	conf := r.config()
+	if !conf.CheckQuorum {
+		return false
+	}
+	if leaderAddr, _ := r.LeaderWithID(); leaderAddr == candidate {
+		return false
+	}
+	r.lastContactLock.RLock()
+	leaderContact := r.leaderContact
+	r.lastContactLock.RUnlock()
+	return time.Since(leaderContact) < conf.ElectionTimeout
+}
+
 type voteResult struct {
 	RequestVoteResponse
 	voterID ServerID
@@ -1998,7 +2507,8 @@ type preVoteResult struct {
 // vote for ourself). This must only be called from the main thread.
 func (r *Raft) electSelf() <-chan *voteResult {
 	// Create a response channel
-	respCh := make(chan *voteResult, len(r.configurations.latest.Servers))
+	voters := configurationVoters(r.configurations.latest)
+	respCh := make(chan *voteResult, len(voters))
 
 	// Increment the term
 	newTerm := r.getCurrentTerm() + 1
@@ -2035,30 +2545,28 @@ func (r *Raft) electSelf() <-chan *voteResult {
 	}
 
 	// For each peer, request a vote
-	for _, server := range r.configurations.latest.Servers {
-		if server.Suffrage == Voter {
-			if server.ID == r.localID {
-				r.logger.Debug("voting for self", "term", req.Term, "id", r.localID)
+	for _, server := range voters {
+		if server.ID == r.localID {
+			r.logger.Debug("voting for self", "term", req.Term, "id", r.localID)
 
-				// Persist a vote for ourselves
-				if err := r.persistVote(req.Term, req.Addr); err != nil {
-					r.logger.Error("failed to persist vote", "error", err)
-					return nil
+			// Persist a vote for ourselves
+			if err := r.persistVote(req.Term, req.Addr); err != nil {
+				r.logger.Error("failed to persist vote", "error", err)
+				return nil
 
-				}
-				// Include our own vote
-				respCh <- &voteResult{
-					RequestVoteResponse: RequestVoteResponse{
-						RPCHeader: r.getRPCHeader(),
-						Term:      req.Term,
-						Granted:   true,
-					},
-					voterID: r.localID,
-				}
-			} else {
-				r.logger.Debug("asking for vote", "term", req.Term, "from", server.ID, "address", server.Address)
-				askPeer(server)
 			}
+			// Include our own vote
+			respCh <- &voteResult{
+				RequestVoteResponse: RequestVoteResponse{
+					RPCHeader: r.getRPCHeader(),
+					Term:      req.Term,
+					Granted:   true,
+				},
+				voterID: r.localID,
+			}
+		} else {
+			r.logger.Debug("asking for vote", "term", req.Term, "from", server.ID, "address", server.Address)
+			askPeer(server)
 		}
 	}
 
@@ -2080,7 +2588,8 @@ func (r *Raft) preElectSelf() <-chan *preVoteResult {
 	}
 
 	// Create a response channel
-	respCh := make(chan *preVoteResult, len(r.configurations.latest.Servers))
+	voters := configurationVoters(r.configurations.latest)
+	respCh := make(chan *preVoteResult, len(voters))
 
 	// Propose the next term without actually changing our state
 	newTerm := r.getCurrentTerm() + 1
@@ -2125,24 +2634,22 @@ func (r *Raft) preElectSelf() <-chan *preVoteResult {
 	}
 
 	// For each peer, request a vote
-	for _, server := range r.configurations.latest.Servers {
-		if server.Suffrage == Voter {
-			if server.ID == r.localID {
-				r.logger.Debug("pre-voting for self", "term", req.Term, "id", r.localID)
-
-				// cast a pre-vote for our self
-				respCh <- &preVoteResult{
-					RequestPreVoteResponse: RequestPreVoteResponse{
-						RPCHeader: r.getRPCHeader(),
-						Term:      req.Term,
-						Granted:   true,
-					},
-					voterID: r.localID,
-				}
-			} else {
-				r.logger.Debug("asking for pre-vote", "term", req.Term, "from", server.ID, "address", server.Address)
-				askPeer(server)
+	for _, server := range voters {
+		if server.ID == r.localID {
+			r.logger.Debug("pre-voting for self", "term", req.Term, "id", r.localID)
+
+			// cast a pre-vote for our self
+			respCh <- &preVoteResult{
+				RequestPreVoteResponse: RequestPreVoteResponse{
+					RPCHeader: r.getRPCHeader(),
+					Term:      req.Term,
+					Granted:   true,
+				},
+				voterID: r.localID,
 			}
+		} else {
+			r.logger.Debug("asking for pre-vote", "term", req.Term, "from", server.ID, "address", server.Address)
+			askPeer(server)
 		}
 	}
 
@@ -2181,7 +2688,45 @@ func (r *Raft) setState(state RaftState) {
 	}
 }
 
-// pickServer returns the follower that is most up to date and participating in quorum.
+// setLastApplied is used to update the last applied index and wake anything
+// waiting for it in waitForApplied.
+func (r *Raft) setLastApplied(index uint64) {
+	r.raftState.setLastApplied(index)
+	r.appliedLock.Lock()
+	if r.appliedCh != nil {
+		close(r.appliedCh)
+		r.appliedCh = nil
+	}
+	r.appliedLock.Unlock()
+}
+
+// waitForApplied blocks until the last applied index reaches the given index,
+// ctx is done, or Raft shuts down.
+func (r *Raft) waitForApplied(ctx context.Context, index uint64) error {
+	for {
+		r.appliedLock.Lock()
+		if r.getLastApplied() >= index {
+			r.appliedLock.Unlock()
+			return nil
+		}
+		if r.appliedCh == nil {
+			r.appliedCh = make(chan struct{})
+		}
+		ch := r.appliedCh
+		r.appliedLock.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.shutdownCh:
+			return ErrRaftShutdown
+		}
+	}
+}
+
+// pickServer returns the follower with the highest priority that is participating
+// in quorum, and the most up to date among those.
 // Because it accesses leaderstate, it should only be called from the leaderloop.
 func (r *Raft) pickServer() *Server {
 	var pick *Server
@@ -2195,7 +2740,8 @@ func (r *Raft) pickServer() *Server {
 			continue
 		}
 		nextIdx := atomic.LoadUint64(&state.nextIndex)
-		if nextIdx > current {
+		if pick == nil || server.Priority > pick.Priority ||
+			(server.Priority == pick.Priority && nextIdx > current) {
 			current = nextIdx
 			tmp := server
 			pick = &tmp
@@ -2230,12 +2776,44 @@ func (r *Raft) initiateLeadershipTransfer(id *ServerID, address *ServerAddress)
 
 // timeoutNow is what happens when a server receives a TimeoutNowRequest.
 func (r *Raft) timeoutNow(rpc RPC, req *TimeoutNowRequest) {
+	if isWitness(r.configurations.latest, r.localID) {
+		rpc.Respond(nil, fmt.Errorf("witness cannot take over leadership"))
+		return
+	}
 	r.setLeader("", "")
 	r.setState(Candidate)
 	r.candidateFromLeadershipTransfer.Store(true)
 	rpc.Respond(&TimeoutNowResponse{}, nil)
 }
 
+// readIndex is what happens when a server receives a ReadIndexRequest. Only
+// the leader can answer it. The request goes through the same path as
+// ReadIndex, but the response is sent from a separate goroutine so the main
+// thread is not blocked while leadership is confirmed.
+func (r *Raft) readIndex(rpc RPC, req *ReadIndexRequest) {
+	if r.getState() != Leader {
+		rpc.Respond(nil, ErrNotLeader)
+		return
+	}
+	v := &verifyFuture{readIndexReq: true}
+	v.ShutdownCh = r.shutdownCh
+	v.init()
+	r.startReadIndex(v)
+
+	term := r.getCurrentTerm()
+	r.goFunc(func() {
+		if err := v.Error(); err != nil {
+			rpc.Respond(nil, err)
+			return
+		}
+		rpc.Respond(&ReadIndexResponse{
+			RPCHeader: r.getRPCHeader(),
+			Term:      term,
+			ReadIndex: v.readIndex,
+		}, nil)
+	})
+}
+
 // setLatestConfiguration stores the latest configuration and updates a copy of it.
 func (r *Raft) setLatestConfiguration(c Configuration, i uint64) {
 	r.configurations.latest = c
@@ -5,9 +5,15 @@ package raft
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -18,6 +24,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-msgpack/v2/codec"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -841,6 +848,344 @@ func TestRaft_RemoveLeader_NoShutdown(t *testing.T) {
 	c.EnsureSame(t)
 }
 
+func TestRaft_ChangeMembership_ReplaceVoters(t *testing.T) {
+	// Make a cluster, and three servers to replace it with
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	c1 := MakeClusterNoBootstrap(3, t, nil)
+	c.Merge(c1)
+	c.FullyConnect()
+
+	leader := c.Leader()
+	var changes []ConfigurationChange
+	for _, r := range c1.rafts {
+		changes = append(changes, ConfigurationChange{Command: AddVoter, ID: r.localID, Address: r.localAddr})
+	}
+	for _, r := range c.rafts[:3] {
+		changes = append(changes, ConfigurationChange{Command: RemoveServer, ID: r.localID})
+	}
+
+	// The future only completes once joint consensus has been left
+	future := leader.ChangeMembership(changes, 0, 0)
+	require.NoError(t, future.Error())
+
+	configuration := c.getConfiguration(leader)
+	require.False(t, inJointConsensus(configuration))
+	require.Len(t, configuration.Servers, 3)
+	for _, r := range c1.rafts {
+		require.True(t, hasVote(configuration, r.localID))
+	}
+
+	// One of the new servers should take over
+	time.Sleep(c.propagateTimeout)
+	newLeader := c1.Leader()
+	require.NoError(t, newLeader.Apply([]byte("test"), 0).Error())
+	require.Equal(t, Shutdown, leader.State())
+}
+
+func TestRaft_ChangeMembership_LeaderLost(t *testing.T) {
+	// Make a cluster
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	c1 := MakeClusterNoBootstrap(1, t, nil)
+	c.Merge(c1)
+	c.FullyConnect()
+
+	// Swap a follower for the new server. With the new server and the
+	// remaining follower cut off, the old voters still have a majority
+	// but the new ones don't, so the joint configuration can't commit.
+	leader := c.Leader()
+	newServer := c.rafts[3]
+	var followers []*Raft
+	for _, r := range c.rafts[:3] {
+		if r != leader {
+			followers = append(followers, r)
+		}
+	}
+	c.Disconnect(newServer.localAddr)
+	c.Disconnect(followers[1].localAddr)
+
+	future := leader.ChangeMembership([]ConfigurationChange{
+		{Command: AddVoter, ID: newServer.localID, Address: newServer.localAddr},
+		{Command: RemoveServer, ID: followers[0].localID},
+	}, 0, 0)
+
+	// The leader can't hear from a majority of the new voters, so it
+	// should step down
+	require.Equal(t, ErrLeadershipLost, future.Error())
+
+	// Once the cluster heals, whichever leader is elected finishes the
+	// change
+	c.FullyConnect()
+	limit := time.Now().Add(c.longstopTimeout)
+	var configuration Configuration
+	for time.Now().Before(limit) {
+		if l := c.Leader(); l != nil {
+			configuration = c.getConfiguration(l)
+			if !inJointConsensus(configuration) && hasVote(configuration, newServer.localID) {
+				break
+			}
+		}
+		time.Sleep(c.conf.CommitTimeout)
+	}
+	require.False(t, inJointConsensus(configuration))
+	require.True(t, hasVote(configuration, newServer.localID))
+	require.False(t, hasVote(configuration, followers[0].localID))
+}
+
+// leaveJointFailingStore fails to store the first configuration that leaves
+// joint consensus once armed.
+type leaveJointFailingStore struct {
+	LogStore
+	armed atomic.Bool
+}
+
+func (s *leaveJointFailingStore) StoreLogs(logs []*Log) error {
+	for _, log := range logs {
+		if log.Type == LogConfiguration && !inJointConsensus(DecodeConfiguration(log.Data)) &&
+			s.armed.CompareAndSwap(true, false) {
+			return errors.New("disk full")
+		}
+	}
+	return s.LogStore.StoreLogs(logs)
+}
+
+func TestRaft_ChangeMembership_LeaveJointRetried(t *testing.T) {
+	conf := inmemConfig(t)
+	start := func(id ServerID, logs LogStore) (*Raft, *InmemTransport) {
+		conf := *conf
+		conf.LocalID = id
+		conf.Logger = newTestLoggerWithPrefix(t, string(id))
+		store := NewInmemStore()
+		if logs == nil {
+			logs = store
+		}
+		_, trans := NewInmemTransport(ServerAddress(id))
+		r, err := NewRaft(&conf, &MockFSM{}, logs, store, NewInmemSnapshotStore(), trans)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Shutdown().Error() })
+		return r, trans
+	}
+	logs := &leaveJointFailingStore{LogStore: NewInmemStore()}
+	r1, trans1 := start("server1", logs)
+	r2, trans2 := start("server2", nil)
+	trans1.Connect(trans2.LocalAddr(), trans2)
+	trans2.Connect(trans1.LocalAddr(), trans1)
+	require.NoError(t, r1.BootstrapCluster(Configuration{Servers: []Server{
+		{Suffrage: Voter, ID: "server1", Address: "server1"},
+	}}).Error())
+	require.Eventually(t, func() bool { return r1.State() == Leader }, 5*time.Second, 10*time.Millisecond)
+
+	// Storing the entry that leaves joint consensus fails, so the leader
+	// steps down. Whichever server is elected next must still leave it.
+	logs.armed.Store(true)
+	future := r1.ChangeMembership([]ConfigurationChange{
+		{Command: AddVoter, ID: "server2", Address: "server2"},
+	}, 0, 0)
+	require.Error(t, future.Error())
+	require.Eventually(t, func() bool {
+		for _, r := range []*Raft{r1, r2} {
+			configuration := r.getLatestConfiguration()
+			if inJointConsensus(configuration) || !hasVote(configuration, "server2") {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestRaft_UpdateLastAppended_NoEntries(t *testing.T) {
+	// A successful request without entries still confirms the follower's
+	// log up to the previous entry.
+	s := &followerReplication{
+		peer:       Server{ID: "follower", Suffrage: Nonvoter},
+		commitment: newCommitment(make(chan struct{}, 1), Configuration{}, 1),
+		notify:     make(map[*verifyFuture]struct{}),
+	}
+	updateLastAppended(s, &AppendEntriesRequest{PrevLogEntry: 10})
+	require.Equal(t, uint64(10), atomic.LoadUint64(&s.matchIndex))
+
+	// It never moves back.
+	updateLastAppended(s, &AppendEntriesRequest{PrevLogEntry: 5})
+	require.Equal(t, uint64(10), atomic.LoadUint64(&s.matchIndex))
+	updateLastAppended(s, &AppendEntriesRequest{PrevLogEntry: 10, Entries: []*Log{{Index: 11}}})
+	require.Equal(t, uint64(11), atomic.LoadUint64(&s.matchIndex))
+}
+
+func TestRaft_AutoPromoteNonvoters(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.AutoPromoteNonvoters = true
+	conf.NonvoterPromotionStabilizationTime = 200 * time.Millisecond
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	c1 := MakeClusterNoBootstrap(1, t, conf)
+	c.Merge(c1)
+	c.FullyConnect()
+
+	leader := c.Leader()
+	nonvoter := c1.rafts[0]
+	start := time.Now()
+	require.NoError(t, leader.AddNonvoter(nonvoter.localID, nonvoter.localAddr, 0, 0).Error())
+	require.False(t, hasVote(c.getConfiguration(leader), nonvoter.localID))
+
+	// The leader should promote the server once it has kept up for the
+	// stabilization time
+	limit := time.Now().Add(c.longstopTimeout)
+	for time.Now().Before(limit) && !hasVote(c.getConfiguration(leader), nonvoter.localID) {
+		time.Sleep(c.conf.CommitTimeout)
+	}
+	require.True(t, hasVote(c.getConfiguration(leader), nonvoter.localID))
+	require.GreaterOrEqual(t, time.Since(start), conf.NonvoterPromotionStabilizationTime)
+}
+
+func TestRaft_AutoPromoteNonvoters_Lagging(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.AutoPromoteNonvoters = true
+	conf.NonvoterPromotionStabilizationTime = 100 * time.Millisecond
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	c1 := MakeClusterNoBootstrap(1, t, conf)
+	c.Merge(c1)
+	c.FullyConnect()
+
+	// A server that can't be reached never catches up, so it stays a
+	// Nonvoter
+	leader := c.Leader()
+	nonvoter := c1.rafts[0]
+	c.Disconnect(nonvoter.localAddr)
+	require.NoError(t, leader.AddNonvoter(nonvoter.localID, nonvoter.localAddr, 0, 0).Error())
+	time.Sleep(5 * conf.NonvoterPromotionStabilizationTime)
+	require.False(t, hasVote(c.getConfiguration(leader), nonvoter.localID))
+}
+
+func TestRaft_Witness(t *testing.T) {
+	// Make a cluster of two full replicas and a witness
+	c := MakeCluster(2, t, nil)
+	defer c.Close()
+	c1 := MakeClusterNoBootstrap(1, t, nil)
+	c.Merge(c1)
+	c.FullyConnect()
+
+	leader := c.Leader()
+	witness := c1.rafts[0]
+	require.NoError(t, leader.AddWitness(witness.localID, witness.localAddr, 0, 0).Error())
+
+	// Cut off the other replica, the witness's vote is enough to commit
+	var follower *Raft
+	for _, r := range c.rafts[:2] {
+		if r != leader {
+			follower = r
+		}
+	}
+	c.Disconnect(follower.localAddr)
+	var future ApplyFuture
+	for i := 0; i < 10; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+	}
+	require.NoError(t, future.Error())
+	require.Len(t, getMockFSM(c.fsms[c.IndexOf(leader)]).logs, 10)
+
+	// The witness only has the index and term of each command, and applies
+	// none of them
+	require.Eventually(t, func() bool {
+		return witness.getLastApplied() >= future.Index()
+	}, c.longstopTimeout, c.conf.CommitTimeout)
+	var l Log
+	require.NoError(t, c.stores[c.IndexOf(witness)].GetLog(future.Index(), &l))
+	require.Equal(t, LogCommand, l.Type)
+	require.Equal(t, future.Index(), l.Index)
+	require.Empty(t, l.Data)
+	require.Empty(t, getMockFSM(c.fsms[c.IndexOf(witness)]).logs)
+
+	// Leadership can't be handed to the witness
+	err := leader.LeadershipTransferToServer(witness.localID, witness.localAddr).Error()
+	require.ErrorContains(t, err, "cannot transfer leadership to witness")
+
+	// Once the leader is gone, the witness elects the other replica rather
+	// than standing itself
+	c.FullyConnect()
+	require.Eventually(t, func() bool {
+		fsm := getMockFSM(c.fsms[c.IndexOf(follower)])
+		fsm.Lock()
+		defer fsm.Unlock()
+		return len(fsm.logs) == 10
+	}, c.longstopTimeout, c.conf.CommitTimeout)
+	c.Disconnect(leader.localAddr)
+	limit := time.Now().Add(c.longstopTimeout)
+	for time.Now().Before(limit) && follower.State() != Leader {
+		time.Sleep(c.conf.CommitTimeout)
+	}
+	require.Equal(t, Leader, follower.State())
+	require.NotEqual(t, Leader, witness.State())
+	require.NotEqual(t, Candidate, witness.State())
+}
+
+func TestRaft_Witness_RemovedBeforeApplying(t *testing.T) {
+	c := MakeClusterNoBootstrap(1, t, nil)
+	defer c.Close()
+	witness := c.rafts[0]
+	leaderAddr, leaderTrans := NewInmemTransport("")
+	leaderTrans.Connect(witness.localAddr, c.trans[0])
+
+	// The witness gets a command without its data, along with the
+	// configuration removing the witness, before it has applied either.
+	withWitness := Configuration{Servers: []Server{
+		{Suffrage: Voter, ID: "leader", Address: leaderAddr},
+		{Suffrage: Witness, ID: witness.localID, Address: witness.localAddr},
+	}}
+	withoutWitness := Configuration{Servers: withWitness.Servers[:1]}
+	req := &AppendEntriesRequest{
+		RPCHeader: RPCHeader{ProtocolVersion: ProtocolVersionMax, ID: []byte("leader"), Addr: []byte(leaderAddr)},
+		Term:      1,
+		Entries: []*Log{
+			{Index: 1, Term: 1, Type: LogConfiguration, Data: EncodeConfiguration(withWitness)},
+			{Index: 2, Term: 1, Type: LogCommand},
+			{Index: 3, Term: 1, Type: LogConfiguration, Data: EncodeConfiguration(withoutWitness)},
+		},
+		LeaderCommitIndex: 3,
+	}
+	var resp AppendEntriesResponse
+	require.NoError(t, leaderTrans.AppendEntries(witness.localID, witness.localAddr, req, &resp))
+	require.True(t, resp.Success)
+
+	// The command was stored as a witness, so it isn't applied.
+	require.Eventually(t, func() bool {
+		return witness.getLastApplied() == 3
+	}, c.longstopTimeout, c.conf.CommitTimeout)
+	require.Never(t, func() bool {
+		return len(getMockFSM(c.fsms[0]).Logs()) > 0
+	}, 10*c.conf.CommitTimeout, c.conf.CommitTimeout)
+}
+
+func TestRaft_LeaderPriority(t *testing.T) {
+	// Make a cluster
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	// Prefer one of the followers
+	leader := c.Leader()
+	var preferred *Raft
+	for _, r := range c.rafts {
+		if r != leader {
+			preferred = r
+			break
+		}
+	}
+	require.NoError(t, leader.SetPriority(preferred.localID, 10, 0, 0).Error())
+
+	// The leader should hand over leadership on its own
+	limit := time.Now().Add(c.longstopTimeout)
+	for time.Now().Before(limit) && preferred.State() != Leader {
+		time.Sleep(c.conf.CommitTimeout)
+	}
+	require.Equal(t, Leader, preferred.State())
+	require.Equal(t, 10, serverPriority(c.getConfiguration(preferred), preferred.localID))
+
+	// It should stay there
+	time.Sleep(c.propagateTimeout)
+	require.Equal(t, preferred, c.Leader())
+}
+
 func TestRaft_RemoveFollower_SplitCluster(t *testing.T) {
 	// Make a cluster.
 	conf := inmemConfig(t)
@@ -2062,6 +2407,64 @@ func TestRaft_Barrier(t *testing.T) {
 	}
 }
 
+func TestRaft_ContextAPIs(t *testing.T) {
+	// Make the cluster
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	ctx := context.Background()
+
+	future := leader.ApplyContext(ctx, []byte("test"))
+	require.NoError(t, future.Error())
+	require.NotZero(t, future.Index())
+
+	require.NoError(t, leader.BarrierContext(ctx).Error())
+	require.NoError(t, leader.VerifyLeaderContext(ctx).Error())
+
+	// Add a nonvoter and promote it
+	c1 := MakeClusterNoBootstrap(1, t, nil)
+	c.Merge(c1)
+	c.FullyConnect()
+	follower := c1.rafts[0]
+	require.NoError(t, leader.AddNonvoterContext(ctx, follower.localID, follower.localAddr, 0).Error())
+	require.NoError(t, leader.AddVoterContext(ctx, follower.localID, follower.localAddr, 0).Error())
+	require.NoError(t, leader.DemoteVoterContext(ctx, follower.localID, 0).Error())
+	require.NoError(t, leader.RemoveServerContext(ctx, follower.localID, 0).Error())
+
+	// Snapshots wait for the latest configuration to be applied
+	require.NoError(t, leader.BarrierContext(ctx).Error())
+	snap := leader.SnapshotContext(ctx)
+	require.NoError(t, snap.Error())
+	_, rc, err := snap.Open()
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	// A context that is already done is reported rather than enqueuing
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, leader.ApplyContext(cancelled, []byte("test")).Error(), context.Canceled)
+	require.ErrorIs(t, leader.SnapshotContext(cancelled).Error(), context.Canceled)
+}
+
+func TestRaft_ApplyContext_Deadline(t *testing.T) {
+	// Use a long lease so the leader doesn't step down while we wait
+	conf := inmemConfig(t)
+	conf.HeartbeatTimeout = time.Second
+	conf.ElectionTimeout = time.Second
+	conf.LeaderLeaseTimeout = time.Second
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Partition the leader so nothing can commit
+	leader := c.Leader()
+	c.Disconnect(leader.localAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := leader.ApplyContext(ctx, []byte("test")).Error()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
 func TestRaft_VerifyLeader(t *testing.T) {
 	// Make the cluster
 	c := MakeCluster(3, t, nil)
@@ -2170,6 +2573,224 @@ func TestRaft_VerifyLeader_PartialConnect(t *testing.T) {
 	}
 }
 
+func TestRaft_ReadIndex(t *testing.T) {
+	// Make the cluster
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	// Apply some logs
+	leader := c.Leader()
+	for i := 0; i < 10; i++ {
+		future := leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+		if err := future.Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	lastIndex := leader.LastIndex()
+
+	// The read index must cover everything committed so far, and should not
+	// have appended anything to the log.
+	readIndex, err := leader.ReadIndex(context.Background())
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, readIndex, lastIndex)
+	require.Equal(t, lastIndex, leader.LastIndex())
+
+	// Followers can't serve a read index
+	for _, f := range c.Followers() {
+		_, err := f.ReadIndex(context.Background())
+		require.Equal(t, ErrNotLeader, err)
+	}
+}
+
+func TestRaft_ReadIndex_Single(t *testing.T) {
+	// Make the cluster
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	future := leader.Apply([]byte("test"), 0)
+	require.NoError(t, future.Error())
+
+	readIndex, err := leader.ReadIndex(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, future.Index(), readIndex)
+}
+
+func TestRaft_ReadIndex_Partitioned(t *testing.T) {
+	// Make the cluster
+	conf := inmemConfig(t)
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Cut the leader off from both followers so it can't confirm leadership
+	leader := c.Leader()
+	c.Disconnect(leader.localAddr)
+
+	// Let any heartbeats that were already in flight drain
+	time.Sleep(conf.HeartbeatTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := leader.ReadIndex(ctx)
+	if err != ErrLeadershipLost && err != ErrNotLeader {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRaft_ReadIndex_ContextDeadline(t *testing.T) {
+	// Use a long lease so the leader doesn't step down while we wait
+	conf := inmemConfig(t)
+	conf.HeartbeatTimeout = time.Second
+	conf.ElectionTimeout = time.Second
+	conf.LeaderLeaseTimeout = time.Second
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Partition the leader so the heartbeat round can't complete
+	leader := c.Leader()
+	c.Disconnect(leader.localAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := leader.ReadIndex(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRaft_LeaseRead(t *testing.T) {
+	// Make the cluster
+	conf := inmemConfig(t)
+	conf.LeaseReads = true
+	conf.LeaseReadMaxClockDrift = 10 * time.Millisecond
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Apply some logs
+	leader := c.Leader()
+	var future ApplyFuture
+	for i := 0; i < 10; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+		require.NoError(t, future.Error())
+	}
+
+	readIndex, err := leader.LeaseRead()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, readIndex, future.Index())
+
+	// Followers can't serve a lease read
+	for _, f := range c.Followers() {
+		_, err := f.LeaseRead()
+		require.Equal(t, ErrNotLeader, err)
+	}
+}
+
+func TestRaft_LeaseRead_Disabled(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+
+	_, err := c.Leader().LeaseRead()
+	require.Equal(t, ErrLeaseReadsDisabled, err)
+}
+
+func TestRaft_LeaseRead_Expired(t *testing.T) {
+	// Use a lease long enough that we can observe it expiring before the
+	// leader steps down
+	conf := inmemConfig(t)
+	conf.HeartbeatTimeout = 200 * time.Millisecond
+	conf.ElectionTimeout = 200 * time.Millisecond
+	conf.LeaderLeaseTimeout = 200 * time.Millisecond
+	conf.LeaseReads = true
+	conf.LeaseReadMaxClockDrift = 50 * time.Millisecond
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	_, err := leader.LeaseRead()
+	require.NoError(t, err)
+
+	// Partition the leader and wait out the lease, less the drift bound
+	c.Disconnect(leader.localAddr)
+	time.Sleep(conf.LeaderLeaseTimeout - conf.LeaseReadMaxClockDrift)
+
+	_, err = leader.LeaseRead()
+	if err != ErrLeaseExpired && err != ErrNotLeader {
+		t.Fatalf("expected lease to have expired, got: %v", err)
+	}
+}
+
+func TestRaft_LeaseRead_AckedSend(t *testing.T) {
+	// The lease counts from when an acknowledged request was sent, so a slow
+	// response doesn't extend it.
+	var s followerReplication
+	sent := time.Now().Add(-time.Second)
+	s.setLastContact(sent)
+	require.Equal(t, sent, s.LastAckedSend())
+	require.True(t, s.LastContact().After(sent))
+
+	// A response to an earlier request, arriving late, doesn't move it back.
+	s.setLastContact(sent.Add(-time.Second))
+	require.Equal(t, sent, s.LastAckedSend())
+}
+
+func TestRaft_LinearizableRead_Follower(t *testing.T) {
+	// Make the cluster
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	// Apply some logs
+	leader := c.Leader()
+	var future ApplyFuture
+	for i := 0; i < 10; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+		if err := future.Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Every server should be able to serve a read that sees the last write
+	for _, r := range c.rafts {
+		readIndex, err := r.LinearizableRead(context.Background())
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, readIndex, future.Index())
+		require.GreaterOrEqual(t, r.AppliedIndex(), readIndex)
+	}
+	require.Equal(t, future.Index(), leader.LastIndex())
+}
+
+func TestRaft_LinearizableRead_LeaderUnreachable(t *testing.T) {
+	// Make the cluster
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	// Cut a follower off from the rest of the cluster so it can't reach the
+	// leader to get a read index
+	c.Leader()
+	follower := c.Followers()[0]
+	c.Disconnect(follower.localAddr)
+
+	_, err := follower.LinearizableRead(context.Background())
+	require.Error(t, err)
+}
+
+func TestRaft_LinearizableRead_StaleLeaderTerm(t *testing.T) {
+	c := MakeClusterNoBootstrap(1, t, nil)
+	defer c.Close()
+	r := c.rafts[0]
+
+	// Point the server at a leader that answers for an older term than the
+	// server's own.
+	leaderAddr, leaderTrans := NewInmemTransport("")
+	c.trans[0].Connect(leaderAddr, leaderTrans)
+	go func() {
+		rpc := <-leaderTrans.Consumer()
+		rpc.Respond(&ReadIndexResponse{Term: 2, ReadIndex: 10}, nil)
+	}()
+	r.setCurrentTerm(3)
+	r.setLeader(leaderAddr, "leader")
+
+	_, err := r.LinearizableRead(context.Background())
+	require.ErrorIs(t, err, ErrNotLeader)
+}
+
 func TestRaft_NotifyCh(t *testing.T) {
 	ch := make(chan bool, 1)
 	conf := inmemConfig(t)
@@ -2400,6 +3021,77 @@ func TestRaft_VotingGrant_WhenLeaderAvailable(t *testing.T) {
 	}
 }
 
+func TestRaft_CheckQuorum_RejectsVotes(t *testing.T) {
+	// Use long timeouts so nothing times out on its own during the test
+	conf := inmemConfig(t)
+	conf.CheckQuorum = true
+	conf.HeartbeatTimeout = 500 * time.Millisecond
+	conf.ElectionTimeout = 500 * time.Millisecond
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	followers := c.Followers()
+	ldr := c.Leader()
+	candidate, voter := followers[0], followers[1]
+	candidateT := c.trans[c.IndexOf(candidate)]
+	term := voter.getCurrentTerm()
+
+	// Even after forgetting who the leader is, a follower that heard from it
+	// recently shouldn't vote or move to the candidate's term. Cut the leader
+	// off so it can't remind the follower.
+	c.Disconnect(ldr.localAddr)
+	voter.setLeader("", "")
+	reqVote := RequestVoteRequest{
+		RPCHeader:    candidate.getRPCHeader(),
+		Term:         term + 10,
+		LastLogIndex: ldr.LastIndex(),
+		LastLogTerm:  term,
+	}
+	var resp RequestVoteResponse
+	require.NoError(t, candidateT.RequestVote(voter.localID, voter.localAddr, &reqVote, &resp))
+	require.False(t, resp.Granted)
+	require.Equal(t, term, voter.getCurrentTerm())
+
+	voter.setLeader("", "")
+	reqPreVote := RequestPreVoteRequest{
+		RPCHeader:    candidate.getRPCHeader(),
+		Term:         term + 10,
+		LastLogIndex: ldr.LastIndex(),
+		LastLogTerm:  term,
+	}
+	var preVoteResp RequestPreVoteResponse
+	require.NoError(t, candidateT.RequestPreVote(voter.localID, voter.localAddr, &reqPreVote, &preVoteResp))
+	require.False(t, preVoteResp.Granted)
+
+	// A leadership transfer is still allowed through
+	voter.setLeader("", "")
+	reqVote.LeadershipTransfer = true
+	require.NoError(t, candidateT.RequestVote(voter.localID, voter.localAddr, &reqVote, &resp))
+	require.True(t, resp.Granted)
+}
+
+func TestRaft_CheckQuorum_GrantsVotesAfterElectionTimeout(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.CheckQuorum = true
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Once the leader has been gone for an election timeout, the others
+	// should elect a new one
+	ldr := c.Leader()
+	c.Disconnect(ldr.localAddr)
+	limit := time.Now().Add(c.longstopTimeout)
+	var newLeader *Raft
+	for time.Now().Before(limit) && newLeader == nil {
+		for _, r := range c.rafts {
+			if r != ldr && r.State() == Leader {
+				newLeader = r
+			}
+		}
+		time.Sleep(c.conf.CommitTimeout)
+	}
+	require.NotNil(t, newLeader)
+}
+
 func TestRaft_ProtocolVersion_RejectRPC(t *testing.T) {
 	c := MakeCluster(3, t, nil)
 	defer c.Close()
@@ -3098,6 +3790,165 @@ func TestRaft_InstallSnapshot_InvalidPeers(t *testing.T) {
 	require.Contains(t, resp.Error.Error(), "failed to decode peers")
 }
 
+func TestRaft_InstallSnapshot_Chunked(t *testing.T) {
+	c := MakeClusterNoBootstrap(1, t, nil)
+	defer c.Close()
+	r := c.rafts[0]
+
+	_, trans := NewInmemTransport("")
+	trans.Connect(r.localAddr, c.trans[0])
+
+	var logs [][]byte
+	for i := 0; i < 50; i++ {
+		logs = append(logs, []byte(fmt.Sprintf("test%d", i)))
+	}
+	var data []byte
+	require.NoError(t, codec.NewEncoderBytes(&data, &codec.MsgpackHandle{}).Encode(logs))
+
+	configuration := Configuration{Servers: []Server{
+		{Suffrage: Voter, ID: r.localID, Address: r.localAddr},
+		{Suffrage: Voter, ID: "leader", Address: trans.LocalAddr()},
+	}}
+	const chunkSize = 64
+	send := func(chunk uint64, reader io.Reader, checksum uint32) (*InstallSnapshotResponse, error) {
+		offset := int64(chunk) * chunkSize
+		size := int64(len(data)) - offset
+		if size > chunkSize {
+			size = chunkSize
+		}
+		req := InstallSnapshotRequest{
+			RPCHeader:          RPCHeader{ProtocolVersion: ProtocolVersionMax, ID: []byte("leader"), Addr: []byte(trans.LocalAddr())},
+			SnapshotVersion:    SnapshotVersionMax,
+			Term:               1,
+			LastLogIndex:       50,
+			LastLogTerm:        1,
+			Configuration:      EncodeConfiguration(configuration),
+			ConfigurationIndex: 1,
+			Size:               int64(len(data)),
+			Chunked:            true,
+			SnapshotID:         "1-50-1",
+			ChunkIndex:         chunk,
+			ChunkOffset:        offset,
+			ChunkSize:          size,
+			ChunkChecksum:      checksum,
+		}
+		var resp InstallSnapshotResponse
+		err := trans.InstallSnapshot(r.localID, r.localAddr, &req, &resp, reader)
+		return &resp, err
+	}
+	chunk := func(i uint64) []byte {
+		end := int(i+1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		return data[int(i)*chunkSize : end]
+	}
+	sendChunk := func(i uint64) (*InstallSnapshotResponse, error) {
+		return send(i, bytes.NewReader(chunk(i)), crc32.Checksum(chunk(i), snapshotChunkTable))
+	}
+
+	resp, err := sendChunk(0)
+	require.NoError(t, err)
+	require.True(t, resp.Success)
+	require.Equal(t, int64(chunkSize), resp.NextOffset)
+
+	// A chunk out of order is answered with the one to resume from.
+	resp, err = sendChunk(2)
+	require.NoError(t, err)
+	require.False(t, resp.Success)
+	require.Equal(t, uint64(1), resp.NextChunk)
+	require.Equal(t, int64(chunkSize), resp.NextOffset)
+
+	// A chunk that is cut short or corrupt is dropped, and can be sent again.
+	_, err = send(1, bytes.NewReader(chunk(1)[:10]), crc32.Checksum(chunk(1), snapshotChunkTable))
+	require.Error(t, err)
+	_, err = send(1, bytes.NewReader(chunk(1)), 0)
+	require.ErrorContains(t, err, ErrSnapshotChunkChecksum.Error())
+
+	last := uint64((len(data) - 1) / chunkSize)
+	for i := uint64(1); i <= last; i++ {
+		resp, err = sendChunk(i)
+		require.NoError(t, err)
+		require.True(t, resp.Success)
+	}
+	require.Equal(t, int64(len(data)), resp.NextOffset)
+	require.Equal(t, logs, getMockFSM(c.fsms[0]).Logs())
+	require.Equal(t, uint64(50), r.getLastApplied())
+}
+
+func TestRaft_SendSnapshot_ResumesChunks(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.SnapshotChunkSize = 64
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+	for i := 0; i < 50; i++ {
+		require.NoError(t, leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0).Error())
+	}
+	require.NoError(t, leader.Snapshot().Error())
+	snaps, err := leader.snapshots.List()
+	require.NoError(t, err)
+	_, rc, err := leader.snapshots.Open(snaps[0].ID)
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	// A follower that drops the connection on the second chunk, and then
+	// loses the transfer.
+	_, trans := NewInmemTransport("")
+	c.trans[0].Connect(trans.LocalAddr(), trans)
+	var chunks []uint64
+	var received []byte
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		for {
+			select {
+			case rpc := <-trans.Consumer():
+				req := rpc.Command.(*InstallSnapshotRequest)
+				buf, _ := io.ReadAll(rpc.Reader)
+				chunks = append(chunks, req.ChunkIndex)
+				resp := &InstallSnapshotResponse{Term: req.Term, Success: true}
+				switch len(chunks) {
+				case 2:
+					rpc.Respond(nil, fmt.Errorf("connection dropped"))
+					continue
+				case 3:
+					resp.Success = false
+				default:
+					received = append(received, buf...)
+				}
+				rpc.Respond(resp, nil)
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+
+	s := &followerReplication{
+		peer:        Server{Suffrage: Voter, ID: "follower", Address: trans.LocalAddr()},
+		commitment:  newCommitment(make(chan struct{}, 1), Configuration{}, 0),
+		currentTerm: leader.getCurrentTerm(),
+		notify:      make(map[*verifyFuture]struct{}),
+	}
+	_, err = leader.sendLatestSnapshot(s)
+	require.ErrorContains(t, err, "connection dropped")
+	_, err = leader.sendLatestSnapshot(s)
+	require.NoError(t, err)
+
+	// The second attempt resumed at the chunk that failed, then started over
+	// when the follower asked for the first one.
+	last := uint64((len(data) - 1) / 64)
+	expected := []uint64{0, 1, 1}
+	for i := uint64(0); i <= last; i++ {
+		expected = append(expected, i)
+	}
+	require.Equal(t, expected, chunks)
+	require.Equal(t, data, received[64:])
+	require.Equal(t, snaps[0].Index+1, atomic.LoadUint64(&s.nextIndex))
+}
+
 func TestRaft_VoteNotGranted_WhenNodeNotInCluster(t *testing.T) {
 	// Make a cluster
 	c := MakeCluster(3, t, nil)
@@ -3351,9 +4202,9 @@ func TestRaft_runFollower_State_Transition(t *testing.T) {
 		fields        fields
 		expectedState RaftState
 	}{
-		{"NonVoter", fields{conf: DefaultConfig(), servers: []Server{{Nonvoter, "first", ""}}, serverID: "first"}, Follower},
-		{"Voter", fields{conf: DefaultConfig(), servers: []Server{{Voter, "first", ""}}, serverID: "first"}, Candidate},
-		{"Not in Config", fields{conf: DefaultConfig(), servers: []Server{{Voter, "second", ""}}, serverID: "first"}, Follower},
+		{"NonVoter", fields{conf: DefaultConfig(), servers: []Server{{Suffrage: Nonvoter, ID: "first", Address: ""}}, serverID: "first"}, Follower},
+		{"Voter", fields{conf: DefaultConfig(), servers: []Server{{Suffrage: Voter, ID: "first", Address: ""}}, serverID: "first"}, Candidate},
+		{"Not in Config", fields{conf: DefaultConfig(), servers: []Server{{Suffrage: Voter, ID: "second", Address: ""}}, serverID: "first"}, Follower},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -3396,7 +4247,7 @@ func TestRaft_runFollower_ReloadTimeoutConfigs(t *testing.T) {
 	conf.skipStartup = true
 
 	env := MakeRaft(t, conf, false)
-	servers := []Server{{Voter, "first", ""}}
+	servers := []Server{{Suffrage: Voter, ID: "first", Address: ""}}
 	env.raft.setLatestConfiguration(Configuration{Servers: servers}, 1)
 	env.raft.setState(Follower)
 
@@ -3501,3 +4352,316 @@ func TestRaft_PreVote_ShouldRejectNonLeader(t *testing.T) {
 		t.Fatalf("expected pre-vote to not be granted, but it was granted, %+v", resp)
 	}
 }
+
+func TestRaft_InstallSnapshot_Checksum(t *testing.T) {
+	c := MakeClusterNoBootstrap(1, t, nil)
+	defer c.Close()
+	r := c.rafts[0]
+
+	_, trans := NewInmemTransport("")
+	trans.Connect(r.localAddr, c.trans[0])
+
+	var logs [][]byte
+	for i := 0; i < 50; i++ {
+		logs = append(logs, []byte(fmt.Sprintf("test%d", i)))
+	}
+	var data bytes.Buffer
+	gz := gzip.NewWriter(&data)
+	require.NoError(t, codec.NewEncoder(gz, &codec.MsgpackHandle{}).Encode(logs))
+	require.NoError(t, gz.Close())
+
+	configuration := Configuration{Servers: []Server{
+		{Suffrage: Voter, ID: r.localID, Address: r.localAddr},
+		{Suffrage: Voter, ID: "leader", Address: trans.LocalAddr()},
+	}}
+	send := func(snapshot []byte, checksum uint64) error {
+		req := InstallSnapshotRequest{
+			RPCHeader:          RPCHeader{ProtocolVersion: ProtocolVersionMax, ID: []byte("leader"), Addr: []byte(trans.LocalAddr())},
+			SnapshotVersion:    SnapshotVersionMax,
+			Term:               1,
+			LastLogIndex:       50,
+			LastLogTerm:        1,
+			Configuration:      EncodeConfiguration(configuration),
+			ConfigurationIndex: 1,
+			Size:               int64(len(snapshot)),
+			Compression:        SnapshotCompressionGzip,
+			Checksum:           binary.BigEndian.AppendUint64(nil, checksum),
+		}
+		var resp InstallSnapshotResponse
+		return trans.InstallSnapshot(r.localID, r.localAddr, &req, &resp, bytes.NewReader(snapshot))
+	}
+
+	// A snapshot corrupted on the way is discarded before it's restored.
+	checksum := crc64.Checksum(data.Bytes(), snapshotCRCTable)
+	corrupt := bytes.Clone(data.Bytes())
+	corrupt[len(corrupt)/2] ^= 0xff
+	require.ErrorContains(t, send(corrupt, checksum), ErrSnapshotChecksum.Error())
+	require.Empty(t, getMockFSM(c.fsms[0]).Logs())
+	snaps, err := c.snaps[0].List()
+	require.NoError(t, err)
+	require.Empty(t, snaps)
+
+	require.NoError(t, send(data.Bytes(), checksum))
+	require.Equal(t, logs, getMockFSM(c.fsms[0]).Logs())
+	require.Equal(t, uint64(50), r.getLastApplied())
+}
+
+// incrementalMockFSM is a MockFSM whose delta snapshots hold the logs applied
+// since its previous snapshot or restore.
+type incrementalMockFSM struct {
+	*MockFSM
+	base   int
+	deltas int
+}
+
+func (m *incrementalMockFSM) Underlying() FSM {
+	return m.MockFSM
+}
+
+func (m *incrementalMockFSM) Snapshot() (FSMSnapshot, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.base = len(m.logs)
+	return &MockSnapshot{m.logs, len(m.logs)}, nil
+}
+
+func (m *incrementalMockFSM) SnapshotDelta(sinceIndex uint64) (FSMSnapshot, error) {
+	m.Lock()
+	defer m.Unlock()
+	delta := m.logs[m.base:]
+	m.base = len(m.logs)
+	m.deltas++
+	return &MockSnapshot{delta, len(delta)}, nil
+}
+
+func (m *incrementalMockFSM) Restore(inp io.ReadCloser) error {
+	if err := m.MockFSM.Restore(inp); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.base = len(m.logs)
+	return nil
+}
+
+func (m *incrementalMockFSM) RestoreDelta(inp io.ReadCloser) error {
+	m.Lock()
+	defer m.Unlock()
+	var delta [][]byte
+	if err := codec.NewDecoder(inp, &codec.MsgpackHandle{}).Decode(&delta); err != nil {
+		return err
+	}
+	m.logs = append(m.logs, delta...)
+	m.base = len(m.logs)
+	return nil
+}
+
+func TestRaft_DeltaSnapshots(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 5
+	conf.MaxSnapshotDeltas = 2
+	makeFSM := func() FSM { return &incrementalMockFSM{MockFSM: &MockFSM{}} }
+	c := MakeClusterCustom(t, &MakeClusterOpts{
+		Peers:       1,
+		Bootstrap:   true,
+		Conf:        conf,
+		MakeFSMFunc: makeFSM,
+	})
+	defer c.Close()
+	leader := c.Leader()
+	fsm := c.fsms[0].(*incrementalMockFSM)
+
+	// Each snapshot chains a delta onto the previous one, until there are
+	// too many of them.
+	next := 0
+	snapshot := func() *SnapshotMeta {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, leader.Apply([]byte(fmt.Sprintf("test%d", next)), 0).Error())
+			next++
+		}
+		future := leader.Snapshot()
+		require.NoError(t, future.Error())
+		meta, r, err := future.Open()
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		return meta
+	}
+	require.Equal(t, 0, snapshot().Chain)
+	require.Equal(t, 2, snapshot().Chain)
+	require.Equal(t, 3, snapshot().Chain)
+	require.Equal(t, 0, snapshot().Chain)
+	require.Equal(t, 2, snapshot().Chain)
+	fsm.Lock()
+	require.Equal(t, 3, fsm.deltas)
+	fsm.Unlock()
+
+	// A new server is sent the whole chain, and restores it.
+	c1 := MakeClusterCustom(t, &MakeClusterOpts{
+		Peers:       1,
+		Conf:        conf,
+		MakeFSMFunc: makeFSM,
+	})
+	c.Merge(c1)
+	c.FullyConnect()
+	require.NoError(t, leader.AddVoter(c1.rafts[0].localID, c1.rafts[0].localAddr, 0, 0).Error())
+	c.EnsureSame(t)
+	snaps, err := c1.snaps[0].List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 1)
+	require.Equal(t, 2, snaps[0].Chain)
+
+	// Its next snapshot builds on the chain.
+	require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	c.EnsureSame(t)
+	require.NoError(t, c1.rafts[0].Snapshot().Error())
+	snaps, err = c1.snaps[0].List()
+	require.NoError(t, err)
+	require.Equal(t, 3, snaps[0].Chain)
+}
+
+// concurrentMockFSM is a MockFSM whose prepared snapshots wait for build to be
+// closed before they're turned into snapshots.
+type concurrentMockFSM struct {
+	*MockFSM
+	build    chan struct{}
+	prepared int32
+}
+
+type concurrentMockSnapshot struct {
+	fsm  *concurrentMockFSM
+	logs [][]byte
+}
+
+func (m *concurrentMockFSM) Underlying() FSM {
+	return m.MockFSM
+}
+
+func (m *concurrentMockFSM) PrepareSnapshot() (PreparedSnapshot, error) {
+	m.Lock()
+	defer m.Unlock()
+	atomic.AddInt32(&m.prepared, 1)
+
+	// Apply only appends, so the logs so far don't change
+	return &concurrentMockSnapshot{m, m.logs[:len(m.logs):len(m.logs)]}, nil
+}
+
+func (s *concurrentMockSnapshot) Snapshot() (FSMSnapshot, error) {
+	<-s.fsm.build
+	return &MockSnapshot{s.logs, len(s.logs)}, nil
+}
+
+func (s *concurrentMockSnapshot) Discard() {}
+
+func TestRaft_ConcurrentSnapshot(t *testing.T) {
+	fsm := &concurrentMockFSM{MockFSM: &MockFSM{}, build: make(chan struct{})}
+	c := MakeClusterCustom(t, &MakeClusterOpts{
+		Peers:       1,
+		Bootstrap:   true,
+		Conf:        inmemConfig(t),
+		MakeFSMFunc: func() FSM { return fsm },
+	})
+	defer c.Close()
+	leader := c.Leader()
+
+	var logs [][]byte
+	apply := func() {
+		for i := 0; i < 10; i++ {
+			logs = append(logs, []byte(fmt.Sprintf("test%d", len(logs))))
+			require.NoError(t, leader.Apply(logs[len(logs)-1], time.Second).Error())
+		}
+	}
+	apply()
+	index := leader.getLastApplied()
+
+	// Logs are applied while the prepared snapshot is being built.
+	future := leader.Snapshot()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&fsm.prepared) == 1 }, time.Second, time.Millisecond)
+	snapshotLogs := logs
+	apply()
+	require.Equal(t, logs, fsm.Logs())
+	close(fsm.build)
+
+	// The snapshot holds the state when it was prepared.
+	require.NoError(t, future.Error())
+	meta, r, err := future.Open()
+	require.NoError(t, err)
+	defer func() { _ = r.Close() }()
+	require.Equal(t, index, meta.Index)
+	var restored [][]byte
+	require.NoError(t, codec.NewDecoder(r, &codec.MsgpackHandle{}).Decode(&restored))
+	require.Equal(t, snapshotLogs, restored)
+}
+
+func TestRaft_RecoverToIndex(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 5
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+
+	// Keep a copy of every log, as an archive would.
+	archive := NewInmemStore()
+	apply := func(n int) {
+		for i := 0; i < n; i++ {
+			require.NoError(t, leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0).Error())
+		}
+		first, err := c.stores[0].FirstIndex()
+		require.NoError(t, err)
+		last, err := c.stores[0].LastIndex()
+		require.NoError(t, err)
+		for index := first; index <= last; index++ {
+			var entry Log
+			require.NoError(t, c.stores[0].GetLog(index, &entry))
+			require.NoError(t, archive.StoreLog(&entry))
+		}
+	}
+	apply(10)
+	require.NoError(t, leader.Snapshot().Error())
+	apply(10)
+	target := leader.getLastIndex()
+	apply(10)
+	require.NoError(t, leader.Snapshot().Error())
+	require.NoError(t, leader.Shutdown().Error())
+
+	// The state is rebuilt from the first snapshot and the archived logs.
+	fsm := &MockFSM{}
+	cfg := leader.config()
+	require.NoError(t, RecoverToIndex(&cfg, fsm, c.snaps[0], archive, nil, leader.trans, target))
+	require.Len(t, fsm.Logs(), 20)
+
+	snaps, err := c.snaps[0].List()
+	require.NoError(t, err)
+	var recovered *SnapshotMeta
+	for _, meta := range snaps {
+		if meta.Index == target {
+			recovered = meta
+		}
+	}
+	require.NotNil(t, recovered)
+	require.Equal(t, leader.localID, recovered.Configuration.Servers[0].ID)
+	_, r, err := c.snaps[0].Open(recovered.ID)
+	require.NoError(t, err)
+	defer func() { _ = r.Close() }()
+	restored := &MockFSM{}
+	require.NoError(t, restored.Restore(r))
+	require.Equal(t, fsm.Logs(), restored.Logs())
+
+	// Logs that weren't archived yet are read from the live log store.
+	first, err := c.stores[0].FirstIndex()
+	require.NoError(t, err)
+	partial := NewInmemStore()
+	for index := target + 1; index < first; index++ {
+		var entry Log
+		require.NoError(t, archive.GetLog(index, &entry))
+		require.NoError(t, partial.StoreLog(&entry))
+	}
+	fsm = &MockFSM{}
+	require.NoError(t, RecoverToIndex(&cfg, fsm, c.snaps[0], partial, c.stores[0], leader.trans, first+2))
+	require.Len(t, fsm.Logs(), 20+int(first+2-target))
+
+	// Logs that are in neither store can't be replayed.
+	err = RecoverToIndex(&cfg, &MockFSM{}, c.snaps[0], NewInmemStore(), nil, leader.trans, target+5)
+	require.ErrorContains(t, err, "failed to get archived log")
+	err = RecoverToIndex(&cfg, &MockFSM{}, c.snaps[0], NewInmemStore(), c.stores[0], leader.trans, target+5)
+	require.ErrorContains(t, err, "from the archive or the log store")
+}
@@ -4,8 +4,11 @@
 package raft
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -43,6 +46,10 @@ type followerReplication struct {
 	// which may fall past the end of the log.
 	nextIndex uint64
 
+	// matchIndex is the index of the last entry known to be replicated to
+	// the follower.
+	matchIndex uint64
+
 	// peer contains the network address and ID of the remote follower.
 	peer Server
 	// peerLock protects 'peer'
@@ -70,7 +77,11 @@ type followerReplication struct {
 	// received from the follower (successful or not). This is used to check
 	// whether the leader should step down (Raft.checkLeaderLease()).
 	lastContact time.Time
-	// lastContactLock protects 'lastContact'.
+	// lastAckedSend is when the latest request the follower responded to was
+	// sent. Unlike lastContact it leaves out how long the response took to
+	// arrive, so it's used for the lease of lease reads.
+	lastAckedSend time.Time
+	// lastContactLock protects 'lastContact' and 'lastAckedSend'.
 	lastContactLock sync.RWMutex
 
 	// failures counts the number of failed RPCs since the last success, which is
@@ -80,6 +91,9 @@ type followerReplication struct {
 	// notifyCh is notified to send out a heartbeat, which is used to check that
 	// this server is still leader.
 	notifyCh chan struct{}
+	// heartbeats is set, before replication starts, when the transport sends
+	// the heartbeats to the follower instead of the heartbeat goroutine.
+	heartbeats heartbeatSchedule
 	// notify is a map of futures to be resolved upon receipt of an
 	// acknowledgement, then cleared from this map.
 	notify map[*verifyFuture]struct{}
@@ -93,6 +107,22 @@ type followerReplication struct {
 	// allowPipeline is used to determine when to pipeline the AppendEntries RPCs.
 	// It is private to this replication goroutine.
 	allowPipeline bool
+
+	// snapshotProgress records how far the last chunked snapshot sent to the
+	// follower got, so that a failed transfer can be resumed. It is private
+	// to this replication goroutine.
+	snapshotProgress snapshotProgress
+
+	// catchUp records the follower that was last asked to send this follower
+	// a snapshot. It is private to this replication goroutine.
+	catchUp catchUpState
+}
+
+// snapshotProgress is the next chunk of a snapshot to send to a follower.
+type snapshotProgress struct {
+	id     string
+	chunk  uint64
+	offset int64
 }
 
 // notifyAll is used to notify all the waiting verify futures
@@ -104,12 +134,26 @@ func (s *followerReplication) notifyAll(leader bool) {
 	s.notify = make(map[*verifyFuture]struct{})
 	s.notifyLock.Unlock()
 
+	s.peerLock.RLock()
+	id := s.peer.ID
+	s.peerLock.RUnlock()
+
 	// Submit our votes
 	for v := range n {
-		v.vote(leader)
+		v.vote(id, leader)
 	}
 }
 
+// heartbeatNow has a heartbeat sent to the follower right away, which is used
+// to check that this server is still leader.
+func (s *followerReplication) heartbeatNow() {
+	if s.heartbeats != nil {
+		s.heartbeats.trigger()
+		return
+	}
+	asyncNotifyCh(s.notifyCh)
+}
+
 // cleanNotify is used to delete notify, .
 func (s *followerReplication) cleanNotify(v *verifyFuture) {
 	s.notifyLock.Lock()
@@ -125,20 +169,38 @@ func (s *followerReplication) LastContact() time.Time {
 	return last
 }
 
-// setLastContact sets the last contact to the current time.
-func (s *followerReplication) setLastContact() {
+// LastAckedSend returns when the latest request the follower responded to
+// was sent.
+func (s *followerReplication) LastAckedSend() time.Time {
+	s.lastContactLock.RLock()
+	last := s.lastAckedSend
+	s.lastContactLock.RUnlock()
+	return last
+}
+
+// setLastContact sets the last contact to the current time, on a response to
+// a request sent at the given time.
+func (s *followerReplication) setLastContact(sent time.Time) {
 	s.lastContactLock.Lock()
 	s.lastContact = time.Now()
+	if sent.After(s.lastAckedSend) {
+		s.lastAckedSend = sent
+	}
 	s.lastContactLock.Unlock()
 }
 
 // replicate is a long running routine that replicates log entries to a single
 // follower.
 func (r *Raft) replicate(s *followerReplication) {
-	// Start an async heartbeating routing
-	stopHeartbeat := make(chan struct{})
-	defer close(stopHeartbeat)
-	r.goFunc(func() { r.heartbeat(s, stopHeartbeat) })
+	if s.heartbeats != nil {
+		// The transport sends the heartbeats
+		defer s.heartbeats.stop()
+	} else {
+		// Start an async heartbeating routing
+		stopHeartbeat := make(chan struct{})
+		defer close(stopHeartbeat)
+		r.goFunc(func() { r.heartbeat(s, stopHeartbeat) })
+	}
 
 RPC:
 	shouldStop := false
@@ -242,7 +304,7 @@ START:
 	}
 
 	// Update the last contact
-	s.setLastContact()
+	s.setLastContact(start)
 
 	// Update s based on success
 	if resp.Success {
@@ -283,6 +345,10 @@ CHECK_MORE:
 	// SEND_SNAP is used when we fail to get a log, usually because the follower
 	// is too far behind, and we must ship a snapshot down instead
 SEND_SNAP:
+	if r.catchUpFromFollower(s) {
+		// Another follower is sending it a snapshot
+		return
+	}
 	if stop, err := r.sendLatestSnapshot(s); stop {
 		return true
 	} else if err != nil {
@@ -312,12 +378,13 @@ func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
 	// Open the most recent snapshot
 	snapID := snapshots[0].ID
 	r.logger.Info("opening snapshot", "id", snapID)
-	meta, snapshot, err := r.snapshots.Open(snapID)
+	meta, snapshot, err := r.openSnapshotToSend(snapID)
 	if err != nil {
 		r.logger.Error("failed to open snapshot", "id", snapID, "error", err)
 		return false, err
 	}
-	defer func() { _ = snapshot.Close() }()
+	cursor := &snapshotCursor{open: r.openSnapshotToSend, id: snapID, rc: snapshot}
+	defer func() { _ = cursor.Close() }()
 
 	// Setup the request
 	req := InstallSnapshotRequest{
@@ -332,17 +399,32 @@ func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
 		Size:               meta.Size,
 		Configuration:      EncodeConfiguration(meta.Configuration),
 		ConfigurationIndex: meta.ConfigurationIndex,
+		Compression:        meta.Compression,
+		Checksum:           meta.Checksum,
+		Chain:              meta.Chain,
 	}
 
 	s.peerLock.RLock()
 	peer := s.peer
 	s.peerLock.RUnlock()
 
+	// A witness has no use for the FSM state, so it only gets the metadata.
+	var data io.Reader = cursor
+	if peer.Suffrage == Witness {
+		req.Size, req.Compression, req.Checksum, req.Chain = 0, "", nil, 0
+		data = bytes.NewReader(nil)
+	}
+
 	r.logger.Info("installing snapshot on", "peer", peer.ID, "id", snapID, "size", req.Size)
 	// Make the call
 	start := time.Now()
 	var resp InstallSnapshotResponse
-	if err := r.trans.InstallSnapshot(peer.ID, peer.Address, &req, &resp, snapshot); err != nil {
+	if chunkSize := r.config().SnapshotChunkSize; chunkSize > 0 {
+		err = r.sendSnapshotChunks(peer, &s.snapshotProgress, &req, &resp, cursor, int64(chunkSize))
+	} else {
+		err = r.trans.InstallSnapshot(peer.ID, peer.Address, &req, &resp, data)
+	}
+	if err != nil {
 		r.logger.Error("failed to install snapshot", "peer", peer.ID, "id", snapID, "error", err)
 		s.failures++
 		return false, err
@@ -362,16 +444,18 @@ func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
 	}
 
 	// Update the last contact
-	s.setLastContact()
+	s.setLastContact(start)
 
 	// Check for success
 	if resp.Success {
 		// Update the indexes
 		atomic.StoreUint64(&s.nextIndex, meta.Index+1)
+		atomic.StoreUint64(&s.matchIndex, meta.Index)
 		s.commitment.match(peer.ID, meta.Index)
 
 		// Clear any failures
 		s.failures = 0
+		s.catchUp = catchUpState{}
 
 		// Notify we are still leader
 		s.notifyAll(true)
@@ -382,17 +466,120 @@ func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
 	return false, nil
 }
 
+// sendSnapshotChunks sends a snapshot to a server in chunks, starting from
+// where the last attempt to send it left off, and records how far it got in
+// progress. It returns the response to the last chunk, or to the first one
+// the server rejected.
+func (r *Raft) sendSnapshotChunks(peer Server, last *snapshotProgress, req *InstallSnapshotRequest,
+	resp *InstallSnapshotResponse, snapshot *snapshotCursor, chunkSize int64) error {
+	progress := *last
+	if progress.id != snapshot.id {
+		progress = snapshotProgress{id: snapshot.id}
+	} else {
+		r.logger.Info("resuming snapshot transfer", "peer", peer.ID, "id", snapshot.id, "chunk", progress.chunk)
+	}
+	req.Chunked = true
+	req.SnapshotID = snapshot.id
+
+	bufSize := chunkSize
+	if req.Size < bufSize {
+		bufSize = req.Size
+	}
+	buf := make([]byte, bufSize)
+	resynced := false
+	for {
+		n := req.Size - progress.offset
+		if n > chunkSize {
+			n = chunkSize
+		}
+		chunk := buf[:n]
+		if err := snapshot.readAt(chunk, progress.offset); err != nil {
+			return err
+		}
+		req.ChunkIndex = progress.chunk
+		req.ChunkOffset = progress.offset
+		req.ChunkSize = n
+		req.ChunkChecksum = crc32.Checksum(chunk, snapshotChunkTable)
+
+		*resp = InstallSnapshotResponse{}
+		if err := r.trans.InstallSnapshot(peer.ID, peer.Address, req, resp, bytes.NewReader(chunk)); err != nil {
+			*last = progress
+			return err
+		}
+		if resp.Term > req.Term {
+			return nil
+		}
+
+		if !resp.Success {
+			// The follower expects a different chunk, for example because
+			// it lost the transfer, so carry on from there once.
+			if !resynced && resp.NextOffset <= req.Size &&
+				(resp.NextChunk != progress.chunk || resp.NextOffset != progress.offset) {
+				r.logger.Info("follower expects a different snapshot chunk", "peer", peer.ID,
+					"chunk", resp.NextChunk, "offset", resp.NextOffset)
+				progress.chunk, progress.offset = resp.NextChunk, resp.NextOffset
+				resynced = true
+				continue
+			}
+			*last = snapshotProgress{}
+			return nil
+		}
+		resynced = false
+		progress.chunk++
+		progress.offset += n
+		if progress.offset >= req.Size {
+			// The follower only reports success for the last chunk once it
+			// has installed the snapshot.
+			*last = snapshotProgress{}
+			return nil
+		}
+	}
+}
+
+// snapshotCursor reads a snapshot, reopening it when it needs to go back to an
+// earlier offset.
+type snapshotCursor struct {
+	open func(id string) (*SnapshotMeta, io.ReadCloser, error)
+	id   string
+	rc   io.ReadCloser
+	pos  int64
+}
+
+// Read implements io.Reader.
+func (c *snapshotCursor) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+// readAt fills p with the snapshot data starting at offset.
+func (c *snapshotCursor) readAt(p []byte, offset int64) error {
+	if offset < c.pos {
+		_ = c.rc.Close()
+		_, rc, err := c.open(c.id)
+		if err != nil {
+			return err
+		}
+		c.rc, c.pos = rc, 0
+	}
+	if _, err := io.CopyN(io.Discard, c, offset-c.pos); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(c, p)
+	return err
+}
+
+// Close closes the snapshot.
+func (c *snapshotCursor) Close() error {
+	return c.rc.Close()
+}
+
 // heartbeat is used to periodically invoke AppendEntries on a peer
 // to ensure they don't time out. This is done async of replicate(),
 // since that routine could potentially be blocked on disk IO.
 func (r *Raft) heartbeat(s *followerReplication, stopCh chan struct{}) {
 	var failures uint64
-	req := AppendEntriesRequest{
-		RPCHeader: r.getRPCHeader(),
-		Term:      s.currentTerm,
-		// this is needed for retro compatibility, before RPCHeader.Addr was added
-		Leader: r.trans.EncodePeer(r.localID, r.localAddr),
-	}
+	req := r.heartbeatRequest(s)
 
 	var resp AppendEntriesResponse
 	for {
@@ -409,36 +596,114 @@ func (r *Raft) heartbeat(s *followerReplication, stopCh chan struct{}) {
 		s.peerLock.RUnlock()
 
 		start := time.Now()
-		if err := r.trans.AppendEntries(peer.ID, peer.Address, &req, &resp); err != nil {
-			nextBackoffTime := cappedExponentialBackoff(failureWait, failures, maxFailureScale, r.config().HeartbeatTimeout/2)
-			r.logger.Error("failed to heartbeat to", "peer", peer.Address, "backoff time",
-				nextBackoffTime, "error", err)
-			r.observe(FailedHeartbeatObservation{PeerID: peer.ID, LastContact: s.LastContact()})
-			failures++
+		err := r.trans.AppendEntries(peer.ID, peer.Address, req, &resp)
+		if backoff := r.heartbeatDone(s, peer, &failures, start, &resp, err); backoff > 0 {
 			select {
-			case <-time.After(nextBackoffTime):
+			case <-time.After(backoff):
 			case <-stopCh:
 				return
 			}
-		} else {
-			if failures > 0 {
-				r.observe(ResumedHeartbeatObservation{PeerID: peer.ID})
-			}
-			s.setLastContact()
-			failures = 0
-			labels := []metrics.Label{{Name: "peer_id", Value: string(peer.ID)}}
-			metrics.MeasureSinceWithLabels([]string{"raft", "replication", "heartbeat"}, start, labels)
-
-			if !r.noLegacyTelemetry {
-				// Duplicated information. Kept for backward compatibility.
-				metrics.MeasureSince([]string{"raft", "replication", "heartbeat", string(peer.ID)}, start)
-			}
-
-			s.notifyAll(resp.Success)
 		}
 	}
 }
 
+// heartbeatRequest returns the heartbeat to send to a follower.
+func (r *Raft) heartbeatRequest(s *followerReplication) *AppendEntriesRequest {
+	return &AppendEntriesRequest{
+		RPCHeader: r.getRPCHeader(),
+		Term:      s.currentTerm,
+		// this is needed for retro compatibility, before RPCHeader.Addr was added
+		Leader: r.trans.EncodePeer(r.localID, r.localAddr),
+	}
+}
+
+// heartbeatDone handles the outcome of a heartbeat sent to a follower at
+// start, counting consecutive failures in failures. It returns how long to
+// back off before the next heartbeat.
+func (r *Raft) heartbeatDone(s *followerReplication, peer Server, failures *uint64, start time.Time, resp *AppendEntriesResponse, err error) time.Duration {
+	if err != nil {
+		nextBackoffTime := cappedExponentialBackoff(failureWait, *failures, maxFailureScale, r.config().HeartbeatTimeout/2)
+		r.logger.Error("failed to heartbeat to", "peer", peer.Address, "backoff time",
+			nextBackoffTime, "error", err)
+		r.observe(FailedHeartbeatObservation{PeerID: peer.ID, LastContact: s.LastContact()})
+		*failures++
+		return nextBackoffTime
+	}
+
+	if *failures > 0 {
+		r.observe(ResumedHeartbeatObservation{PeerID: peer.ID})
+	}
+	s.setLastContact(start)
+	*failures = 0
+	labels := []metrics.Label{{Name: "peer_id", Value: string(peer.ID)}}
+	metrics.MeasureSinceWithLabels([]string{"raft", "replication", "heartbeat"}, start, labels)
+
+	if !r.noLegacyTelemetry {
+		// Duplicated information. Kept for backward compatibility.
+		metrics.MeasureSince([]string{"raft", "replication", "heartbeat", string(peer.ID)}, start)
+	}
+
+	s.notifyAll(resp.Success)
+	return 0
+}
+
+// heartbeatScheduler is implemented by transports that send the heartbeats of
+// many Rafts from one shared ticker, such as the transports of the groups on
+// a MultiRaft, so that each follower doesn't need a heartbeat goroutine.
+type heartbeatScheduler interface {
+	// scheduleHeartbeats starts sending the heartbeats of a task, until the
+	// returned schedule is stopped.
+	scheduleHeartbeats(task *heartbeatTask) heartbeatSchedule
+}
+
+// heartbeatTask describes the heartbeats to send to a follower.
+type heartbeatTask struct {
+	// req is the heartbeat to send.
+	req *AppendEntriesRequest
+
+	// interval returns how often to send a heartbeat. The scheduler may send
+	// them up to twice as often, to send them with other heartbeats.
+	interval func() time.Duration
+
+	// peer returns the follower to send heartbeats to.
+	peer func() Server
+
+	// done is called with the outcome of each heartbeat, and returns how
+	// long to back off before the next one. At most one heartbeat to the
+	// follower is outstanding at a time.
+	done func(peer Server, start time.Time, resp *AppendEntriesResponse, err error) time.Duration
+}
+
+// heartbeatSchedule controls the heartbeats a heartbeatScheduler sends to a
+// follower.
+type heartbeatSchedule interface {
+	// trigger sends a heartbeat as soon as possible.
+	trigger()
+
+	// stop stops sending heartbeats.
+	stop()
+}
+
+// heartbeatTask returns the heartbeats to send to a follower when the
+// transport is a heartbeatScheduler.
+func (r *Raft) heartbeatTask(s *followerReplication) *heartbeatTask {
+	var failures uint64
+	return &heartbeatTask{
+		req: r.heartbeatRequest(s),
+		interval: func() time.Duration {
+			return r.config().HeartbeatTimeout / 10
+		},
+		peer: func() Server {
+			s.peerLock.RLock()
+			defer s.peerLock.RUnlock()
+			return s.peer
+		},
+		done: func(peer Server, start time.Time, resp *AppendEntriesResponse, err error) time.Duration {
+			return r.heartbeatDone(s, peer, &failures, start, resp, err)
+		},
+	}
+}
+
 // pipelineReplicate is used when we have synchronized our state with the follower,
 // and want to switch to a higher performance pipeline mode of replication.
 // We only pipeline AppendEntries commands, and if we ever hit an error, we fall
@@ -551,7 +816,7 @@ func (r *Raft) pipelineDecode(s *followerReplication, p AppendPipeline, stopCh,
 			}
 
 			// Update the last contact
-			s.setLastContact()
+			s.setLastContact(ready.Start())
 
 			// Abort pipeline if not successful
 			if !resp.Success {
@@ -576,7 +841,10 @@ func (r *Raft) setupAppendEntries(s *followerReplication, req *AppendEntriesRequ
 	if err := r.setPreviousLog(req, nextIndex); err != nil {
 		return err
 	}
-	if err := r.setNewLogs(req, nextIndex, lastIndex); err != nil {
+	s.peerLock.RLock()
+	witness := s.peer.Suffrage == Witness
+	s.peerLock.RUnlock()
+	if err := r.setNewLogs(req, nextIndex, lastIndex, witness); err != nil {
 		return err
 	}
 	return nil
@@ -611,7 +879,8 @@ func (r *Raft) setPreviousLog(req *AppendEntriesRequest, nextIndex uint64) error
 }
 
 // setNewLogs is used to setup the logs which should be appended for a request.
-func (r *Raft) setNewLogs(req *AppendEntriesRequest, nextIndex, lastIndex uint64) error {
+// A witness is only sent the index and term of commands, without their data.
+func (r *Raft) setNewLogs(req *AppendEntriesRequest, nextIndex, lastIndex uint64, witness bool) error {
 	// Append up to MaxAppendEntries or up to the lastIndex. we need to use a
 	// consistent value for maxAppendEntries in the lines below in case it ever
 	// becomes reloadable.
@@ -624,6 +893,10 @@ func (r *Raft) setNewLogs(req *AppendEntriesRequest, nextIndex, lastIndex uint64
 			r.logger.Error("failed to get log", "index", i, "error", err)
 			return err
 		}
+		if witness && oldLog.Type == LogCommand {
+			oldLog.Data = nil
+			oldLog.Extensions = nil
+		}
 		req.Entries = append(req.Entries, oldLog)
 	}
 	return nil
@@ -657,7 +930,15 @@ func updateLastAppended(s *followerReplication, req *AppendEntriesRequest) {
 	if logs := req.Entries; len(logs) > 0 {
 		last := logs[len(logs)-1]
 		atomic.StoreUint64(&s.nextIndex, last.Index+1)
+		atomic.StoreUint64(&s.matchIndex, last.Index)
 		s.commitment.match(s.peer.ID, last.Index)
+	} else if req.PrevLogEntry > atomic.LoadUint64(&s.matchIndex) {
+		// Without entries, the follower still confirmed that its log matches
+		// ours up to the previous entry. This keeps an idle follower that was
+		// already caught up from looking behind. Heartbeats don't say where
+		// the follower's log is, so they can't do the same.
+		atomic.StoreUint64(&s.matchIndex, req.PrevLogEntry)
+		s.commitment.match(s.peer.ID, req.PrevLogEntry)
 	}
 
 	// Notify still leader
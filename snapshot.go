@@ -37,6 +37,27 @@ type SnapshotMeta struct {
 
 	// Size is the size of the snapshot in bytes.
 	Size int64
+
+	// Checksum is the CRC-64 (ECMA) of the snapshot, if the store tracks it.
+	// It's sent along with the snapshot when it's installed on another
+	// server, which checks it before restoring the snapshot.
+	Checksum []byte
+
+	// Compression names the algorithm the snapshot is stored compressed
+	// with, or is empty if it isn't. Size and Checksum describe the
+	// uncompressed snapshot, which is what Open returns. See RawSnapshotStore.
+	Compression string
+
+	// ParentID is set for a delta snapshot, which only holds the changes an
+	// IncrementalFSM made since the snapshot with that ID. See
+	// DeltaSnapshotStore.
+	ParentID string
+
+	// Chain is the number of snapshots in the data Open returns when it's a
+	// full snapshot followed by the delta snapshots taken after it, each
+	// prefixed with its size as a big-endian uint64. It's zero when the data
+	// is a single full snapshot.
+	Chain int
 }
 
 // SnapshotStore interface is used to allow for flexible implementations
@@ -59,6 +80,39 @@ type SnapshotStore interface {
 	Open(id string) (*SnapshotMeta, io.ReadCloser, error)
 }
 
+// RawSnapshotStore is an interface that a SnapshotStore may provide if it
+// stores snapshots compressed. It lets snapshots be sent to other servers as
+// they're stored, without decompressing and compressing them again.
+type RawSnapshotStore interface {
+	// OpenRaw is like Open, but provides the snapshot as stored, compressed
+	// with the returned meta's Compression. The returned meta's Size and
+	// Checksum describe the stored data.
+	OpenRaw(id string) (*SnapshotMeta, io.ReadCloser, error)
+
+	// CreateRaw is like Create, but the returned sink takes a snapshot that's
+	// already compressed with the named algorithm, as provided by OpenRaw.
+	CreateRaw(version SnapshotVersion, index, term uint64, configuration Configuration,
+		configurationIndex uint64, trans Transport, compression string) (SnapshotSink, error)
+}
+
+// DeltaSnapshotStore is an interface that a SnapshotStore may provide to
+// store the delta snapshots of an IncrementalFSM. Open chains a delta
+// snapshot after its parents, back to the full snapshot they build on, and
+// sets Chain in the returned meta.
+type DeltaSnapshotStore interface {
+	// CreateDelta is like Create, but for a delta snapshot holding the
+	// changes since the snapshot with the given ID, which the store must
+	// keep for as long as it keeps the delta.
+	CreateDelta(parentID string, version SnapshotVersion, index, term uint64, configuration Configuration,
+		configurationIndex uint64, trans Transport) (SnapshotSink, error)
+
+	// CreateChain is like Create, but the returned sink takes a chain of the
+	// given number of snapshots, as returned by Open, which is how chains are
+	// sent to other servers.
+	CreateChain(chain int, version SnapshotVersion, index, term uint64, configuration Configuration,
+		configurationIndex uint64, trans Transport) (SnapshotSink, error)
+}
+
 // SnapshotSink is returned by StartSnapshot. The FSM will Write state
 // to the sink and call Close on completion. On error, Cancel will be invoked.
 type SnapshotSink interface {
@@ -126,9 +180,14 @@ func (r *Raft) shouldSnapshot() bool {
 func (r *Raft) takeSnapshot() (string, error) {
 	defer metrics.MeasureSince([]string{"raft", "snapshot", "takeSnapshot"}, time.Now())
 
-	// Create a request for the FSM to perform a snapshot.
+	// Create a request for the FSM to perform a snapshot, which is a delta
+	// one if it can build on the latest snapshot.
 	snapReq := &reqSnapshotFuture{}
 	snapReq.init()
+	parent := r.deltaSnapshotParent()
+	if parent != nil {
+		snapReq.sinceIndex = parent.Index
+	}
 
 	// Wait for dispatch or shutdown.
 	select {
@@ -144,7 +203,13 @@ func (r *Raft) takeSnapshot() (string, error) {
 		}
 		return "", err
 	}
-	defer snapReq.snapshot.Release()
+	defer func() {
+		if snapReq.snapshot != nil {
+			snapReq.snapshot.Release()
+		} else if snapReq.prepared != nil {
+			snapReq.prepared.Discard()
+		}
+	}()
 
 	// Make a request for the configurations and extract the committed info.
 	// We have to use the future here to safely get this information since
@@ -176,11 +241,30 @@ func (r *Raft) takeSnapshot() (string, error) {
 			committedIndex, snapReq.index)
 	}
 
+	// Turn a prepared view into a snapshot, while the FSM carries on
+	// applying logs.
+	if prepared := snapReq.prepared; prepared != nil {
+		snapReq.prepared = nil
+		snap, err := prepared.Snapshot()
+		if err != nil {
+			return "", fmt.Errorf("failed to start snapshot: %v", err)
+		}
+		snapReq.snapshot = snap
+	}
+
 	// Create a new snapshot.
-	r.logger.Info("starting snapshot up to", "index", snapReq.index)
 	start := time.Now()
 	version := getSnapshotVersion(r.protocolVersion)
-	sink, err := r.snapshots.Create(version, snapReq.index, snapReq.term, committed, committedIndex, r.trans)
+	var sink SnapshotSink
+	var err error
+	if snapReq.sinceIndex > 0 {
+		r.logger.Info("starting delta snapshot up to", "index", snapReq.index, "since", snapReq.sinceIndex)
+		sink, err = r.snapshots.(DeltaSnapshotStore).CreateDelta(parent.ID, version,
+			snapReq.index, snapReq.term, committed, committedIndex, r.trans)
+	} else {
+		r.logger.Info("starting snapshot up to", "index", snapReq.index)
+		sink, err = r.snapshots.Create(version, snapReq.index, snapReq.term, committed, committedIndex, r.trans)
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to create snapshot: %v", err)
 	}
@@ -211,10 +295,38 @@ func (r *Raft) takeSnapshot() (string, error) {
 	return sink.ID(), nil
 }
 
+// deltaSnapshotParent returns the snapshot the next snapshot can be a delta
+// of, or nil if it must be a full one. Whether the FSM still has what changed
+// since then is up to it; see IncrementalFSM.
+func (r *Raft) deltaSnapshotParent() *SnapshotMeta {
+	maxDeltas := r.config().MaxSnapshotDeltas
+	if maxDeltas <= 0 {
+		return nil
+	}
+	if _, ok := r.fsm.(IncrementalFSM); !ok {
+		return nil
+	}
+	if _, ok := r.snapshots.(DeltaSnapshotStore); !ok {
+		return nil
+	}
+	snapshots, err := r.snapshots.List()
+	if err != nil || len(snapshots) == 0 {
+		return nil
+	}
+
+	// Take a full snapshot once the chain is long enough, so that restoring
+	// it doesn't take ever longer.
+	if latest := snapshots[0]; latest.Chain <= maxDeltas {
+		return latest
+	}
+	return nil
+}
+
 // compactLogsWithTrailing takes the last inclusive index of a snapshot,
 // the lastLogIdx, and the trailingLogs and trims the logs that
-// are no longer needed.
-func (r *Raft) compactLogsWithTrailing(snapIdx uint64, lastLogIdx uint64, trailingLogs uint64) error {
+// are no longer needed. Only the logs up to committedIdx are archived
+// first, as any after it may never have been committed.
+func (r *Raft) compactLogsWithTrailing(snapIdx uint64, lastLogIdx uint64, trailingLogs uint64, committedIdx uint64) error {
 	// Determine log ranges to compact
 	minLog, err := r.logs.FirstIndex()
 	if err != nil {
@@ -239,6 +351,11 @@ func (r *Raft) compactLogsWithTrailing(snapIdx uint64, lastLogIdx uint64, traili
 		return nil
 	}
 
+	// Make sure the committed logs are archived before they're gone
+	if err := r.archiveLogs(minLog, min(maxLog, committedIdx)); err != nil {
+		return fmt.Errorf("log archiving failed: %v", err)
+	}
+
 	r.logger.Info("compacting logs", "from", minLog, "to", maxLog)
 
 	// Compact the logs
@@ -249,20 +366,33 @@ func (r *Raft) compactLogsWithTrailing(snapIdx uint64, lastLogIdx uint64, traili
 }
 
 // compactLogs takes the last inclusive index of a snapshot
-// and trims the logs that are no longer needed.
+// and trims the logs that are no longer needed. Every log up to the
+// snapshot is committed, so those are archived first.
 func (r *Raft) compactLogs(snapIdx uint64) error {
 	defer metrics.MeasureSince([]string{"raft", "compactLogs"}, time.Now())
 
 	lastLogIdx, _ := r.getLastLog()
 	trailingLogs := r.config().TrailingLogs
 
-	return r.compactLogsWithTrailing(snapIdx, lastLogIdx, trailingLogs)
+	return r.compactLogsWithTrailing(snapIdx, lastLogIdx, trailingLogs, snapIdx)
+}
+
+// archiveLogs gives the logs from first to last, inclusive, to the
+// LogArchiver, if one is set.
+func (r *Raft) archiveLogs(first, last uint64) error {
+	archiver := r.config().LogArchiver
+	if archiver == nil || first > last {
+		return nil
+	}
+	defer metrics.MeasureSince([]string{"raft", "archiveLogs"}, time.Now())
+	return archiver.ArchiveLogs(r.logs, first, last)
 }
 
 // removeOldLogs removes all old logs from the store. This is used for
 // MonotonicLogStores after restore. Callers should verify that the store
-// implementation is monotonic prior to calling.
-func (r *Raft) removeOldLogs() error {
+// implementation is monotonic prior to calling. The logs up to committedIdx
+// are archived first, and none are removed if that fails.
+func (r *Raft) removeOldLogs(committedIdx uint64) error {
 	defer metrics.MeasureSince([]string{"raft", "removeOldLogs"}, time.Now())
 
 	lastLogIdx, err := r.logs.LastIndex()
@@ -275,5 +405,5 @@ func (r *Raft) removeOldLogs() error {
 	// call compactLogsWithTrailing with lastLogIdx for snapIdx since
 	// it will take the lesser of lastLogIdx and snapIdx to figure out
 	// the end for which to apply trailingLogs.
-	return r.compactLogsWithTrailing(lastLogIdx, lastLogIdx, 0)
+	return r.compactLogsWithTrailing(lastLogIdx, lastLogIdx, 0, committedIdx)
 }
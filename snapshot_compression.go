@@ -0,0 +1,237 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+)
+
+// SnapshotCompressionGzip is the name of the built-in gzip compression.
+const SnapshotCompressionGzip = "gzip"
+
+var (
+	// ErrSnapshotChecksum is returned when a snapshot doesn't match the
+	// checksum it was sent with, so it is discarded instead of restored.
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+	// snapshotCRCTable is used for the checksums of snapshots.
+	snapshotCRCTable = crc64.MakeTable(crc64.ECMA)
+)
+
+// SnapshotCompressor compresses snapshots in a SnapshotStore. Servers that
+// exchange snapshots must agree on the compressors they use by Name; gzip is
+// always available.
+type SnapshotCompressor interface {
+	// Name identifies the compression in snapshot metadata and on the wire.
+	Name() string
+
+	// NewWriter returns a writer that compresses into w. Closing it must
+	// flush all compressed data to w, but not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader that decompresses r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCompressor is a SnapshotCompressor using gzip.
+type GzipCompressor struct {
+	// Level is the gzip compression level. Zero uses gzip.DefaultCompression.
+	Level int
+}
+
+// Name implements the SnapshotCompressor interface.
+func (g *GzipCompressor) Name() string {
+	return SnapshotCompressionGzip
+}
+
+// NewWriter implements the SnapshotCompressor interface.
+func (g *GzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// NewReader implements the SnapshotCompressor interface.
+func (g *GzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// builtinSnapshotCompressor returns the built-in compressor with the given
+// name, or nil if there is none.
+func builtinSnapshotCompressor(name string) SnapshotCompressor {
+	switch name {
+	case SnapshotCompressionGzip:
+		return &GzipCompressor{}
+	default:
+		return nil
+	}
+}
+
+// decompressingReader closes both the decompressor and the reader below it.
+type decompressingReader struct {
+	io.ReadCloser
+	underlying io.Closer
+}
+
+func (d *decompressingReader) Close() error {
+	err := d.ReadCloser.Close()
+	if closeErr := d.underlying.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// decompressingSink decompresses a compressed snapshot into a sink that
+// takes it uncompressed, for stores that don't implement RawSnapshotStore.
+type decompressingSink struct {
+	SnapshotSink
+	pw    *io.PipeWriter
+	errCh chan error
+}
+
+// newDecompressingSink returns a sink that decompresses the named compression
+// into sink. The sink is canceled if the compression isn't known.
+func newDecompressingSink(sink SnapshotSink, compression string) (SnapshotSink, error) {
+	compressor := builtinSnapshotCompressor(compression)
+	if compressor == nil {
+		_ = sink.Cancel()
+		return nil, fmt.Errorf("unknown snapshot compression %q", compression)
+	}
+
+	pr, pw := io.Pipe()
+	d := &decompressingSink{
+		SnapshotSink: sink,
+		pw:           pw,
+		errCh:        make(chan error, 1),
+	}
+	go func() {
+		err := d.decompress(compressor, pr)
+		_ = pr.CloseWithError(err)
+		d.errCh <- err
+	}()
+	return d, nil
+}
+
+// decompress copies the decompressed snapshot from r into the sink.
+func (d *decompressingSink) decompress(compressor SnapshotCompressor, r io.Reader) error {
+	dec, err := compressor.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dec.Close() }()
+	if _, err := io.Copy(d.SnapshotSink, dec); err != nil {
+		return err
+	}
+	// Make sure nothing trails the compressed data.
+	if n, _ := io.Copy(io.Discard, r); n > 0 {
+		return fmt.Errorf("%d bytes after compressed snapshot", n)
+	}
+	return nil
+}
+
+func (d *decompressingSink) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+// Close finishes decompressing, and closes the sink if that succeeded or
+// cancels it otherwise.
+func (d *decompressingSink) Close() error {
+	_ = d.pw.Close()
+	if err := <-d.errCh; err != nil {
+		_ = d.SnapshotSink.Cancel()
+		return fmt.Errorf("failed to decompress snapshot: %w", err)
+	}
+	return d.SnapshotSink.Close()
+}
+
+func (d *decompressingSink) Cancel() error {
+	_ = d.pw.CloseWithError(errors.New("snapshot canceled"))
+	<-d.errCh
+	return d.SnapshotSink.Cancel()
+}
+
+// checksumSink checks the data written to a sink against a checksum when it
+// is closed, and cancels the sink instead if they don't match.
+type checksumSink struct {
+	SnapshotSink
+	hash     hash.Hash64
+	expected []byte
+}
+
+// newChecksumSink returns sink checking the given checksum, if there is one.
+func newChecksumSink(sink SnapshotSink, checksum []byte) SnapshotSink {
+	if len(checksum) == 0 {
+		return sink
+	}
+	return &checksumSink{
+		SnapshotSink: sink,
+		hash:         crc64.New(snapshotCRCTable),
+		expected:     checksum,
+	}
+}
+
+func (c *checksumSink) Write(p []byte) (int, error) {
+	n, err := c.SnapshotSink.Write(p)
+	c.hash.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumSink) Close() error {
+	if computed := c.hash.Sum(nil); !bytes.Equal(computed, c.expected) {
+		_ = c.SnapshotSink.Cancel()
+		return fmt.Errorf("%w: expected %x, computed %x", ErrSnapshotChecksum, c.expected, computed)
+	}
+	return c.SnapshotSink.Close()
+}
+
+// openSnapshotToSend opens a snapshot to send to another server, as it is
+// stored if the store supports that.
+func (r *Raft) openSnapshotToSend(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	if raw, ok := r.snapshots.(RawSnapshotStore); ok {
+		return raw.OpenRaw(id)
+	}
+	return r.snapshots.Open(id)
+}
+
+// createSnapshotToInstall creates a sink for a snapshot sent by another
+// server, which decompresses it if needed and checks it against the checksum
+// it was sent with.
+func (r *Raft) createSnapshotToInstall(req *InstallSnapshotRequest, configuration Configuration, configurationIndex uint64) (SnapshotSink, error) {
+	version := getSnapshotVersion(r.protocolVersion)
+	var sink SnapshotSink
+	var err error
+	if req.Chain > 0 {
+		// A chain of snapshots is stored as one
+		deltas, ok := r.snapshots.(DeltaSnapshotStore)
+		if !ok {
+			return nil, fmt.Errorf("snapshot store can't store a chain of %d snapshots", req.Chain)
+		}
+		sink, err = deltas.CreateChain(req.Chain, version, req.LastLogIndex, req.LastLogTerm,
+			configuration, configurationIndex, r.trans)
+		if err == nil && req.Compression != "" {
+			sink, err = newDecompressingSink(sink, req.Compression)
+		}
+	} else if raw, ok := r.snapshots.(RawSnapshotStore); ok && req.Compression != "" {
+		sink, err = raw.CreateRaw(version, req.LastLogIndex, req.LastLogTerm,
+			configuration, configurationIndex, r.trans, req.Compression)
+	} else {
+		sink, err = r.snapshots.Create(version, req.LastLogIndex, req.LastLogTerm,
+			configuration, configurationIndex, r.trans)
+		if err == nil && req.Compression != "" {
+			sink, err = newDecompressingSink(sink, req.Compression)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newChecksumSink(sink, req.Checksum), nil
+}
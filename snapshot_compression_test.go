@@ -0,0 +1,58 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc64"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecompressingSink(t *testing.T) {
+	data := bytes.Repeat([]byte("compress me\n"), 1000)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	store := NewInmemSnapshotStore()
+	_, trans := NewInmemTransport(NewInmemAddr())
+	create := func() SnapshotSink {
+		sink, err := store.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans)
+		require.NoError(t, err)
+		sink, err = newDecompressingSink(sink, SnapshotCompressionGzip)
+		require.NoError(t, err)
+		return sink
+	}
+
+	// Compressed data is stored uncompressed.
+	sink := create()
+	_, err = io.Copy(sink, bytes.NewReader(compressed.Bytes()))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	meta, r, err := store.Open(sink.ID())
+	require.NoError(t, err)
+	read, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+	require.Equal(t, crc64.Checksum(data, snapshotCRCTable), binary.BigEndian.Uint64(meta.Checksum))
+
+	// Truncated data fails to close.
+	sink = create()
+	_, err = sink.Write(compressed.Bytes()[:compressed.Len()/2])
+	require.NoError(t, err)
+	require.Error(t, sink.Close())
+
+	// Unknown compression is rejected.
+	sink, err = store.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans)
+	require.NoError(t, err)
+	_, err = newDecompressingSink(sink, "unknown")
+	require.Error(t, err)
+}
@@ -0,0 +1,81 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// snapshotChainHeaderSize is the size of the header before each snapshot in a
+// chain, which holds the snapshot's size.
+const snapshotChainHeaderSize = 8
+
+// ErrSnapshotDeltaUnavailable is returned by IncrementalFSM.SnapshotDelta when
+// it can't tell what changed since the given index.
+var ErrSnapshotDeltaUnavailable = errors.New("snapshot delta unavailable")
+
+// snapshotChainHeader returns the header before a snapshot of the given size
+// in a chain.
+func snapshotChainHeader(size int64) []byte {
+	header := make([]byte, snapshotChainHeaderSize)
+	binary.BigEndian.PutUint64(header, uint64(size))
+	return header
+}
+
+// restoreSnapshotChain restores an FSM from a snapshot, which is a chain of
+// the given number of snapshots if that's not zero. The first of them is
+// restored with Restore, and the deltas after it with RestoreDelta.
+func restoreSnapshotChain(fsm FSM, source io.ReadCloser, chain int) error {
+	if chain == 0 {
+		return fsm.Restore(source)
+	}
+	incremental, ok := fsm.(IncrementalFSM)
+	if !ok && chain > 1 {
+		return fmt.Errorf("snapshot is a chain of %d snapshots, but the FSM can't restore deltas", chain)
+	}
+
+	header := make([]byte, snapshotChainHeaderSize)
+	for i := 0; i < chain; i++ {
+		if _, err := io.ReadFull(source, header); err != nil {
+			return fmt.Errorf("failed to read snapshot %d of chain: %w", i, err)
+		}
+		link := io.LimitReader(source, int64(binary.BigEndian.Uint64(header)))
+
+		var err error
+		if i == 0 {
+			err = fsm.Restore(io.NopCloser(link))
+		} else {
+			err = incremental.RestoreDelta(io.NopCloser(link))
+		}
+		if err != nil {
+			return err
+		}
+
+		// Skip whatever the FSM didn't read, to get to the next header
+		if _, err := io.Copy(io.Discard, link); err != nil {
+			return fmt.Errorf("failed to read snapshot %d of chain: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// snapshotChainReader reads a chain of snapshots, and closes all of them when
+// it's closed.
+type snapshotChainReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *snapshotChainReader) Close() error {
+	var err error
+	for _, closer := range s.closers {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,361 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package storetest
+
+// storetest provides conformance tests which can be used by anything which
+// implements the raft.LogStore and raft.StableStore interfaces, and the
+// optional raft.CommitTrackingLogStore and raft.MonotonicLogStore ones. Each
+// function checks a store against the contracts Raft relies on, in subtests,
+// using the given function to get a new, empty store for each of them.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// logs returns logs with the given indexes, in the given term.
+func logs(first, last, term uint64) []*raft.Log {
+	var logs []*raft.Log
+	for i := first; i <= last; i++ {
+		logs = append(logs, &raft.Log{
+			Index:      i,
+			Term:       term,
+			Type:       raft.LogCommand,
+			Data:       []byte(fmt.Sprintf("data %d-%d", term, i)),
+			Extensions: []byte(fmt.Sprintf("ext %d", i)),
+			AppendedAt: time.Unix(1700000000, int64(i)),
+		})
+	}
+	return logs
+}
+
+// storeLogs stores logs, failing the test on error.
+func storeLogs(t *testing.T, store raft.LogStore, logs []*raft.Log) {
+	t.Helper()
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("failed to store logs %d to %d: %v", logs[0].Index, logs[len(logs)-1].Index, err)
+	}
+}
+
+// deleteRange deletes logs, failing the test on error.
+func deleteRange(t *testing.T, store raft.LogStore, min, max uint64) {
+	t.Helper()
+	if err := store.DeleteRange(min, max); err != nil {
+		t.Fatalf("failed to delete logs %d to %d: %v", min, max, err)
+	}
+}
+
+// checkIndexes checks the first and last index of a store.
+func checkIndexes(t *testing.T, store raft.LogStore, first, last uint64) {
+	t.Helper()
+	idx, err := store.FirstIndex()
+	if err != nil {
+		t.Fatalf("FirstIndex failed: %v", err)
+	}
+	if idx != first {
+		t.Fatalf("FirstIndex is %d, expected %d", idx, first)
+	}
+	idx, err = store.LastIndex()
+	if err != nil {
+		t.Fatalf("LastIndex failed: %v", err)
+	}
+	if idx != last {
+		t.Fatalf("LastIndex is %d, expected %d", idx, last)
+	}
+}
+
+// checkLogs checks that a store holds the given logs.
+func checkLogs(t *testing.T, store raft.LogStore, logs []*raft.Log) {
+	t.Helper()
+	for _, want := range logs {
+		var got raft.Log
+		if err := store.GetLog(want.Index, &got); err != nil {
+			t.Fatalf("GetLog(%d) failed: %v", want.Index, err)
+		}
+		if got.Index != want.Index || got.Term != want.Term || got.Type != want.Type ||
+			!bytes.Equal(got.Data, want.Data) || !bytes.Equal(got.Extensions, want.Extensions) ||
+			!got.AppendedAt.Equal(want.AppendedAt) {
+			t.Fatalf("GetLog(%d) returned %+v, expected %+v", want.Index, got, *want)
+		}
+	}
+}
+
+// checkNotFound checks that a store doesn't hold the logs with the given
+// indexes.
+func checkNotFound(t *testing.T, store raft.LogStore, first, last uint64) {
+	t.Helper()
+	for i := first; i <= last; i++ {
+		var log raft.Log
+		if err := store.GetLog(i, &log); !errors.Is(err, raft.ErrLogNotFound) {
+			t.Fatalf("GetLog(%d) returned %v, expected ErrLogNotFound", i, err)
+		}
+	}
+}
+
+// CheckLogStore checks the LogStore contracts. Logs are stored with
+// consecutive indexes, as Raft stores them, so MonotonicLogStores can be
+// checked too.
+func CheckLogStore(t *testing.T, newStore func(t *testing.T) raft.LogStore) {
+	t.Run("Empty", func(t *testing.T) {
+		store := newStore(t)
+		checkIndexes(t, store, 0, 0)
+		checkNotFound(t, store, 0, 2)
+	})
+
+	t.Run("StoreLogs", func(t *testing.T) {
+		store := newStore(t)
+		storeLogs(t, store, logs(1, 10, 1))
+		if err := store.StoreLog(logs(11, 11, 1)[0]); err != nil {
+			t.Fatalf("StoreLog failed: %v", err)
+		}
+		checkIndexes(t, store, 1, 11)
+		checkLogs(t, store, logs(1, 11, 1))
+		checkNotFound(t, store, 12, 12)
+	})
+
+	t.Run("DeleteRangePrefix", func(t *testing.T) {
+		// This is how Raft compacts the log after a snapshot.
+		store := newStore(t)
+		storeLogs(t, store, logs(1, 20, 1))
+		deleteRange(t, store, 1, 10)
+		checkIndexes(t, store, 11, 20)
+		checkNotFound(t, store, 1, 10)
+		checkLogs(t, store, logs(11, 20, 1))
+
+		deleteRange(t, store, 11, 15)
+		checkIndexes(t, store, 16, 20)
+		storeLogs(t, store, logs(21, 25, 2))
+		checkIndexes(t, store, 16, 25)
+		checkLogs(t, store, logs(16, 20, 1))
+		checkLogs(t, store, logs(21, 25, 2))
+	})
+
+	t.Run("DeleteRangeSuffix", func(t *testing.T) {
+		// This is how Raft removes conflicting logs on a follower.
+		store := newStore(t)
+		storeLogs(t, store, logs(1, 20, 1))
+		deleteRange(t, store, 15, 20)
+		checkIndexes(t, store, 1, 14)
+		checkNotFound(t, store, 15, 20)
+
+		// The deleted logs can be replaced.
+		storeLogs(t, store, logs(15, 18, 2))
+		checkIndexes(t, store, 1, 18)
+		checkLogs(t, store, logs(1, 14, 1))
+		checkLogs(t, store, logs(15, 18, 2))
+		checkNotFound(t, store, 19, 20)
+	})
+
+	t.Run("DeleteRangeSuffixAnywhere", func(t *testing.T) {
+		// Stores that keep logs in chunks, such as files, must handle a
+		// suffix that starts at the beginning of one.
+		for min := uint64(2); min <= 40; min++ {
+			store := newStore(t)
+			storeLogs(t, store, logs(1, 40, 1))
+			deleteRange(t, store, min, 40)
+			checkIndexes(t, store, 1, min-1)
+			checkNotFound(t, store, min, 40)
+
+			storeLogs(t, store, logs(min, 40, 2))
+			checkIndexes(t, store, 1, 40)
+			checkLogs(t, store, logs(1, min-1, 1))
+			checkLogs(t, store, logs(min, 40, 2))
+		}
+	})
+
+	t.Run("DeleteRangeAll", func(t *testing.T) {
+		// This is how Raft clears the log when it restores a snapshot past
+		// its end. The next logs leave a gap behind, which must not show.
+		store := newStore(t)
+		storeLogs(t, store, logs(1, 10, 1))
+		deleteRange(t, store, 1, 10)
+		checkIndexes(t, store, 0, 0)
+		checkNotFound(t, store, 1, 10)
+
+		storeLogs(t, store, logs(101, 110, 2))
+		checkIndexes(t, store, 101, 110)
+		checkNotFound(t, store, 1, 100)
+		checkLogs(t, store, logs(101, 110, 2))
+	})
+
+	t.Run("DeleteRangeMissing", func(t *testing.T) {
+		// Deleting logs that are already gone is harmless.
+		store := newStore(t)
+		storeLogs(t, store, logs(11, 20, 1))
+		deleteRange(t, store, 1, 5)
+		deleteRange(t, store, 30, 40)
+		checkIndexes(t, store, 11, 20)
+		checkLogs(t, store, logs(11, 20, 1))
+	})
+}
+
+// CheckMonotonicLogStore checks a MonotonicLogStore, in addition to the
+// checks of CheckLogStore.
+func CheckMonotonicLogStore(t *testing.T, newStore func(t *testing.T) raft.LogStore) {
+	t.Run("IsMonotonic", func(t *testing.T) {
+		store, ok := newStore(t).(raft.MonotonicLogStore)
+		if !ok || !store.IsMonotonic() {
+			t.Fatalf("store is not monotonic")
+		}
+	})
+	CheckLogStore(t, newStore)
+}
+
+// CheckStableStore checks the StableStore contracts.
+func CheckStableStore(t *testing.T, newStore func(t *testing.T) raft.StableStore) {
+	t.Run("Missing", func(t *testing.T) {
+		// Raft accepts either an empty value or a "not found" error.
+		store := newStore(t)
+		val, err := store.Get([]byte("missing"))
+		if (err != nil && err.Error() != "not found") || len(val) != 0 {
+			t.Fatalf("Get of a missing key returned %q, %v", val, err)
+		}
+		n, err := store.GetUint64([]byte("missing"))
+		if (err != nil && err.Error() != "not found") || n != 0 {
+			t.Fatalf("GetUint64 of a missing key returned %d, %v", n, err)
+		}
+	})
+
+	t.Run("SetGet", func(t *testing.T) {
+		store := newStore(t)
+		keys := [][]byte{[]byte("key"), {0x00}, {0xff, 0xfe}}
+		for i, key := range keys {
+			if err := store.Set(key, []byte(fmt.Sprintf("val %d", i))); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+		}
+		if err := store.Set(keys[0], []byte("new val")); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+		for i, key := range keys {
+			want := []byte(fmt.Sprintf("val %d", i))
+			if i == 0 {
+				want = []byte("new val")
+			}
+			val, err := store.Get(key)
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if !bytes.Equal(val, want) {
+				t.Fatalf("Get(%q) returned %q, expected %q", key, val, want)
+			}
+		}
+	})
+
+	t.Run("SetGetUint64", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.SetUint64([]byte("term"), 1); err != nil {
+			t.Fatalf("SetUint64 failed: %v", err)
+		}
+		if err := store.SetUint64([]byte("term"), 1<<40); err != nil {
+			t.Fatalf("SetUint64 failed: %v", err)
+		}
+		if err := store.SetUint64([]byte("vote"), 3); err != nil {
+			t.Fatalf("SetUint64 failed: %v", err)
+		}
+		for key, want := range map[string]uint64{"term": 1 << 40, "vote": 3} {
+			n, err := store.GetUint64([]byte(key))
+			if err != nil {
+				t.Fatalf("GetUint64 failed: %v", err)
+			}
+			if n != want {
+				t.Fatalf("GetUint64(%q) returned %d, expected %d", key, n, want)
+			}
+		}
+	})
+}
+
+// CheckCommitTrackingLogStore checks a CommitTrackingLogStore, in addition
+// to the checks of CheckLogStore. If reopen is given, it must close the store
+// and open it again from what it persisted, as after a crash, so that the
+// commit index can be checked to be persisted along with the logs.
+func CheckCommitTrackingLogStore(t *testing.T, newStore func(t *testing.T) raft.CommitTrackingLogStore,
+	reopen func(t *testing.T, store raft.CommitTrackingLogStore) raft.CommitTrackingLogStore) {
+	CheckLogStore(t, func(t *testing.T) raft.LogStore { return newStore(t) })
+
+	getCommitIndex := func(t *testing.T, store raft.CommitTrackingLogStore) uint64 {
+		t.Helper()
+		index, err := store.GetCommitIndex()
+		if err != nil {
+			t.Fatalf("GetCommitIndex failed: %v", err)
+		}
+		return index
+	}
+	stage := func(t *testing.T, store raft.CommitTrackingLogStore, index uint64) {
+		t.Helper()
+		if err := store.StageCommitIndex(index); err != nil {
+			t.Fatalf("StageCommitIndex failed: %v", err)
+		}
+	}
+
+	t.Run("CommitIndexEmpty", func(t *testing.T) {
+		if index := getCommitIndex(t, newStore(t)); index != 0 {
+			t.Fatalf("GetCommitIndex returned %d for an empty store", index)
+		}
+	})
+
+	t.Run("CommitIndexPersisted", func(t *testing.T) {
+		if reopen == nil {
+			t.Skip("the store can't be reopened")
+		}
+		store := newStore(t)
+		storeLogs(t, store, logs(1, 5, 1))
+		stage(t, store, 3)
+		storeLogs(t, store, logs(6, 10, 1))
+		store = reopen(t, store)
+		if index := getCommitIndex(t, store); index != 3 {
+			t.Fatalf("GetCommitIndex returned %d after a restart, expected 3", index)
+		}
+
+		// A staged index that wasn't followed by logs isn't persisted.
+		stage(t, store, 8)
+		store = reopen(t, store)
+		if index := getCommitIndex(t, store); index != 3 {
+			t.Fatalf("GetCommitIndex returned %d after a restart, expected 3", index)
+		}
+		checkIndexes(t, store, 1, 10)
+		checkLogs(t, store, logs(1, 10, 1))
+	})
+
+	t.Run("FirstIndexAfterCompaction", func(t *testing.T) {
+		if reopen == nil {
+			t.Skip("the store can't be reopened")
+		}
+		// Logs deleted from the front of the log stay deleted after a
+		// restart, even if the store keeps some of them on disk until it
+		// can remove them.
+		store := newStore(t)
+		storeLogs(t, store, logs(1, 40, 1))
+		deleteRange(t, store, 1, 25)
+		store = reopen(t, store)
+		checkIndexes(t, store, 26, 40)
+		checkNotFound(t, store, 1, 25)
+		checkLogs(t, store, logs(26, 40, 1))
+
+		// Nor does a log cleared and started over show an earlier start.
+		deleteRange(t, store, 26, 40)
+		storeLogs(t, store, logs(101, 110, 2))
+		store = reopen(t, store)
+		checkIndexes(t, store, 101, 110)
+		checkLogs(t, store, logs(101, 110, 2))
+	})
+
+	t.Run("CommitIndexBounded", func(t *testing.T) {
+		if reopen == nil {
+			t.Skip("the store can't be reopened")
+		}
+		store := newStore(t)
+		stage(t, store, 100)
+		storeLogs(t, store, logs(1, 5, 1))
+		store = reopen(t, store)
+		if index := getCommitIndex(t, store); index > 5 {
+			t.Fatalf("GetCommitIndex returned %d, past the last index 5", index)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package storetest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestInmemStore(t *testing.T) {
+	CheckLogStore(t, func(t *testing.T) raft.LogStore { return raft.NewInmemStore() })
+	CheckStableStore(t, func(t *testing.T) raft.StableStore { return raft.NewInmemStore() })
+	CheckCommitTrackingLogStore(t, func(t *testing.T) raft.CommitTrackingLogStore {
+		return raft.NewInmemCommitTrackingStore()
+	}, nil)
+}
+
+func TestLogCache(t *testing.T) {
+	CheckLogStore(t, func(t *testing.T) raft.LogStore {
+		cache, err := raft.NewLogCache(4, raft.NewInmemStore())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return cache
+	})
+}
+
+func TestEncryptedLogStore(t *testing.T) {
+	CheckLogStore(t, func(t *testing.T) raft.LogStore {
+		keys, err := raft.NewKeyRing("key", bytes.Repeat([]byte{1}, 32))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return raft.NewEncryptedLogStore(raft.NewInmemStore(), keys)
+	})
+}
+
+func TestWALStore(t *testing.T) {
+	dirs := make(map[raft.CommitTrackingLogStore]string)
+	open := func(t *testing.T, dir string) *raft.WALStore {
+		store, err := raft.NewWALStoreWithConfig(dir, &raft.WALStoreConfig{SegmentSize: 512})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		t.Cleanup(func() { _ = store.Close() })
+		dirs[store] = dir
+		return store
+	}
+	newStore := func(t *testing.T) *raft.WALStore {
+		return open(t, t.TempDir())
+	}
+
+	CheckMonotonicLogStore(t, func(t *testing.T) raft.LogStore { return newStore(t) })
+	CheckStableStore(t, func(t *testing.T) raft.StableStore { return newStore(t) })
+	CheckCommitTrackingLogStore(t, func(t *testing.T) raft.CommitTrackingLogStore {
+		return newStore(t)
+	}, func(t *testing.T, store raft.CommitTrackingLogStore) raft.CommitTrackingLogStore {
+		if err := store.(*raft.WALStore).Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return open(t, dirs[store])
+	})
+}
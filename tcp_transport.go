@@ -68,7 +68,7 @@ func newTCPTransport(bindAddr string,
 	advertise net.Addr,
 	transportCreator func(stream StreamLayer) *NetworkTransport) (*NetworkTransport, error) {
 	// Try to bind
-	list, err := net.Listen("tcp", bindAddr)
+	list, err := listenTCP(bindAddr, advertise)
 	if err != nil {
 		return nil, err
 	}
@@ -76,11 +76,27 @@ func newTCPTransport(bindAddr string,
 	// Create stream
 	stream := &TCPStreamLayer{
 		advertise: advertise,
-		listener:  list.(*net.TCPListener),
+		listener:  list,
+	}
+
+	// Create the network transport
+	trans := transportCreator(stream)
+	return trans, nil
+}
+
+// listenTCP binds a TCP listener and verifies that it, or the advertise
+// address if given, is usable by peers.
+func listenTCP(bindAddr string, advertise net.Addr) (*net.TCPListener, error) {
+	list, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
 	}
 
 	// Verify that we have a usable advertise address
-	addr, ok := stream.Addr().(*net.TCPAddr)
+	if advertise == nil {
+		advertise = list.Addr()
+	}
+	addr, ok := advertise.(*net.TCPAddr)
 	if !ok {
 		_ = list.Close()
 		return nil, errNotTCP
@@ -89,10 +105,7 @@ func newTCPTransport(bindAddr string,
 		_ = list.Close()
 		return nil, errNotAdvertisable
 	}
-
-	// Create the network transport
-	trans := transportCreator(stream)
-	return trans, nil
+	return list.(*net.TCPListener), nil
 }
 
 // Dial implements the StreamLayer interface.
@@ -0,0 +1,757 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+const (
+	archiveMetaBlob  = "meta.json"
+	archiveStateBlob = "state.bin"
+)
+
+// ErrBlobNotFound is returned by a BlobStore when a blob doesn't exist.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore is a flat store of named blobs, such as an object storage bucket,
+// which a TieredSnapshotStore archives snapshots to. Names are made of
+// slash-separated parts.
+type BlobStore interface {
+	// Put stores a blob, replacing any blob with the same name. A blob is
+	// only visible once it's been stored whole.
+	Put(name string, data io.Reader) error
+
+	// Get opens a blob, or returns ErrBlobNotFound.
+	Get(name string) (io.ReadCloser, error)
+
+	// List returns the names of the blobs that start with the given prefix,
+	// in any order.
+	List(prefix string) ([]string, error)
+
+	// Delete removes a blob. Deleting a blob that doesn't exist isn't an
+	// error.
+	Delete(name string) error
+}
+
+// DirBlobStore implements the BlobStore interface with files in a directory,
+// which may be a mounted network filesystem.
+type DirBlobStore struct {
+	dir string
+}
+
+// NewDirBlobStore creates a new DirBlobStore in the given directory, creating
+// it if needed.
+func NewDirBlobStore(dir string) (*DirBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("blob path not accessible: %v", err)
+	}
+	return &DirBlobStore{dir: dir}, nil
+}
+
+// path returns the path of the file holding a blob.
+func (d *DirBlobStore) path(name string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) || strings.HasSuffix(name, tmpSuffix) {
+		return "", fmt.Errorf("invalid blob name %q", name)
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(name)), nil
+}
+
+// Put implements the BlobStore interface.
+func (d *DirBlobStore) Put(name string, data io.Reader) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file, and move it into place once it's synced
+	fh, err := os.Create(path + tmpSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fh, data); err != nil {
+		_ = fh.Close()
+		_ = os.Remove(fh.Name())
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		_ = fh.Close()
+		_ = os.Remove(fh.Name())
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		_ = os.Remove(fh.Name())
+		return err
+	}
+	return os.Rename(fh.Name(), path)
+}
+
+// Get implements the BlobStore interface.
+func (d *DirBlobStore) Get(name string) (io.ReadCloser, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return fh, err
+}
+
+// List implements the BlobStore interface.
+func (d *DirBlobStore) List(prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasSuffix(path, tmpSuffix) {
+			return err
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// Delete implements the BlobStore interface. Directories left empty are
+// removed too.
+func (d *DirBlobStore) Delete(name string) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != d.dir; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// TieredSnapshotStoreConfig encapsulates configuration for a
+// TieredSnapshotStore.
+type TieredSnapshotStoreConfig struct {
+	// ArchiveRetain controls how many snapshots are kept in the archive. Zero
+	// keeps all of them.
+	ArchiveRetain int
+
+	// Logger is used to log archive operations. If nil, a default logger is
+	// used.
+	Logger hclog.Logger
+}
+
+// TieredSnapshotStore implements the SnapshotStore interface by keeping the
+// newest snapshots in a FileSnapshotStore, as many as it retains, and copying
+// snapshots to a BlobStore before they're reaped from it. Archived snapshots
+// are listed and opened along with the local ones, so a new server with an
+// empty local store restores the latest archived snapshot.
+//
+// Snapshots are archived in the background once a new snapshot is closed,
+// and the local store doesn't reap a snapshot until it's archived. If
+// archiving fails, the error is logged and archiving is tried again with the
+// next snapshot, while the local store holds on to the snapshots it would
+// have reaped.
+//
+// The metadata of the archived snapshots is listed from the BlobStore once,
+// and then kept in memory as snapshots are archived and reaped, so the store
+// must be the only one writing to its BlobStore. If the BlobStore can't be
+// listed, List logs the error and returns the local snapshots.
+type TieredSnapshotStore struct {
+	local   *FileSnapshotStore
+	archive BlobStore
+	retain  int
+	logger  hclog.Logger
+
+	// archived holds the IDs of the snapshots known to be archived, which
+	// the local store may reap, unless they're fetched copies a delta is
+	// being built on. catalog holds the metadata of the snapshots in the
+	// archive, or is nil until it's been listed.
+	archived     map[string]bool
+	fetched      map[string]bool
+	catalog      map[string]*fileSnapshotMeta
+	archivedLock sync.Mutex
+
+	// archiving is set while archiving runs in the background, and again is
+	// set to run it once more when it's done.
+	archiving     bool
+	again         bool
+	archivingLock sync.Mutex
+}
+
+// tieredSnapshotSink starts archiving once the snapshot it writes is closed.
+// fetched is the ID of the fetched copy a delta builds on, if any, which may
+// be reaped once the delta is done.
+type tieredSnapshotSink struct {
+	SnapshotSink
+	store   *TieredSnapshotStore
+	fetched string
+	closed  bool
+}
+
+// NewTieredSnapshotStore creates a new TieredSnapshotStore which archives
+// snapshots from the given local store to the given BlobStore.
+func NewTieredSnapshotStore(local *FileSnapshotStore, archive BlobStore) *TieredSnapshotStore {
+	return NewTieredSnapshotStoreWithConfig(local, archive, &TieredSnapshotStoreConfig{})
+}
+
+// NewTieredSnapshotStoreWithConfig creates a new TieredSnapshotStore, using
+// the given config struct.
+func NewTieredSnapshotStoreWithConfig(local *FileSnapshotStore, archive BlobStore, config *TieredSnapshotStoreConfig) *TieredSnapshotStore {
+	logger := config.Logger
+	if logger == nil {
+		logger = hclog.New(&hclog.LoggerOptions{
+			Name:   "snapshot-archive",
+			Output: hclog.DefaultOutput,
+			Level:  hclog.DefaultLevel,
+		})
+	}
+	t := &TieredSnapshotStore{
+		local:    local,
+		archive:  archive,
+		retain:   config.ArchiveRetain,
+		logger:   logger,
+		archived: make(map[string]bool),
+		fetched:  make(map[string]bool),
+	}
+	local.pinned = t.pinned
+
+	// Catch up with snapshots left unarchived by a previous run
+	t.archiveInBackground()
+	return t
+}
+
+// Create is used to start a new snapshot.
+func (t *TieredSnapshotStore) Create(version SnapshotVersion, index, term uint64,
+	configuration Configuration, configurationIndex uint64, trans Transport) (SnapshotSink, error) {
+	return t.wrap(t.local.Create(version, index, term, configuration, configurationIndex, trans))
+}
+
+// CreateRaw implements the RawSnapshotStore interface.
+func (t *TieredSnapshotStore) CreateRaw(version SnapshotVersion, index, term uint64,
+	configuration Configuration, configurationIndex uint64, trans Transport, compression string) (SnapshotSink, error) {
+	return t.wrap(t.local.CreateRaw(version, index, term, configuration, configurationIndex, trans, compression))
+}
+
+// CreateDelta implements the DeltaSnapshotStore interface. An archived parent
+// is copied back to the local store, and the delta builds on the copy.
+func (t *TieredSnapshotStore) CreateDelta(parentID string, version SnapshotVersion, index, term uint64,
+	configuration Configuration, configurationIndex uint64, trans Transport) (SnapshotSink, error) {
+	localID, err := t.localID(parentID)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := t.wrap(t.local.CreateDelta(localID, version, index, term, configuration, configurationIndex, trans))
+	if localID != parentID {
+		if err != nil {
+			t.release(localID)
+			return nil, err
+		}
+		sink.(*tieredSnapshotSink).fetched = localID
+	}
+	return sink, err
+}
+
+// CreateChain implements the DeltaSnapshotStore interface.
+func (t *TieredSnapshotStore) CreateChain(chain int, version SnapshotVersion, index, term uint64,
+	configuration Configuration, configurationIndex uint64, trans Transport) (SnapshotSink, error) {
+	return t.wrap(t.local.CreateChain(chain, version, index, term, configuration, configurationIndex, trans))
+}
+
+// wrap wraps a sink of the local store.
+func (t *TieredSnapshotStore) wrap(sink SnapshotSink, err error) (SnapshotSink, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &tieredSnapshotSink{SnapshotSink: sink, store: t}, nil
+}
+
+// List returns the local snapshots, followed by the archived ones that aren't
+// also local, with the highest index first.
+func (t *TieredSnapshotStore) List() ([]*SnapshotMeta, error) {
+	local, err := t.local.List()
+	if err != nil {
+		return nil, err
+	}
+	archived, err := t.archivedSnapshots()
+	if err != nil {
+		t.logger.Error("failed to list archived snapshots, listing local ones only", "error", err)
+	}
+
+	snapshots := make(snapMetaSlice, 0, len(local)+len(archived))
+	seen := make(map[string]bool, len(local))
+	for _, meta := range local {
+		seen[meta.ID] = true
+		snapshots = append(snapshots, &fileSnapshotMeta{SnapshotMeta: *meta})
+	}
+	for _, meta := range archived {
+		if !seen[meta.ID] {
+			snapshots = append(snapshots, meta)
+		}
+	}
+	sort.Sort(sort.Reverse(snapshots))
+
+	metas := make([]*SnapshotMeta, 0, len(snapshots))
+	for _, meta := range snapshots {
+		metas = append(metas, &meta.SnapshotMeta)
+	}
+	return metas, nil
+}
+
+// Open takes a snapshot ID and returns a ReadCloser for that snapshot, which
+// is read from the archive if it's not local.
+func (t *TieredSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	if _, err := t.local.readMeta(id); err == nil {
+		return t.local.Open(id)
+	}
+	return t.openArchived(id, false)
+}
+
+// OpenRaw implements the RawSnapshotStore interface.
+func (t *TieredSnapshotStore) OpenRaw(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	if _, err := t.local.readMeta(id); err == nil {
+		return t.local.OpenRaw(id)
+	}
+	return t.openArchived(id, true)
+}
+
+// openArchived opens an archived snapshot, as stored if raw is set. The CRC
+// of the stored data is checked once it's been read.
+func (t *TieredSnapshotStore) openArchived(id string, raw bool) (*SnapshotMeta, io.ReadCloser, error) {
+	meta, err := t.archivedMeta(id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("snapshot %v is neither local nor archived: %w", id, err)
+	}
+	state, err := t.archive.Get(path.Join(id, archiveStateBlob))
+	if err != nil {
+		return nil, nil, err
+	}
+	checked := &crcCheckingReader{
+		ReadCloser: state,
+		hash:       crc64.New(crc64.MakeTable(crc64.ECMA)),
+		expected:   meta.CRC,
+	}
+	if raw {
+		rawMeta := meta.SnapshotMeta
+		rawMeta.Size = meta.StoredSize
+		rawMeta.Checksum = meta.CRC
+		return &rawMeta, checked, nil
+	}
+	if meta.Compression == "" {
+		return &meta.SnapshotMeta, checked, nil
+	}
+
+	compressor := t.local.compressorFor(meta.Compression)
+	if compressor == nil {
+		_ = state.Close()
+		return nil, nil, fmt.Errorf("unknown snapshot compression %q", meta.Compression)
+	}
+	dec, err := compressor.NewReader(checked)
+	if err != nil {
+		_ = state.Close()
+		return nil, nil, err
+	}
+	return &meta.SnapshotMeta, &decompressingReader{ReadCloser: dec, underlying: checked}, nil
+}
+
+// localID returns the ID of the local snapshot with the given ID, copying it
+// from the archive if it's not local. A copy is kept until it's released.
+func (t *TieredSnapshotStore) localID(id string) (string, error) {
+	if _, err := t.local.readMeta(id); err == nil {
+		return id, nil
+	}
+
+	meta, err := t.archivedMeta(id)
+	if err != nil {
+		return "", fmt.Errorf("snapshot %v is neither local nor archived: %w", id, err)
+	}
+	return t.fetch(meta)
+}
+
+// Close is used to indicate a successful end. The snapshots the local store
+// holds on to for the archive are archived in the background.
+func (s *tieredSnapshotSink) Close() error {
+	// Make sure close is idempotent
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.SnapshotSink.Close()
+	s.store.release(s.fetched)
+	if err != nil {
+		return err
+	}
+	s.store.archiveInBackground()
+	return nil
+}
+
+// Cancel is used to indicate an unsuccessful end.
+func (s *tieredSnapshotSink) Cancel() error {
+	// Make sure close is idempotent
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.SnapshotSink.Cancel()
+	s.store.release(s.fetched)
+	return err
+}
+
+// pinned reports whether the local store must not reap a snapshot, as it
+// isn't known to be archived, or a delta is being built on it.
+func (t *TieredSnapshotStore) pinned(id string) bool {
+	t.archivedLock.Lock()
+	defer t.archivedLock.Unlock()
+	return !t.archived[id] || t.fetched[id]
+}
+
+// release lets the local store reap a fetched copy once the delta built on
+// it is done.
+func (t *TieredSnapshotStore) release(id string) {
+	if id == "" {
+		return
+	}
+	t.archivedLock.Lock()
+	delete(t.fetched, id)
+	t.archivedLock.Unlock()
+}
+
+// unarchived reports whether a local snapshot isn't known to be archived.
+func (t *TieredSnapshotStore) unarchived(id string) bool {
+	t.archivedLock.Lock()
+	defer t.archivedLock.Unlock()
+	return !t.archived[id]
+}
+
+// archiveInBackground archives snapshots in a goroutine. If that's running
+// already, it runs once more when it's done, to pick up new snapshots.
+func (t *TieredSnapshotStore) archiveInBackground() {
+	t.archivingLock.Lock()
+	defer t.archivingLock.Unlock()
+	if t.archiving {
+		t.again = true
+		return
+	}
+	t.archiving = true
+	go t.runArchive()
+}
+
+// runArchive archives snapshots until no more snapshots were added in the
+// meantime.
+func (t *TieredSnapshotStore) runArchive() {
+	for {
+		if err := t.archiveOld(); err != nil {
+			t.logger.Error("failed to archive snapshots", "error", err)
+		}
+
+		t.archivingLock.Lock()
+		if !t.again {
+			t.archiving = false
+			t.archivingLock.Unlock()
+			return
+		}
+		t.again = false
+		t.archivingLock.Unlock()
+	}
+}
+
+// archiveOld archives the local snapshots past the local store's retain
+// count, which it holds on to until then, unless they're archived already. Then it
+// deletes any archived snapshots beyond the retain count, and lets the local
+// store reap the snapshots it held on to. Only one runs at a time.
+func (t *TieredSnapshotStore) archiveOld() error {
+	local, err := t.local.getSnapshots()
+	if err != nil {
+		return err
+	}
+	if len(local) <= t.local.retain {
+		return nil
+	}
+	archived, err := t.archivedSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, meta := range local[t.local.retain:] {
+		if !t.unarchived(meta.ID) {
+			continue
+		}
+		archivedMeta, err := t.archiveSnapshot(meta)
+		if err != nil {
+			return fmt.Errorf("failed to archive snapshot %v: %w", meta.ID, err)
+		}
+		t.addArchived(archivedMeta)
+		archived = append(archived, archivedMeta)
+	}
+	if err := t.reapArchive(archived); err != nil {
+		return err
+	}
+	return t.local.ReapSnapshots()
+}
+
+// setArchived records that a snapshot is archived.
+func (t *TieredSnapshotStore) setArchived(id string) {
+	t.archivedLock.Lock()
+	defer t.archivedLock.Unlock()
+	t.archived[id] = true
+}
+
+// addArchived records a snapshot that was copied to the archive.
+func (t *TieredSnapshotStore) addArchived(meta *fileSnapshotMeta) {
+	t.archivedLock.Lock()
+	defer t.archivedLock.Unlock()
+	t.archived[meta.ID] = true
+	if t.catalog != nil {
+		t.catalog[meta.ID] = meta
+	}
+}
+
+// archivedSnapshots returns copies of the metadata of the archived snapshots,
+// listing them from the archive the first time.
+func (t *TieredSnapshotStore) archivedSnapshots() (snapMetaSlice, error) {
+	t.archivedLock.Lock()
+	listed := t.catalog != nil
+	t.archivedLock.Unlock()
+	if !listed {
+		// List without the lock held, as that's slow
+		metas, err := t.listArchive()
+		if err != nil {
+			return nil, err
+		}
+		t.archivedLock.Lock()
+		if t.catalog == nil {
+			t.catalog = make(map[string]*fileSnapshotMeta, len(metas))
+			for _, meta := range metas {
+				t.catalog[meta.ID] = meta
+				t.archived[meta.ID] = true
+			}
+		}
+		t.archivedLock.Unlock()
+	}
+
+	t.archivedLock.Lock()
+	defer t.archivedLock.Unlock()
+	snapshots := make(snapMetaSlice, 0, len(t.catalog))
+	for _, meta := range t.catalog {
+		copied := *meta
+		snapshots = append(snapshots, &copied)
+	}
+	return snapshots, nil
+}
+
+// archivedMeta returns a copy of the metadata of an archived snapshot.
+func (t *TieredSnapshotStore) archivedMeta(id string) (*fileSnapshotMeta, error) {
+	t.archivedLock.Lock()
+	meta, ok := t.catalog[id]
+	t.archivedLock.Unlock()
+	if ok {
+		copied := *meta
+		return &copied, nil
+	}
+	return t.readArchivedMeta(id)
+}
+
+// archiveSnapshot copies a local snapshot to the archive, and returns its
+// archived metadata. Delta snapshots are archived chained after their
+// parents, so that they're self-contained.
+func (t *TieredSnapshotStore) archiveSnapshot(meta *fileSnapshotMeta) (*fileSnapshotMeta, error) {
+	t.logger.Info("archiving snapshot", "id", meta.ID)
+	archivedMeta := *meta
+	var source io.ReadCloser
+	if meta.ParentID != "" {
+		chained, chain, err := t.local.openChain(meta)
+		if err != nil {
+			return nil, err
+		}
+		archivedMeta.SnapshotMeta = *chained
+		archivedMeta.ParentID = ""
+		archivedMeta.StoredSize = chained.Size
+		source = chain
+	} else {
+		_, buffered, err := t.local.openState(meta.ID)
+		if err != nil {
+			return nil, err
+		}
+		source = buffered
+	}
+	defer func() { _ = source.Close() }()
+
+	// Store the state, then the metadata, which makes it visible
+	stateHash := crc64.New(crc64.MakeTable(crc64.ECMA))
+	if err := t.archive.Put(path.Join(meta.ID, archiveStateBlob), io.TeeReader(source, stateHash)); err != nil {
+		return nil, err
+	}
+	archivedMeta.CRC = stateHash.Sum(nil)
+	if archivedMeta.Checksum == nil {
+		archivedMeta.Checksum = archivedMeta.CRC
+	}
+	encoded, err := json.Marshal(&archivedMeta)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.archive.Put(path.Join(meta.ID, archiveMetaBlob), bytes.NewReader(encoded)); err != nil {
+		return nil, err
+	}
+	return &archivedMeta, nil
+}
+
+// reapArchive deletes the archived snapshots beyond the retain count.
+func (t *TieredSnapshotStore) reapArchive(archived snapMetaSlice) error {
+	if t.retain == 0 || len(archived) <= t.retain {
+		return nil
+	}
+	sort.Sort(sort.Reverse(archived))
+	for _, meta := range archived[t.retain:] {
+		t.logger.Info("reaping archived snapshot", "id", meta.ID)
+		t.archivedLock.Lock()
+		delete(t.catalog, meta.ID)
+		t.archivedLock.Unlock()
+
+		// Delete the metadata first, so a partly deleted snapshot isn't
+		// listed
+		for _, blob := range []string{archiveMetaBlob, archiveStateBlob} {
+			if err := t.archive.Delete(path.Join(meta.ID, blob)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetch copies an archived snapshot to the local store, and returns the ID
+// of the copy, which is kept until it's released.
+func (t *TieredSnapshotStore) fetch(meta *fileSnapshotMeta) (string, error) {
+	t.logger.Info("fetching archived snapshot", "id", meta.ID)
+	state, err := t.archive.Get(path.Join(meta.ID, archiveStateBlob))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = state.Close() }()
+
+	var compressor SnapshotCompressor
+	if meta.Compression != "" {
+		if compressor = t.local.compressorFor(meta.Compression); compressor == nil {
+			return "", fmt.Errorf("unknown snapshot compression %q", meta.Compression)
+		}
+	}
+
+	// The copy is created without a configuration, which would need a
+	// transport to encode the peers, and given the archived one instead.
+	sink, err := t.local.create(meta.Version, meta.Index, meta.Term, Configuration{},
+		meta.ConfigurationIndex, nil, compressor, compressor != nil)
+	if err != nil {
+		return "", err
+	}
+	fileSink := sink.(*FileSnapshotSink)
+	fileSink.meta.Configuration = meta.Configuration
+	fileSink.meta.Peers = meta.Peers
+	fileSink.meta.Chain = meta.Chain
+
+	stateHash := crc64.New(crc64.MakeTable(crc64.ECMA))
+	if _, err := io.Copy(sink, io.TeeReader(state, stateHash)); err != nil {
+		_ = sink.Cancel()
+		return "", err
+	}
+	if computed := stateHash.Sum(nil); !bytes.Equal(meta.CRC, computed) {
+		_ = sink.Cancel()
+		return "", fmt.Errorf("CRC mismatch")
+	}
+
+	// The copy is archived already, but it's kept until the delta built on
+	// it is done. Adding it may push out another snapshot, which is archived
+	// in the background.
+	t.archivedLock.Lock()
+	t.archived[sink.ID()] = true
+	t.fetched[sink.ID()] = true
+	t.archivedLock.Unlock()
+	if err := sink.Close(); err != nil {
+		t.release(sink.ID())
+		return "", err
+	}
+	t.archiveInBackground()
+	return sink.ID(), nil
+}
+
+// listArchive returns the metadata of the archived snapshots.
+func (t *TieredSnapshotStore) listArchive() (snapMetaSlice, error) {
+	names, err := t.archive.List("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archived snapshots: %w", err)
+	}
+	var snapshots snapMetaSlice
+	for _, name := range names {
+		id, blob := path.Split(name)
+		if blob != archiveMetaBlob || id == "" {
+			continue
+		}
+		meta, err := t.readArchivedMeta(strings.TrimSuffix(id, "/"))
+		if err != nil {
+			t.logger.Warn("failed to read archived metadata", "name", name, "error", err)
+			continue
+		}
+		snapshots = append(snapshots, meta)
+	}
+	return snapshots, nil
+}
+
+// readArchivedMeta reads the metadata of an archived snapshot.
+func (t *TieredSnapshotStore) readArchivedMeta(id string) (*fileSnapshotMeta, error) {
+	blob, err := t.archive.Get(path.Join(id, archiveMetaBlob))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = blob.Close() }()
+
+	meta := &fileSnapshotMeta{}
+	if err := json.NewDecoder(blob).Decode(meta); err != nil {
+		return nil, err
+	}
+	if meta.ID != id {
+		return nil, fmt.Errorf("archived snapshot %v has ID %v", id, meta.ID)
+	}
+	return meta, nil
+}
+
+// crcCheckingReader reads a snapshot, and returns an error at the end of it if
+// it doesn't match its CRC.
+type crcCheckingReader struct {
+	io.ReadCloser
+	hash     hash.Hash64
+	expected []byte
+}
+
+func (c *crcCheckingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(c.hash.Sum(nil), c.expected) {
+		return n, fmt.Errorf("CRC mismatch")
+	}
+	return n, err
+}
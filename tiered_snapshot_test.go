@@ -0,0 +1,360 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirBlobStore(t *testing.T) {
+	blobs, err := NewDirBlobStore(t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, blobs.Put("a/one", strings.NewReader("1")))
+	require.NoError(t, blobs.Put("a/two", strings.NewReader("2")))
+	require.NoError(t, blobs.Put("b", strings.NewReader("3")))
+	require.NoError(t, blobs.Put("a/one", strings.NewReader("new 1")))
+	require.Error(t, blobs.Put("../escape", strings.NewReader("")))
+
+	names, err := blobs.List("a/")
+	require.NoError(t, err)
+	sort.Strings(names)
+	require.Equal(t, []string{"a/one", "a/two"}, names)
+
+	r, err := blobs.Get("a/one")
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, "new 1", string(data))
+
+	require.NoError(t, blobs.Delete("a/one"))
+	require.NoError(t, blobs.Delete("a/one"))
+	_, err = blobs.Get("a/one")
+	require.ErrorIs(t, err, ErrBlobNotFound)
+	names, err = blobs.List("")
+	require.NoError(t, err)
+	sort.Strings(names)
+	require.Equal(t, []string{"a/two", "b"}, names)
+}
+
+// waitArchived waits for a TieredSnapshotStore to finish archiving in the
+// background.
+func waitArchived(t *testing.T, store *TieredSnapshotStore) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		store.archivingLock.Lock()
+		defer store.archivingLock.Unlock()
+		return !store.archiving
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestTieredSnapshotStore(t *testing.T) {
+	archive, err := NewDirBlobStore(t.TempDir())
+	require.NoError(t, err)
+	local, err := NewFileSnapshotStoreWithConfig(t.TempDir(), &FileSnapshotStoreConfig{
+		Retain:     2,
+		Logger:     newTestLogger(t),
+		Compressor: &GzipCompressor{},
+	})
+	require.NoError(t, err)
+	store := NewTieredSnapshotStoreWithConfig(local, archive, &TieredSnapshotStoreConfig{
+		ArchiveRetain: 3,
+		Logger:        newTestLogger(t),
+	})
+	_, trans := NewInmemTransport(NewInmemAddr())
+
+	var ids []string
+	for i := 1; i <= 5; i++ {
+		sink, err := store.Create(SnapshotVersionMax, uint64(i*10), 1, Configuration{}, 1, trans)
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(sink, "snapshot %d", i)
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+		waitArchived(t, store)
+		ids = append(ids, sink.ID())
+	}
+	read := func(store SnapshotStore, id string) string {
+		meta, r, err := store.Open(id)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, int64(len(data)), meta.Size)
+		return string(data)
+	}
+
+	// The newest two are local, and the three before them archived.
+	localSnaps, err := local.List()
+	require.NoError(t, err)
+	require.Len(t, localSnaps, 2)
+	snaps, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 5)
+	for i, meta := range snaps {
+		require.Equal(t, ids[4-i], meta.ID)
+		require.Equal(t, fmt.Sprintf("snapshot %d", 5-i), read(store, meta.ID))
+	}
+
+	// Only three are kept in the archive.
+	sink, err := store.Create(SnapshotVersionMax, 60, 1, Configuration{}, 1, trans)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	waitArchived(t, store)
+	snaps, err = store.List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 5)
+	require.Equal(t, ids[1], snaps[4].ID)
+	_, _, err = store.Open(ids[0])
+	require.Error(t, err)
+
+	// A new server sees the archived snapshots.
+	empty, err := NewFileSnapshotStoreWithLogger(t.TempDir(), 2, newTestLogger(t))
+	require.NoError(t, err)
+	other := NewTieredSnapshotStore(empty, archive)
+	snaps, err = other.List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 3)
+	require.Equal(t, ids[3], snaps[0].ID)
+	require.Equal(t, "snapshot 4", read(other, snaps[0].ID))
+
+	// Deltas build on a local copy of an archived parent.
+	delta, err := other.CreateDelta(snaps[0].ID, SnapshotVersionMax, 70, 1, Configuration{}, 1, trans)
+	require.NoError(t, err)
+	_, err = delta.Write([]byte("delta"))
+	require.NoError(t, err)
+	require.NoError(t, delta.Close())
+	waitArchived(t, other)
+	meta, r, err := other.Open(delta.ID())
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, 2, meta.Chain)
+	require.Equal(t, string(snapshotChainHeader(10))+"snapshot 4"+string(snapshotChainHeader(5))+"delta", string(data))
+
+	// Corruption in the archive is caught.
+	require.NoError(t, archive.Put(ids[3]+"/"+archiveStateBlob, strings.NewReader("corrupt")))
+	_, r, err = store.Open(ids[3])
+	if err == nil {
+		_, err = io.ReadAll(r)
+		require.NoError(t, r.Close())
+	}
+	require.Error(t, err)
+}
+
+func TestTieredSnapshotStore_Raft(t *testing.T) {
+	archive, err := NewDirBlobStore(t.TempDir())
+	require.NoError(t, err)
+	conf := inmemConfig(t)
+	conf.LocalID = "server1"
+	conf.SnapshotThreshold = 1 << 30
+
+	start := func() (*Raft, *MockFSM, *TieredSnapshotStore) {
+		local, err := NewFileSnapshotStoreWithLogger(t.TempDir(), 1, newTestLogger(t))
+		require.NoError(t, err)
+		store := NewInmemStore()
+		snaps := NewTieredSnapshotStoreWithConfig(local, archive, &TieredSnapshotStoreConfig{Logger: newTestLogger(t)})
+		_, trans := NewInmemTransport("server1")
+		fsm := &MockFSM{}
+		r, err := NewRaft(conf, fsm, store, store, snaps, trans)
+		require.NoError(t, err)
+		return r, fsm, snaps
+	}
+
+	r, _, snaps := start()
+	require.NoError(t, r.BootstrapCluster(Configuration{Servers: []Server{
+		{Suffrage: Voter, ID: "server1", Address: "server1"},
+	}}).Error())
+	require.Eventually(t, func() bool { return r.State() == Leader }, 5*time.Second, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, r.Apply([]byte(fmt.Sprintf("cmd %d", i)), time.Second).Error())
+		if i%5 == 4 {
+			require.NoError(t, r.Snapshot().Error())
+		}
+	}
+	require.NoError(t, r.Shutdown().Error())
+	waitArchived(t, snaps)
+
+	// A new server with nothing local restores the archived snapshot, the
+	// latest one having only been kept locally.
+	r, fsm, snaps := start()
+	defer func() {
+		_ = r.Shutdown().Error()
+		waitArchived(t, snaps)
+	}()
+	require.Len(t, fsm.Logs(), 5)
+	require.Equal(t, []byte("cmd 4"), fsm.Logs()[4])
+}
+
+// blockingBlobStore is a BlobStore whose Puts wait for unblock to be closed.
+type blockingBlobStore struct {
+	BlobStore
+	unblock chan struct{}
+}
+
+func (b *blockingBlobStore) Put(name string, data io.Reader) error {
+	<-b.unblock
+	return b.BlobStore.Put(name, data)
+}
+
+func TestTieredSnapshotStore_ArchiveInBackground(t *testing.T) {
+	dir, err := NewDirBlobStore(t.TempDir())
+	require.NoError(t, err)
+	archive := &blockingBlobStore{BlobStore: dir, unblock: make(chan struct{})}
+	local, err := NewFileSnapshotStoreWithLogger(t.TempDir(), 1, newTestLogger(t))
+	require.NoError(t, err)
+	store := NewTieredSnapshotStoreWithConfig(local, archive, &TieredSnapshotStoreConfig{Logger: newTestLogger(t)})
+	_, trans := NewInmemTransport(NewInmemAddr())
+
+	// Snapshots are closed without waiting for the archive.
+	var ids []string
+	for i := 1; i <= 3; i++ {
+		sink, err := store.Create(SnapshotVersionMax, uint64(i*10), 1, Configuration{}, 1, trans)
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(sink, "snapshot %d", i)
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+		ids = append(ids, sink.ID())
+	}
+
+	// Nothing is reaped locally before it's archived.
+	localSnaps, err := local.getSnapshots()
+	require.NoError(t, err)
+	require.Len(t, localSnaps, 3)
+
+	close(archive.unblock)
+	waitArchived(t, store)
+	localSnaps, err = local.getSnapshots()
+	require.NoError(t, err)
+	require.Len(t, localSnaps, 1)
+	require.Equal(t, ids[2], localSnaps[0].ID)
+	archived, err := store.listArchive()
+	require.NoError(t, err)
+	require.Len(t, archived, 2)
+}
+
+// countingBlobStore counts the calls listing and reading its blobs, and fails
+// them all once failing is set.
+type countingBlobStore struct {
+	BlobStore
+	lists   int32
+	gets    int32
+	failing atomic.Bool
+}
+
+func (c *countingBlobStore) List(prefix string) ([]string, error) {
+	atomic.AddInt32(&c.lists, 1)
+	if c.failing.Load() {
+		return nil, errors.New("archive unavailable")
+	}
+	return c.BlobStore.List(prefix)
+}
+
+func (c *countingBlobStore) Get(name string) (io.ReadCloser, error) {
+	atomic.AddInt32(&c.gets, 1)
+	if c.failing.Load() {
+		return nil, errors.New("archive unavailable")
+	}
+	return c.BlobStore.Get(name)
+}
+
+func TestTieredSnapshotStore_ListCached(t *testing.T) {
+	dir, err := NewDirBlobStore(t.TempDir())
+	require.NoError(t, err)
+	archive := &countingBlobStore{BlobStore: dir}
+	localDir := t.TempDir()
+	local, err := NewFileSnapshotStoreWithLogger(localDir, 1, newTestLogger(t))
+	require.NoError(t, err)
+	store := NewTieredSnapshotStoreWithConfig(local, archive, &TieredSnapshotStoreConfig{Logger: newTestLogger(t)})
+	_, trans := NewInmemTransport(NewInmemAddr())
+	for i := 1; i <= 3; i++ {
+		sink, err := store.Create(SnapshotVersionMax, uint64(i*10), 1, Configuration{}, 1, trans)
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+		waitArchived(t, store)
+	}
+
+	// The archive is only listed once, and kept up to date after.
+	lists, gets := atomic.LoadInt32(&archive.lists), atomic.LoadInt32(&archive.gets)
+	require.LessOrEqual(t, lists, int32(1))
+	for i := 0; i < 3; i++ {
+		snaps, err := store.List()
+		require.NoError(t, err)
+		require.Len(t, snaps, 3)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&archive.lists))
+	require.Equal(t, gets, atomic.LoadInt32(&archive.gets))
+
+	// A new store that can't reach the archive lists its local snapshots.
+	archive.failing.Store(true)
+	local, err = NewFileSnapshotStoreWithLogger(localDir, 1, newTestLogger(t))
+	require.NoError(t, err)
+	store = NewTieredSnapshotStoreWithConfig(local, archive, &TieredSnapshotStoreConfig{Logger: newTestLogger(t)})
+	snaps, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 1)
+	require.Equal(t, uint64(30), snaps[0].Index)
+
+	// Once it's back, the archived ones are listed too.
+	archive.failing.Store(false)
+	snaps, err = store.List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 3)
+}
+
+func TestTieredSnapshotStore_FetchDuringArchive(t *testing.T) {
+	dir, err := NewDirBlobStore(t.TempDir())
+	require.NoError(t, err)
+	localDir := t.TempDir()
+	local, err := NewFileSnapshotStoreWithLogger(localDir, 1, newTestLogger(t))
+	require.NoError(t, err)
+	store := NewTieredSnapshotStoreWithConfig(local, dir, &TieredSnapshotStoreConfig{Logger: newTestLogger(t)})
+	_, trans := NewInmemTransport(NewInmemAddr())
+	create := func(store *TieredSnapshotStore, index uint64) string {
+		sink, err := store.Create(SnapshotVersionMax, index, 1, Configuration{}, 1, trans)
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(sink, "snapshot %d", index)
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+		return sink.ID()
+	}
+	parent := create(store, 10)
+	create(store, 20)
+	waitArchived(t, store)
+
+	// While a slow upload runs, a delta on an archived parent fetches it
+	// without waiting for the upload.
+	archive := &blockingBlobStore{BlobStore: dir, unblock: make(chan struct{})}
+	local, err = NewFileSnapshotStoreWithLogger(localDir, 1, newTestLogger(t))
+	require.NoError(t, err)
+	store = NewTieredSnapshotStoreWithConfig(local, archive, &TieredSnapshotStoreConfig{Logger: newTestLogger(t)})
+	defer waitArchived(t, store)
+	defer close(archive.unblock)
+	create(store, 30)
+
+	done := make(chan error, 1)
+	go func() {
+		sink, err := store.CreateDelta(parent, SnapshotVersionMax, 40, 1, Configuration{}, 1, trans)
+		if err == nil {
+			err = sink.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("delta snapshot waited for the upload")
+	}
+}
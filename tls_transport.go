@@ -0,0 +1,286 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+var (
+	errNoTLSConfig         = errors.New("a tls config is required")
+	errNoPeerCertificate   = errors.New("peer did not present a certificate")
+	errServerIDNotVerified = errors.New("server ID is required to verify the peer")
+	errPeerChainUnverified = errors.New("peer certificate chain was not verified")
+)
+
+// TLSStreamConfig configures a TLSStreamLayer.
+type TLSStreamConfig struct {
+	// Config is used for both accepted and dialed connections. For mutual
+	// TLS, set ClientAuth to tls.RequireAndVerifyClientCert and provide
+	// certificates that are valid for both client and server auth. To rotate
+	// certificates without replacing the config, use GetCertificate and
+	// GetClientCertificate, or call TLSStreamLayer.SetTLSConfig.
+	Config *tls.Config
+
+	// VerifyServerID requires peers to present a certificate with a SAN
+	// matching their ServerID. When dialing, this replaces the usual host
+	// name check, so certificates don't need to list peer addresses. When
+	// accepting, each request is checked against the client certificate,
+	// which requires ClientAuth to be tls.VerifyClientCertIfGiven or
+	// tls.RequireAndVerifyClientCert, so that its chain is verified against
+	// ClientCAs. Otherwise any self-signed certificate could claim any
+	// ServerID.
+	VerifyServerID bool
+
+	// ServerIDs returns the ServerIDs a certificate is valid for. If nil, the
+	// DNS and URI SANs of the certificate are used.
+	ServerIDs func(cert *x509.Certificate) []ServerID
+}
+
+// TLSStreamLayer implements the StreamLayer interface for TLS over TCP.
+type TLSStreamLayer struct {
+	advertise net.Addr
+	listener  *net.TCPListener
+	config    atomic.Pointer[tls.Config]
+
+	verifyServerID bool
+	serverIDs      func(cert *x509.Certificate) []ServerID
+}
+
+// NewTLSStreamLayer returns a TLSStreamLayer listening on bindAddr.
+func NewTLSStreamLayer(bindAddr string, advertise net.Addr, config *TLSStreamConfig) (*TLSStreamLayer, error) {
+	if config == nil || config.Config == nil {
+		return nil, errNoTLSConfig
+	}
+	if config.VerifyServerID && config.Config.ClientAuth < tls.VerifyClientCertIfGiven {
+		return nil, fmt.Errorf("VerifyServerID requires ClientAuth to verify client certificates, not %v",
+			config.Config.ClientAuth)
+	}
+	list, err := listenTCP(bindAddr, advertise)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &TLSStreamLayer{
+		advertise:      advertise,
+		listener:       list,
+		verifyServerID: config.VerifyServerID,
+		serverIDs:      config.ServerIDs,
+	}
+	if stream.serverIDs == nil {
+		stream.serverIDs = certSANServerIDs
+	}
+	stream.config.Store(config.Config)
+	return stream, nil
+}
+
+// NewTLSTransport returns a NetworkTransport that is built on top of
+// a TLS streaming transport layer.
+func NewTLSTransport(
+	bindAddr string,
+	advertise net.Addr,
+	tlsConfig *TLSStreamConfig,
+	maxPool int,
+	timeout time.Duration,
+	logOutput io.Writer,
+) (*NetworkTransport, error) {
+	stream, err := NewTLSStreamLayer(bindAddr, advertise, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return NewNetworkTransport(stream, maxPool, timeout, logOutput), nil
+}
+
+// NewTLSTransportWithLogger returns a NetworkTransport that is built on top of
+// a TLS streaming transport layer, with log output going to the supplied Logger
+func NewTLSTransportWithLogger(
+	bindAddr string,
+	advertise net.Addr,
+	tlsConfig *TLSStreamConfig,
+	maxPool int,
+	timeout time.Duration,
+	logger hclog.Logger,
+) (*NetworkTransport, error) {
+	stream, err := NewTLSStreamLayer(bindAddr, advertise, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return NewNetworkTransportWithLogger(stream, maxPool, timeout, logger), nil
+}
+
+// NewTLSTransportWithConfig returns a NetworkTransport that is built on top of
+// a TLS streaming transport layer, using the given config struct.
+func NewTLSTransportWithConfig(
+	bindAddr string,
+	advertise net.Addr,
+	tlsConfig *TLSStreamConfig,
+	config *NetworkTransportConfig,
+) (*NetworkTransport, error) {
+	stream, err := NewTLSStreamLayer(bindAddr, advertise, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	config.Stream = stream
+	return NewNetworkTransportWithConfig(config), nil
+}
+
+// SetTLSConfig replaces the TLS config used for new connections, for example
+// to rotate certificates. Existing connections are not affected. With
+// VerifyServerID, requests on connections accepted with a config that
+// doesn't verify client certificates are rejected.
+func (t *TLSStreamLayer) SetTLSConfig(config *tls.Config) {
+	t.config.Store(config)
+}
+
+// Dial implements the StreamLayer interface. It fails if VerifyServerID is
+// set, since there is no ServerID to check the peer against.
+func (t *TLSStreamLayer) Dial(address ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return t.DialPeer("", address, timeout)
+}
+
+// DialPeer implements the WithDialPeer interface.
+func (t *TLSStreamLayer) DialPeer(id ServerID, address ServerAddress, timeout time.Duration) (net.Conn, error) {
+	config := t.config.Load()
+	if t.verifyServerID {
+		if id == "" {
+			return nil, errServerIDNotVerified
+		}
+		config = t.verifyingConfig(config, id)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", string(address), config)
+}
+
+// verifyingConfig returns a copy of config that verifies the server's
+// certificate chain and that it is valid for the given ServerID, instead of
+// checking the host name.
+func (t *TLSStreamLayer) verifyingConfig(config *tls.Config, id ServerID) *tls.Config {
+	verifyConnection := config.VerifyConnection
+	roots := config.RootCAs
+
+	config = config.Clone()
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errNoPeerCertificate
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+			return err
+		}
+		if err := t.checkServerID(cs.PeerCertificates[0], id); err != nil {
+			return err
+		}
+		if verifyConnection != nil {
+			return verifyConnection(cs)
+		}
+		return nil
+	}
+	return config
+}
+
+// checkServerID returns an error if cert is not valid for the given ServerID.
+func (t *TLSStreamLayer) checkServerID(cert *x509.Certificate, id ServerID) error {
+	for _, certID := range t.serverIDs(cert) {
+		if certID == id {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate is not valid for server ID %q", id)
+}
+
+// Accept implements the net.Listener interface. The TLS handshake runs on the
+// first read or write, so a slow peer doesn't hold up the listener.
+func (t *TLSStreamLayer) Accept() (net.Conn, error) {
+	conn, err := t.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsConn{
+		Conn:  tls.Server(conn, t.config.Load()),
+		layer: t,
+	}, nil
+}
+
+// Close implements the net.Listener interface.
+func (t *TLSStreamLayer) Close() error {
+	return t.listener.Close()
+}
+
+// Addr implements the net.Listener interface.
+func (t *TLSStreamLayer) Addr() net.Addr {
+	// Use an advertise addr if provided
+	if t.advertise != nil {
+		return t.advertise
+	}
+	return t.listener.Addr()
+}
+
+// certSANServerIDs returns the DNS and URI SANs of cert as ServerIDs.
+func certSANServerIDs(cert *x509.Certificate) []ServerID {
+	ids := make([]ServerID, 0, len(cert.DNSNames)+len(cert.URIs))
+	for _, name := range cert.DNSNames {
+		ids = append(ids, ServerID(name))
+	}
+	for _, uri := range cert.URIs {
+		ids = append(ids, ServerID(uri.String()))
+	}
+	return ids
+}
+
+// tlsConn is an accepted TLS connection, which authorizes the ServerIDs its
+// peer sends requests from against the peer's certificate.
+type tlsConn struct {
+	*tls.Conn
+	layer *TLSStreamLayer
+
+	// authorized is the last ServerID that passed the check.
+	authorized     ServerID
+	authorizedLock sync.Mutex
+}
+
+// authorizeServerID implements the serverIDAuthorizer interface.
+func (c *tlsConn) authorizeServerID(id ServerID) error {
+	if !c.layer.verifyServerID {
+		return nil
+	}
+	c.authorizedLock.Lock()
+	defer c.authorizedLock.Unlock()
+	if id != "" && id == c.authorized {
+		return nil
+	}
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	state := c.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return errNoPeerCertificate
+	}
+	// Go only verifies the client's chain for some ClientAuth types, and the
+	// config may have been replaced since the layer checked it.
+	if len(state.VerifiedChains) == 0 {
+		return errPeerChainUnverified
+	}
+	if err := c.layer.checkServerID(state.PeerCertificates[0], id); err != nil {
+		return err
+	}
+	c.authorized = id
+	return nil
+}
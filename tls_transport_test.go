@@ -0,0 +1,182 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates for TLS transport tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "raft test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// config returns a mutual TLS config with a certificate for the given
+// ServerID, which is also valid for 127.0.0.1.
+func (ca *testCA) config(t *testing.T, id ServerID) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: string(id)},
+		DNSNames:     []string{string(id)},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      ca.pool,
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func makeTLSTransport(t *testing.T, config *tls.Config) (*TLSStreamLayer, *NetworkTransport) {
+	t.Helper()
+	stream, err := NewTLSStreamLayer("127.0.0.1:0", nil, &TLSStreamConfig{Config: config, VerifyServerID: true})
+	require.NoError(t, err)
+	// Rejected handshakes are logged by connection handlers that can outlive
+	// the test, so don't log to t.
+	trans := NewNetworkTransportWithConfig(&NetworkTransportConfig{
+		Stream:  stream,
+		MaxPool: 2,
+		Timeout: time.Second,
+		Logger:  hclog.NewNullLogger(),
+	})
+	t.Cleanup(func() { _ = trans.Close() })
+	return stream, trans
+}
+
+// respondVotes answers vote requests on trans until it shuts down.
+func respondVotes(trans *NetworkTransport) {
+	for {
+		select {
+		case rpc := <-trans.Consumer():
+			rpc.Respond(&RequestVoteResponse{Term: 10, Granted: true}, nil)
+		case <-trans.shutdownCh:
+			return
+		}
+	}
+}
+
+func TestTLSTransport_BadAddr(t *testing.T) {
+	ca := newTestCA(t)
+	_, err := NewTLSTransportWithLogger("0.0.0.0:0", nil, &TLSStreamConfig{Config: ca.config(t, "id1")}, 1, 0, newTestLogger(t))
+	require.Equal(t, errNotAdvertisable, err)
+
+	_, err = NewTLSTransportWithLogger("127.0.0.1:0", nil, &TLSStreamConfig{}, 1, 0, newTestLogger(t))
+	require.Equal(t, errNoTLSConfig, err)
+}
+
+func TestTLSTransport_MutualAuth(t *testing.T) {
+	ca := newTestCA(t)
+	_, trans1 := makeTLSTransport(t, ca.config(t, "id1"))
+	_, trans2 := makeTLSTransport(t, ca.config(t, "id2"))
+	go respondVotes(trans1)
+
+	args := RequestVoteRequest{RPCHeader: RPCHeader{ID: []byte("id2")}, Term: 10}
+	var resp RequestVoteResponse
+	require.NoError(t, trans2.RequestVote("id1", trans1.LocalAddr(), &args, &resp))
+	require.True(t, resp.Granted)
+
+	// The server's certificate isn't valid for another ServerID.
+	err := trans2.RequestVote("id3", trans1.LocalAddr(), &args, &resp)
+	require.ErrorContains(t, err, `not valid for server ID "id3"`)
+
+	// The client can't send requests on behalf of another ServerID.
+	args.ID = []byte("id3")
+	require.Error(t, trans2.RequestVote("id1", trans1.LocalAddr(), &args, &resp))
+
+	// A client from another CA is rejected.
+	_, trans3 := makeTLSTransport(t, newTestCA(t).config(t, "id2"))
+	args.ID = []byte("id2")
+	require.Error(t, trans3.RequestVote("id1", trans1.LocalAddr(), &args, &resp))
+}
+
+func TestTLSTransport_Rotation(t *testing.T) {
+	ca := newTestCA(t)
+	stream1, trans1 := makeTLSTransport(t, ca.config(t, "id1"))
+	_, trans2 := makeTLSTransport(t, ca.config(t, "id2"))
+	go respondVotes(trans1)
+
+	args := RequestVoteRequest{RPCHeader: RPCHeader{ID: []byte("id2")}, Term: 10}
+	var resp RequestVoteResponse
+	require.NoError(t, trans2.RequestVote("id1", trans1.LocalAddr(), &args, &resp))
+
+	// New connections pick up the rotated certificate without a restart.
+	stream1.SetTLSConfig(ca.config(t, "id1-renamed"))
+	require.NoError(t, trans2.RequestVote("id1-renamed", trans1.LocalAddr(), &args, &resp))
+
+	// A pooled connection is only reused for the ServerID it was dialed for,
+	// so this dials again and sees the new certificate.
+	err := trans2.RequestVote("id1", trans1.LocalAddr(), &args, &resp)
+	require.ErrorContains(t, err, `not valid for server ID "id1"`)
+}
+
+func TestTLSTransport_UnverifiedClient(t *testing.T) {
+	ca := newTestCA(t)
+
+	// ServerIDs can't be checked against client certificates that Go doesn't
+	// verify.
+	config := ca.config(t, "id1")
+	config.ClientAuth = tls.RequireAnyClientCert
+	_, err := NewTLSStreamLayer("127.0.0.1:0", nil, &TLSStreamConfig{Config: config, VerifyServerID: true})
+	require.ErrorContains(t, err, "ClientAuth")
+
+	// Nor when the config is replaced by one that doesn't verify them.
+	stream1, trans1 := makeTLSTransport(t, ca.config(t, "id1"))
+	go respondVotes(trans1)
+	stream1.SetTLSConfig(config)
+
+	// A client with a certificate from another CA, which trusts the server's,
+	// can't claim a ServerID.
+	other := newTestCA(t).config(t, "id2")
+	other.RootCAs = ca.pool
+	_, trans2 := makeTLSTransport(t, other)
+	args := RequestVoteRequest{RPCHeader: RPCHeader{ID: []byte("id2")}, Term: 10}
+	var resp RequestVoteResponse
+	require.Error(t, trans2.RequestVote("id1", trans1.LocalAddr(), &args, &resp))
+}
@@ -76,6 +76,40 @@ type WithPreVote interface {
 	RequestPreVote(id ServerID, target ServerAddress, args *RequestPreVoteRequest, resp *RequestPreVoteResponse) error
 }
 
+// WithReadIndex is an interface that a transport may provide which allows
+// followers to ask the leader for a read index, so they can serve
+// linearizable reads.
+//
+// It is defined separately from Transport as unfortunately it wasn't in the
+// original interface specification.
+type WithReadIndex interface {
+	// ReadIndex sends the appropriate RPC to the target node.
+	ReadIndex(id ServerID, target ServerAddress, args *ReadIndexRequest, resp *ReadIndexResponse) error
+}
+
+// WithCatchUp is an interface that a transport may provide which allows a
+// leader to have a follower send its snapshot to another server.
+type WithCatchUp interface {
+	// CatchUp sends the appropriate RPC to the target node.
+	CatchUp(id ServerID, target ServerAddress, args *CatchUpRequest, resp *CatchUpResponse) error
+}
+
+// WithHeartbeatBatch is an interface that a transport may provide to carry
+// the heartbeats of several raft groups to the same server in a single RPC.
+// The receiving side gets the batch through its heartbeat handler, or its
+// consumer if none is set. See MultiRaft.
+type WithHeartbeatBatch interface {
+	// HeartbeatBatch sends the appropriate RPC to the target node.
+	HeartbeatBatch(id ServerID, target ServerAddress, args *HeartbeatBatchRequest, resp *HeartbeatBatchResponse) error
+}
+
+// WithGroupID is an interface that a transport may provide to tag the RPCs a
+// Raft sends with the ID of its raft group, when several groups share the
+// underlying transport. See MultiRaft.
+type WithGroupID interface {
+	GroupID() []byte
+}
+
 // WithClose is an interface that a transport may provide which
 // allows a transport to be shut down cleanly when a Raft instance
 // shuts down.
@@ -91,10 +125,11 @@ type WithClose interface {
 // LoopbackTransport is an interface that provides a loopback transport suitable for testing
 // e.g. InmemTransport. It's there so we don't have to rewrite tests.
 type LoopbackTransport interface {
-	Transport   // Embedded transport reference
-	WithPeers   // Embedded peer management
-	WithClose   // with a close routine
-	WithPreVote // with a prevote
+	Transport     // Embedded transport reference
+	WithPeers     // Embedded peer management
+	WithClose     // with a close routine
+	WithPreVote   // with a prevote
+	WithReadIndex // with a read index
 }
 
 // WithPeers is an interface that a transport may provide which allows for connection and
@@ -0,0 +1,785 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWALSegmentSize is the size at which a WALStore starts a new
+	// segment, unless configured otherwise.
+	DefaultWALSegmentSize = 64 * 1024 * 1024
+
+	walPath          = "wal"
+	walSegmentSuffix = ".wal"
+	walStableFile    = "stable.json"
+	walFirstFile     = "first"
+
+	// walHeaderSize is the length and CRC before each record.
+	walHeaderSize = 8
+
+	// walMaxRecordSize bounds the records read back, so a corrupt length
+	// can't cause a huge allocation.
+	walMaxRecordSize = 1 << 30
+)
+
+var (
+	// ErrKeyNotFound is returned by a WALStore for a StableStore key that
+	// isn't set.
+	ErrKeyNotFound = errors.New("not found")
+
+	// ErrNonMonotonicLog is returned by a WALStore when logs are stored out
+	// of order, which Raft never does.
+	ErrNonMonotonicLog = errors.New("logs must be stored with consecutive indexes")
+
+	// walCRCTable is used for the checksums of WAL records.
+	walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+var (
+	_ CommitTrackingLogStore = &WALStore{}
+	_ MonotonicLogStore      = &WALStore{}
+	_ StableStore            = &WALStore{}
+)
+
+// WALStoreConfig encapsulates configuration for a WALStore.
+type WALStoreConfig struct {
+	// SegmentSize is the size at which a new segment file is started. Logs
+	// are removed a whole segment at a time once they've been compacted.
+	// Defaults to DefaultWALSegmentSize.
+	SegmentSize int64
+
+	// NoSync skips fsync calls, which is only safe for testing.
+	NoSync bool
+}
+
+// WALStore implements the LogStore, StableStore and CommitTrackingLogStore
+// interfaces using files on the local disk. Logs are appended to a
+// write-ahead log made of segment files, and the callers of StoreLogs that
+// arrive while the log is being synced share the next fsync. Each record is
+// checksummed, and a partly written record at the end of the log, as left by
+// a crash, is discarded on startup.
+//
+// Since Raft stores logs in order, logs must be stored with consecutive
+// indexes, and only a prefix or a suffix of the log can be deleted. Deleting a
+// prefix records the new first index on disk, so the deleted logs don't
+// reappear after a restart while their segment is still in use.
+type WALStore struct {
+	dir         string
+	segmentSize int64
+	noSync      bool
+
+	// lock protects the log. Reads of segments happen under a read lock.
+	lock        sync.RWMutex
+	segments    []*walSegment
+	first       uint64
+	last        uint64
+	commitIndex uint64
+	staged      uint64
+	written     uint64 // number of batches written
+
+	// syncLock serializes syncing the log.
+	syncLock sync.Mutex
+	synced   uint64 // number of batches synced
+
+	// stableLock protects the stable store.
+	stableLock sync.RWMutex
+	stable     map[string][]byte
+}
+
+// walSegment is a segment file of the log. The records it holds begin at
+// base, but the ones before first have been deleted.
+type walSegment struct {
+	base    uint64
+	first   uint64
+	fh      *os.File
+	offsets []int64
+	size    int64
+}
+
+// lastIndex returns the index of the last log in the segment, or base-1 if it
+// is empty.
+func (s *walSegment) lastIndex() uint64 {
+	return s.base + uint64(len(s.offsets)) - 1
+}
+
+// NewWALStore returns a WALStore keeping its files in the given directory,
+// with default configuration.
+func NewWALStore(dir string) (*WALStore, error) {
+	return NewWALStoreWithConfig(dir, &WALStoreConfig{})
+}
+
+// NewWALStoreWithConfig returns a WALStore keeping its files in the given
+// directory, using the given config struct. Logs left by a previous run are
+// recovered.
+func NewWALStoreWithConfig(dir string, config *WALStoreConfig) (*WALStore, error) {
+	w := &WALStore{
+		dir:         dir,
+		segmentSize: config.SegmentSize,
+		noSync:      config.NoSync,
+		stable:      make(map[string][]byte),
+	}
+	if w.segmentSize <= 0 {
+		w.segmentSize = DefaultWALSegmentSize
+	}
+	if err := os.MkdirAll(filepath.Join(dir, walPath), 0o755); err != nil {
+		return nil, fmt.Errorf("wal path not accessible: %v", err)
+	}
+	if err := w.loadStable(); err != nil {
+		return nil, err
+	}
+	if err := w.recover(); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	if err := w.recoverFirst(); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Close closes the segment files. The store can't be used after that.
+func (w *WALStore) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var err error
+	for _, seg := range w.segments {
+		if closeErr := seg.fh.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	w.segments = nil
+	return err
+}
+
+// recover opens the segments on disk and reads back their records.
+func (w *WALStore) recover() error {
+	entries, err := os.ReadDir(filepath.Join(w.dir, walPath))
+	if err != nil {
+		return err
+	}
+	var bases []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentSuffix), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad segment name %q", name)
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	for i, base := range bases {
+		fh, err := os.OpenFile(w.segmentPath(base), os.O_RDWR, 0o644)
+		if err != nil {
+			return err
+		}
+		seg := &walSegment{base: base, first: base, fh: fh}
+		w.segments = append(w.segments, seg)
+		if err := w.scanSegment(seg, i == len(bases)-1); err != nil {
+			return fmt.Errorf("segment %d: %w", base, err)
+		}
+		if i > 0 && base != w.segments[i-1].lastIndex()+1 {
+			return fmt.Errorf("segment %d doesn't follow segment %d", base, w.segments[i-1].base)
+		}
+	}
+
+	// Drop an empty last segment, so the next log can start a new one.
+	if n := len(w.segments); n > 0 && len(w.segments[n-1].offsets) == 0 {
+		if err := w.removeSegment(w.segments[n-1]); err != nil {
+			return err
+		}
+		w.segments = w.segments[:n-1]
+	}
+	if len(w.segments) > 0 {
+		w.first = w.segments[0].first
+		w.last = w.segments[len(w.segments)-1].lastIndex()
+	}
+	return nil
+}
+
+// scanSegment reads the records of a segment to find their offsets. A torn
+// record at the end of the last segment is cut off.
+func (w *WALStore) scanSegment(seg *walSegment, last bool) error {
+	stat, err := seg.fh.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	var log Log
+	var commit uint64
+	for seg.size < size {
+		n, err := readWALRecord(seg.fh, seg.size, &log, &commit)
+		if err == nil && log.Index != seg.base+uint64(len(seg.offsets)) {
+			err = fmt.Errorf("found log %d, expected %d", log.Index, seg.base+uint64(len(seg.offsets)))
+		}
+		if err != nil {
+			if !last {
+				return err
+			}
+			// The rest was being written when we stopped.
+			if err := seg.fh.Truncate(seg.size); err != nil {
+				return err
+			}
+			break
+		}
+		seg.offsets = append(seg.offsets, seg.size)
+		seg.size += n
+		w.commitIndex = commit
+	}
+	return nil
+}
+
+// recoverFirst drops the logs before the first index recorded by deleting a
+// prefix of the log.
+func (w *WALStore) recoverFirst() error {
+	data, err := os.ReadFile(filepath.Join(w.dir, walPath, walFirstFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) != 8 {
+		return fmt.Errorf("bad first index file")
+	}
+	first := binary.BigEndian.Uint64(data)
+	if len(w.segments) == 0 || first <= w.first {
+		return nil
+	}
+
+	// Segments may be left behind if we stopped while deleting them.
+	for len(w.segments) > 0 && w.segments[0].lastIndex() < first {
+		if err := w.removeSegment(w.segments[0]); err != nil {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+	if len(w.segments) == 0 {
+		w.first, w.last = 0, 0
+		return nil
+	}
+	w.segments[0].first = first
+	w.first = first
+	return nil
+}
+
+// saveFirst records the first index of the log, replacing the previous
+// record atomically. Zero clears it.
+func (w *WALStore) saveFirst(first uint64) error {
+	return w.writeFile(filepath.Join(w.dir, walPath, walFirstFile), binary.BigEndian.AppendUint64(nil, first))
+}
+
+func (w *WALStore) segmentPath(base uint64) string {
+	return filepath.Join(w.dir, walPath, fmt.Sprintf("%020d%s", base, walSegmentSuffix))
+}
+
+// IsMonotonic implements the MonotonicLogStore interface.
+func (w *WALStore) IsMonotonic() bool {
+	return true
+}
+
+// FirstIndex implements the LogStore interface.
+func (w *WALStore) FirstIndex() (uint64, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.first, nil
+}
+
+// LastIndex implements the LogStore interface.
+func (w *WALStore) LastIndex() (uint64, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.last, nil
+}
+
+// GetLog implements the LogStore interface.
+func (w *WALStore) GetLog(index uint64, log *Log) error {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.first == 0 || index < w.first || index > w.last {
+		return ErrLogNotFound
+	}
+	i := sort.Search(len(w.segments), func(i int) bool {
+		return w.segments[i].lastIndex() >= index
+	})
+	seg := w.segments[i]
+	var commit uint64
+	if _, err := readWALRecord(seg.fh, seg.offsets[index-seg.base], log, &commit); err != nil {
+		return fmt.Errorf("failed to read log %d: %w", index, err)
+	}
+	return nil
+}
+
+// StoreLog implements the LogStore interface.
+func (w *WALStore) StoreLog(log *Log) error {
+	return w.StoreLogs([]*Log{log})
+}
+
+// StoreLogs implements the LogStore interface. It returns once the logs have
+// been synced to disk.
+func (w *WALStore) StoreLogs(logs []*Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	w.lock.Lock()
+	seq, err := w.appendLogs(logs)
+	w.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return w.sync(seq)
+}
+
+// appendLogs writes logs to the log and returns the number of the batch,
+// which must be synced before they're durable. On failure, the log is left
+// as it was. It's called with the lock held.
+func (w *WALStore) appendLogs(logs []*Log) (uint64, error) {
+	next := logs[0].Index
+	if next == 0 || (w.last != 0 && next != w.last+1) {
+		return 0, fmt.Errorf("%w: got %d after %d", ErrNonMonotonicLog, next, w.last)
+	}
+	for i, log := range logs[1:] {
+		if log.Index != next+uint64(i)+1 {
+			return 0, fmt.Errorf("%w: got %d after %d", ErrNonMonotonicLog, log.Index, next+uint64(i))
+		}
+	}
+
+	// Remember where we started, to undo a failed write.
+	numSegments := len(w.segments)
+	var active *walSegment
+	var activeSize int64
+	var activeOffsets int
+	if numSegments > 0 {
+		active = w.segments[numSegments-1]
+		activeSize, activeOffsets = active.size, len(active.offsets)
+	}
+	undo := func() {
+		for _, seg := range w.segments[numSegments:] {
+			_ = w.removeSegment(seg)
+		}
+		w.segments = w.segments[:numSegments]
+		if active != nil {
+			_ = active.fh.Truncate(activeSize)
+			active.size, active.offsets = activeSize, active.offsets[:activeOffsets]
+		}
+	}
+
+	var buf []byte
+	flush := func() error {
+		seg := w.segments[len(w.segments)-1]
+		if _, err := seg.fh.WriteAt(buf, seg.size); err != nil {
+			return err
+		}
+		seg.size += int64(len(buf))
+		buf = buf[:0]
+		return nil
+	}
+	for _, log := range logs {
+		n := len(w.segments)
+		if n == 0 || (len(w.segments[n-1].offsets) > 0 && w.segments[n-1].size+int64(len(buf)) >= w.segmentSize) {
+			if n > 0 {
+				if err := flush(); err != nil {
+					undo()
+					return 0, err
+				}
+			}
+			if err := w.startSegment(log.Index); err != nil {
+				undo()
+				return 0, err
+			}
+		}
+		seg := w.segments[len(w.segments)-1]
+		seg.offsets = append(seg.offsets, seg.size+int64(len(buf)))
+		buf = appendWALRecord(buf, log, w.staged)
+	}
+	if err := flush(); err != nil {
+		undo()
+		return 0, err
+	}
+
+	if w.first == 0 {
+		w.first = next
+	}
+	w.last = logs[len(logs)-1].Index
+	w.commitIndex = w.staged
+	w.written++
+	return w.written, nil
+}
+
+// startSegment starts a new segment for logs from the given index, after
+// syncing the current one.
+func (w *WALStore) startSegment(base uint64) error {
+	if n := len(w.segments); n > 0 && !w.noSync {
+		if err := w.segments[n-1].fh.Sync(); err != nil {
+			return err
+		}
+	}
+	fh, err := os.OpenFile(w.segmentPath(base), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w.segments = append(w.segments, &walSegment{base: base, first: base, fh: fh})
+	return w.syncDir(filepath.Join(w.dir, walPath))
+}
+
+// removeSegment closes and deletes a segment file.
+func (w *WALStore) removeSegment(seg *walSegment) error {
+	_ = seg.fh.Close()
+	return os.Remove(seg.fh.Name())
+}
+
+// sync makes sure the given batch is on disk. Callers that arrive while the
+// log is being synced wait, and are then covered by a single sync.
+func (w *WALStore) sync(seq uint64) error {
+	if w.noSync {
+		return nil
+	}
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+	if w.synced >= seq {
+		return nil
+	}
+
+	// Earlier segments were synced when they were finished.
+	w.lock.RLock()
+	target := w.written
+	var fh *os.File
+	if n := len(w.segments); n > 0 {
+		fh = w.segments[n-1].fh
+	}
+	w.lock.RUnlock()
+	if fh != nil {
+		// A segment that was deleted in the meantime is closed, and its
+		// logs are no longer needed.
+		if err := fh.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+	w.synced = target
+	return nil
+}
+
+// DeleteRange implements the LogStore interface. Only a prefix or a suffix of
+// the log can be deleted. Segments are removed once all their logs are
+// deleted.
+func (w *WALStore) DeleteRange(min, max uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.first == 0 || max < w.first || min > w.last || min > max {
+		return nil
+	}
+
+	switch {
+	case min <= w.first && max >= w.last:
+		if err := w.saveFirst(0); err != nil {
+			return err
+		}
+		for _, seg := range w.segments {
+			if err := w.removeSegment(seg); err != nil {
+				return err
+			}
+		}
+		w.segments = nil
+		w.first, w.last = 0, 0
+
+	case min <= w.first:
+		// The new first index is recorded before segments are removed, so
+		// that the rest of them can be removed on startup if we stop.
+		if err := w.saveFirst(max + 1); err != nil {
+			return err
+		}
+		for len(w.segments) > 0 && w.segments[0].lastIndex() <= max {
+			if err := w.removeSegment(w.segments[0]); err != nil {
+				return err
+			}
+			w.segments = w.segments[1:]
+		}
+		w.segments[0].first = max + 1
+		w.first = max + 1
+
+	case max >= w.last:
+		for n := len(w.segments); w.segments[n-1].base >= min; n-- {
+			if err := w.removeSegment(w.segments[n-1]); err != nil {
+				return err
+			}
+			w.segments = w.segments[:n-1]
+		}
+		// Unless min began a segment, the one before it is cut short too.
+		seg := w.segments[len(w.segments)-1]
+		if keep := min - seg.base; keep < uint64(len(seg.offsets)) {
+			size := seg.offsets[keep]
+			if err := seg.fh.Truncate(size); err != nil {
+				return err
+			}
+			if !w.noSync {
+				if err := seg.fh.Sync(); err != nil {
+					return err
+				}
+			}
+			seg.offsets = seg.offsets[:keep]
+			seg.size = size
+		}
+		w.last = min - 1
+
+	default:
+		return fmt.Errorf("can't delete logs %d to %d from the middle of the log", min, max)
+	}
+
+	if w.commitIndex > w.last {
+		w.commitIndex = w.last
+	}
+	return nil
+}
+
+// StageCommitIndex implements the CommitTrackingLogStore interface. The
+// commit index is written with the next logs stored.
+func (w *WALStore) StageCommitIndex(index uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.staged = index
+	return nil
+}
+
+// GetCommitIndex implements the CommitTrackingLogStore interface.
+func (w *WALStore) GetCommitIndex() (uint64, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.commitIndex > w.last {
+		return w.last, nil
+	}
+	return w.commitIndex, nil
+}
+
+// appendWALRecord appends the record of a log to buf. A record is the length
+// and CRC-32 (Castagnoli) of its payload, followed by the payload.
+func appendWALRecord(buf []byte, log *Log, commit uint64) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, walHeaderSize)...)
+	buf = binary.BigEndian.AppendUint64(buf, log.Index)
+	buf = binary.BigEndian.AppendUint64(buf, log.Term)
+	buf = binary.BigEndian.AppendUint64(buf, commit)
+	buf = append(buf, byte(log.Type))
+	var appendedAt int64
+	if !log.AppendedAt.IsZero() {
+		appendedAt = log.AppendedAt.UnixNano()
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(appendedAt))
+	buf = binary.AppendUvarint(buf, uint64(len(log.Data)))
+	buf = append(buf, log.Data...)
+	buf = binary.AppendUvarint(buf, uint64(len(log.Extensions)))
+	buf = append(buf, log.Extensions...)
+
+	payload := buf[start+walHeaderSize:]
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, walCRCTable))
+	return buf
+}
+
+// readWALRecord reads the record at the given offset into log, and returns
+// its size.
+func readWALRecord(r io.ReaderAt, offset int64, log *Log, commit *uint64) (int64, error) {
+	var header [walHeaderSize]byte
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > walMaxRecordSize {
+		return 0, fmt.Errorf("record too large: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := r.ReadAt(payload, offset+walHeaderSize); err != nil {
+		return 0, err
+	}
+	if crc32.Checksum(payload, walCRCTable) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, fmt.Errorf("record checksum mismatch")
+	}
+	if err := decodeWALRecord(payload, log, commit); err != nil {
+		return 0, err
+	}
+	return walHeaderSize + int64(length), nil
+}
+
+// decodeWALRecord decodes the payload of a record.
+func decodeWALRecord(payload []byte, log *Log, commit *uint64) error {
+	const fixed = 8 + 8 + 8 + 1 + 8
+	if len(payload) < fixed {
+		return fmt.Errorf("record too short")
+	}
+	*log = Log{
+		Index: binary.BigEndian.Uint64(payload),
+		Term:  binary.BigEndian.Uint64(payload[8:]),
+		Type:  LogType(payload[24]),
+	}
+	*commit = binary.BigEndian.Uint64(payload[16:])
+	if appendedAt := int64(binary.BigEndian.Uint64(payload[25:])); appendedAt != 0 {
+		log.AppendedAt = time.Unix(0, appendedAt)
+	}
+	rest := payload[fixed:]
+	var err error
+	if log.Data, rest, err = readWALBytes(rest); err != nil {
+		return err
+	}
+	if log.Extensions, _, err = readWALBytes(rest); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readWALBytes reads a length-prefixed byte slice. Empty slices are nil.
+func readWALBytes(buf []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || n > uint64(len(buf)-size) {
+		return nil, nil, fmt.Errorf("bad record field")
+	}
+	buf = buf[size:]
+	if n == 0 {
+		return nil, buf, nil
+	}
+	return buf[:n], buf[n:], nil
+}
+
+// Set implements the StableStore interface.
+func (w *WALStore) Set(key []byte, val []byte) error {
+	w.stableLock.Lock()
+	defer w.stableLock.Unlock()
+	old, existed := w.stable[string(key)]
+	w.stable[string(key)] = append([]byte(nil), val...)
+	if err := w.saveStable(); err != nil {
+		if existed {
+			w.stable[string(key)] = old
+		} else {
+			delete(w.stable, string(key))
+		}
+		return err
+	}
+	return nil
+}
+
+// Get implements the StableStore interface. It returns ErrKeyNotFound for a
+// key that isn't set.
+func (w *WALStore) Get(key []byte) ([]byte, error) {
+	w.stableLock.RLock()
+	defer w.stableLock.RUnlock()
+	val, ok := w.stable[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// SetUint64 implements the StableStore interface.
+func (w *WALStore) SetUint64(key []byte, val uint64) error {
+	return w.Set(key, binary.BigEndian.AppendUint64(nil, val))
+}
+
+// GetUint64 implements the StableStore interface. It returns ErrKeyNotFound
+// for a key that isn't set.
+func (w *WALStore) GetUint64(key []byte) (uint64, error) {
+	val, err := w.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("value of %q is not a uint64", key)
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// loadStable reads the stable store from disk, if it has been written.
+func (w *WALStore) loadStable() error {
+	data, err := os.ReadFile(filepath.Join(w.dir, walStableFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []walStableEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to decode stable store: %v", err)
+	}
+	for _, entry := range entries {
+		w.stable[string(entry.Key)] = entry.Value
+	}
+	return nil
+}
+
+// walStableEntry is how a key of the stable store is saved. Keys are saved
+// as bytes, since they needn't be valid UTF-8.
+type walStableEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// saveStable writes the stable store to disk, replacing the previous copy
+// atomically.
+func (w *WALStore) saveStable() error {
+	entries := make([]walStableEntry, 0, len(w.stable))
+	for key, val := range w.stable {
+		entries = append(entries, walStableEntry{Key: []byte(key), Value: val})
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return w.writeFile(filepath.Join(w.dir, walStableFile), data)
+}
+
+// writeFile writes a file, replacing the previous copy atomically.
+func (w *WALStore) writeFile(path string, data []byte) error {
+	tmp := path + tmpSuffix
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(data); err != nil {
+		_ = fh.Close()
+		return err
+	}
+	if !w.noSync {
+		if err := fh.Sync(); err != nil {
+			_ = fh.Close()
+			return err
+		}
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return w.syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs a directory, so entries added to it are durable.
+func (w *WALStore) syncDir(dir string) error {
+	if w.noSync || runtime.GOOS == "windows" { // skipping fsync for directory entry edits on Windows, only needed for *nix style file systems
+		return nil
+	}
+	fh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fh.Close() }()
+	return fh.Sync()
+}
@@ -0,0 +1,356 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func walTestLogs(first, last uint64) []*Log {
+	var logs []*Log
+	for i := first; i <= last; i++ {
+		logs = append(logs, &Log{
+			Index:      i,
+			Term:       1,
+			Type:       LogCommand,
+			Data:       []byte(fmt.Sprintf("log %d", i)),
+			AppendedAt: time.Unix(0, int64(i)),
+		})
+	}
+	return logs
+}
+
+func requireWALLogs(t *testing.T, w *WALStore, first, last uint64) {
+	t.Helper()
+	idx, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, first, idx)
+	idx, err = w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, last, idx)
+	if first == 0 {
+		return
+	}
+	for _, want := range walTestLogs(first, last) {
+		var got Log
+		require.NoError(t, w.GetLog(want.Index, &got))
+		require.Equal(t, want.Data, got.Data)
+		require.Equal(t, want.Term, got.Term)
+		require.Equal(t, want.Type, got.Type)
+		require.True(t, want.AppendedAt.Equal(got.AppendedAt))
+	}
+	require.ErrorIs(t, w.GetLog(first-1, new(Log)), ErrLogNotFound)
+	require.ErrorIs(t, w.GetLog(last+1, new(Log)), ErrLogNotFound)
+}
+
+func TestWALStore_Logs(t *testing.T) {
+	dir := t.TempDir()
+	config := &WALStoreConfig{SegmentSize: 256}
+	w, err := NewWALStoreWithConfig(dir, config)
+	require.NoError(t, err)
+	requireWALLogs(t, w, 0, 0)
+
+	// Logs are split over several segments.
+	require.NoError(t, w.StoreLogs(walTestLogs(1, 20)))
+	require.NoError(t, w.StoreLog(walTestLogs(21, 21)[0]))
+	requireWALLogs(t, w, 1, 21)
+	require.Greater(t, len(w.segments), 2)
+	require.ErrorIs(t, w.StoreLogs(walTestLogs(23, 23)), ErrNonMonotonicLog)
+
+	// Deleting a suffix cuts off the end of the log.
+	require.NoError(t, w.DeleteRange(15, 21))
+	requireWALLogs(t, w, 1, 14)
+	require.NoError(t, w.StoreLogs(walTestLogs(15, 30)))
+	requireWALLogs(t, w, 1, 30)
+
+	// Deleting a prefix removes whole segments.
+	segments := len(w.segments)
+	require.NoError(t, w.DeleteRange(1, 12))
+	requireWALLogs(t, w, 13, 30)
+	require.Less(t, len(w.segments), segments)
+	require.Error(t, w.DeleteRange(20, 21))
+
+	// Logs survive a restart.
+	require.NoError(t, w.Close())
+	w, err = NewWALStoreWithConfig(dir, config)
+	require.NoError(t, err)
+	requireWALLogs(t, w, 13, 30)
+
+	// Deleting everything lets the log start over anywhere.
+	require.NoError(t, w.DeleteRange(0, 30))
+	requireWALLogs(t, w, 0, 0)
+	require.NoError(t, w.StoreLogs(walTestLogs(100, 105)))
+	requireWALLogs(t, w, 100, 105)
+	require.NoError(t, w.Close())
+}
+
+func TestWALStore_DeleteSuffixSegmentBoundary(t *testing.T) {
+	// Every log gets a segment of its own, so the suffix starts exactly at
+	// the beginning of one.
+	dir := t.TempDir()
+	config := &WALStoreConfig{SegmentSize: 1}
+	w, err := NewWALStoreWithConfig(dir, config)
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(walTestLogs(1, 4)))
+	require.Len(t, w.segments, 4)
+
+	require.NoError(t, w.DeleteRange(3, 4))
+	requireWALLogs(t, w, 1, 2)
+	require.Len(t, w.segments, 2)
+	require.NoError(t, w.StoreLogs(walTestLogs(3, 5)))
+	requireWALLogs(t, w, 1, 5)
+
+	require.NoError(t, w.Close())
+	w, err = NewWALStoreWithConfig(dir, config)
+	require.NoError(t, err)
+	requireWALLogs(t, w, 1, 5)
+	require.NoError(t, w.Close())
+}
+
+func TestWALStore_FirstIndexReopen(t *testing.T) {
+	// Logs deleted from the front stay deleted after a restart, and a log
+	// cleared and started over doesn't pick up its old start.
+	dir := t.TempDir()
+	config := &WALStoreConfig{SegmentSize: 256}
+	w, err := NewWALStoreWithConfig(dir, config)
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(walTestLogs(1, 20)))
+
+	// Stop partway into the second segment, so its earlier logs stay on
+	// disk.
+	require.Greater(t, len(w.segments), 2)
+	first := w.segments[1].base + 1
+	require.NoError(t, w.DeleteRange(1, first-1))
+	require.NoError(t, w.Close())
+
+	w, err = NewWALStoreWithConfig(dir, config)
+	require.NoError(t, err)
+	requireWALLogs(t, w, first, 20)
+	require.NoError(t, w.DeleteRange(first, 20))
+	require.NoError(t, w.StoreLogs(walTestLogs(50, 55)))
+	require.NoError(t, w.Close())
+
+	w, err = NewWALStoreWithConfig(dir, config)
+	require.NoError(t, err)
+	requireWALLogs(t, w, 50, 55)
+	require.NoError(t, w.Close())
+}
+
+func TestWALStore_TornWrite(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWALStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(walTestLogs(1, 10)))
+	path := w.segments[0].fh.Name()
+	require.NoError(t, w.Close())
+
+	// Cut the last record short, as a crash in the middle of a write would.
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, stat.Size()-3))
+
+	w, err = NewWALStore(dir)
+	require.NoError(t, err)
+	requireWALLogs(t, w, 1, 9)
+	require.NoError(t, w.StoreLogs(walTestLogs(10, 12)))
+	requireWALLogs(t, w, 1, 12)
+	require.NoError(t, w.Close())
+
+	// Corruption elsewhere is an error.
+	segment := filepath.Join(dir, walPath, fmt.Sprintf("%020d%s", 1, walSegmentSuffix))
+	fh, err := os.OpenFile(segment, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = fh.WriteAt([]byte{0xff}, 20)
+	require.NoError(t, err)
+	require.NoError(t, fh.Close())
+	w, err = NewWALStoreWithConfig(dir, &WALStoreConfig{})
+	require.NoError(t, err)
+	require.Error(t, w.GetLog(1, new(Log)))
+	require.NoError(t, w.Close())
+}
+
+func TestWALStore_ConcurrentStoreLogs(t *testing.T) {
+	w, err := NewWALStore(t.TempDir())
+	require.NoError(t, err)
+	defer func() { _ = w.Close() }()
+
+	// Concurrent callers take turns appending, and share syncs.
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	next := uint64(1)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				lock.Lock()
+				logs := walTestLogs(next, next+2)
+				next += 3
+				err := w.StoreLogs(logs)
+				lock.Unlock()
+				if err != nil {
+					t.Errorf("err: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	requireWALLogs(t, w, 1, 480)
+}
+
+func TestWALStore_CommitIndex(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWALStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, w.StoreLogs(walTestLogs(1, 5)))
+	require.NoError(t, w.StageCommitIndex(4))
+	index, err := w.GetCommitIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), index)
+
+	// The staged index is written with the next logs.
+	require.NoError(t, w.StoreLogs(walTestLogs(6, 6)))
+	index, err = w.GetCommitIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), index)
+	require.NoError(t, w.Close())
+
+	w, err = NewWALStore(dir)
+	require.NoError(t, err)
+	index, err = w.GetCommitIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), index)
+
+	// It's never past the end of the log.
+	require.NoError(t, w.DeleteRange(3, 6))
+	index, err = w.GetCommitIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), index)
+	require.NoError(t, w.Close())
+}
+
+func TestWALStore_Stable(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWALStore(dir)
+	require.NoError(t, err)
+
+	_, err = w.Get([]byte("missing"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = w.GetUint64([]byte("missing"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, w.Set([]byte{0xff, 0x00}, []byte("binary key")))
+	require.NoError(t, w.SetUint64(keyCurrentTerm, 7))
+	require.NoError(t, w.Close())
+
+	w, err = NewWALStore(dir)
+	require.NoError(t, err)
+	defer func() { _ = w.Close() }()
+	val, err := w.Get([]byte{0xff, 0x00})
+	require.NoError(t, err)
+	require.Equal(t, []byte("binary key"), val)
+	term, err := w.GetUint64(keyCurrentTerm)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), term)
+}
+
+func TestWALStore_Raft(t *testing.T) {
+	dir := t.TempDir()
+	conf := inmemConfig(t)
+	conf.LocalID = "server1"
+
+	start := func() (*Raft, *MockFSM, *WALStore) {
+		store, err := NewWALStore(dir)
+		require.NoError(t, err)
+		snaps, err := NewFileSnapshotStoreWithLogger(dir, 1, newTestLogger(t))
+		require.NoError(t, err)
+		_, trans := NewInmemTransport("server1")
+		fsm := &MockFSM{}
+		r, err := NewRaft(conf, fsm, store, store, snaps, trans)
+		require.NoError(t, err)
+		return r, fsm, store
+	}
+
+	r, _, store := start()
+	require.NoError(t, r.BootstrapCluster(Configuration{Servers: []Server{
+		{Suffrage: Voter, ID: "server1", Address: "server1"},
+	}}).Error())
+	require.Eventually(t, func() bool { return r.State() == Leader }, 5*time.Second, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, r.Apply([]byte(fmt.Sprintf("cmd %d", i)), time.Second).Error())
+	}
+	require.NoError(t, r.Shutdown().Error())
+	require.NoError(t, store.Close())
+
+	// The logs are replayed after a restart.
+	r, fsm, store := start()
+	defer func() {
+		_ = r.Shutdown().Error()
+		_ = store.Close()
+	}()
+	require.Eventually(t, func() bool { return len(fsm.Logs()) == 10 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []byte("cmd 9"), fsm.Logs()[9])
+}
+
+func BenchmarkWALStore_StoreLogs(b *testing.B) {
+	for _, batch := range []int{1, 16} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			w, err := NewWALStore(b.TempDir())
+			require.NoError(b, err)
+			defer func() { _ = w.Close() }()
+
+			logs := make([]*Log, batch)
+			for i := range logs {
+				logs[i] = &Log{Type: LogCommand, Data: make([]byte, 256)}
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				for i, log := range logs {
+					log.Index = uint64(n*batch + i + 1)
+				}
+				if err := w.StoreLogs(logs); err != nil {
+					b.Fatalf("err: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWALStore_GetLog(b *testing.B) {
+	w, err := NewWALStoreWithConfig(b.TempDir(), &WALStoreConfig{NoSync: true})
+	require.NoError(b, err)
+	defer func() { _ = w.Close() }()
+	require.NoError(b, w.StoreLogs(walTestLogs(1, 1000)))
+
+	b.ResetTimer()
+	var log Log
+	for n := 0; n < b.N; n++ {
+		if err := w.GetLog(uint64(n%1000)+1, &log); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkWALStore_DeleteRange(b *testing.B) {
+	// Compacting the log removes whole segments.
+	w, err := NewWALStoreWithConfig(b.TempDir(), &WALStoreConfig{SegmentSize: 4096, NoSync: true})
+	require.NoError(b, err)
+	defer func() { _ = w.Close() }()
+	require.NoError(b, w.StoreLogs(walTestLogs(1, uint64(b.N)*10)))
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := w.DeleteRange(uint64(n*10+1), uint64(n*10+10)); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}